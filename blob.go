@@ -0,0 +1,240 @@
+package gitdb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// OpenBlob opens a blob in database for streaming read. Unlike ReadBlobs,
+// the content is decompressed while being read, instead of being loaded
+// into memory at once. Objects stored in chunks (see WithChunkSize) are
+// read one chunk at a time. Otherwise, the compressed object is read at
+// once.
+//
+// dt is either *sql.DB or *sql.Tx. With *sql.DB, reading an object stored
+// in chunks keeps a transaction open until the reader is closed.
+// oid is the git object ID of the blob.
+//
+// Returns a reader of the blob content and its size. The reader verifies
+// sha1 of the content at EOF and returns an error on mismatch.
+func OpenBlob(dt dbOrTx, oid Oid) (io.ReadCloser, int64, error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, 0, err
+	}
+	if txByUs {
+		// The reader rolls back tx instead when it is closed
+		defer func() {
+			if tx != nil {
+				tx.Rollback()
+			}
+		}()
+	}
+
+	var zcontent []byte
+	err = tx.QueryRow(tx.rebind("SELECT zcontent FROM "+table+" WHERE oid = ?"), string(oid)).Scan(&zcontent)
+	if err == sql.ErrNoRows {
+		return nil, 0, fmt.Errorf("object not found: %s", oid)
+	} else if err != nil {
+		return nil, 0, err
+	}
+
+	var z io.Reader = bytes.NewReader(zcontent)
+	if len(zcontent) == 0 {
+		z = &chunkReader{tx: tx, oid: oid}
+	}
+	r, typ, size, err := newObjectReader(oid, z)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ != "blob" {
+		r.Close()
+		return nil, 0, fmt.Errorf("%s is a %s, not a blob", oid, typ)
+	}
+	if txByUs && len(zcontent) == 0 {
+		r.tx, tx = tx, nil
+	}
+	return r, size, nil
+}
+
+// eachBlobBatchSize is the max number of compressed objects EachBlob reads
+// at a time.
+const eachBlobBatchSize = 64
+
+// EachBlob is like ReadBlobs but calls fn with one blob at a time, so only
+// one blob content is in memory. Compressed contents are read in small
+// batches, and objects stored in chunks are streamed. Blobs are visited in
+// no particular order. Duplicated oids are visited once. If fn returns an
+// error, EachBlob stops and returns the error.
+//
+// fn is called when no rows are being read, so it can query the
+// transaction.
+//
+// Note: like ReadBlobs, EachBlob does not check git object type.
+func EachBlob(dt dbOrTx, oids []Oid, fn func(oid Oid, content []byte) error) error {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	oids = uniqueOids(oids)
+	for i := 0; i < len(oids); i += eachBlobBatchSize {
+		batch := oids[i:min(i+eachBlobBatchSize, len(oids))]
+		zcontents := make(map[Oid]io.Reader, len(batch))
+		err = queryZcontents(tx, batch, func(oid Oid, zcontent io.Reader) error {
+			zcontents[oid] = zcontent
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, oid := range batch {
+			zcontent, ok := zcontents[oid]
+			if !ok {
+				return fmt.Errorf("object not found: %s", oid)
+			}
+			content, err := readObjectBody(oid, zcontent)
+			if err != nil {
+				return err
+			}
+			delete(zcontents, oid)
+			if err := fn(oid, content); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readObjectBody reads the body of a zlib compressed git object, and
+// verifies its sha1.
+func readObjectBody(oid Oid, zcontent io.Reader) ([]byte, error) {
+	r, _, size, err := newObjectReader(oid, zcontent)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	content := make([]byte, size)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	// Reach EOF to verify sha1
+	if _, err := r.Read(nil); err != io.EOF {
+		return nil, err
+	}
+	return content, nil
+}
+
+// objectReader streams the body of a zlib compressed git object, and
+// verifies its sha1 at EOF.
+type objectReader struct {
+	oid       Oid
+	z         io.ReadCloser
+	hash      hash.Hash
+	remaining int64
+	err       error
+	// tx is rolled back by Close, if it is not nil
+	tx *gitTx
+}
+
+// newObjectReader parses the header of zcontent and returns a reader of the
+// object body, the object type and the body size.
+func newObjectReader(oid Oid, zcontent io.Reader) (*objectReader, string, int64, error) {
+	z, err := zlib.NewReader(zcontent)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("cannot read object %s: %s", oid, err)
+	}
+
+	// Header: type + " " + size + "\0"
+	var header []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(z, b); err != nil {
+			z.Close()
+			return nil, "", 0, fmt.Errorf("cannot read object %s: %s", oid, errInvalidZcontent("no header delimiter"))
+		}
+		if b[0] == 0 {
+			break
+		}
+		header = append(header, b[0])
+	}
+	fields := strings.Split(string(header), " ")
+	var size int64 = -1
+	if len(fields) == 2 {
+		size, err = strconv.ParseInt(fields[1], 10, 64)
+	}
+	if err != nil || size < 0 {
+		z.Close()
+		return nil, "", 0, fmt.Errorf("cannot read object %s: %s", oid, errInvalidZcontent("illegal header "+string(header)))
+	}
+
+	h := sha1.New()
+	h.Write(header)
+	h.Write([]byte{0})
+	return &objectReader{oid: oid, z: z, hash: h, remaining: size}, fields[0], size, nil
+}
+
+func (r *objectReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.remaining == 0 {
+		r.err = r.finish()
+		return 0, r.err
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.z.Read(p)
+	r.hash.Write(p[:n])
+	r.remaining -= int64(n)
+	if err == io.EOF {
+		if r.remaining > 0 {
+			err = fmt.Errorf("cannot read object %s: %s", r.oid, errInvalidZcontent("body is truncated"))
+		} else {
+			err = nil
+		}
+	} else if err != nil {
+		err = fmt.Errorf("cannot read object %s: %s", r.oid, err)
+	}
+	r.err = err
+	return n, err
+}
+
+// finish checks there is no extra data, and sha1 matches. Returns io.EOF if
+// everything is fine.
+func (r *objectReader) finish() error {
+	// Read to the zlib EOF so its checksum is verified.
+	n, err := io.Copy(ioutil.Discard, r.z)
+	if err != nil {
+		return fmt.Errorf("cannot read object %s: %s", r.oid, err)
+	}
+	if n > 0 {
+		return fmt.Errorf("cannot read object %s: %s", r.oid, errInvalidZcontent("body size mismatch"))
+	}
+	if actual := Oid(fmt.Sprintf("%040x", r.hash.Sum(nil))); actual != r.oid {
+		return fmt.Errorf("sha1 mismatch: oid = %s, sha1(content) = %s", r.oid, actual)
+	}
+	return io.EOF
+}
+
+// Close releases resources used by the reader.
+func (r *objectReader) Close() error {
+	if r.tx != nil {
+		r.tx.Rollback()
+		r.tx = nil
+	}
+	return r.z.Close()
+}
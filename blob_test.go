@@ -0,0 +1,120 @@
+package gitdb
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestOpenBlob(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("openBlob")
+	defer db.Close()
+
+	dir := createRandomRepo("ob", 30, true, true)
+	_, head, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	// A large blob and an empty blob
+	large := bytes.Repeat([]byte("0123456789abcdef\n"), 200000)
+	b := NewCommitBuilder(head)
+	b.Put("large", ModeBlob, large)
+	b.Put("empty", ModeBlob, nil)
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	oid, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+
+	// Compare with ReadBlobs
+	_, oids, paths, e := ReadTree(db, oid)
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	contents, e := ReadBlobs(db, oids)
+	if e != nil {
+		t.Fatal("ReadBlobs error", e)
+	}
+	for i, blobOid := range oids {
+		r, size, e := OpenBlob(db, blobOid)
+		if e != nil {
+			t.Fatal("OpenBlob error", e)
+		}
+		content, e := ioutil.ReadAll(r)
+		r.Close()
+		if e != nil || size != int64(len(contents[i])) || !bytes.Equal(content, contents[i]) {
+			t.Errorf("OpenBlob(%s) read %d bytes, size %d, %v; expected %d bytes", paths[i], len(content), size, e, len(contents[i]))
+		}
+	}
+
+	visited := make(map[Oid][]byte)
+	e = EachBlob(db, append(oids, oids[0]), func(oid Oid, content []byte) error {
+		if _, ok := visited[oid]; ok {
+			t.Errorf("EachBlob visited %s twice", oid)
+		}
+		visited[oid] = content
+		return nil
+	})
+	if e != nil {
+		t.Fatal("EachBlob error", e)
+	}
+	for i, blobOid := range oids {
+		if !bytes.Equal(visited[blobOid], contents[i]) {
+			t.Errorf("EachBlob returned wrong content for %s", paths[i])
+		}
+	}
+
+	// fn can query the transaction
+	tx := beginTx(db)
+	e = EachBlob(tx, oids, func(oid Oid, content []byte) error {
+		_, e := ReadBlobs(tx, []Oid{oid})
+		return e
+	})
+	tx.Rollback()
+	if e != nil {
+		t.Error("EachBlob error when fn queries the transaction", e)
+	}
+
+	// Errors from fn stop the iteration
+	count := 0
+	e = EachBlob(db, oids, func(oid Oid, content []byte) error {
+		count++
+		return io.ErrUnexpectedEOF
+	})
+	if e != io.ErrUnexpectedEOF || count != 1 {
+		t.Error("EachBlob should stop at the first error", e, count)
+	}
+
+	// Not blobs, or missing
+	missing := Oid(strings.Repeat("1", 40))
+	for _, o := range []Oid{oid, missing} {
+		if _, _, e := OpenBlob(db, o); e == nil {
+			t.Errorf("OpenBlob(%s) should fail", o)
+		}
+	}
+	if e := EachBlob(db, []Oid{oids[0], missing}, func(Oid, []byte) error { return nil }); e == nil {
+		t.Error("EachBlob should fail on missing objects")
+	}
+
+	// Corrupted content is detected at EOF
+	_, largeOid, _ := Stat(db, oid, "large")
+	_, emptyOid, _ := Stat(db, oid, "empty")
+	if _, e := db.Exec(rebind(testDialect, "UPDATE "+table+" SET zcontent = (SELECT zcontent FROM "+table+" WHERE oid = ?) WHERE oid = ?"), string(emptyOid), string(largeOid)); e != nil {
+		t.Fatal("UPDATE error", e)
+	}
+	r, _, e := OpenBlob(db, largeOid)
+	if e != nil {
+		t.Fatal("OpenBlob error", e)
+	}
+	if _, e := ioutil.ReadAll(r); e == nil || !strings.Contains(e.Error(), "sha1 mismatch") {
+		t.Error("OpenBlob should detect sha1 mismatch", e)
+	}
+	r.Close()
+}
@@ -0,0 +1,282 @@
+package gitdb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const commitCacheTable = "gitcommit_objects"
+
+// WithCommitCache makes gitdb maintain and use the gitcommit_objects table.
+// The table records objects introduced by each commit, so Export of a
+// commit whose parents were exported before only reads objects of the new
+// commits, and GC only reads the table, instead of walking the whole
+// history.
+//
+// The choice is stored in the gitdb_settings table, so all processes
+// sharing the database agree on it. Calling CreateTable or Migrate without
+// options keeps it. Use WithoutCommitCache to disable the cache. Commits
+// written while the cache is disabled are not cached. Export and GC fall
+// back to walking the history if they need them.
+func WithCommitCache() CreateTableOption {
+	return func(c *createTableConfig) {
+		commitCache := true
+		c.commitCache = &commitCache
+	}
+}
+
+// WithoutCommitCache makes gitdb stop maintaining and using the
+// gitcommit_objects table. The cache is disabled in new databases.
+func WithoutCommitCache() CreateTableOption {
+	return func(c *createTableConfig) {
+		commitCache := false
+		c.commitCache = &commitCache
+	}
+}
+
+// createCommitCacheTable creates the commit cache table. It is a migration
+// step. The table is used if WithCommitCache is used.
+func createCommitCacheTable(db *sql.DB) (sql.Result, error) {
+	return db.Exec("CREATE TABLE IF NOT EXISTS " + commitCacheTable + " (" +
+		"commit_oid CHAR(40) NOT NULL," +
+		// seq is the BFS order of objects introduced by the commit.
+		"seq INT NOT NULL," +
+		"oid CHAR(40) NOT NULL," +
+		"PRIMARY KEY (commit_oid, seq))")
+}
+
+// cacheCommits writes objects introduced by commits to the commit cache.
+// The commits and their trees must exist in database. Commits with parents
+// missing in database, like the oldest commits of a shallow clone, are
+// treated as root commits.
+//
+// Objects introduced by a commit are the commit itself, and objects in its
+// tree not at the same path in trees of its parents, in BFS order. Moved or
+// reverted objects are included, which is fine since the lists are only used
+// to find a superset of missing objects.
+func cacheCommits(tx *gitTx, commits []Oid) error {
+	if len(commits) == 0 {
+		return nil
+	}
+	objs, err := readObjects(tx, commits)
+	if err != nil {
+		return err
+	}
+
+	// Trees are compared with trees at the same path in parent commits.
+	// All commits are walked together so each tree level is one query.
+	type pending struct {
+		commit      int
+		oid         Oid
+		parentTrees []Oid
+	}
+	lists := make([][]Oid, len(commits))
+	visited := make([]map[Oid]bool, len(commits))
+	var next []pending
+	var parents []Oid
+	for i, obj := range objs {
+		referred := obj.referredOids()
+		if len(referred) == 0 {
+			return fmt.Errorf("commit %s is illformed: no tree", obj.Oid)
+		}
+		lists[i] = []Oid{commits[i], referred[0]}
+		visited[i] = map[Oid]bool{referred[0]: true}
+		next = append(next, pending{i, referred[0], nil})
+		parents = append(parents, referred[1:]...)
+	}
+
+	// Trees are only compared with trees of parents in database
+	treeOf := make(map[Oid]Oid)
+	err = queryByOids(tx, "oid, referred", uniqueOids(parents), func(scan rowScanFunc) error {
+		var oid string
+		var referred sql.NullString
+		if err := scan(&oid, &referred); err != nil {
+			return err
+		}
+		if tree := strings.SplitN(referred.String, ",", 2)[0]; len(tree) > 0 {
+			treeOf[Oid(oid)] = Oid(tree)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := range next {
+		for _, p := range objs[i].referredOids()[1:] {
+			if tree, ok := treeOf[p]; ok {
+				next[i].parentTrees = append(next[i].parentTrees, tree)
+			}
+		}
+	}
+
+	for len(next) > 0 {
+		curr := next
+		next = nil
+		var oids []Oid
+		for _, p := range curr {
+			oids = append(oids, p.oid)
+			oids = append(oids, p.parentTrees...)
+		}
+		objs, err := readObjects(tx, uniqueOids(oids))
+		if err != nil {
+			return err
+		}
+		entriesOf := make(map[Oid][]*TreeEntry, len(objs))
+		for _, obj := range objs {
+			entriesOf[obj.Oid] = parseTree(obj.Body)
+		}
+
+		for _, p := range curr {
+			// Name -> entries at the same path in parent trees
+			parentEntries := make(map[string][]*TreeEntry)
+			for _, t := range p.parentTrees {
+				for _, ti := range entriesOf[t] {
+					parentEntries[ti.Name] = append(parentEntries[ti.Name], ti)
+				}
+			}
+			for _, ti := range entriesOf[p.oid] {
+				if ti.IsGitlink() || visited[p.commit][ti.Oid] {
+					continue
+				}
+				var parentTrees []Oid
+				unchanged := false
+				for _, pti := range parentEntries[ti.Name] {
+					if pti.Oid == ti.Oid {
+						unchanged = true
+					} else if pti.IsTree() {
+						parentTrees = append(parentTrees, pti.Oid)
+					}
+				}
+				if unchanged {
+					continue
+				}
+				visited[p.commit][ti.Oid] = true
+				lists[p.commit] = append(lists[p.commit], ti.Oid)
+				if ti.IsTree() {
+					next = append(next, pending{p.commit, ti.Oid, parentTrees})
+				}
+			}
+		}
+	}
+
+	stmt, err := tx.Prepare(tx.rebind(tx.dialect.InsertIgnore(commitCacheTable, []string{"commit_oid", "seq", "oid"})))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, commit := range commits {
+		for seq, oid := range lists[i] {
+			if _, err := stmt.Exec(string(commit), seq, string(oid)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// cachedNewOids is bfsOids using the commit cache. It returns objects
+// reachable from a commit, but not in the filesystem repo, tested by has.
+// Commits in the repo are assumed to have all objects they refer to.
+//
+// Returned oids are ordered like bfsOids: commits are before their parents,
+// and trees are before their entries. Returns false if the commit cache
+// cannot be used, for example, oid is not a commit or some commits are not
+// cached.
+func cachedNewOids(tx *gitTx, oid Oid, has func(Oid) bool) ([]Oid, bool, error) {
+	if has(oid) {
+		return nil, true, nil
+	}
+
+	// Walk commits not in the repo
+	lists := make(map[Oid][]Oid)
+	parentsOf := make(map[Oid][]Oid)
+	for curr := []Oid{oid}; len(curr) > 0; {
+		err := queryCommitCache(tx, curr, func(commit Oid, oid Oid) {
+			lists[commit] = append(lists[commit], oid)
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		for _, c := range curr {
+			if len(lists[c]) == 0 {
+				return nil, false, nil
+			}
+		}
+
+		var next []Oid
+		err = queryByOids(tx, "oid, referred", curr, func(scan rowScanFunc) error {
+			var commit string
+			var referred sql.NullString
+			if err := scan(&commit, &referred); err != nil {
+				return err
+			}
+			parents := commitParents(referred.String)
+			for _, p := range parents {
+				if _, ok := parentsOf[p]; !ok && !has(p) {
+					parentsOf[p] = nil
+					next = append(next, p)
+				}
+			}
+			parentsOf[Oid(commit)] = parents
+			return nil
+		})
+		if err != nil {
+			return nil, false, err
+		}
+		curr = uniqueOids(next)
+	}
+
+	// Sort commits so children are before parents. Objects of a commit
+	// might refer to objects introduced by any of its ancestors.
+	children := make(map[Oid]int)
+	for _, parents := range parentsOf {
+		for _, p := range parents {
+			children[p]++
+		}
+	}
+	var result []Oid
+	visited := make(map[Oid]bool)
+	for stack := []Oid{oid}; len(stack) > 0; {
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, o := range lists[c] {
+			if !visited[o] && !has(o) {
+				visited[o] = true
+				result = append(result, o)
+			}
+		}
+		for _, p := range parentsOf[c] {
+			if children[p]--; children[p] == 0 && !has(p) {
+				stack = append(stack, p)
+			}
+		}
+	}
+	return result, true, nil
+}
+
+// queryCommitCache reads objects introduced by commits in BFS order.
+func queryCommitCache(tx *gitTx, commits []Oid, handler func(commit Oid, oid Oid)) error {
+	batchSize := tx.dialect.MaxParams()
+	for i := 0; i < len(commits); i += batchSize {
+		j := min(i+batchSize, len(commits))
+		query := "SELECT commit_oid, oid FROM " + commitCacheTable + " WHERE commit_oid IN (" + params(j-i) + ") ORDER BY commit_oid, seq"
+		rows, err := tx.Query(tx.rebind(query), toInterfaces(commits[i:j])...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var commit, oid string
+			if err := rows.Scan(&commit, &oid); err != nil {
+				rows.Close()
+				return err
+			}
+			handler(Oid(commit), Oid(oid))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
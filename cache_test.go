@@ -0,0 +1,185 @@
+package gitdb
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommitCache(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("commitCache")
+	defer db.Close()
+	defer CreateTable(db, WithoutCommitCache())
+	if _, e := CreateTable(db, WithCommitCache()); e != nil {
+		t.Fatal("CreateTable error", e)
+	}
+
+	// Migrate without options keeps the cache
+	if e := Migrate(db); e != nil {
+		t.Fatal("Migrate error", e)
+	}
+	if values, e := readSettings(db); e != nil || values[settingCommitCache] != "on" {
+		t.Error("Migrate without options should not disable the commit cache", e)
+	}
+
+	dir := createRandomRepo("cc", 30, true, true)
+	_, base, e := Import(db, dir, "HEAD~2")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, head, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	// Cached objects match the BFS of the database
+	tx := beginTx(db)
+	none := func(Oid) bool { return false }
+	for _, oid := range []Oid{base, head} {
+		expected, e := bfsOids(tx, []Oid{oid}, nil)
+		if e != nil {
+			t.Fatal("bfsOids error", e)
+		}
+		actual, cached, e := cachedNewOids(tx, oid, none)
+		if e != nil || !cached {
+			t.Fatal("cachedNewOids unexpected", cached, e)
+		}
+		if sortedOids(actual) != sortedOids(expected) {
+			t.Errorf("cachedNewOids returned %d oids, expected %d", len(actual), len(expected))
+		}
+	}
+	tx.Rollback()
+
+	// Export only walks new commits
+	dir2 := filepath.Join(repoDir, "cc-export")
+	os.RemoveAll(dir2)
+	if _, e := Export(db, dir2, base, "HEAD"); e != nil {
+		t.Fatal("Export error", e)
+	}
+	repo, _ := openOrInitRepo(dir2)
+	tx = beginTx(db)
+	refOids, _ := repo.allRefOids()
+	repoOids, _ := repo.listOids(refOids)
+	expected, _ := bfsOids(tx, []Oid{head}, repoOids)
+	actual, cached, e := cachedNewOids(tx, head, repo.hasOid)
+	tx.Rollback()
+	repo.close()
+	if e != nil || !cached {
+		t.Fatal("cachedNewOids unexpected", cached, e)
+	}
+	if sortedOids(minus(actual, repoOids)) != sortedOids(minus(expected, repoOids)) {
+		t.Errorf("cachedNewOids returned %d new oids, expected %d", len(minus(actual, repoOids)), len(minus(expected, repoOids)))
+	}
+	if _, e := Export(db, dir2, head, "HEAD", LooseObjectLimit(1000)); e != nil {
+		t.Fatal("Export error", e)
+	}
+	if out, e := exec.Command("git", "--git-dir", filepath.Join(dir2, ".git"), "fsck", "--full", "--strict").CombinedOutput(); e != nil {
+		t.Error("Exported repo is broken", e, string(out))
+	}
+
+	// Names with spaces are compared with parent trees correctly
+	b := NewCommitBuilder(head)
+	b.Put("my dir/sub dir/a b", ModeBlob, []byte("1\n"))
+	b.Put("my dir/c d", ModeBlob, []byte("2\n"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	child, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	b = NewCommitBuilder(child)
+	b.Put("my dir/sub dir/a b", ModeBlob, []byte("3\n"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	grandchild, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	tx = beginTx(db)
+	for _, oid := range []Oid{child, grandchild} {
+		expected, _ := bfsOids(tx, []Oid{oid}, nil)
+		if actual, cached, e := cachedNewOids(tx, oid, none); e != nil || !cached || sortedOids(actual) != sortedOids(expected) {
+			t.Errorf("cachedNewOids returned %d oids, expected %d", len(actual), len(expected))
+		}
+	}
+	tx.Rollback()
+	if _, e := Export(db, dir2, grandchild, "HEAD", LooseObjectLimit(1000)); e != nil {
+		t.Fatal("Export error", e)
+	}
+	if out, e := exec.Command("git", "--git-dir", filepath.Join(dir2, ".git"), "fsck", "--full", "--strict").CombinedOutput(); e != nil {
+		t.Error("Exported repo is broken", e, string(out))
+	}
+
+	// GC reads the cache
+	tx = beginTx(db)
+	for _, oids := range [][]Oid{{base}, {child}, {grandchild}} {
+		actual, e := GC(tx, oids, DryRun())
+		if e != nil {
+			t.Fatal("GC error", e)
+		}
+		tx.commitCache = false
+		expected, e := GC(tx, oids, DryRun())
+		tx.commitCache = true
+		if e != nil {
+			t.Fatal("GC error", e)
+		}
+		if sortedOids(actual) != sortedOids(expected) {
+			t.Errorf("GC with the commit cache deleted %d objects, expected %d", len(actual), len(expected))
+		}
+	}
+	tx.Rollback()
+
+	// GC removes entries of deleted commits
+	tx = beginTx(db)
+	if _, e := GC(tx, []Oid{base}); e != nil {
+		t.Fatal("GC error", e)
+	}
+	if _, cached, _ := cachedNewOids(tx, head, none); cached {
+		t.Error("GC should remove cache entries of deleted commits")
+	}
+	tx.Rollback()
+}
+
+func TestCommitCacheShallow(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("commitCacheShallow")
+	defer db.Close()
+	if _, e := CreateTable(db, WithCommitCache()); e != nil {
+		t.Fatal("CreateTable error", e)
+	}
+
+	// Commits with missing parents are cached like root commits
+	dir := createRandomRepo("ccs", 20, true, true)
+	shallowDir := filepath.Join(repoDir, "ccs-shallow")
+	os.RemoveAll(shallowDir)
+	runGit(t, repoDir, "clone", "-q", "--depth", "3", "file://"+dir, shallowDir)
+	_, head, e := Import(db, shallowDir, "HEAD")
+	if e != nil {
+		t.Fatal("Import of a shallow clone error", e)
+	}
+	tx := beginTx(db)
+	defer tx.Rollback()
+	expected, e := bfsOids(tx, []Oid{head}, nil)
+	if e != nil {
+		t.Fatal("bfsOids error", e)
+	}
+	// Missing parents are treated as objects in the filesystem repo
+	missing := func(oid Oid) bool {
+		unseen, _ := unseenOids(tx, []Oid{oid})
+		return len(unseen) > 0
+	}
+	actual, cached, e := cachedNewOids(tx, head, missing)
+	if e != nil || !cached {
+		t.Fatal("cachedNewOids unexpected", cached, e)
+	}
+	unseen, _ := unseenOids(tx, expected)
+	if sortedOids(actual) != sortedOids(minus(expected, unseen)) {
+		t.Errorf("cachedNewOids returned %d oids, expected %d", len(actual), len(expected)-len(unseen))
+	}
+}
@@ -0,0 +1,136 @@
+package gitdb
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+)
+
+const chunkTable = "gitobject_chunks"
+
+// maxZcontentSize is the max size of MEDIUMBLOB.
+const maxZcontentSize = 1<<24 - 1
+
+// WithChunkSize makes Migrate set the max size of zcontent (zlib compressed
+// git object) stored in one row. Larger zcontent is split into ordered
+// chunks stored in the gitobject_chunks table, and is reassembled
+// transparently when read.
+//
+// The default is 16MB - 1, the size limit of MEDIUMBLOB in MySQL. A smaller
+// size can be used if MySQL max_allowed_packet is small.
+//
+// n <= 0 disables chunking. Writing objects that do not fit in MEDIUMBLOB
+// will fail before they are sent to database. The limit applies to all
+// dialects, including PostgreSQL and SQLite, so objects written to one
+// database can be copied to another.
+//
+// The size is stored in the gitdb_settings table. It affects all later
+// writes to the database, including Import, CommitBuilder and HTTPHandler.
+// If this option is not used, the stored size is kept.
+func WithChunkSize(n int) CreateTableOption {
+	return func(c *createTableConfig) {
+		c.chunkSize = &n
+	}
+}
+
+// createChunkTable creates the table storing chunks of large objects. It is
+// a migration step.
+func createChunkTable(db *sql.DB, d Dialect) (sql.Result, error) {
+	return db.Exec("CREATE TABLE IF NOT EXISTS " + chunkTable + " (" +
+		"oid CHAR(40) NOT NULL," +
+		"seq INT NOT NULL," +
+		"data " + d.BlobType() + " NOT NULL," +
+		"PRIMARY KEY (oid, seq))")
+}
+
+type errObjectTooLarge struct {
+	oid  Oid
+	size int
+}
+
+func (e errObjectTooLarge) Error() string {
+	return fmt.Sprintf("object %s is too large: %d bytes compressed, exceeding the MEDIUMBLOB limit (%d bytes) with chunking disabled", e.oid, e.size, maxZcontentSize)
+}
+
+// insertChunks splits zcontent into chunks of tx.chunkSize and writes them.
+func insertChunks(tx *gitTx, oid Oid, zcontent []byte) error {
+	stmt, err := tx.Prepare(tx.rebind(tx.dialect.InsertIgnore(chunkTable, []string{"oid", "seq", "data"})))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for seq := 0; len(zcontent) > 0; seq++ {
+		n := min(tx.chunkSize, len(zcontent))
+		if _, err := stmt.Exec(string(oid), seq, zcontent[:n]); err != nil {
+			return err
+		}
+		zcontent = zcontent[n:]
+	}
+	return nil
+}
+
+// queryZcontents reads zcontent of objects in batch. Chunked zcontent is
+// streamed by chunkReader, one object at a time, after other objects are
+// visited. Objects are visited in no particular order. Missing objects are
+// skipped.
+func queryZcontents(tx *gitTx, oids []Oid, handler func(oid Oid, zcontent io.Reader) error) error {
+	var chunked []Oid
+	err := queryByOids(tx, "oid, zcontent", oids, func(scan rowScanFunc) error {
+		var s string
+		var zcontent []byte
+		if err := scan(&s, &zcontent); err != nil {
+			return err
+		}
+		if len(zcontent) == 0 {
+			chunked = append(chunked, Oid(s))
+			return nil
+		}
+		return handler(Oid(s), bytes.NewReader(zcontent))
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, oid := range chunked {
+		if err := handler(oid, &chunkReader{tx: tx, oid: oid}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkReader reads chunks of an object in order. Only one chunk is in
+// memory at a time. Each chunk is read by its own query, so no rows are
+// left open between reads. Errors do not include the oid. Callers add it.
+type chunkReader struct {
+	tx   *gitTx
+	oid  Oid
+	seq  int
+	data []byte
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		var seq int
+		query := "SELECT seq, data FROM " + chunkTable + " WHERE oid = ? AND seq >= ? ORDER BY seq LIMIT 1"
+		err := r.tx.QueryRow(r.tx.rebind(query), string(r.oid), r.seq).Scan(&seq, &r.data)
+		if err == sql.ErrNoRows {
+			if r.seq == 0 {
+				return 0, fmt.Errorf("chunks are missing")
+			}
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, err
+		}
+		if seq != r.seq {
+			return 0, fmt.Errorf("chunk %d is missing", r.seq)
+		}
+		r.seq++
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
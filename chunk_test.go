@@ -0,0 +1,110 @@
+package gitdb
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func countChunks(t *testing.T, db dbOrTx) (n int) {
+	rows, err := db.Query("SELECT COUNT(1) FROM " + chunkTable)
+	if err != nil {
+		t.Fatal("SELECT error", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rows.Scan(&n)
+	}
+	return n
+}
+
+func TestChunks(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("chunks")
+	defer db.Close()
+
+	// Objects larger than 64 bytes are chunked
+	if e := Migrate(db, WithChunkSize(64)); e != nil {
+		t.Fatal("Migrate error", e)
+	}
+	dir := createRandomRepo("ch", 30, true, true)
+	oids, head, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	if countChunks(t, db) == 0 {
+		t.Fatal("Import should write chunks")
+	}
+
+	// Chunked objects are read transparently. sha1 is verified.
+	if _, e := ReadBlobs(db, oids); e != nil {
+		t.Fatal("ReadBlobs error", e)
+	}
+	_, blobOids, _, e := ReadTree(db, head)
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	for _, oid := range blobOids {
+		r, _, e := OpenBlob(db, oid)
+		if e != nil {
+			t.Fatal("OpenBlob error", e)
+		}
+		if _, e := ioutil.ReadAll(r); e != nil {
+			t.Error("OpenBlob read error", e)
+		}
+		r.Close()
+	}
+	dir2 := filepath.Join(repoDir, "ch-export")
+	os.RemoveAll(dir2)
+	if _, e := Export(db, dir2, head, "HEAD"); e != nil {
+		t.Fatal("Export error", e)
+	}
+	if out, e := exec.Command("git", "--git-dir", filepath.Join(dir2, ".git"), "fsck", "--full", "--strict").CombinedOutput(); e != nil {
+		t.Error("Exported repo is broken", e, string(out))
+	}
+
+	// Missing chunks are reported while streaming
+	tx := beginTx(db)
+	var oid string
+	if e := tx.QueryRow("SELECT oid FROM " + chunkTable + " WHERE seq = 2").Scan(&oid); e != nil {
+		t.Fatal("No object with 3 chunks", e)
+	}
+	tx.Exec(tx.rebind("DELETE FROM "+chunkTable+" WHERE oid = ? AND seq = 1"), oid)
+	if _, e := readObjects(tx, []Oid{Oid(oid)}); e == nil || !strings.Contains(e.Error(), "chunk 1 is missing") {
+		t.Error("Reading an object with a missing chunk should fail", e)
+	}
+	tx.Rollback()
+
+	// GC removes chunks
+	tx = beginTx(db)
+	if _, e := GC(tx, nil); e != nil {
+		t.Fatal("GC error", e)
+	}
+	if n := countChunks(t, tx); n != 0 {
+		t.Errorf("GC should remove chunks, %d left", n)
+	}
+	tx.Rollback()
+
+	// With chunking disabled, objects not fitting in MEDIUMBLOB are
+	// rejected before being written
+	if e := Migrate(db, WithChunkSize(0)); e != nil {
+		t.Fatal("Migrate error", e)
+	}
+	data := make([]byte, maxZcontentSize+1)
+	rand.Read(data)
+	b := NewCommitBuilder()
+	b.Put("large", ModeBlob, data)
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	if _, e := b.Commit(db); e == nil {
+		t.Error("Commit should fail with chunking disabled")
+	} else if _, ok := e.(errObjectTooLarge); !ok {
+		t.Error("Commit should fail with errObjectTooLarge", e)
+	}
+}
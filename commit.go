@@ -0,0 +1,459 @@
+package gitdb
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature is the identity and time of a commit author or committer.
+type Signature struct {
+	Name  string
+	Email string
+	When  time.Time
+
+	// raw is the original text of an illformed signature read from an
+	// object, like one without a timezone. It is written back as-is unless
+	// fields are changed, so objects serialize back to their bodies.
+	raw string
+}
+
+// String formats the signature like it is in a git commit object:
+// "Name <email> unix-timestamp timezone".
+func (s Signature) String() string {
+	if len(s.raw) > 0 {
+		if parseSignature(s.raw).format() == s.format() {
+			return s.raw
+		}
+	}
+	return s.format()
+}
+
+func (s Signature) format() string {
+	tz := s.When.Format("-0700")
+	if name, _ := s.When.Zone(); name == "-0000" {
+		// Preserve "-0000" from parseSignature. It is used by some old
+		// commits and means the timezone is unknown.
+		tz = name
+	}
+	return fmt.Sprintf("%s <%s> %d %s", s.Name, s.Email, s.When.Unix(), tz)
+}
+
+func (s Signature) isValid() bool {
+	return len(s.Name) > 0 && !strings.ContainsAny(s.Name+s.Email, "<>\n")
+}
+
+// parseSignature parses a signature in a git commit or tag object. Like git,
+// it is lenient: a missing email, timestamp or timezone is read as empty,
+// zero or UTC. The original text is kept if it differs from the formatted
+// signature.
+func parseSignature(s string) Signature {
+	var sig Signature
+	rest := ""
+	lt := strings.IndexByte(s, '<')
+	gt := strings.LastIndexByte(s, '>')
+	if lt < 0 || gt < lt {
+		sig.Name = strings.TrimSpace(s)
+	} else {
+		sig.Name, sig.Email, rest = strings.TrimSpace(s[:lt]), s[lt+1:gt], s[gt+1:]
+	}
+	fields := strings.Fields(rest)
+	var ts int64
+	if len(fields) > 0 {
+		ts, _ = strconv.ParseInt(fields[0], 10, 64)
+	}
+	zone, offset := "+0000", 0
+	if len(fields) > 1 && len(fields[1]) == 5 && (fields[1][0] == '+' || fields[1][0] == '-') {
+		if tz, err := strconv.Atoi(fields[1]); err == nil {
+			zone, offset = fields[1], (tz/100*60+tz%100)*60
+		}
+	}
+	sig.When = time.Unix(ts, 0).In(time.FixedZone(zone, offset))
+	if sig.format() != s {
+		sig.raw = s
+	}
+	return sig
+}
+
+// Commit is a parsed git commit object.
+type Commit struct {
+	Oid       Oid
+	Tree      Oid
+	Parents   []Oid
+	Author    Signature
+	Committer Signature
+	// Encoding is the value of the "encoding" header. Empty means UTF-8.
+	Encoding string
+	// Gpgsig is the value of the "gpgsig" header, the signature of a signed
+	// commit. Empty if the commit is not signed.
+	Gpgsig string
+	// ExtraHeaders are other headers, like "mergetag", in original order.
+	// Repeated "tree", "author", "committer", "encoding" and "gpgsig"
+	// headers are also here. Like git, the first one is used.
+	ExtraHeaders []Header
+	Message      string
+
+	// noSeparator is true if the commit has no empty line after headers.
+	noSeparator bool
+	// raw is the body read from an object that does not serialize back to
+	// it, like one with headers in an unusual order. It is returned by Bytes
+	// unless fields are changed. formatted is the body formatted from the
+	// fields when the object was read.
+	raw, formatted []byte
+}
+
+// Type returns "commit".
+func (c *Commit) Type() string {
+	return "commit"
+}
+
+// Bytes serializes the commit into the body of a git commit object.
+// Headers are written in the order used by git. The body of a commit read
+// from database is returned unchanged unless fields are changed.
+func (c *Commit) Bytes() []byte {
+	body := c.format()
+	if c.raw != nil && bytes.Equal(body, c.formatted) {
+		return c.raw
+	}
+	return body
+}
+
+func (c *Commit) format() []byte {
+	headers := []Header{{"tree", string(c.Tree)}}
+	for _, p := range c.Parents {
+		headers = append(headers, Header{"parent", string(p)})
+	}
+	headers = append(headers, Header{"author", c.Author.String()}, Header{"committer", c.Committer.String()})
+	if len(c.Encoding) > 0 {
+		headers = append(headers, Header{"encoding", c.Encoding})
+	}
+	headers = append(headers, c.ExtraHeaders...)
+	if len(c.Gpgsig) > 0 {
+		headers = append(headers, Header{"gpgsig", c.Gpgsig})
+	}
+	return formatHeaders(headers, c.Message, c.noSeparator)
+}
+
+// parseCommit parses the body of a git commit object.
+func parseCommit(oid Oid, body []byte) (*Commit, error) {
+	headers, message, noSeparator, err := parseHeaders(body)
+	if err != nil {
+		return nil, fmt.Errorf("commit %s is illformed: %s", oid, err)
+	}
+	c := &Commit{Oid: oid, Message: message, noSeparator: noSeparator}
+	seen := make(map[string]bool)
+	for _, h := range headers {
+		if h.Key != "parent" && seen[h.Key] {
+			c.ExtraHeaders = append(c.ExtraHeaders, h)
+			continue
+		}
+		seen[h.Key] = true
+		switch h.Key {
+		case "tree":
+			c.Tree = Oid(h.Value)
+		case "parent":
+			c.Parents = append(c.Parents, Oid(h.Value))
+		case "author":
+			c.Author = parseSignature(h.Value)
+		case "committer":
+			c.Committer = parseSignature(h.Value)
+		case "encoding":
+			c.Encoding = h.Value
+		case "gpgsig":
+			c.Gpgsig = h.Value
+		default:
+			c.ExtraHeaders = append(c.ExtraHeaders, h)
+		}
+	}
+	if !c.Tree.IsValid() {
+		return nil, fmt.Errorf("commit %s is illformed: no tree", oid)
+	}
+	if formatted := c.format(); !bytes.Equal(formatted, body) {
+		c.raw, c.formatted = body, formatted
+	}
+	return c, nil
+}
+
+// CommitBuilder creates a commit by changing files of its parent commit.
+// It works directly in database without a filesystem checkout:
+//
+//	b := gitdb.NewCommitBuilder(parentOid)
+//	b.Put("config/app.json", gitdb.ModeBlob, content)
+//	b.Delete("config/old.json")
+//	b.Author = gitdb.Signature{Name: "Alice", Email: "alice@example.com"}
+//	b.Message = "Update config"
+//	commitOid, err := b.Commit(tx)
+//
+// Only new blobs, and trees on the paths of changed files are written.
+// Unchanged sub-trees are reused.
+type CommitBuilder struct {
+	// Author is required. If When is not set, the current time is used.
+	Author Signature
+	// Committer defaults to Author if Name is not set.
+	Committer Signature
+	Message   string
+
+	parents []Oid
+	tree    Oid
+	root    *treeChange
+	err     error
+}
+
+// treeChange is a pending change to a path.
+type treeChange struct {
+	// For a directory: changes of its entries. replace means the original
+	// entries are dropped.
+	children map[string]*treeChange
+	replace  bool
+
+	// For a file: the new entry, or nil if the path is deleted.
+	item *TreeEntry
+	body []byte
+}
+
+func (c *treeChange) isDir() bool {
+	return c.children != nil
+}
+
+// NewCommitBuilder creates a CommitBuilder. Files are based on the first
+// parent. If there are no parents, a root commit will be created.
+func NewCommitBuilder(parents ...Oid) *CommitBuilder {
+	return &CommitBuilder{
+		parents: parents,
+		root:    &treeChange{children: make(map[string]*treeChange)},
+	}
+}
+
+// Put adds or replaces a file. mode is one of ModeBlob, ModeExecutable,
+// ModeSymlink and ModeGitlink. For ModeSymlink, content is the link target.
+// For ModeGitlink, content is the hex oid of the submodule commit.
+// Directories are created as needed.
+func (b *CommitBuilder) Put(path string, mode int32, content []byte) {
+	item := &TreeEntry{Mode: mode}
+	switch mode {
+	case ModeBlob, ModeExecutable, ModeSymlink:
+		item.Oid = hashObject("blob", content)
+	case ModeGitlink:
+		if item.Oid = Oid(content); !item.Oid.IsValid() {
+			b.setErr(fmt.Errorf("invalid gitlink %q at %s", content, path))
+			return
+		}
+		content = nil
+	default:
+		b.setErr(fmt.Errorf("unsupported mode %o at %s", mode, path))
+		return
+	}
+	b.change(path, &treeChange{item: item, body: content})
+}
+
+// SetTree makes files based on the given tree instead of the first parent.
+// It is useful to commit a tree from MergeTrees:
+//
+//	tree, conflicts, err := gitdb.MergeTrees(tx, base, ours, theirs)
+//	b := gitdb.NewCommitBuilder(ours, theirs)
+//	b.SetTree(tree)
+//
+// Changes made by Put and Delete still apply.
+func (b *CommitBuilder) SetTree(oid Oid) {
+	b.tree = oid
+}
+
+// Delete deletes a file, or a directory recursively. Deleting a path that
+// does not exist is a no-op.
+func (b *CommitBuilder) Delete(path string) {
+	b.change(path, &treeChange{})
+}
+
+// change records a change to a path.
+func (b *CommitBuilder) change(path string, c *treeChange) {
+	names := strings.Split(strings.Trim(path, "/"), "/")
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || name == ".git" || strings.IndexByte(name, 0) >= 0 {
+			b.setErr(fmt.Errorf("invalid path: %q", path))
+			return
+		}
+	}
+	dir := b.root
+	for _, name := range names[:len(names)-1] {
+		sub := dir.children[name]
+		if sub == nil {
+			sub = &treeChange{children: make(map[string]*treeChange)}
+			dir.children[name] = sub
+		} else if !sub.isDir() {
+			// A file, or a deleted path, becomes a directory.
+			sub.children, sub.replace = make(map[string]*treeChange), true
+			sub.item, sub.body = nil, nil
+		}
+		dir = sub
+	}
+	dir.children[names[len(names)-1]] = c
+}
+
+func (b *CommitBuilder) setErr(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Commit writes the commit and objects it needs to database.
+// Returns the oid of the new commit. Refs are not updated. Use UpdateRef to
+// update refs.
+//
+// dt is either *sql.DB or *sql.Tx.
+func (b *CommitBuilder) Commit(dt dbOrTx) (Oid, error) {
+	if b.err != nil {
+		return "", b.err
+	}
+	author, committer := b.Author, b.Committer
+	if len(committer.Name) == 0 {
+		committer = author
+	}
+	now := time.Now()
+	for _, s := range []*Signature{&author, &committer} {
+		if !s.isValid() {
+			return "", fmt.Errorf("invalid signature: %q", s.String())
+		}
+		if s.When.IsZero() {
+			s.When = now
+		}
+	}
+
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return "", err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	var baseTree Oid
+	if len(b.parents) > 0 {
+		parents, err := readObjects(tx, b.parents)
+		if err != nil {
+			return "", err
+		}
+		for _, p := range parents {
+			if p.Type != "commit" {
+				return "", fmt.Errorf("parent %s is a %s, not a commit", p.Oid, p.Type)
+			}
+		}
+		baseTree = parents[0].referredOids()[0]
+	}
+	if len(b.tree) > 0 {
+		baseTree = b.tree
+	}
+
+	var objs []*gitObj
+	treeOid, err := writeTreeChange(tx, baseTree, b.root, &objs)
+	if err != nil {
+		return "", err
+	}
+	if len(treeOid) == 0 {
+		// Empty tree
+		objs = append(objs, &gitObj{Oid: hashObject("tree", nil), Type: "tree"})
+		treeOid = objs[len(objs)-1].Oid
+	}
+
+	c := &Commit{Tree: treeOid, Parents: b.parents, Author: author, Committer: committer, Message: b.Message}
+	if len(c.Message) > 0 && !strings.HasSuffix(c.Message, "\n") {
+		c.Message += "\n"
+	}
+	body := c.Bytes()
+	commit := &gitObj{Oid: hashObject("commit", body), Type: "commit", Body: body}
+	objs = append(objs, commit)
+
+	// Write objects not in database
+	oids := make([]Oid, len(objs))
+	for i, o := range objs {
+		oids[i] = o.Oid
+	}
+	newOids, err := unseenOids(tx, uniqueOids(oids))
+	if err != nil {
+		return "", err
+	}
+	isNew := toSet(newOids)
+	var newObjs []*gitObj
+	for _, o := range objs {
+		if isNew[o.Oid] {
+			newObjs = append(newObjs, o)
+			isNew[o.Oid] = false
+		}
+	}
+	for _, o := range newObjs {
+		if err := checkObject(o); err != nil {
+			return "", err
+		}
+	}
+	if err = insertObjects(tx, newObjs); err != nil {
+		return "", err
+	}
+
+	if txByUs {
+		if err = tx.Commit(); err != nil {
+			return "", err
+		}
+	}
+	return commit.Oid, nil
+}
+
+// writeTreeChange applies changes to a tree and appends new objects to
+// objs. Returns the new tree oid, or an empty string if the tree becomes
+// empty. treeOid is empty if the tree does not exist.
+func writeTreeChange(tx *gitTx, treeOid Oid, change *treeChange, objs *[]*gitObj) (Oid, error) {
+	items := make(map[string]*TreeEntry)
+	if len(treeOid) > 0 && !change.replace {
+		trees, err := readObjects(tx, []Oid{treeOid})
+		if err != nil {
+			return "", err
+		}
+		if trees[0].Type != "tree" {
+			return "", fmt.Errorf("%s is a %s, not a tree", treeOid, trees[0].Type)
+		}
+		for _, ti := range parseTree(trees[0].Body) {
+			items[ti.Name] = ti
+		}
+	}
+
+	for name, c := range change.children {
+		old := items[name]
+		switch {
+		case c.isDir():
+			var subOid Oid
+			if old != nil && old.IsTree() {
+				subOid = old.Oid
+			}
+			newOid, err := writeTreeChange(tx, subOid, c, objs)
+			if err != nil {
+				return "", err
+			}
+			if len(newOid) == 0 {
+				delete(items, name)
+			} else {
+				items[name] = &TreeEntry{Oid: newOid, Name: name, Mode: ModeTree}
+			}
+		case c.item != nil:
+			items[name] = &TreeEntry{Oid: c.item.Oid, Name: name, Mode: c.item.Mode}
+			if c.item.Mode != ModeGitlink {
+				*objs = append(*objs, &gitObj{Oid: c.item.Oid, Type: "blob", Body: c.body})
+			}
+		default:
+			delete(items, name)
+		}
+	}
+
+	if len(items) == 0 {
+		return "", nil
+	}
+	list := make([]*TreeEntry, 0, len(items))
+	for _, ti := range items {
+		list = append(list, ti)
+	}
+	body := formatTree(list)
+	oid := hashObject("tree", body)
+	if oid != treeOid {
+		*objs = append(*objs, &gitObj{Oid: oid, Type: "tree", Body: body})
+	}
+	return oid, nil
+}
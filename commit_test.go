@@ -0,0 +1,183 @@
+package gitdb
+
+import (
+	"database/sql"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func countObjects(db *sql.DB) (n int) {
+	db.QueryRow("SELECT COUNT(1) FROM " + table).Scan(&n)
+	return n
+}
+
+func TestCommitBuilder(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("commitBuilder")
+	defer db.Close()
+
+	dir := createRandomRepo("cb", 30, true, true)
+	_, parent, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, _, paths, e := ReadTree(db, parent)
+	if e != nil || len(paths) < 2 {
+		t.Fatal("ReadTree unexpected", e, paths)
+	}
+
+	count := countObjects(db)
+	when := time.Unix(1500000000, 0).In(time.FixedZone("", 8*3600))
+	b := NewCommitBuilder(parent)
+	b.Put("new/dir/file.txt", ModeBlob, []byte("hello\n"))
+	b.Put("new/run.sh", ModeExecutable, []byte("#!/bin/sh\n"))
+	b.Put("link", ModeSymlink, []byte("new/dir/file.txt"))
+	b.Put(paths[0], ModeBlob, []byte("changed\n"))
+	b.Delete(paths[1])
+	b.Put("deleted/later", ModeBlob, []byte("x"))
+	b.Delete("deleted")
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com", When: when}
+	b.Message = "built"
+	oid, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+
+	// Only new blobs, changed trees and the commit are written
+	if n := countObjects(db); n != count+8 {
+		t.Errorf("Commit wrote %d objects, expected 8", n-count)
+	}
+
+	// Compare with git plumbing commands doing the same changes
+	out := filepath.Join(repoDir, "cb-export")
+	os.RemoveAll(out)
+	if _, e := Export(db, out, oid, "HEAD"); e != nil {
+		t.Fatal("Export error", e)
+	}
+	git := func(stdin string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = out
+		cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+filepath.Join(out, ".git", "test-index"),
+			"GIT_AUTHOR_NAME=Alice", "GIT_AUTHOR_EMAIL=alice@example.com", "GIT_AUTHOR_DATE=1500000000 +0800",
+			"GIT_COMMITTER_NAME=Alice", "GIT_COMMITTER_EMAIL=alice@example.com", "GIT_COMMITTER_DATE=1500000000 +0800")
+		cmd.Stdin = strings.NewReader(stdin)
+		o, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatal("git", args, "error", err, string(o))
+		}
+		return strings.TrimSpace(string(o))
+	}
+	git("", "read-tree", string(parent))
+	put := func(mode, path, content string) {
+		blob := git(content, "hash-object", "-w", "--stdin")
+		git("", "update-index", "--add", "--cacheinfo", mode+","+blob+","+path)
+	}
+	put("100644", "new/dir/file.txt", "hello\n")
+	put("100755", "new/run.sh", "#!/bin/sh\n")
+	put("120000", "link", "new/dir/file.txt")
+	put("100644", paths[0], "changed\n")
+	git("", "update-index", "--force-remove", paths[1])
+	tree := git("", "write-tree")
+	expected := git("built\n", "commit-tree", tree, "-p", string(parent))
+	if string(oid) != expected {
+		t.Errorf("Commit unexpected: %s, git commit-tree: %s", oid, expected)
+	}
+	git("", "fsck", "--full", "--strict")
+
+	// Building on top of the new commit. Deleting the last file in a
+	// directory removes the directory.
+	b = NewCommitBuilder(oid)
+	b.Delete("new/dir/file.txt")
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	oid2, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	_, _, paths2, e := ReadTree(db, oid2)
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	for _, p := range paths2 {
+		if strings.HasPrefix(p, "new/dir") {
+			t.Error("new/dir should be removed")
+		}
+	}
+
+	// Errors
+	for _, f := range []func(b *CommitBuilder){
+		func(b *CommitBuilder) { b.Put("a/../b", ModeBlob, nil) },
+		func(b *CommitBuilder) { b.Put("a\x00b", ModeBlob, nil) },
+		func(b *CommitBuilder) { b.Delete("a\x00/b") },
+		func(b *CommitBuilder) { b.Put("a", ModeTree, nil) },
+		func(b *CommitBuilder) { b.Author.Name = "" },
+	} {
+		b = NewCommitBuilder(oid)
+		b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+		f(b)
+		if _, e := b.Commit(db); e == nil {
+			t.Error("Commit should fail")
+		}
+	}
+	b = NewCommitBuilder(Oid(strings.Repeat("1", 40)))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	if _, e := b.Commit(db); e == nil {
+		t.Error("Commit should fail if parent is missing")
+	}
+
+	// Root commit
+	b = NewCommitBuilder()
+	b.Put("README", ModeBlob, []byte("root\n"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	if _, e := b.Commit(db); e != nil {
+		t.Error("Commit error", e)
+	}
+}
+
+func TestCommitBuilderNamesWithSpaces(t *testing.T) {
+	db := createDb("commitBuilderSpaces")
+	defer db.Close()
+
+	b := NewCommitBuilder()
+	b.Put("my file.txt", ModeBlob, []byte("a\n"))
+	b.Put("my dir/a b.txt", ModeBlob, []byte("b\n"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	parent, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+
+	// Trees of the parent are rewritten without mangling names
+	b = NewCommitBuilder(parent)
+	b.Put("other", ModeBlob, []byte("c\n"))
+	b.Put("my dir/other", ModeBlob, []byte("d\n"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	oid, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	for path, expected := range map[string]string{"my file.txt": "a\n", "my dir/a b.txt": "b\n", "other": "c\n", "my dir/other": "d\n"} {
+		mode, _, content, e := ReadPath(db, oid, path)
+		if e != nil || mode != ModeBlob || string(content) != expected {
+			t.Errorf("ReadPath(%q) = %o, %q, %v, expected %q", path, mode, content, e, expected)
+		}
+	}
+
+	if !checkGit() {
+		return
+	}
+	out := filepath.Join(repoDir, "cb-spaces-export")
+	os.RemoveAll(out)
+	if _, e := Export(db, out, oid, "HEAD"); e != nil {
+		t.Fatal("Export error", e)
+	}
+	if o, e := exec.Command("git", "-C", out, "fsck", "--full", "--strict").CombinedOutput(); e != nil {
+		t.Error("Exported repo is broken", e, string(o))
+	}
+}
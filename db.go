@@ -2,13 +2,16 @@ package gitdb
 
 import (
 	"database/sql"
+	"database/sql/driver"
 	"fmt"
-	"path/filepath"
+	"io"
+	"io/ioutil"
+	"path"
 	"strings"
+	"time"
 )
 
 const table = "gitobjects"
-const batchRows = 500
 
 // dbOrTx is compatible with sql.DB and sql.Tx
 type dbOrTx interface {
@@ -19,8 +22,55 @@ type dbOrTx interface {
 // rowScanFunc matches the signature of (*sql.Rows).Scan
 type rowScanFunc func(...interface{}) error
 
-// CreateTable creates the required git objects table on demand.
-func CreateTable(db *sql.DB) (sql.Result, error) {
+// CreateTableOption customizes the behavior of CreateTable.
+type CreateTableOption func(*createTableConfig)
+
+// Options stored in the gitdb_settings table are pointers. nil keeps the
+// stored value, so a process calling Migrate on start does not undo the
+// choice of another process.
+type createTableConfig struct {
+	edges       *bool
+	commitCache *bool
+	dialect     Dialect
+	chunkSize   *int
+}
+
+// WithoutEdges makes CreateTable empty the gitobject_edges table, and makes
+// gitdb stop writing and using it. It saves space if recursive queries and
+// ReferringOids are not needed.
+//
+// The choice is stored in the gitdb_settings table, so all processes
+// sharing the database agree on it. Calling CreateTable or Migrate without
+// options keeps it. Use WithEdges to use the table again.
+func WithoutEdges() CreateTableOption {
+	return func(c *createTableConfig) {
+		edges := false
+		c.edges = &edges
+	}
+}
+
+// WithEdges makes CreateTable backfill the gitobject_edges table from
+// existing objects, after it was emptied by WithoutEdges. The table is used
+// after the backfill completes. New databases use the table by default.
+func WithEdges() CreateTableOption {
+	return func(c *createTableConfig) {
+		edges := true
+		c.edges = &edges
+	}
+}
+
+// CreateTable creates the required tables on demand, or upgrades them.
+// It is like Migrate. The returned sql.Result reports no affected rows.
+func CreateTable(db *sql.DB, options ...CreateTableOption) (sql.Result, error) {
+	if err := Migrate(db, options...); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// createObjectTable creates the git objects table. It is a migration step.
+// The mtime column is added by a later step.
+func createObjectTable(db *sql.DB, d Dialect) (sql.Result, error) {
 	return db.Exec("CREATE TABLE IF NOT EXISTS " + table + " (" +
 		"oid CHAR(40) PRIMARY KEY NOT NULL," +
 		"type CHAR(6) NOT NULL," +
@@ -32,19 +82,139 @@ func CreateTable(db *sql.DB) (sql.Result, error) {
 		// These fields seem to be unnecessary but they exist for
 		// performance reason.
 		//
-		// MEDIUMBLOB is MySQL specific, which is 16MB. BLOB in Sqlite
-		// does not have a length limit.
-		"zcontent MEDIUMBLOB NOT NULL," +
+		// The blob type depends on the dialect. MEDIUMBLOB in MySQL
+		// is 16MB. BYTEA in PostgreSQL and BLOB in SQLite are larger.
+		// Larger zcontent is stored in chunks. See WithChunkSize.
+		"zcontent " + d.BlobType() + " NOT NULL," +
 		"referred TEXT)")
 }
 
+// ReadTreeOption customizes the behavior of ReadTree.
+type ReadTreeOption func(*readTreeConfig)
+
+type readTreeConfig struct {
+	recurseSubmodules bool
+	prefix            string
+	globs             [][]string // split by "/"
+	maxDepth          int
+	includeTrees      bool
+	repo              *Repo // set by Repo.ReadTree
+}
+
+// RecurseSubmodules makes ReadTree read submodules recursively if the commits
+// their gitlinks point to are also stored in database. Paths in submodules are
+// prefixed by the gitlink path, like `git ls-files --recurse-submodules`.
+// Gitlinks pointing to commits not in database are skipped.
+func RecurseSubmodules() ReadTreeOption {
+	return func(c *readTreeConfig) {
+		c.recurseSubmodules = true
+	}
+}
+
+// Prefix makes ReadTree only return paths starting with prefix, like
+// "docs/". Trees not containing such paths are not read.
+func Prefix(prefix string) ReadTreeOption {
+	return func(c *readTreeConfig) {
+		c.prefix = prefix
+	}
+}
+
+// Glob makes ReadTree only return paths matching any of the patterns.
+// Patterns use the syntax of path.Match, plus "**" matching zero or more
+// directories. For example, "**/*.yaml" matches YAML files in all
+// directories. Trees not containing matched paths are not read.
+func Glob(patterns ...string) ReadTreeOption {
+	return func(c *readTreeConfig) {
+		for _, p := range patterns {
+			c.globs = append(c.globs, strings.Split(strings.Trim(p, "/"), "/"))
+		}
+	}
+}
+
+// MaxDepth makes ReadTree only return paths with at most depth components.
+// For example, MaxDepth(1) only returns entries of the root tree, like
+// `git ls-tree` without -r. Trees deeper than that are not read.
+func MaxDepth(depth int) ReadTreeOption {
+	return func(c *readTreeConfig) {
+		c.maxDepth = depth
+	}
+}
+
+// IncludeTrees makes ReadTree also return tree entries, like
+// `git ls-tree -r -t`.
+func IncludeTrees() ReadTreeOption {
+	return func(c *readTreeConfig) {
+		c.includeTrees = true
+	}
+}
+
+// matches tests whether an entry at path should be returned.
+func (c *readTreeConfig) matches(path string) bool {
+	if !strings.HasPrefix(path, c.prefix) {
+		return false
+	}
+	names := strings.Split(path, "/")
+	if c.maxDepth > 0 && len(names) > c.maxDepth {
+		return false
+	}
+	return c.matchesGlobs(names, false)
+}
+
+// descends tests whether a tree at path might contain entries that should
+// be returned.
+func (c *readTreeConfig) descends(path string) bool {
+	dir := path + "/"
+	if !strings.HasPrefix(dir, c.prefix) && !strings.HasPrefix(c.prefix, dir) {
+		return false
+	}
+	names := strings.Split(path, "/")
+	if c.maxDepth > 0 && len(names) >= c.maxDepth {
+		return false
+	}
+	return c.matchesGlobs(names, true)
+}
+
+func (c *readTreeConfig) matchesGlobs(names []string, partial bool) bool {
+	if len(c.globs) == 0 {
+		return true
+	}
+	for _, g := range c.globs {
+		if globMatch(g, names, partial) {
+			return true
+		}
+	}
+	return false
+}
+
 // ReadTree reads trees and sub-trees recursively from database.
 // Returns modes, oids, full paths for non-tree objects.
 // It is like `git ls-tree -r` but works directly in database.
 //
 // dt is either *sql.DB or *sql.Tx.
-// oid is the git object ID of a git tree or commit.
-func ReadTree(dt dbOrTx, oid Oid) (modes []int32, oids []Oid, paths []string, err error) {
+// oid is the git object ID of a git tree, commit or annotated tag.
+//
+// Gitlinks (submodules) are not returned since the commits they point to
+// usually belong to other repos. Use ReadGitlinks to list them, or the
+// RecurseSubmodules option to read submodules stored in database. Therefore
+// the returned oids are safe to be passed to ReadBlobs, unless the
+// IncludeTrees option is used.
+//
+// Use Prefix, Glob and MaxDepth options to filter paths. They are applied
+// while walking trees, so trees outside the filter are not read. Paths are
+// always separated by "/".
+func ReadTree(dt dbOrTx, oid Oid, options ...ReadTreeOption) (modes []int32, oids []Oid, paths []string, err error) {
+	var cfg readTreeConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+	for _, g := range cfg.globs {
+		for _, name := range g {
+			if _, err := path.Match(name, ""); err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid glob pattern %q: %s", strings.Join(g, "/"), err)
+			}
+		}
+	}
+
 	tx, txByUs, err := getOrCreateTx(dt)
 	if err != nil {
 		return nil, nil, nil, err
@@ -53,36 +223,137 @@ func ReadTree(dt dbOrTx, oid Oid) (modes []int32, oids []Oid, paths []string, er
 		defer tx.Rollback()
 	}
 
-	prefixes := map[Oid]string{oid: ""}
-	for nextOids := []Oid{oid}; len(nextOids) > 0; {
-		objs, err := readObjects(tx, nextOids)
-		nextOids = []Oid{}
+	err = walkTree(tx, oid, &cfg, func(ti *TreeEntry, path string) {
+		if !ti.IsGitlink() {
+			paths = append(paths, path)
+			oids = append(oids, ti.Oid)
+			modes = append(modes, ti.Mode)
+		}
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return modes, oids, paths, nil
+}
+
+// ReadGitlinks reads trees and sub-trees recursively from database and
+// returns commit oids and full paths of gitlinks (submodules).
+// It is like `git ls-files -s | grep ^160000` but works directly in database.
+//
+// dt is either *sql.DB or *sql.Tx.
+// oid is the git object ID of a git tree, commit or annotated tag.
+func ReadGitlinks(dt dbOrTx, oid Oid) (oids []Oid, paths []string, err error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	err = walkTree(tx, oid, &readTreeConfig{}, func(ti *TreeEntry, path string) {
+		if ti.IsGitlink() {
+			paths = append(paths, path)
+			oids = append(oids, ti.Oid)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return oids, paths, nil
+}
+
+// walkTree reads trees recursively in BFS order and calls visit for every
+// non-tree entry, including gitlinks that are not recursed into, and tree
+// entries if cfg.includeTrees is set. Entries and trees not matching cfg
+// filters are skipped.
+func walkTree(tx *gitTx, oid Oid, cfg *readTreeConfig, visit func(ti *TreeEntry, path string)) error {
+	// The same tree can appear in different paths. Therefore oids and
+	// paths are tracked as pairs.
+	type pending struct {
+		oid    Oid
+		prefix string
+	}
+	for next := []pending{{oid, ""}}; len(next) > 0; {
+		curr := next
+		next = nil
+		currOids := make([]Oid, len(curr))
+		for i, p := range curr {
+			currOids[i] = p.oid
+		}
+		objs, err := readObjects(tx, currOids)
 		if err != nil {
-			return nil, nil, nil, err
+			return err
 		}
-		for _, o := range objs {
-			prefix := prefixes[o.Oid]
+
+		var gitlinks []*TreeEntry
+		var gitlinkPaths []string
+		for i, o := range objs {
+			prefix := curr[i].prefix
 			switch o.Type {
 			case "commit":
 				// extract tree oid from commit object automatically
-				treeOid := Oid(o.Body[5:45])
-				nextOids = append(nextOids, treeOid)
+				referred := o.referredOids()
+				if len(referred) == 0 {
+					return fmt.Errorf("%s %s is illformed", o.Type, o.Oid)
+				}
+				next = append(next, pending{referred[0], prefix})
+			case "tag":
+				// peel annotated tags to the tagged commit or tree
+				for _, taggedOid := range o.referredOids() {
+					next = append(next, pending{taggedOid, prefix})
+				}
 			case "tree":
 				for _, ti := range parseTree(o.Body) {
-					path := filepath.Join(prefix, ti.Name)
-					if ti.IsTree() {
-						prefixes[ti.Oid] = path
-						nextOids = append(nextOids, ti.Oid)
-					} else {
-						paths = append(paths, path)
-						oids = append(oids, ti.Oid)
-						modes = append(modes, ti.Mode)
+					path := ti.Name
+					if len(prefix) > 0 {
+						path = prefix + "/" + ti.Name
+					}
+					switch {
+					case ti.IsTree():
+						if cfg.includeTrees && cfg.matches(path) {
+							visit(ti, path)
+						}
+						if cfg.descends(path) {
+							next = append(next, pending{ti.Oid, path})
+						}
+					case ti.IsGitlink() && cfg.recurseSubmodules && cfg.descends(path):
+						gitlinks = append(gitlinks, ti)
+						gitlinkPaths = append(gitlinkPaths, path)
+					case cfg.matches(path):
+						visit(ti, path)
 					}
 				}
 			}
 		}
+
+		if len(gitlinks) > 0 {
+			linkOids := make([]Oid, len(gitlinks))
+			for i, ti := range gitlinks {
+				linkOids[i] = ti.Oid
+			}
+			var missing []Oid
+			if cfg.repo != nil {
+				missing, err = cfg.repo.unowned(tx, linkOids)
+			} else {
+				missing, err = unseenOids(tx, linkOids)
+			}
+			if err != nil {
+				return err
+			}
+			missingSet := toSet(missing)
+			for i, ti := range gitlinks {
+				if missingSet[ti.Oid] {
+					if cfg.matches(gitlinkPaths[i]) {
+						visit(ti, gitlinkPaths[i])
+					}
+				} else {
+					next = append(next, pending{ti.Oid, gitlinkPaths[i]})
+				}
+			}
+		}
 	}
-	return modes, oids, paths, nil
+	return nil
 }
 
 // ReadBlobs reads blob contents from database.
@@ -117,6 +388,39 @@ func ReadBlobs(dt dbOrTx, oids []Oid) ([][]byte, error) {
 	return result, nil
 }
 
+// ReadObject reads and parses a git object from database.
+// It is like `git cat-file -p` but returns a typed value.
+//
+// dt is either *sql.DB or *sql.Tx.
+// oid is the git object ID of the object to be read.
+//
+// Returns *Blob, *Tree, *Commit or *Tag.
+func ReadObject(dt dbOrTx, oid Oid) (Object, error) {
+	objs, err := ReadObjects(dt, []Oid{oid})
+	if err != nil {
+		return nil, err
+	}
+	return objs[0], nil
+}
+
+// ReadObjects is like ReadObject but reads multiple objects in one batch.
+func ReadObjects(dt dbOrTx, oids []Oid) ([]Object, error) {
+	objs, err := readObjects(dt, oids)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Object, 0, len(objs))
+	for _, o := range objs {
+		obj, err := parseObject(o)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, obj)
+	}
+	return result, nil
+}
+
 // readObjects reads git objects from database and return gitObjs.
 // For duplicated oids, returns two pointers to a same gitObj.
 // Missing objects or mismatched SHA1 will cause errors.
@@ -130,14 +434,8 @@ func readObjects(dt dbOrTx, oids []Oid) ([]*gitObj, error) {
 	}
 
 	m := make(map[Oid]*gitObj, len(oids))
-	err = queryByOids(tx, "oid, zcontent", oids, func(scan rowScanFunc) error {
-		var s string
-		var zcontent []byte
-		if err := scan(&s, &zcontent); err != nil {
-			return err
-		}
-		oid := Oid(s)
-		o, err := newGitObjFromZcontent(zcontent)
+	err = queryZcontents(tx, oids, func(oid Oid, zcontent io.Reader) error {
+		o, err := newGitObjFromZreader(zcontent)
 		if err != nil {
 			return fmt.Errorf("cannot read object %s: %s", oid, err)
 		}
@@ -162,6 +460,23 @@ func readObjects(dt dbOrTx, oids []Oid) ([]*gitObj, error) {
 	return result, nil
 }
 
+// ImportOption customizes the behavior of Import.
+type ImportOption func(*importConfig)
+
+type importConfig struct {
+	gitBinary bool
+	repo      *Repo // set by Repo.Import
+}
+
+// UseGitBinary makes Import run the external git binary (`git rev-parse`,
+// `git rev-list` and `git cat-file`) to read the repository, instead of
+// reading loose objects and packfiles directly.
+func UseGitBinary() ImportOption {
+	return func(c *importConfig) {
+		c.gitBinary = true
+	}
+}
+
 // Import syncs git objects from filesystem to database.
 // It is like `git push` running from the filesystem.
 //
@@ -169,20 +484,38 @@ func readObjects(dt dbOrTx, oids []Oid) ([]*gitObj, error) {
 // path is the path of the git repository. It can be the `.git` directory,
 // or its parent.
 // ref is the reference string. It can be "HEAD", a tag name, a branch name,
-// a commit hash or its prefix.
+// a commit hash or its prefix, optionally followed by "^", "~N", "^{}".
+//
+// The git repository is read directly without the git binary, unless the
+// UseGitBinary option is used.
 //
 // Returns oids, refOid, err.
 // oids are imported object IDs. If nothing is imported (the database is
 // up-to-date), oids will be an empty array.
 // refOid is the parsed git object ID (40-char hex string) of the given ref.
-func Import(dt dbOrTx, path string, ref string) (oids []Oid, refOid Oid, err error) {
-	// List object IDs to check or import
+// If ref is an annotated tag, refOid is the oid of the tag object.
+func Import(dt dbOrTx, path string, ref string, options ...ImportOption) (oids []Oid, refOid Oid, err error) {
+	var cfg importConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	// Resolve ref without peeling annotated tags, so tag objects are
+	// imported and refOid is the tag, not the tagged commit.
 	repo := newRepo(path)
-	oids, err = repo.listOids(ref)
-	if err != nil || len(oids) == 0 {
+	repo.gitBinary = cfg.gitBinary
+	defer repo.close()
+	refOid, err = repo.resolveRef(ref)
+	if err != nil {
 		return nil, "", err
 	}
-	refOid = oids[0]
+
+	// List object IDs to check or import
+	oids, listed, err := repo.listObjects([]Oid{refOid})
+	if err != nil {
+		return nil, refOid, err
+	}
+	oids = append([]Oid{refOid}, minus(oids, []Oid{refOid})...)
 
 	tx, txByUs, err := getOrCreateTx(dt)
 	if err != nil {
@@ -194,32 +527,67 @@ func Import(dt dbOrTx, path string, ref string) (oids []Oid, refOid Oid, err err
 		defer tx.Rollback()
 	}
 
+	// Remove oids that the repo in database already owns
+	if cfg.repo != nil {
+		oids, err = cfg.repo.unowned(tx, oids)
+		if err != nil {
+			return nil, refOid, err
+		}
+	}
+
 	// Remove oids that exist in database
-	oids, err = unseenOids(tx, oids)
+	newOids, err := unseenOids(tx, oids)
 	if err != nil {
 		return nil, refOid, err
 	}
 
-	// Read new objects
-	objs, err := repo.readObjects(oids)
-	if err != nil {
-		return nil, refOid, err
+	// Read new objects. Objects other than blobs were read by listObjects.
+	var unread []Oid
+	for _, oid := range newOids {
+		if listed[oid] == nil {
+			unread = append(unread, oid)
+		}
+	}
+	var read []*gitObj
+	if len(unread) > 0 {
+		read, err = repo.readObjects(unread)
+		if err != nil {
+			return nil, refOid, err
+		}
+	}
+	objs := make([]*gitObj, 0, len(newOids))
+	for _, oid := range newOids {
+		if o := listed[oid]; o != nil {
+			objs = append(objs, o)
+		} else {
+			objs = append(objs, read[0])
+			read = read[1:]
+		}
 	}
 
 	// Write new objects
-	stmt, err := tx.Prepare("INSERT INTO " + table + " (oid, zcontent, type, referred) VALUES (?, ?, ?, ?)")
-	if err != nil {
+	if err = insertObjects(tx, objs); err != nil {
 		return nil, refOid, err
 	}
-	defer stmt.Close()
 
-	for _, obj := range objs {
-		_, err = stmt.Exec(string(obj.Oid), obj.zcontent(), obj.Type, joinOids(obj.referredOids(), ","))
-		if err != nil {
+	// Refresh the existing ref object so a concurrent GC keeps it and
+	// objects reachable from it. New objects refresh existing objects they
+	// refer to.
+	if !toSet(newOids)[refOid] {
+		if err = touchObjects(tx, []Oid{refOid}, time.Now().Unix()); err != nil {
 			return nil, refOid, err
 		}
 	}
 
+	if cfg.repo != nil {
+		err = cfg.repo.own(tx, oids)
+	} else {
+		oids = newOids
+	}
+	if err != nil {
+		return nil, refOid, err
+	}
+
 	if txByUs {
 		if err = tx.Commit(); err != nil {
 			return nil, refOid, err
@@ -229,29 +597,69 @@ func Import(dt dbOrTx, path string, ref string) (oids []Oid, refOid Oid, err err
 	return oids, refOid, nil
 }
 
+// ExportOption customizes the behavior of Export.
+type ExportOption func(*exportConfig)
+
+type exportConfig struct {
+	looseObjectLimit int
+	deltas           bool
+	repo             *Repo // set by Repo.Export
+}
+
+// LooseObjectLimit makes Export write loose objects, one file per object,
+// instead of a packfile if fewer than n objects are exported. It is like
+// git's `transfer.unpackLimit` and is suitable for small increments.
+func LooseObjectLimit(n int) ExportOption {
+	return func(c *exportConfig) {
+		c.looseObjectLimit = n
+	}
+}
+
+// DeltaCompression makes Export delta-compress objects in the packfile. The
+// packfile will be smaller at the cost of CPU time.
+func DeltaCompression() ExportOption {
+	return func(c *exportConfig) {
+		c.deltas = true
+	}
+}
+
 // Export syncs git objects from database to filesystem.
 // It is like `git pull` running from the filesystem.
 //
 // dt is either *sql.DB or *sql.Tx.
 // path is the path of the git repository. It can be the `.git` directory,
-// or its parent.
+// or its parent. If path does not exist or is an empty directory, a new
+// repository is created, like `git clone`.
 // oid is the git object ID in database.
 // ref is the reference string which will be written to the filesystem.
 // It is usually "HEAD". It could also be "refs/tags/foo", or "refs/heads/bar".
 // If ref is an empty string, a generated tag name will be used to make the
 // newly written objects not orphaned.
 //
+// By default, objects are written to a single packfile under objects/pack.
+// Use the LooseObjectLimit option to write loose objects instead.
+//
 // Returns oids and error.
 // oids is a list of git object IDs exported. If nothing is exported (the
 // git repository in the filesystem is up-to-date), oids will be an empty
 // array.
-func Export(dt dbOrTx, path string, oid Oid, ref string) ([]Oid, error) {
+func Export(dt dbOrTx, path string, oid Oid, ref string, options ...ExportOption) ([]Oid, error) {
+	var cfg exportConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+
 	if len(ref) == 0 {
 		ref = "refs/tags/gitdb/" + string(oid)
 	}
 
+	repo, err := openOrInitRepo(path)
+	if err != nil {
+		return nil, err
+	}
+	defer repo.close()
+
 	// Quick up-to-date test
-	repo := newRepo(path)
 	if repo.hasOid(oid) {
 		return nil, repo.writeRef(ref, oid)
 	}
@@ -263,46 +671,88 @@ func Export(dt dbOrTx, path string, oid Oid, ref string) ([]Oid, error) {
 	if txByUs {
 		defer tx.Rollback()
 	}
+	if cfg.repo != nil {
+		if err := cfg.repo.checkOwned(tx, []Oid{oid}); err != nil {
+			return nil, err
+		}
+	}
 
-	// Scan oids that the repo already have
-	repoOids, err := repo.listOids("--all")
-	if err != nil {
-		return nil, err
+	// With the commit cache, only commits not in the repo are walked
+	var newOids []Oid
+	cached := false
+	if tx.commitCache {
+		newOids, cached, err = cachedNewOids(tx, oid, repo.hasOid)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// BFS the database to select what we need to export
-	// Note: If an object exists in the repo, we won't check its parent.
-	// This requires writting objects in a certain order. See below.
-	newOids, err := bfsOids(tx, []Oid{oid}, repoOids)
-	if err != nil {
-		return nil, err
+	if !cached {
+		// Scan oids that the repo already have
+		refOids, err := repo.allRefOids()
+		if err != nil {
+			return nil, err
+		}
+		repoOids, err := repo.listOids(refOids)
+		if err != nil {
+			return nil, err
+		}
+
+		// BFS the database to select what we need to export
+		// Note: If an object exists in the repo, we won't check its parent.
+		// This requires writting objects in a certain order. See below.
+		newOids, err = bfsOids(tx, []Oid{oid}, repoOids)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Read contents of selected oids
 	zmap := make(map[Oid][]byte, len(newOids))
-	err = queryByOids(tx, "oid, zcontent", newOids, func(scan rowScanFunc) error {
-		var s string
-		var zcontent []byte
-		if err := scan(&s, &zcontent); err != nil {
-			return err
+	err = queryZcontents(tx, newOids, func(oid Oid, zcontent io.Reader) error {
+		z, err := ioutil.ReadAll(zcontent)
+		if err != nil {
+			return fmt.Errorf("cannot read object %s: %s", oid, err)
 		}
-		oid := Oid(s)
-		zmap[oid] = zcontent
+		zmap[oid] = z
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
-	// Write git objects to filesystem
-	// Dependent objects (with higher level of the BFS tree) are written first.
-	for i := len(newOids) - 1; i >= 0; i-- {
-		o := newOids[i]
-		z, ok := zmap[o]
-		if !ok {
-			return nil, errDbMissingObject(o)
+	if len(newOids) < cfg.looseObjectLimit {
+		// Write git objects to filesystem
+		// Dependent objects (with higher level of the BFS tree) are written first.
+		for i := len(newOids) - 1; i >= 0; i-- {
+			o := newOids[i]
+			z, ok := zmap[o]
+			if !ok {
+				return nil, errDbMissingObject(o)
+			}
+			if err := repo.writeRawObject(o, z); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		// Write a single packfile. Objects become visible together when
+		// the index is written so the order does not matter.
+		objs := make([]*gitObj, 0, len(newOids))
+		for _, o := range newOids {
+			z, ok := zmap[o]
+			if !ok {
+				return nil, errDbMissingObject(o)
+			}
+			obj, err := newGitObjFromZcontent(z)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read object %s: %s", o, err)
+			}
+			if obj.Oid != o {
+				return nil, fmt.Errorf("sha1 mismatch: oid = %s, sha1(content) = %s", o, obj.Oid)
+			}
+			objs = append(objs, obj)
 		}
-		if err := repo.writeRawObject(o, z); err != nil {
+		if err := repo.writePack(objs, cfg.deltas); err != nil {
 			return nil, err
 		}
 	}
@@ -317,51 +767,81 @@ func Export(dt dbOrTx, path string, oid Oid, ref string) ([]Oid, error) {
 	return newOids, repo.writeRef(ref, oid)
 }
 
-// GC removes all objects from database except for oids and their parents
-// and ancestors.
-//
-// Returns deleted git object IDs.
-func GC(tx *sql.Tx, oids []Oid) ([]Oid, error) {
-	// Scan reachable objects
-	oids, err := bfsOids(tx, oids, nil)
+// insertObjects writes git objects to database. Objects, and chunks of
+// objects, already in database are kept as is.
+func insertObjects(tx *gitTx, objs []*gitObj) error {
+	stmt, err := tx.Prepare(tx.rebind(tx.dialect.InsertIgnore(table, []string{"oid", "zcontent", "type", "referred", "mtime"})))
 	if err != nil {
-		return nil, err
+		return err
 	}
-	reachable := toSet(oids)
-
-	// Find out deletable objects
-	deletable := make([]Oid, 0)
-	rows, err := tx.Query("SELECT oid FROM " + table)
+	defer stmt.Close()
+	var edgeStmt *sql.Stmt
+	writeEdges, err := tx.writeEdges()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if writeEdges {
+		edgeStmt, err = tx.Prepare(tx.rebind(tx.dialect.InsertIgnore(edgeTable, []string{"src", "dst", "kind"})))
+		if err != nil {
+			return err
+		}
+		defer edgeStmt.Close()
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var s string
-		if err = rows.Scan(&s); err != nil {
-			return nil, err
+	mtime := time.Now().Unix()
+	oids := make([]Oid, 0, len(objs))
+	var allReferred, commits []Oid
+	parentsOf := make(map[Oid][]Oid)
+	for _, obj := range objs {
+		zcontent := obj.zcontent()
+		referred := obj.referredOids()
+		chunked := tx.chunkSize > 0 && len(zcontent) > tx.chunkSize
+		if chunked {
+			// Empty zcontent is never valid. It marks chunked objects.
+			_, err = stmt.Exec(string(obj.Oid), []byte{}, obj.Type, joinOids(referred, ","), mtime)
+		} else if len(zcontent) > maxZcontentSize && tx.chunkSize <= 0 {
+			return errObjectTooLarge{obj.Oid, len(zcontent)}
+		} else {
+			_, err = stmt.Exec(string(obj.Oid), zcontent, obj.Type, joinOids(referred, ","), mtime)
 		}
-		oid := Oid(s)
-		if reachable[oid] == false {
-			deletable = append(deletable, oid)
+		if err != nil {
+			return err
+		}
+		if edgeStmt != nil {
+			if err := insertEdges(edgeStmt, obj.Oid, edgesFromReferred(obj.Type, referred)); err != nil {
+				return err
+			}
+		}
+		if chunked {
+			if err := insertChunks(tx, obj.Oid, zcontent); err != nil {
+				return err
+			}
+		}
+		oids = append(oids, obj.Oid)
+		allReferred = append(allReferred, referred...)
+		if obj.Type == "commit" {
+			if len(referred) == 0 {
+				return fmt.Errorf("commit %s is illformed: no tree", obj.Oid)
+			}
+			commits = append(commits, obj.Oid)
+			parentsOf[obj.Oid] = referred[1:]
 		}
-	}
-	if err := rows.Err(); err != nil {
-		return nil, err
 	}
 
-	// Delete objects in batch
-	for i := 0; i < len(deletable); i += batchRows {
-		j := min(i+batchRows, len(deletable))
-		args := toInterfaces(deletable[i:j])
-		_, err := tx.Exec("DELETE FROM "+table+" WHERE oid IN (?"+strings.Repeat(",?", len(args)-1)+")", args...)
-		if err != nil {
-			return nil, err
+	missingParents, err := insertCommitGraph(tx, parentsOf)
+	if err != nil {
+		return err
+	}
+	if tx.commitCache {
+		if err := cacheCommits(tx, commits); err != nil {
+			return err
 		}
 	}
 
-	return deletable, nil
+	// Existing objects are now referred by new objects. Refresh them so a
+	// concurrent GC does not delete them. Missing parents, like parents of
+	// shallow commits, are boundaries of the commit graph.
+	return touchObjects(tx, minus(uniqueOids(allReferred), append(oids, missingParents...)), mtime)
 }
 
 // bfsOids returns all referred oids by reading referred oids recursively.
@@ -375,8 +855,30 @@ func GC(tx *sql.Tx, oids []Oid) ([]Oid, error) {
 //
 // Returns oids and error. oids is in BFS order.
 //
-// Note: bfsOids is slow. Use cache whenever possible.
-func bfsOids(tx *sql.Tx, initOids []Oid, skipOids []Oid) ([]Oid, error) {
+// If the dialect supports recursive queries, and oids fit in a statement,
+// a single recursive query over the edges table is used. Otherwise, there
+// is one query per BFS level, which is slow. Export uses the commit cache
+// instead if it is enabled. See WithCommitCache.
+func bfsOids(tx *gitTx, initOids []Oid, skipOids []Oid) ([]Oid, error) {
+	readEdges, err := tx.readEdges()
+	if err != nil {
+		return nil, err
+	}
+	if readEdges && tx.dialect.RecursiveCTE() && 2*(len(initOids)+len(skipOids)) <= tx.dialect.MaxParams() {
+		oids, err := bfsOidsRecursive(tx, initOids, skipOids)
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := edgesStillOn(tx); err != nil || ok {
+			return oids, err
+		}
+		// The edges table was disabled concurrently
+	}
+	return bfsOidsByLevel(tx, initOids, skipOids)
+}
+
+// bfsOidsByLevel is bfsOids using one query per BFS level.
+func bfsOidsByLevel(tx *gitTx, initOids []Oid, skipOids []Oid) ([]Oid, error) {
 	visited := toSet(append(initOids, skipOids...))
 	result := initOids
 	for currOids := initOids; len(currOids) > 0; {
@@ -404,7 +906,7 @@ func bfsOids(tx *sql.Tx, initOids []Oid, skipOids []Oid) ([]Oid, error) {
 }
 
 // unseenOids removes oids already stored in the database.
-func unseenOids(tx *sql.Tx, oids []Oid) ([]Oid, error) {
+func unseenOids(tx *gitTx, oids []Oid) ([]Oid, error) {
 	exists := make([]Oid, 0)
 	err := queryByOids(tx, "oid", oids, func(scan rowScanFunc) error {
 		var s string
@@ -423,14 +925,15 @@ func unseenOids(tx *sql.Tx, oids []Oid) ([]Oid, error) {
 
 // queryByOids fetches db rows by oids.
 // It handles large oids array by spltting it into smaller queries.
-func queryByOids(tx *sql.Tx, columns string, oids []Oid, rowHandler func(rowScanFunc) error) error {
+func queryByOids(tx *gitTx, columns string, oids []Oid, rowHandler func(rowScanFunc) error) error {
 	if (len(oids)) == 0 {
 		return nil
 	}
-	for i := 0; i < len(oids); i += batchRows {
-		j := min(i+batchRows, len(oids))
+	batchSize := tx.dialect.MaxParams()
+	for i := 0; i < len(oids); i += batchSize {
+		j := min(i+batchSize, len(oids))
 		args := toInterfaces(oids[i:j])
-		rows, err := tx.Query("SELECT "+columns+" FROM "+table+" WHERE oid IN (?"+strings.Repeat(",?", len(args)-1)+")", args...)
+		rows, err := tx.Query(tx.rebind("SELECT "+columns+" FROM "+table+" WHERE oid IN ("+params(len(args))+")"), args...)
 		if err != nil {
 			return err
 		}
@@ -447,19 +950,45 @@ func queryByOids(tx *sql.Tx, columns string, oids []Oid, rowHandler func(rowScan
 	return nil
 }
 
+// gitTx is a transaction with settings of its database.
+type gitTx struct {
+	*sql.Tx
+	settings
+}
+
+// rebind replaces "?" placeholders in query with placeholders of the
+// dialect of the database.
+func (tx *gitTx) rebind(query string) string {
+	return rebind(tx.dialect, query)
+}
+
 // getOrCreateTx creates a new tx and set txByUs to true if dt is sql.DB,
-// otherwise, getOrCreateTx returns tx as is and txByUs is false.
-func getOrCreateTx(dt dbOrTx) (tx *sql.Tx, txByUs bool, err error) {
-	db, isDb := dt.(*sql.DB)
-	if isDb {
-		tx, err := db.Begin()
-		return tx, true, err
-	}
-	tx, isTx := dt.(*sql.Tx)
-	if isTx {
-		return tx, false, nil
+// otherwise, getOrCreateTx uses tx as is and txByUs is false. Settings of
+// the database are read, and the schema version is checked. They are
+// cached. See dbSettings.
+func getOrCreateTx(dt dbOrTx) (tx *gitTx, txByUs bool, err error) {
+	var sqlTx *sql.Tx
+	var s settings
+	switch dt := dt.(type) {
+	case *sql.DB:
+		if s, err = dbSettings(dt); err != nil {
+			return nil, false, err
+		}
+		if sqlTx, err = dt.Begin(); err != nil {
+			return nil, false, err
+		}
+		txByUs = true
+	case *sql.Tx:
+		if s, err = dbSettings(dt); err != nil {
+			return nil, false, err
+		}
+		sqlTx = dt
+	case *gitTx:
+		return dt, false, nil
+	default:
+		panic("dt should be either sql.DB or sql.Tx")
 	}
-	panic("dt should be either sql.DB or sql.Tx")
+	return &gitTx{sqlTx, s}, txByUs, nil
 }
 
 // minus returns []Oid with elements in a but not b.
@@ -474,6 +1003,19 @@ func minus(a []Oid, b []Oid) []Oid {
 	return r
 }
 
+// uniqueOids returns a without duplicated items. Order is preserved.
+func uniqueOids(a []Oid) []Oid {
+	m := make(map[Oid]bool, len(a))
+	r := make([]Oid, 0, len(a))
+	for _, v := range a {
+		if m[v] == false {
+			r = append(r, v)
+			m[v] = true
+		}
+	}
+	return r
+}
+
 // toSet converts []Oid to map[Oid]bool.
 func toSet(a []Oid) map[Oid]bool {
 	m := make(map[Oid]bool, len(a))
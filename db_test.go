@@ -10,25 +10,44 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 )
 
 var dbDir string = filepath.Join(os.TempDir(), "gitdb-test", "db")
 
-func createDb(name string) *sql.DB {
+// openTestDb opens an empty database for a test. It uses SQLite by default.
+// See postgres_test.go for running tests against PostgreSQL.
+var openTestDb = func(name string) (*sql.DB, error) {
 	os.MkdirAll(dbDir, 0755)
 	dp := filepath.Join(dbDir, fmt.Sprintf("%s.sqlite3", filepath.Base(name)))
 	os.RemoveAll(dp)
-	db, err := sql.Open("sqlite3", dp)
+	return sql.Open("sqlite3", dp)
+}
+
+// testDialect is the dialect of databases opened by openTestDb.
+var testDialect Dialect = SQLite
+
+func createDb(name string) *sql.DB {
+	db, err := openTestDb(name)
 	if err != nil {
 		panic(err)
 	}
-	if _, err := CreateTable(db); err != nil {
+	if _, err := CreateTable(db, WithDialect(testDialect)); err != nil {
 		panic(err)
 	}
 	return db
 }
 
+// beginTx starts a transaction with settings of db.
+func beginTx(db *sql.DB) *gitTx {
+	tx, _, err := getOrCreateTx(db)
+	if err != nil {
+		panic(err)
+	}
+	return tx
+}
+
 func updateRepo(name string, n int) {
 	createRandomRepo(name, 15, false, false)
 }
@@ -163,6 +182,241 @@ func TestImportExport(t *testing.T) {
 	}
 }
 
+func TestImportExportTag(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("importExportTag")
+	defer db.Close()
+
+	dir := createRandomRepo("t", 20, true, true)
+	gitDir := filepath.Join(dir, ".git")
+	if err := exec.Command("git", "--git-dir", gitDir, "tag", "-f", "-a", "-m", "Release", "v1.0", "HEAD").Run(); err != nil {
+		t.Fatal("git tag error", err)
+	}
+	out, _ := exec.Command("git", "--git-dir", gitDir, "rev-parse", "v1.0").Output()
+	tagOid := Oid(strings.TrimSpace(string(out)))
+
+	oids, refOid, e := Import(db, dir, "v1.0")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	if refOid != tagOid || len(oids) == 0 || oids[0] != tagOid {
+		t.Fatal("Import unexpected: tag object is not imported", tagOid, refOid)
+	}
+	if _, _, e := Import(db, dir, "refs/tags/missing"); e == nil {
+		t.Fatal("Import unexpected: missing ref does not cause an error")
+	}
+
+	// ReadTree peels the tag
+	_, treeOids, _, e := ReadTree(db, tagOid)
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	if len(treeOids) == 0 {
+		t.Fatal("ReadTree unexpected: tag is not peeled")
+	}
+
+	// GC keeps objects reachable from the tag
+	tx, e := db.Begin()
+	if e != nil {
+		t.Fatal("Failed to start transaction", e)
+	}
+	if deleted, e := GC(tx, []Oid{tagOid}); e != nil || len(deleted) > 0 {
+		t.Fatal("GC unexpected: reachable objects are deleted", deleted, e)
+	}
+	tx.Rollback()
+
+	// Export writes the tag and everything it points to
+	dir2 := createRandomRepo("t2", 0, false, true)
+	exported, e := Export(db, dir2, tagOid, "refs/tags/v1.0")
+	if e != nil {
+		t.Fatal("Export error", e)
+	}
+	if len(exported) != len(oids) {
+		t.Fatal("Export unexpected: expected wrote ", oids, " actually wrote", exported)
+	}
+	if err := exec.Command("git", "--git-dir", filepath.Join(dir2, ".git"), "fsck", "--full", "--strict", "v1.0").Run(); err != nil {
+		t.Fatal("Export unexpected: failed git fsck check", err)
+	}
+}
+
+func TestGitlinks(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("gitlinks")
+	defer db.Close()
+
+	subDir := createRandomRepo("gs", 10, true, true)
+	out, _ := exec.Command("git", "--git-dir", filepath.Join(subDir, ".git"), "rev-parse", "HEAD").Output()
+	subOid := Oid(strings.TrimSpace(string(out)))
+
+	dir := createRandomRepo("g", 10, false, true)
+	for _, args := range [][]string{
+		{"update-index", "--add", "--cacheinfo", "160000," + string(subOid) + ",sub/module"},
+		{"commit", "-m", "add submodule"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		if err := cmd.Run(); err != nil {
+			t.Fatal("git", args, "error", err)
+		}
+	}
+
+	_, oid, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	modes, oids, paths, e := ReadTree(db, oid)
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	for i, o := range oids {
+		if o == subOid || modes[i] == 0160000 {
+			t.Fatal("ReadTree unexpected: gitlink is returned", paths[i])
+		}
+	}
+	if _, e := ReadBlobs(db, oids); e != nil {
+		t.Fatal("ReadBlobs error", e)
+	}
+
+	linkOids, linkPaths, e := ReadGitlinks(db, oid)
+	if e != nil {
+		t.Fatal("ReadGitlinks error", e)
+	}
+	if len(linkOids) != 1 || linkOids[0] != subOid || linkPaths[0] != "sub/module" {
+		t.Fatal("ReadGitlinks unexpected: ", linkOids, linkPaths)
+	}
+
+	// Submodule not in database is skipped
+	_, oids2, _, e := ReadTree(db, oid, RecurseSubmodules())
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	if len(oids2) != len(oids) {
+		t.Fatal("ReadTree unexpected: missing submodule is not skipped")
+	}
+
+	// Submodule in database is read recursively
+	if _, _, e := Import(db, subDir, "HEAD"); e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, subOids, _, e := ReadTree(db, subOid)
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	_, oids2, paths2, e := ReadTree(db, oid, RecurseSubmodules())
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	if len(oids2) != len(oids)+len(subOids) {
+		t.Fatal("ReadTree unexpected: submodule is not read recursively")
+	}
+	for i, o := range oids2 {
+		if i >= len(oids) && !strings.HasPrefix(paths2[i], "sub/module/") {
+			t.Fatal("ReadTree unexpected: submodule path is not prefixed", o, paths2[i])
+		}
+	}
+
+	// GC and Export do not follow gitlinks
+	tx, e := db.Begin()
+	if e != nil {
+		t.Fatal("Failed to start transaction", e)
+	}
+	if deleted, e := GC(tx, []Oid{oid, subOid}); e != nil || len(deleted) > 0 {
+		t.Fatal("GC unexpected: reachable objects are deleted", deleted, e)
+	}
+	tx.Rollback()
+
+	dir2 := createRandomRepo("g2", 0, false, true)
+	if _, e := Export(db, dir2, oid, "HEAD"); e != nil {
+		t.Fatal("Export error", e)
+	}
+	if err := exec.Command("git", "--git-dir", filepath.Join(dir2, ".git"), "fsck", "--full", "--strict", string(oid)).Run(); err != nil {
+		t.Fatal("Export unexpected: failed git fsck check", err)
+	}
+}
+
+func TestExportPack(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("exportPack")
+	defer db.Close()
+
+	dir := createRandomRepo("ep", 30, true, true)
+	_, oid1, e := Import(db, dir, "HEAD~3")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, oid2, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	countFiles := func(gitDir string) (packs int, loose int) {
+		p, _ := filepath.Glob(filepath.Join(gitDir, "objects", "pack", "*.pack"))
+		l, _ := filepath.Glob(filepath.Join(gitDir, "objects", "??", "*"))
+		return len(p), len(l)
+	}
+	fsck := func(gitDir string, ref string) {
+		if out, err := exec.Command("git", "--git-dir", gitDir, "fsck", "--full", "--strict", ref).CombinedOutput(); err != nil {
+			t.Fatal("Export unexpected: failed git fsck check", err, string(out))
+		}
+	}
+
+	// Export to a directory that does not exist, like git clone
+	dir2 := filepath.Join(repoDir, "ep-clone")
+	os.RemoveAll(dir2)
+	oids, e := Export(db, dir2, oid1, "refs/heads/master", DeltaCompression())
+	if e != nil {
+		t.Fatal("Export error", e)
+	}
+	gitDir2 := filepath.Join(dir2, ".git")
+	fsck(gitDir2, "HEAD")
+	if packs, loose := countFiles(gitDir2); packs != 1 || loose != 0 {
+		t.Fatal("Export unexpected: expected 1 pack and no loose objects, got", packs, loose)
+	}
+	out, _ := exec.Command("git", "--git-dir", gitDir2, "rev-parse", "HEAD").Output()
+	if Oid(strings.TrimSpace(string(out))) != oid1 {
+		t.Fatal("Export unexpected: HEAD is not updated")
+	}
+
+	// Incremental export writes another pack
+	oids2, e := Export(db, dir2, oid2, "refs/heads/master")
+	if e != nil {
+		t.Fatal("Export error", e)
+	}
+	if len(oids2) == 0 || len(oids2) >= len(oids) {
+		t.Fatal("Export unexpected: exported objects are not incremental", len(oids2), len(oids))
+	}
+	fsck(gitDir2, "HEAD")
+	if packs, loose := countFiles(gitDir2); packs != 2 || loose != 0 {
+		t.Fatal("Export unexpected: expected 2 packs and no loose objects, got", packs, loose)
+	}
+
+	// Loose objects for small increments
+	dir3 := filepath.Join(repoDir, "ep-loose")
+	os.RemoveAll(dir3)
+	if _, e := Export(db, dir3, oid1, "refs/heads/master"); e != nil {
+		t.Fatal("Export error", e)
+	}
+	oids3, e := Export(db, dir3, oid2, "refs/heads/master", LooseObjectLimit(len(oids2)+1))
+	if e != nil {
+		t.Fatal("Export error", e)
+	}
+	gitDir3 := filepath.Join(dir3, ".git")
+	fsck(gitDir3, "HEAD")
+	if packs, loose := countFiles(gitDir3); packs != 1 || loose != len(oids3) {
+		t.Fatal("Export unexpected: expected 1 pack and", len(oids3), "loose objects, got", packs, loose)
+	}
+}
+
 func TestRead(t *testing.T) {
 	db := createDb("read")
 	defer db.Close()
@@ -205,3 +459,71 @@ func TestRead(t *testing.T) {
 		}
 	}
 }
+
+func TestReadTreeFilters(t *testing.T) {
+	db := createDb("readTreeFilters")
+	defer db.Close()
+
+	b := NewCommitBuilder()
+	for _, p := range []string{"docs/a.md", "docs/x/b.yaml", "e.yaml", "src/c.go", "src/deep/d.yaml"} {
+		b.Put(p, ModeBlob, []byte(p))
+	}
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	oid, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+
+	readTree := func(options ...ReadTreeOption) string {
+		_, _, paths, e := ReadTree(db, oid, options...)
+		if e != nil {
+			t.Fatal("ReadTree error", e)
+		}
+		return strings.Join(paths, " ")
+	}
+	for _, c := range []struct {
+		options  []ReadTreeOption
+		expected string
+	}{
+		{nil, "e.yaml docs/a.md src/c.go docs/x/b.yaml src/deep/d.yaml"},
+		{[]ReadTreeOption{Glob("**/*.yaml")}, "e.yaml docs/x/b.yaml src/deep/d.yaml"},
+		{[]ReadTreeOption{Glob("*.yaml", "docs/*.md")}, "e.yaml docs/a.md"},
+		{[]ReadTreeOption{MaxDepth(2), Glob("**/*.yaml")}, "e.yaml"},
+		{[]ReadTreeOption{MaxDepth(1), IncludeTrees()}, "docs e.yaml src"},
+		{[]ReadTreeOption{Prefix("src/"), IncludeTrees()}, "src/c.go src/deep src/deep/d.yaml"},
+		{[]ReadTreeOption{Prefix("docs/"), Glob("**/*.yaml")}, "docs/x/b.yaml"},
+	} {
+		if paths := readTree(c.options...); paths != c.expected {
+			t.Errorf("ReadTree unexpected: %s, expected %s", paths, c.expected)
+		}
+	}
+
+	if _, _, _, e := ReadTree(db, oid, Glob("[")); e == nil {
+		t.Error("ReadTree should fail with bad patterns")
+	}
+
+	// Trees outside the filter are not read
+	_, srcOid, _ := Stat(db, oid, "src")
+	if _, e := db.Exec(rebind(testDialect, "DELETE FROM "+table+" WHERE oid = ?"), string(srcOid)); e != nil {
+		t.Fatal("DELETE error", e)
+	}
+	if paths := readTree(Prefix("docs/")); paths != "docs/a.md docs/x/b.yaml" {
+		t.Errorf("ReadTree unexpected: %s", paths)
+	}
+	if paths := readTree(MaxDepth(1)); paths != "e.yaml" {
+		t.Errorf("ReadTree unexpected: %s", paths)
+	}
+	if paths := readTree(Glob("docs/**")); paths != "docs/a.md docs/x/b.yaml" {
+		t.Errorf("ReadTree unexpected: %s", paths)
+	}
+
+	// Illformed commits written without checks are reported
+	body := []byte("tree 1234\n")
+	o := &gitObj{Oid: hashObject("commit", body), Type: "commit", Body: body}
+	if _, e := db.Exec(rebind(testDialect, "INSERT INTO "+table+" (oid, zcontent, type, referred) VALUES (?, ?, ?, ?)"), string(o.Oid), o.zcontent(), o.Type, ""); e != nil {
+		t.Fatal("INSERT error", e)
+	}
+	if _, _, _, e := ReadTree(db, o.Oid); e == nil {
+		t.Error("ReadTree should fail with illformed commits")
+	}
+}
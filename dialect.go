@@ -0,0 +1,172 @@
+package gitdb
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Dialect describes SQL differences between databases. See WithDialect.
+type Dialect interface {
+	// Name identifies the dialect in the gitdb_settings table. Dialects
+	// other than the built-in ones must be registered by RegisterDialect.
+	Name() string
+	// BlobType returns the column type of binary data up to 16MB.
+	BlobType() string
+	// Placeholder returns the placeholder of the n-th parameter of a
+	// statement. n starts from 1.
+	Placeholder(n int) string
+	// InsertIgnore returns an INSERT statement, with "?" as placeholders,
+	// that skips rows conflicting with existing primary keys. Skipped rows
+	// are not counted as affected rows.
+	InsertIgnore(table string, columns []string) string
+	// MaxParams returns the max number of parameters in a statement.
+	MaxParams() int
+	// RecursiveCTE tests whether `WITH RECURSIVE` is supported.
+	RecursiveCTE() bool
+}
+
+// Built-in dialects.
+var (
+	// MySQL works with MySQL 5.6 and later, and MariaDB.
+	MySQL Dialect = mysqlDialect{}
+	// MySQL8 is MySQL with recursive queries. It works with MySQL 8.0 and
+	// later, and MariaDB 10.2.2 and later.
+	MySQL8 Dialect = mysqlDialect{recursiveCTE: true}
+	// PostgreSQL works with PostgreSQL 9.5 and later.
+	PostgreSQL Dialect = postgresDialect{}
+	// SQLite works with SQLite 3.7.11 and later.
+	SQLite Dialect = sqliteDialect{}
+)
+
+// WithDialect makes Migrate create tables for the given SQL dialect. By
+// default, the dialect is detected from the driver of the database: SQLite
+// and PostgreSQL drivers are recognized, and others are assumed to be MySQL.
+//
+// The dialect is stored in the gitdb_settings table, so other functions use
+// it without being told, and databases of different types can be used in a
+// process. Migrate fails if the database was created with another dialect.
+func WithDialect(d Dialect) CreateTableOption {
+	return func(c *createTableConfig) {
+		c.dialect = d
+	}
+}
+
+var (
+	dialectsMu sync.Mutex
+	dialects   = map[string]Dialect{}
+)
+
+func init() {
+	for _, d := range []Dialect{MySQL, MySQL8, PostgreSQL, SQLite} {
+		RegisterDialect(d)
+	}
+}
+
+// RegisterDialect makes a Dialect implemented outside gitdb available by its
+// name. It is usually called in an init function, like sql.Register.
+func RegisterDialect(d Dialect) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	dialects[d.Name()] = d
+}
+
+// dialectByName returns a registered Dialect.
+func dialectByName(name string) (Dialect, error) {
+	dialectsMu.Lock()
+	defer dialectsMu.Unlock()
+	d, ok := dialects[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown dialect: %q", name)
+	}
+	return d, nil
+}
+
+// detectDialect guesses the dialect from the type of the driver, like
+// *sqlite3.SQLiteDriver or *pq.Driver. Drivers do not tell which database
+// they talk to, so unknown drivers are assumed to be MySQL.
+func detectDialect(db *sql.DB) Dialect {
+	name := strings.ToLower(fmt.Sprintf("%T", db.Driver()))
+	switch {
+	case strings.Contains(name, "sqlite"):
+		return SQLite
+	case strings.HasPrefix(name, "*pq.") || strings.Contains(name, "postgres") || strings.Contains(name, "pgx"):
+		return PostgreSQL
+	}
+	return MySQL
+}
+
+type mysqlDialect struct {
+	recursiveCTE bool
+}
+
+func (d mysqlDialect) Name() string {
+	if d.recursiveCTE {
+		return "mysql8"
+	}
+	return "mysql"
+}
+func (mysqlDialect) BlobType() string         { return "MEDIUMBLOB" }
+func (mysqlDialect) Placeholder(n int) string { return "?" }
+func (mysqlDialect) MaxParams() int           { return 65535 }
+func (d mysqlDialect) RecursiveCTE() bool     { return d.recursiveCTE }
+
+// InsertIgnore uses a no-op ON DUPLICATE KEY UPDATE, since INSERT IGNORE
+// also turns errors, like truncated values, into warnings. The no-op update
+// is not counted as an affected row unless clientFoundRows is set.
+func (mysqlDialect) InsertIgnore(table string, columns []string) string {
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + params(len(columns)) + ") ON DUPLICATE KEY UPDATE " + columns[0] + " = " + columns[0]
+}
+
+type postgresDialect struct{}
+
+func (postgresDialect) Name() string             { return "postgres" }
+func (postgresDialect) BlobType() string         { return "BYTEA" }
+func (postgresDialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+func (postgresDialect) MaxParams() int           { return 65535 }
+func (postgresDialect) RecursiveCTE() bool       { return true }
+func (postgresDialect) InsertIgnore(table string, columns []string) string {
+	return "INSERT INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + params(len(columns)) + ") ON CONFLICT DO NOTHING"
+}
+
+type sqliteDialect struct{}
+
+func (sqliteDialect) Name() string             { return "sqlite" }
+func (sqliteDialect) BlobType() string         { return "BLOB" }
+func (sqliteDialect) Placeholder(n int) string { return "?" }
+func (sqliteDialect) RecursiveCTE() bool       { return true }
+
+// MaxParams returns SQLITE_MAX_VARIABLE_NUMBER of SQLite before 3.32.
+func (sqliteDialect) MaxParams() int { return 999 }
+func (sqliteDialect) InsertIgnore(table string, columns []string) string {
+	return "INSERT OR IGNORE INTO " + table + " (" + strings.Join(columns, ", ") + ") VALUES (" + params(len(columns)) + ")"
+}
+
+// params returns n "?" placeholders separated by ",".
+func params(n int) string {
+	if n <= 0 {
+		return ""
+	}
+	return "?" + strings.Repeat(",?", n-1)
+}
+
+// rebind replaces "?" placeholders in query with placeholders of dialect d.
+func rebind(d Dialect, query string) string {
+	if d.Placeholder(1) == "?" {
+		return query
+	}
+	var b bytes.Buffer
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			b.WriteString(d.Placeholder(n))
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,75 @@
+package gitdb
+
+import (
+	"testing"
+)
+
+func TestDialect(t *testing.T) {
+	query := "SELECT oid FROM t WHERE repo = ? AND name IN (" + params(3) + ")"
+	columns := []string{"a", "b"}
+	for _, c := range []struct {
+		dialect      Dialect
+		query        string
+		insertIgnore string
+	}{
+		{MySQL, "SELECT oid FROM t WHERE repo = ? AND name IN (?,?,?)", "INSERT INTO t (a, b) VALUES (?,?) ON DUPLICATE KEY UPDATE a = a"},
+		{PostgreSQL, "SELECT oid FROM t WHERE repo = $1 AND name IN ($2,$3,$4)", "INSERT INTO t (a, b) VALUES ($1,$2) ON CONFLICT DO NOTHING"},
+		{SQLite, "SELECT oid FROM t WHERE repo = ? AND name IN (?,?,?)", "INSERT OR IGNORE INTO t (a, b) VALUES (?,?)"},
+	} {
+		if q := rebind(c.dialect, query); q != c.query {
+			t.Errorf("rebind(%q) = %q, expected %q", query, q, c.query)
+		}
+		if q := rebind(c.dialect, c.dialect.InsertIgnore("t", columns)); q != c.insertIgnore {
+			t.Errorf("InsertIgnore = %q, expected %q", q, c.insertIgnore)
+		}
+		if c.dialect.MaxParams() <= 0 || len(c.dialect.BlobType()) == 0 {
+			t.Errorf("%T has invalid MaxParams or BlobType", c.dialect)
+		}
+	}
+}
+
+func TestDetectDialect(t *testing.T) {
+	db, e := openTestDb("detectDialect")
+	if e != nil {
+		t.Fatal("openTestDb error", e)
+	}
+	defer db.Close()
+	if d := detectDialect(db); d != testDialect {
+		t.Errorf("detectDialect = %s, expected %s", d.Name(), testDialect.Name())
+	}
+
+	// Tables can be created without selecting the dialect
+	if _, e := CreateTable(db); e != nil {
+		t.Fatal("CreateTable error", e)
+	}
+	if !checkGit() {
+		return
+	}
+	if _, _, e := Import(db, createRandomRepo("dd", 3, true, true), "HEAD"); e != nil {
+		t.Error("Import error", e)
+	}
+}
+
+func TestQueryByOidsBatches(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("queryByOidsBatches")
+	defer db.Close()
+
+	// More oids than MaxParams are read in multiple batches
+	dir := createRandomRepo("qb", 30, true, true)
+	oids, _, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	var many []Oid
+	for len(many) <= testDialect.MaxParams() {
+		many = append(many, oids...)
+	}
+	contents, e := ReadBlobs(db, many)
+	if e != nil || len(contents) != len(many) {
+		t.Error("ReadBlobs unexpected", e, len(contents))
+	}
+}
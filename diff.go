@@ -0,0 +1,251 @@
+package gitdb
+
+import (
+	"sort"
+)
+
+// DiffStatus describes how an entry changed between two trees.
+type DiffStatus int
+
+const (
+	// DiffAdded means the entry only exists in the new tree.
+	DiffAdded DiffStatus = iota + 1
+	// DiffDeleted means the entry only exists in the old tree.
+	DiffDeleted
+	// DiffModified means the entry has a different oid.
+	DiffModified
+	// DiffModeChanged means the entry has a same oid but a different mode.
+	DiffModeChanged
+	// DiffRenamed means the entry is moved. See DetectRenames.
+	DiffRenamed
+)
+
+// String returns the status letter used by `git diff --name-status`.
+func (s DiffStatus) String() string {
+	switch s {
+	case DiffAdded:
+		return "A"
+	case DiffDeleted:
+		return "D"
+	case DiffModified, DiffModeChanged:
+		return "M"
+	case DiffRenamed:
+		return "R"
+	}
+	return "?"
+}
+
+// DiffEntry is a changed non-tree entry between two trees. Old fields are
+// empty for added entries. New fields are empty for deleted entries.
+type DiffEntry struct {
+	Status  DiffStatus
+	OldPath string
+	NewPath string
+	OldMode int32
+	NewMode int32
+	OldOid  Oid
+	NewOid  Oid
+}
+
+// DiffOption customizes the behavior of DiffTrees.
+type DiffOption func(*diffConfig)
+
+type diffConfig struct {
+	detectRenames bool
+}
+
+// DetectRenames makes DiffTrees pair deleted and added entries having a same
+// oid as renames. Only exact renames are detected, like
+// `git diff -M100%`.
+func DetectRenames() DiffOption {
+	return func(c *diffConfig) {
+		c.detectRenames = true
+	}
+}
+
+// DiffTrees compares two trees in database and returns changed entries
+// sorted by path. It is like `git diff-tree -r` but works directly in
+// database.
+//
+// dt is either *sql.DB or *sql.Tx.
+// oldOid and newOid are git object IDs of trees, commits or annotated tags.
+// An empty oid means an empty tree.
+//
+// Sub-trees having a same oid are skipped without being read. Trees in
+// database are read in one batch per depth.
+func DiffTrees(dt dbOrTx, oldOid Oid, newOid Oid, options ...DiffOption) ([]*DiffEntry, error) {
+	var cfg diffConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	trees := make(map[Oid][]*TreeEntry)
+	var roots [2]Oid
+	for i, oid := range []Oid{oldOid, newOid} {
+		if len(oid) == 0 {
+			continue
+		}
+		tree, err := peelToTree(tx, oid)
+		if err != nil {
+			return nil, err
+		}
+		roots[i] = tree.Oid
+		trees[tree.Oid] = parseTree(tree.Body)
+	}
+
+	var result []*DiffEntry
+	type pending struct {
+		oldOid, newOid Oid
+		prefix         string
+	}
+	next := []pending{{roots[0], roots[1], ""}}
+	if roots[0] == roots[1] {
+		next = nil
+	}
+	for len(next) > 0 {
+		curr := next
+		next = nil
+		var oids []Oid
+		for _, p := range curr {
+			oids = append(oids, p.oldOid, p.newOid)
+		}
+		if err := readTreesInto(tx, trees, oids); err != nil {
+			return nil, err
+		}
+
+		for _, p := range curr {
+			oldItems := make(map[string]*TreeEntry)
+			for _, ti := range trees[p.oldOid] {
+				oldItems[ti.Name] = ti
+			}
+			var newNames []string
+			newItems := make(map[string]*TreeEntry)
+			for _, ti := range trees[p.newOid] {
+				newItems[ti.Name] = ti
+				newNames = append(newNames, ti.Name)
+			}
+			var names []string
+			for _, ti := range trees[p.oldOid] {
+				names = append(names, ti.Name)
+			}
+			names = append(names, newNames...)
+
+			visited := make(map[string]bool)
+			for _, name := range names {
+				if visited[name] {
+					continue
+				}
+				visited[name] = true
+				path := name
+				if len(p.prefix) > 0 {
+					path = p.prefix + "/" + name
+				}
+
+				// Split entries into trees to compare later and
+				// non-tree entries.
+				o, n := oldItems[name], newItems[name]
+				var oldTree, newTree Oid
+				if o != nil && o.IsTree() {
+					oldTree, o = o.Oid, nil
+				}
+				if n != nil && n.IsTree() {
+					newTree, n = n.Oid, nil
+				}
+				if oldTree != newTree {
+					next = append(next, pending{oldTree, newTree, path})
+				}
+
+				switch {
+				case o == nil && n == nil:
+				case o == nil:
+					result = append(result, &DiffEntry{Status: DiffAdded, NewPath: path, NewMode: n.Mode, NewOid: n.Oid})
+				case n == nil:
+					result = append(result, &DiffEntry{Status: DiffDeleted, OldPath: path, OldMode: o.Mode, OldOid: o.Oid})
+				case o.Oid != n.Oid:
+					result = append(result, &DiffEntry{Status: DiffModified, OldPath: path, NewPath: path, OldMode: o.Mode, NewMode: n.Mode, OldOid: o.Oid, NewOid: n.Oid})
+				case o.Mode != n.Mode:
+					result = append(result, &DiffEntry{Status: DiffModeChanged, OldPath: path, NewPath: path, OldMode: o.Mode, NewMode: n.Mode, OldOid: o.Oid, NewOid: n.Oid})
+				}
+			}
+		}
+	}
+
+	if cfg.detectRenames {
+		result = detectRenames(result)
+	}
+	sort.Sort(diffEntriesByPath(result))
+	return result, nil
+}
+
+// readTreesInto reads and parses trees not in the trees map yet. Empty oids
+// are ignored.
+func readTreesInto(tx *gitTx, trees map[Oid][]*TreeEntry, oids []Oid) error {
+	var missing []Oid
+	for _, oid := range oids {
+		if _, ok := trees[oid]; !ok && len(oid) > 0 {
+			missing = append(missing, oid)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	objs, err := readObjects(tx, uniqueOids(missing))
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		trees[o.Oid] = parseTree(o.Body)
+	}
+	return nil
+}
+
+// detectRenames pairs deleted and added entries with a same oid as renames.
+func detectRenames(entries []*DiffEntry) []*DiffEntry {
+	sort.Sort(diffEntriesByPath(entries))
+	deleted := make(map[Oid][]*DiffEntry)
+	for _, e := range entries {
+		if e.Status == DiffDeleted {
+			deleted[e.OldOid] = append(deleted[e.OldOid], e)
+		}
+	}
+
+	renamed := make(map[*DiffEntry]bool)
+	var result []*DiffEntry
+	for _, e := range entries {
+		if e.Status != DiffAdded || len(deleted[e.NewOid]) == 0 {
+			continue
+		}
+		d := deleted[e.NewOid][0]
+		deleted[e.NewOid] = deleted[e.NewOid][1:]
+		renamed[d], renamed[e] = true, true
+		result = append(result, &DiffEntry{Status: DiffRenamed, OldPath: d.OldPath, NewPath: e.NewPath, OldMode: d.OldMode, NewMode: e.NewMode, OldOid: d.OldOid, NewOid: e.NewOid})
+	}
+	for _, e := range entries {
+		if !renamed[e] {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+// path returns NewPath, or OldPath for deleted entries.
+func (e *DiffEntry) path() string {
+	if len(e.NewPath) > 0 {
+		return e.NewPath
+	}
+	return e.OldPath
+}
+
+type diffEntriesByPath []*DiffEntry
+
+func (s diffEntriesByPath) Len() int           { return len(s) }
+func (s diffEntriesByPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s diffEntriesByPath) Less(i, j int) bool { return s[i].path() < s[j].path() }
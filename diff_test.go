@@ -0,0 +1,124 @@
+package gitdb
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// formatDiff formats entries like `git diff-tree -r --raw` without the
+// leading colon, sorted.
+func formatDiff(entries []*DiffEntry) string {
+	var lines []string
+	for _, e := range entries {
+		oldOid, newOid := e.OldOid, e.NewOid
+		if len(oldOid) == 0 {
+			oldOid = zeroOid
+		}
+		if len(newOid) == 0 {
+			newOid = zeroOid
+		}
+		lines = append(lines, fmt.Sprintf("%06o %06o %s %s %s\t%s", e.OldMode, e.NewMode, oldOid, newOid, e.Status, e.path()))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestDiffTrees(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("diffTrees")
+	defer db.Close()
+
+	dir := createRandomRepo("dt", 40, true, true)
+	if _, _, e := Import(db, dir, "HEAD"); e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	// Compare with git diff-tree
+	for _, revs := range [][2]string{{"HEAD~3", "HEAD"}, {"HEAD", "HEAD~2"}, {"HEAD~1", "HEAD~1"}} {
+		out, e := exec.Command("git", "--git-dir", filepath.Join(dir, ".git"), "diff-tree", "-r", "--raw", "--no-renames", revs[0], revs[1]).Output()
+		if e != nil {
+			t.Fatal("git diff-tree error", e)
+		}
+		var lines []string
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if len(line) > 0 {
+				lines = append(lines, strings.TrimPrefix(line, ":"))
+			}
+		}
+		sort.Strings(lines)
+		expected := strings.Join(lines, "\n")
+
+		r := newRepo(dir)
+		oldOid, _ := r.resolveRef(revs[0])
+		newOid, _ := r.resolveRef(revs[1])
+		entries, e := DiffTrees(db, oldOid, newOid)
+		if e != nil {
+			t.Fatal("DiffTrees error", e)
+		}
+		if actual := formatDiff(entries); actual != expected {
+			t.Errorf("DiffTrees(%s, %s) = \n%s\nexpected:\n%s", revs[0], revs[1], actual, expected)
+		}
+	}
+
+	// Renames, mode changes, files becoming directories
+	b := NewCommitBuilder()
+	b.Put("a/b/c", ModeBlob, []byte("c"))
+	b.Put("a/d", ModeBlob, []byte("d"))
+	b.Put("e", ModeBlob, []byte("e"))
+	b.Put("f", ModeBlob, []byte("f"))
+	b.Put("same/g", ModeBlob, []byte("g"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	oid1, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	b = NewCommitBuilder(oid1)
+	b.Delete("a/b/c")
+	b.Put("x/c", ModeBlob, []byte("c"))
+	b.Put("a/d", ModeExecutable, []byte("d"))
+	b.Put("e/new", ModeBlob, []byte("e"))
+	b.Put("f", ModeBlob, []byte("f2"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	oid2, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+
+	entries, e := DiffTrees(db, oid1, oid2, DetectRenames())
+	if e != nil {
+		t.Fatal("DiffTrees error", e)
+	}
+	var summary []string
+	for _, e := range entries {
+		summary = append(summary, fmt.Sprintf("%s %s %s", e.Status, e.OldPath, e.NewPath))
+	}
+	expected := "M a/d a/d|R e e/new|M f f|R a/b/c x/c"
+	if actual := strings.Join(summary, "|"); actual != expected {
+		t.Errorf("DiffTrees unexpected: %s, expected %s", actual, expected)
+	}
+	if entries[0].Status != DiffModeChanged {
+		t.Error("a/d should be mode-changed")
+	}
+
+	// Empty oid means empty tree
+	entries, e = DiffTrees(db, "", oid1)
+	if e != nil || len(entries) != 5 || entries[0].Status != DiffAdded {
+		t.Error("DiffTrees against empty tree unexpected", e, entries)
+	}
+
+	// Identical sub-trees are not read
+	_, sameOid, _ := Stat(db, oid1, "same")
+	if _, e := db.Exec(rebind(testDialect, "DELETE FROM "+table+" WHERE oid = ?"), string(sameOid)); e != nil {
+		t.Fatal("DELETE error", e)
+	}
+	if _, e := DiffTrees(db, oid1, oid2); e != nil {
+		t.Error("DiffTrees should not read identical trees", e)
+	}
+}
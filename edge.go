@@ -0,0 +1,281 @@
+package gitdb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const edgeTable = "gitobject_edges"
+
+// Kinds of edges.
+const (
+	edgeTree   = "tree"   // commit -> tree
+	edgeParent = "parent" // commit -> parent commit
+	edgeEntry  = "entry"  // tree -> sub-tree or blob, excluding gitlinks
+	edgeObject = "object" // tag -> tagged object
+)
+
+// edge is a reference from a git object to another.
+type edge struct {
+	dst  Oid
+	kind string
+}
+
+// edgesFromReferred returns edges of an object from its type and referred
+// oids. See referredOids.
+func edgesFromReferred(typ string, referred []Oid) []edge {
+	edges := make([]edge, len(referred))
+	for i, oid := range referred {
+		kind := edgeEntry
+		switch {
+		case typ == "commit" && i == 0:
+			kind = edgeTree
+		case typ == "commit":
+			kind = edgeParent
+		case typ == "tag":
+			kind = edgeObject
+		}
+		edges[i] = edge{oid, kind}
+	}
+	return edges
+}
+
+// createEdgeTable creates the table of references between objects. It is a
+// migration step. The table is used after it is backfilled. See
+// enableEdges.
+//
+// The table is a normalized form of the referred column. It makes
+// reachability queries possible in a single recursive SQL query.
+func createEdgeTable(db *sql.DB) (sql.Result, error) {
+	return db.Exec("CREATE TABLE IF NOT EXISTS " + edgeTable + " (" +
+		"src CHAR(40) NOT NULL," +
+		"dst CHAR(40) NOT NULL," +
+		// kind is one of "tree", "parent", "entry" and "object".
+		"kind VARCHAR(8) NOT NULL," +
+		"PRIMARY KEY (src, dst)," +
+		// The unique constraint is an index for reverse lookups.
+		"UNIQUE (dst, src))")
+}
+
+// enableEdges makes gitdb write and use the edges table. It is called by
+// Migrate unless WithoutEdges is used. The table is backfilled from the
+// referred column of existing objects, unless the edges setting records a
+// completed backfill.
+func enableEdges(db *sql.DB, d Dialect) error {
+	// Other processes start writing edges of new objects before the
+	// backfill reads existing objects.
+	_, err := db.Exec(rebind(d, "DELETE FROM "+settingsTable+" WHERE name = ? AND value = ?"), settingEdges, edgesOff)
+	if err != nil {
+		return err
+	}
+	return backfillEdges(db, d)
+}
+
+// disableEdges makes gitdb stop writing and using the edges table, and
+// deletes its rows. The setting and the rows are changed in a single
+// transaction. See edgesStillOn.
+func disableEdges(db *sql.DB, d Dialect) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := writeSetting(tx, d, settingEdges, edgesOff); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM " + edgeTable); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// edgesStillOn re-reads the edges setting after reading the edges table.
+// Depending on the isolation level, rows deleted by a concurrent
+// disableEdges might be visible to the transaction after the setting was
+// read. Since both are changed in a single transaction, the rows read are
+// complete if the setting is still on.
+func edgesStillOn(tx *gitTx) (bool, error) {
+	values, err := readSettings(tx)
+	return values[settingEdges] == edgesOn, err
+}
+
+// backfillEdges writes edges of all objects from their referred column. The
+// edges setting is set to edgesOn in the same transaction, so an
+// interrupted backfill is redone by the next Migrate.
+func backfillEdges(db *sql.DB, d Dialect) error {
+	sqlTx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	tx := &gitTx{sqlTx, settings{dialect: d}}
+	defer tx.Rollback()
+
+	values, err := readSettings(tx)
+	if err != nil || values[settingEdges] == edgesOn {
+		return err
+	}
+
+	// Rows are read before writing since some drivers do not support
+	// interleaved queries in a transaction.
+	var srcs []Oid
+	var edges [][]edge
+	rows, err := tx.Query("SELECT oid, type, referred FROM " + table + " WHERE type <> 'blob'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid, typ string
+		var referred sql.NullString
+		if err := rows.Scan(&oid, &typ, &referred); err != nil {
+			return err
+		}
+		var oids []Oid
+		for _, s := range strings.Split(referred.String, ",") {
+			if len(s) > 0 {
+				oids = append(oids, Oid(s))
+			}
+		}
+		srcs = append(srcs, Oid(oid))
+		edges = append(edges, edgesFromReferred(typ, oids))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(tx.rebind(tx.dialect.InsertIgnore(edgeTable, []string{"src", "dst", "kind"})))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, src := range srcs {
+		if err := insertEdges(stmt, src, edges[i]); err != nil {
+			return err
+		}
+	}
+	if err := writeSetting(tx, d, settingEdges, edgesOn); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// insertEdges writes edges of an object using a prepared InsertIgnore
+// statement.
+func insertEdges(stmt *sql.Stmt, src Oid, edges []edge) error {
+	for _, e := range edges {
+		if _, err := stmt.Exec(string(src), string(e.dst), e.kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bfsOidsRecursive is bfsOids using a single recursive SQL query. It reads
+// edges of all reachable objects, then sorts them in BFS order.
+func bfsOidsRecursive(tx *gitTx, initOids []Oid, skipOids []Oid) ([]Oid, error) {
+	if len(initOids) == 0 {
+		return nil, nil
+	}
+
+	// Skipped objects are pruned in SQL
+	skip := ""
+	if len(skipOids) > 0 {
+		skip = " AND e.dst NOT IN (" + params(len(skipOids)) + ")"
+	}
+	query := "WITH RECURSIVE reachable(oid) AS (" +
+		"SELECT e.dst FROM " + edgeTable + " e WHERE e.src IN (" + params(len(initOids)) + ")" + skip +
+		" UNION " +
+		"SELECT e.dst FROM " + edgeTable + " e JOIN reachable r ON e.src = r.oid WHERE 1 = 1" + skip +
+		") " +
+		"SELECT e.src, e.dst FROM " + edgeTable + " e WHERE e.src IN (" + params(len(initOids)) + ")" +
+		" UNION ALL " +
+		"SELECT e.src, e.dst FROM " + edgeTable + " e JOIN reachable r ON e.src = r.oid"
+	var args []interface{}
+	args = append(args, toInterfaces(initOids)...)
+	args = append(args, toInterfaces(skipOids)...)
+	args = append(args, toInterfaces(skipOids)...)
+	args = append(args, toInterfaces(initOids)...)
+
+	rows, err := tx.Query(tx.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	children := make(map[Oid][]Oid)
+	for rows.Next() {
+		var src, dst string
+		if err := rows.Scan(&src, &dst); err != nil {
+			return nil, err
+		}
+		children[Oid(src)] = append(children[Oid(src)], Oid(dst))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	visited := toSet(append(initOids, skipOids...))
+	result := append([]Oid{}, initOids...)
+	for i := 0; i < len(result); i++ {
+		for _, o := range children[result[i]] {
+			if !visited[o] {
+				visited[o] = true
+				result = append(result, o)
+			}
+		}
+	}
+	return result, nil
+}
+
+// ReferringOids finds objects referring to any of the given objects
+// directly. For example, trees containing a blob, commits using a tree, or
+// children of a commit.
+//
+// dt is either *sql.DB or *sql.Tx.
+//
+// Returns oids of referring objects in no particular order. Duplicated oids
+// are removed. ReferringOids fails if the edges table is disabled by
+// WithoutEdges.
+func ReferringOids(dt dbOrTx, oids []Oid) ([]Oid, error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+	if readEdges, err := tx.readEdges(); err != nil {
+		return nil, err
+	} else if !readEdges {
+		return nil, fmt.Errorf("ReferringOids requires the %s table", edgeTable)
+	}
+
+	var result []Oid
+	batchSize := tx.dialect.MaxParams()
+	for i := 0; i < len(oids); i += batchSize {
+		j := min(i+batchSize, len(oids))
+		args := toInterfaces(oids[i:j])
+		rows, err := tx.Query(tx.rebind("SELECT DISTINCT src FROM "+edgeTable+" WHERE dst IN ("+params(len(args))+")"), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			result = append(result, Oid(s))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if ok, err := edgesStillOn(tx); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("ReferringOids requires the %s table", edgeTable)
+	}
+	return uniqueOids(result), nil
+}
@@ -0,0 +1,272 @@
+package gitdb
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func sortedOids(oids []Oid) string {
+	s := make([]string, len(oids))
+	for i, o := range oids {
+		s[i] = string(o)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func TestBfsOidsRecursive(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("bfsOidsRecursive")
+	defer db.Close()
+
+	dir := createRandomRepo("bfs", 30, true, true)
+	_, oldOid, e := Import(db, dir, "HEAD~2")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, newOid, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	check := func() {
+		tx := beginTx(db)
+		defer tx.Rollback()
+		skipOids, e := bfsOidsByLevel(tx, []Oid{oldOid}, nil)
+		if e != nil {
+			t.Fatal("bfsOidsByLevel error", e)
+		}
+		for _, skip := range [][]Oid{nil, skipOids} {
+			expected, e := bfsOidsByLevel(tx, []Oid{newOid}, skip)
+			if e != nil {
+				t.Fatal("bfsOidsByLevel error", e)
+			}
+			actual, e := bfsOidsRecursive(tx, []Oid{newOid}, skip)
+			if e != nil {
+				t.Fatal("bfsOidsRecursive error", e)
+			}
+			if len(actual) != len(expected) || sortedOids(actual) != sortedOids(expected) || actual[0] != newOid {
+				t.Errorf("bfsOidsRecursive returned %d oids, expected %d", len(actual), len(expected))
+			}
+		}
+	}
+	check()
+
+	// An interrupted backfill leaves the table without the edges setting.
+	// It is redone.
+	if _, e := db.Exec("DELETE FROM " + edgeTable); e != nil {
+		t.Fatal("DELETE error", e)
+	}
+	if _, e := db.Exec(rebind(testDialect, "DELETE FROM "+settingsTable+" WHERE name = ?"), settingEdges); e != nil {
+		t.Fatal("DELETE error", e)
+	}
+	if _, e := CreateTable(db); e != nil {
+		t.Fatal("CreateTable error", e)
+	}
+	check()
+
+	// Edge kinds
+	tx := beginTx(db)
+	defer tx.Rollback()
+	rows, e := tx.Query(tx.rebind("SELECT dst, kind FROM "+edgeTable+" WHERE src = ?"), string(newOid))
+	if e != nil {
+		t.Fatal("SELECT error", e)
+	}
+	defer rows.Close()
+	kinds := make(map[string]int)
+	for rows.Next() {
+		var dst, kind string
+		rows.Scan(&dst, &kind)
+		kinds[kind]++
+	}
+	if kinds[edgeTree] != 1 || kinds[edgeParent] < 1 {
+		t.Errorf("Edges of a commit are unexpected: %v", kinds)
+	}
+}
+
+func TestReferringOids(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("referringOids")
+	defer db.Close()
+
+	dir := createRandomRepo("ref-oids", 30, true, true)
+	_, head, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	commit, e := ReadObject(db, head)
+	if e != nil {
+		t.Fatal("ReadObject error", e)
+	}
+	c := commit.(*Commit)
+	if len(c.Parents) == 0 {
+		t.Fatal("HEAD should have a parent")
+	}
+
+	// Children of a commit, and commits using a tree
+	for _, oid := range []Oid{c.Parents[0], c.Tree} {
+		oids, e := ReferringOids(db, []Oid{oid})
+		if e != nil {
+			t.Fatal("ReferringOids error", e)
+		}
+		found := false
+		for _, o := range oids {
+			found = found || o == head
+		}
+		if !found {
+			t.Errorf("ReferringOids(%s) = %v, should contain %s", oid, oids, head)
+		}
+	}
+
+	// Trees containing a blob
+	tree, e := ReadObject(db, c.Tree)
+	if e != nil {
+		t.Fatal("ReadObject error", e)
+	}
+	for _, entry := range tree.(*Tree).Entries {
+		oids, e := ReferringOids(db, []Oid{entry.Oid, entry.Oid})
+		if e != nil {
+			t.Fatal("ReferringOids error", e)
+		}
+		if sortedOids(oids) != sortedOids(uniqueOids(oids)) || len(oids) == 0 {
+			t.Errorf("ReferringOids(%s) returned unexpected %v", entry.Oid, oids)
+		}
+	}
+}
+
+func TestGCRecursive(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("gcRecursive")
+	defer db.Close()
+
+	dir := createRandomRepo("gc-rec", 30, true, true)
+	if _, _, e := Import(db, dir, "HEAD"); e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, keep, e := Import(db, dir, "HEAD~2")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	tx := beginTx(db)
+	defer tx.Rollback()
+	for _, oids := range [][]Oid{nil, {keep}} {
+		actual, e := GC(tx, oids, DryRun())
+		if e != nil {
+			t.Fatal("GC error", e)
+		}
+		tx.edges = edgesOff
+		expected, e := GC(tx, oids, DryRun())
+		tx.edges = edgesOn
+		if e != nil {
+			t.Fatal("GC error", e)
+		}
+		if sortedOids(actual) != sortedOids(expected) {
+			t.Errorf("GC using recursive queries returned %d oids, expected %d", len(actual), len(expected))
+		}
+	}
+
+	// GC removes edges of deleted objects
+	deleted, e := GC(tx, []Oid{keep})
+	if e != nil || len(deleted) == 0 {
+		t.Fatal("GC unexpected", e, len(deleted))
+	}
+	oids, e := ReferringOids(tx, deleted)
+	if e != nil || len(oids) > 0 {
+		t.Error("GC should remove edges of deleted objects", e, oids)
+	}
+}
+
+func TestWithoutEdges(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("withoutEdges")
+	defer db.Close()
+	defer CreateTable(db, WithEdges())
+
+	// The table is emptied and not used
+	if _, e := CreateTable(db, WithoutEdges()); e != nil {
+		t.Fatal("CreateTable error", e)
+	}
+	var n int
+	if e := db.QueryRow("SELECT COUNT(1) FROM " + edgeTable).Scan(&n); e != nil || n != 0 {
+		t.Error("The edges table should be emptied", n, e)
+	}
+	dir := createRandomRepo("without-edges", 30, true, true)
+	_, head, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	tx := beginTx(db)
+	if _, e := GC(tx, []Oid{head}); e != nil {
+		t.Error("GC error", e)
+	}
+	tx.Rollback()
+	if _, e := ReferringOids(db, []Oid{head}); e == nil {
+		t.Error("ReferringOids should fail without the edges table")
+	}
+
+	// A transaction that read the setting before the table was emptied
+	// does not use the table
+	tx = beginTx(db)
+	tx.edges = edgesOn
+	expected, _ := bfsOidsByLevel(tx, []Oid{head}, nil)
+	if actual, e := bfsOids(tx, []Oid{head}, nil); e != nil || sortedOids(actual) != sortedOids(expected) {
+		t.Error("bfsOids should not use an emptied edges table", e)
+	}
+	if _, e := ReferringOids(tx, []Oid{head}); e == nil {
+		t.Error("ReferringOids should fail with an emptied edges table")
+	}
+	tx.Rollback()
+
+	// Migrate without options keeps the table unused
+	if e := Migrate(db); e != nil {
+		t.Fatal("Migrate error", e)
+	}
+	if values, e := readSettings(db); e != nil || values[settingEdges] != edgesOff {
+		t.Error("Migrate without options should not enable edges", e)
+	}
+
+	// Enabling the table again backfills it
+	if _, e := CreateTable(db, WithEdges()); e != nil {
+		t.Fatal("CreateTable error", e)
+	}
+	tx = beginTx(db)
+	expected, _ = bfsOidsByLevel(tx, []Oid{head}, nil)
+	actual, e := bfsOidsRecursive(tx, []Oid{head}, nil)
+	if e != nil || sortedOids(actual) != sortedOids(expected) {
+		t.Error("Edges are not backfilled", e)
+	}
+	tx.Rollback()
+
+	// During a backfill, edges of new objects are written, but the table is
+	// not used yet
+	if _, e := db.Exec(rebind(testDialect, "DELETE FROM "+settingsTable+" WHERE name = ?"), settingEdges); e != nil {
+		t.Fatal("DELETE error", e)
+	}
+	if _, e := ReferringOids(db, []Oid{head}); e == nil {
+		t.Error("ReferringOids should fail during the backfill")
+	}
+	b := NewCommitBuilder(head)
+	b.Put("new-file", ModeBlob, []byte("new\n"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	child, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	if e := db.QueryRow(rebind(testDialect, "SELECT COUNT(1) FROM "+edgeTable+" WHERE src = ?"), string(child)).Scan(&n); e != nil || n != 2 {
+		t.Error("Edges should be written during the backfill", n, e)
+	}
+}
@@ -0,0 +1,495 @@
+package gitdb
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GCOption customizes the behavior of GC.
+type GCOption func(*gcConfig)
+
+type gcConfig struct {
+	gracePeriod time.Duration
+	batchSize   int
+	dryRun      bool
+	progress    func(GCProgress)
+	// start is when GC starts, before marking reachable objects.
+	start time.Time
+}
+
+// GracePeriod makes GC keep objects written within d, and objects reachable
+// from them. It protects objects written by a concurrent Import,
+// CommitBuilder or push before a ref points to them. It is like
+// `git gc --prune=<date>`.
+//
+// Objects already in database are refreshed when new objects refer to them,
+// or when Import finds them already imported, so they count as recently
+// written too. Before each batch, GC marks objects refreshed since it
+// started, and objects reachable from them.
+func GracePeriod(d time.Duration) GCOption {
+	return func(c *gcConfig) {
+		c.gracePeriod = d
+	}
+}
+
+// BatchSize makes GC scan at most n objects per batch. If GC is called with
+// *sql.DB, each batch is swept in its own transaction, so locks are held
+// briefly. The default is the max number of parameters of the dialect.
+func BatchSize(n int) GCOption {
+	return func(c *gcConfig) {
+		c.batchSize = n
+	}
+}
+
+// DryRun makes GC return objects that would be deleted without deleting
+// them.
+func DryRun() GCOption {
+	return func(c *gcConfig) {
+		c.dryRun = true
+	}
+}
+
+// GCProgress describes the progress of GC. See ReportProgress.
+type GCProgress struct {
+	// Reachable is the number of objects marked reachable.
+	Reachable int
+	// Scanned is the number of objects scanned by the sweep so far. If
+	// objects not reachable are found by a recursive query, only they are
+	// scanned.
+	Scanned int
+	// Deleted is the number of objects deleted so far. With DryRun, it is
+	// the number of objects that would be deleted.
+	Deleted int
+}
+
+// ReportProgress makes GC call fn after marking reachable objects, and
+// after each batch.
+func ReportProgress(fn func(p GCProgress)) GCOption {
+	return func(c *gcConfig) {
+		c.progress = fn
+	}
+}
+
+// GC removes all objects from database except for oids and their parents
+// and ancestors.
+//
+// dt is either *sql.DB or *sql.Tx. With *sql.DB, GC can run against a live
+// database: batches are swept in separate transactions, and if GC fails,
+// earlier batches are not rolled back. With *sql.Tx, all batches are in the
+// given transaction.
+//
+// GC marks reachable objects first, then sweeps other objects in batches
+// ordered by oid. If the dialect supports recursive queries, objects not
+// reachable are found in a single query over the edges table, without
+// reading reachable objects into memory. Use GracePeriod to keep objects
+// written by concurrent writers.
+//
+// Objects owned by any repo are not deleted. If multiple repos share the
+// database, use Repo.GC to delete objects they no longer use.
+//
+// Returns deleted git object IDs. If GC fails, objects deleted by committed
+// batches are returned with the error.
+func GC(dt dbOrTx, oids []Oid, options ...GCOption) ([]Oid, error) {
+	cfg, cutoff := newGCConfig(options)
+	m, err := markOids(dt, oids, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	return sweep(dt, &cfg, m, cutoff, func(tx *gitTx, after Oid) ([]Oid, []Oid, error) {
+		scanned, deletable, err := sweepOids(tx, after, cutoff, cfg.batchSize, m)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Objects of repos are deleted by Repo.GC
+		owned, err := ownedOids(tx, deletable)
+		if err != nil {
+			return nil, nil, err
+		}
+		deletable = minus(deletable, owned)
+		if !cfg.dryRun {
+			deletable, err = deleteObjects(tx, deletable, cutoff)
+		}
+		return scanned, deletable, err
+	})
+}
+
+// newGCConfig applies options. Returns the config, and the cutoff time of
+// the grace period.
+func newGCConfig(options []GCOption) (gcConfig, int64) {
+	cfg := gcConfig{start: time.Now()}
+	for _, option := range options {
+		option(&cfg)
+	}
+	cutoff := cfg.start.Add(-cfg.gracePeriod).Unix()
+	return cfg, cutoff
+}
+
+// sweep calls fn in batches after marking reachable objects. fn scans at
+// most cfg.batchSize objects after the given oid, and deletes some of them.
+// It returns scanned oids in order, and deleted oids.
+//
+// With *sql.DB, each batch is in its own transaction. Before each batch,
+// objects refreshed by concurrent writers are marked by remarkOids.
+func sweep(dt dbOrTx, cfg *gcConfig, m *marks, cutoff int64, fn func(tx *gitTx, after Oid) ([]Oid, []Oid, error)) ([]Oid, error) {
+	// Objects modified at the cutoff second are not kept by markOids.
+	// Objects refreshed while markOids runs are kept by remarkOids.
+	since := cfg.start.Unix()
+	if since <= cutoff {
+		since = cutoff + 1
+	}
+	progress := GCProgress{Reachable: m.count}
+	if cfg.progress != nil {
+		cfg.progress(progress)
+	}
+
+	deleted := make([]Oid, 0)
+	for after := Oid(""); ; {
+		tx, txByUs, err := getOrCreateTx(dt)
+		if err != nil {
+			return deleted, err
+		}
+		if cfg.batchSize <= 0 {
+			cfg.batchSize = tx.dialect.MaxParams()
+		}
+		var scanned, deletable []Oid
+		err = remarkOids(tx, m, since)
+		if err == nil {
+			scanned, deletable, err = fn(tx, after)
+		}
+		if txByUs {
+			if err == nil {
+				err = tx.Commit()
+			} else {
+				tx.Rollback()
+			}
+		}
+		if err != nil {
+			if txByUs {
+				return deleted, err
+			}
+			return nil, err
+		}
+
+		deleted = append(deleted, deletable...)
+		progress.Reachable = m.count
+		progress.Scanned += len(scanned)
+		progress.Deleted += len(deletable)
+		if cfg.progress != nil {
+			cfg.progress(progress)
+		}
+		if len(scanned) < cfg.batchSize {
+			return deleted, nil
+		}
+		after = scanned[len(scanned)-1]
+	}
+}
+
+// marks are results of the mark phase of GC.
+type marks struct {
+	// reachable is the set of reachable objects.
+	reachable map[Oid]bool
+	// candidates are objects not reachable, in oid order, if they are found
+	// by unreachableOidsRecursive. Otherwise, candidates is nil, and objects
+	// not in reachable are not reachable.
+	candidates  []Oid
+	isCandidate map[Oid]bool
+	// count is the number of reachable objects.
+	count int
+}
+
+// unmarked tests whether an object is not known to be reachable.
+func (m *marks) unmarked(oid Oid) bool {
+	return !m.reachable[oid] && (m.candidates == nil || m.isCandidate[oid])
+}
+
+// mark marks an object reachable.
+func (m *marks) mark(oid Oid) {
+	m.reachable[oid] = true
+	m.count++
+}
+
+// markOids finds objects reachable from oids, or from objects modified after
+// cutoff.
+//
+// If the edges table is used, and the dialect supports recursive queries,
+// objects not reachable are found by unreachableOidsRecursive instead.
+func markOids(dt dbOrTx, oids []Oid, cutoff int64) (*marks, error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	m := &marks{reachable: make(map[Oid]bool)}
+	readEdges, err := tx.readEdges()
+	if err != nil {
+		return nil, err
+	}
+	if !tx.commitCache && readEdges && tx.dialect.RecursiveCTE() && len(oids)+2 <= tx.dialect.MaxParams() {
+		candidates, err := unreachableOidsRecursive(tx, oids, cutoff)
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := edgesStillOn(tx); err != nil {
+			return nil, err
+		} else if ok {
+			var n int
+			if err := tx.QueryRow("SELECT COUNT(1) FROM " + table).Scan(&n); err != nil {
+				return nil, err
+			}
+			m.candidates = candidates
+			m.isCandidate = toSet(candidates)
+			m.count = n - len(candidates)
+			return m, nil
+		}
+		// The edges table was disabled concurrently
+	}
+
+	// With the commit cache, objects reachable from commits are read from
+	// the cache. Other objects are walked by bfsOids.
+	commits := oids
+	var others []Oid
+	rows, err := tx.Query(tx.rebind("SELECT oid, type FROM "+table+" WHERE mtime > ?"), cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s, typ string
+		if err := rows.Scan(&s, &typ); err != nil {
+			return nil, err
+		}
+		if typ == "commit" {
+			commits = append(commits, Oid(s))
+		} else {
+			others = append(others, Oid(s))
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	rows.Close()
+
+	if !tx.commitCache {
+		others = append(others, commits...)
+		commits = nil
+	}
+	has := func(oid Oid) bool { return m.reachable[oid] }
+	for _, oid := range uniqueOids(commits) {
+		cachedOids, cached, err := cachedNewOids(tx, oid, has)
+		if err != nil {
+			return nil, err
+		}
+		if !cached {
+			others = append(others, oid)
+		}
+		for _, o := range cachedOids {
+			m.reachable[o] = true
+		}
+	}
+
+	oids, err = bfsOids(tx, uniqueOids(others), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, oid := range oids {
+		m.reachable[oid] = true
+	}
+	m.count = len(m.reachable)
+	return m, nil
+}
+
+// unreachableOidsRecursive returns objects modified before cutoff, and not
+// reachable from oids, or from objects modified after cutoff, in oid order.
+// It uses a single recursive SQL query over the edges table.
+func unreachableOidsRecursive(tx *gitTx, oids []Oid, cutoff int64) ([]Oid, error) {
+	roots := "mtime > ?"
+	if len(oids) > 0 {
+		roots = "oid IN (" + params(len(oids)) + ") OR " + roots
+	}
+	query := "WITH RECURSIVE reachable(oid) AS (" +
+		"SELECT oid FROM " + table + " WHERE " + roots +
+		" UNION " +
+		"SELECT e.dst FROM " + edgeTable + " e JOIN reachable r ON e.src = r.oid" +
+		") " +
+		"SELECT oid FROM " + table + " WHERE mtime <= ? AND oid NOT IN (SELECT oid FROM reachable) ORDER BY oid"
+	args := append(toInterfaces(oids), cutoff, cutoff)
+	rows, err := tx.Query(tx.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := make([]Oid, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, Oid(s))
+	}
+	return candidates, rows.Err()
+}
+
+// remarkOids marks objects modified since the given time, which are written
+// or refreshed by concurrent writers after markOids, and objects reachable
+// from them. The walk stops at marked objects.
+func remarkOids(tx *gitTx, m *marks, since int64) error {
+	rows, err := tx.Query(tx.rebind("SELECT oid FROM "+table+" WHERE mtime >= ?"), since)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	curr := make([]Oid, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return err
+		}
+		if oid := Oid(s); m.unmarked(oid) {
+			m.mark(oid)
+			curr = append(curr, oid)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	for len(curr) > 0 {
+		next := make([]Oid, 0)
+		err := queryByOids(tx, "referred", curr, func(scan rowScanFunc) error {
+			var referred string
+			if err := scan(&referred); err != nil {
+				return err
+			}
+			for _, v := range strings.Split(referred, ",") {
+				if o := Oid(v); len(v) > 0 && m.unmarked(o) {
+					m.mark(o)
+					next = append(next, o)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		curr = next
+	}
+	return nil
+}
+
+// sweepOids scans at most n objects with oids after the given one, and
+// modified before cutoff. Returns scanned oids in order, and oids not
+// reachable.
+//
+// If candidates are found by markOids, the next n candidates are scanned
+// instead.
+func sweepOids(tx *gitTx, after Oid, cutoff int64, n int, m *marks) (scanned []Oid, deletable []Oid, err error) {
+	deletable = make([]Oid, 0)
+	if m.candidates != nil {
+		scanned = m.candidates[:min(n, len(m.candidates))]
+		m.candidates = m.candidates[len(scanned):]
+		for _, oid := range scanned {
+			if !m.reachable[oid] {
+				deletable = append(deletable, oid)
+			}
+		}
+		return scanned, deletable, nil
+	}
+
+	query := "SELECT oid FROM " + table + " WHERE oid > ? AND mtime <= ? ORDER BY oid LIMIT " + strconv.Itoa(n)
+	rows, err := tx.Query(tx.rebind(query), string(after), cutoff)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, nil, err
+		}
+		oid := Oid(s)
+		scanned = append(scanned, oid)
+		if !m.reachable[oid] {
+			deletable = append(deletable, oid)
+		}
+	}
+	return scanned, deletable, rows.Err()
+}
+
+// deleteObjects deletes objects not modified after cutoff, and their
+// chunks, edges, owners, commit graph nodes and commit cache entries in
+// batch. Returns deleted oids.
+//
+// The modification time is checked by the DELETE statement, so objects
+// refreshed by a concurrent touchObjects after they were scanned are kept.
+func deleteObjects(tx *gitTx, oids []Oid, cutoff int64) ([]Oid, error) {
+	batchSize := tx.dialect.MaxParams() - 1
+	for i := 0; i < len(oids); i += batchSize {
+		j := min(i+batchSize, len(oids))
+		args := append(toInterfaces(oids[i:j]), cutoff)
+		_, err := tx.Exec(tx.rebind("DELETE FROM "+table+" WHERE oid IN ("+params(j-i)+") AND mtime <= ?"), args...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	deleted, err := unseenOids(tx, oids)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := []string{chunkTable, memberTable, commitGraphTable, commitGraphParentsTable, edgeTable, commitCacheTable}
+	batchSize = tx.dialect.MaxParams()
+	for i := 0; i < len(deleted); i += batchSize {
+		j := min(i+batchSize, len(deleted))
+		args := toInterfaces(deleted[i:j])
+		for _, t := range tables {
+			column := "oid"
+			switch t {
+			case edgeTable:
+				column = "src"
+			case commitCacheTable:
+				column = "commit_oid"
+			}
+			_, err := tx.Exec(tx.rebind("DELETE FROM "+t+" WHERE "+column+" IN ("+params(len(args))+")"), args...)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// touchObjects sets the modification time of objects, so a concurrent GC
+// does not delete them within the grace period. See GracePeriod.
+//
+// Objects deleted by a concurrent GC are reported as missing objects, and
+// the caller should retry. Since GC does not delete objects touched after
+// they were scanned, an object is either kept by GC, or reported missing.
+func touchObjects(tx *gitTx, oids []Oid, mtime int64) error {
+	batchSize := tx.dialect.MaxParams() - 1
+	for i := 0; i < len(oids); i += batchSize {
+		j := min(i+batchSize, len(oids))
+		args := append([]interface{}{mtime}, toInterfaces(oids[i:j])...)
+		result, err := tx.Exec(tx.rebind("UPDATE "+table+" SET mtime = ? WHERE oid IN ("+params(j-i)+")"), args...)
+		if err != nil {
+			return err
+		}
+		// Some drivers, like MySQL, do not count rows already having the
+		// mtime. Check missing rows only if the count is short.
+		if n, err := result.RowsAffected(); err != nil || n < int64(j-i) {
+			missing, err := unseenOids(tx, oids[i:j])
+			if err != nil {
+				return err
+			}
+			if len(missing) > 0 {
+				return errDbMissingObject(missing[0])
+			}
+		}
+	}
+	return nil
+}
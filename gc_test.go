@@ -0,0 +1,178 @@
+package gitdb
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIncrementalGC(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("incrementalGC")
+	defer db.Close()
+
+	dir := createRandomRepo("igc", 30, true, true)
+	_, keep, e := Import(db, dir, "HEAD~2")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, head, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	n := countObjects(db)
+
+	// Recently written objects are kept
+	if oids, e := GC(db, []Oid{keep}, GracePeriod(time.Hour)); e != nil || len(oids) != 0 {
+		t.Fatal("GC should keep recent objects", e, oids)
+	}
+	db.Exec("UPDATE " + table + " SET mtime = 0")
+
+	// Dry run deletes nothing
+	expected, e := GC(db, []Oid{keep}, DryRun())
+	if e != nil || len(expected) == 0 {
+		t.Fatal("GC dry run unexpected", e, len(expected))
+	}
+	if countObjects(db) != n {
+		t.Fatal("GC dry run should not delete objects")
+	}
+
+	// Importing existing objects refreshes them
+	if _, _, e := Import(db, dir, "HEAD~2"); e != nil {
+		t.Fatal("Import error", e)
+	}
+	if oids, e := GC(db, nil, GracePeriod(time.Hour), DryRun()); e != nil || len(oids) != len(expected) {
+		t.Fatal("GC should keep objects imported again", e, len(oids), len(expected))
+	}
+	db.Exec("UPDATE " + table + " SET mtime = 0")
+
+	// Objects referred by new objects are refreshed, and kept with their
+	// ancestors
+	b := NewCommitBuilder(head)
+	b.Put("new-file", ModeBlob, []byte("new"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	if _, e := b.Commit(db); e != nil {
+		t.Fatal("Commit error", e)
+	}
+	var mtime int64
+	db.QueryRow(rebind(testDialect, "SELECT mtime FROM "+table+" WHERE oid = ?"), string(head)).Scan(&mtime)
+	if mtime == 0 {
+		t.Error("Objects referred by new objects should be refreshed")
+	}
+	if oids, e := GC(db, []Oid{keep}, GracePeriod(time.Hour)); e != nil || len(oids) != 0 {
+		t.Fatal("GC should keep objects reachable from recent objects", e, oids)
+	}
+	db.Exec("UPDATE " + table + " SET mtime = 0")
+	n = countObjects(db)
+
+	// Batches report progress
+	var reports []GCProgress
+	deleted, e := GC(db, []Oid{keep}, BatchSize(7), ReportProgress(func(p GCProgress) {
+		reports = append(reports, p)
+	}))
+	if e != nil {
+		t.Fatal("GC error", e)
+	}
+	// The new commit, its tree and blob are not reachable from keep
+	if len(deleted) != len(expected)+3 {
+		t.Errorf("GC deleted %d objects, expected %d", len(deleted), len(expected)+3)
+	}
+	if countObjects(db) != n-len(deleted) {
+		t.Error("GC should delete returned objects")
+	}
+	// Objects found reachable by a recursive query are not scanned
+	last := reports[len(reports)-1]
+	if len(reports) < last.Scanned/7+2 {
+		t.Fatal("GC should report progress of each batch", len(reports))
+	}
+	if last.Scanned > n || last.Scanned < len(deleted) || last.Deleted != len(deleted) || last.Reachable == 0 {
+		t.Error("GC reported unexpected progress", last)
+	}
+}
+
+func TestGCTouchRace(t *testing.T) {
+	db := createDb("gcTouchRace")
+	defer db.Close()
+
+	b := NewCommitBuilder()
+	b.Put("a", ModeBlob, []byte("a"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	commit, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	_, tree, _ := Stat(db, commit, "")
+	_, blob, _ := Stat(db, commit, "a")
+	db.Exec("UPDATE " + table + " SET mtime = 0")
+
+	// Objects reachable from refreshed objects are marked again
+	tx := beginTx(db)
+	defer tx.Rollback()
+	if e := touchObjects(tx, []Oid{tree}, 100); e != nil {
+		t.Fatal("touchObjects error", e)
+	}
+	m := &marks{reachable: make(map[Oid]bool)}
+	if e := remarkOids(tx, m, 100); e != nil || m.count != 2 || !m.reachable[tree] || !m.reachable[blob] {
+		t.Fatal("remarkOids unexpected", e, m.reachable)
+	}
+
+	// With candidates, the walk stops at objects not in candidates
+	m = &marks{reachable: make(map[Oid]bool), candidates: []Oid{commit}, isCandidate: toSet([]Oid{commit})}
+	if e := remarkOids(tx, m, 100); e != nil || m.count != 0 {
+		t.Fatal("remarkOids should only mark candidates", e, m.reachable)
+	}
+
+	// An object touched after GC scanned it is kept
+	deleted, e := deleteObjects(tx, []Oid{commit, tree}, 50)
+	if e != nil || len(deleted) != 1 || deleted[0] != commit {
+		t.Fatal("deleteObjects should only delete untouched objects", deleted, e)
+	}
+
+	// Touching an object deleted by GC fails
+	if e := touchObjects(tx, []Oid{tree, commit}, 100); e == nil || e.Error() != errDbMissingObject(commit).Error() {
+		t.Error("touchObjects should report deleted objects", e)
+	}
+}
+
+func TestGCRefreshWhileMarking(t *testing.T) {
+	db := createDb("gcRefreshWhileMarking")
+	defer db.Close()
+
+	b := NewCommitBuilder()
+	b.Put("a/b", ModeBlob, []byte("b"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	commit, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	_, tree, _ := Stat(db, commit, "")
+	_, subtree, _ := Stat(db, commit, "a")
+	_, blob, _ := Stat(db, commit, "a/b")
+	db.Exec("UPDATE " + table + " SET mtime = 0")
+
+	// The tree is refreshed at the second GC starts, after markOids read
+	// recent objects
+	start := func(c *gcConfig) { c.start = time.Unix(1000, 0) }
+	refreshed := false
+	deleted, e := GC(db, nil, GracePeriod(time.Minute), start, ReportProgress(func(p GCProgress) {
+		if !refreshed {
+			refreshed = true
+			tx := beginTx(db)
+			if e := touchObjects(tx, []Oid{tree}, 1000); e != nil {
+				t.Fatal("touchObjects error", e)
+			}
+			tx.Commit()
+		}
+	}))
+	if e != nil {
+		t.Fatal("GC error", e)
+	}
+	if len(deleted) != 1 || deleted[0] != commit {
+		t.Error("GC should keep objects reachable from refreshed objects", deleted)
+	}
+	if n := countObjects(db); n != 3 {
+		t.Error("GC deleted objects under the refreshed tree", n, subtree, blob)
+	}
+}
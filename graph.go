@@ -0,0 +1,664 @@
+package gitdb
+
+import (
+	"container/heap"
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+const (
+	commitGraphTable        = "gitcommit_graph"
+	commitGraphParentsTable = "gitcommit_graph_parents"
+)
+
+// createCommitGraphTable creates the commit graph table. It is a migration
+// step. The table is filled by fillCommitGraph.
+//
+// The table is like git's commit-graph file. It stores parents and the
+// generation number of each commit, so ancestry queries do not need to read
+// and parse commit objects. The generation number of a root commit is 1.
+// Otherwise, it is 1 + the max generation number of its parents.
+//
+// Commits with parents missing in database, like the oldest commits of a
+// shallow clone, are incomplete. They are boundaries of the graph, like
+// root commits: their generation numbers are 1, and their parents are not
+// walked. Once the parents are written, the commits are complete, and
+// generation numbers of them and their descendants are updated.
+func createCommitGraphTable(db *sql.DB) (sql.Result, error) {
+	return db.Exec("CREATE TABLE IF NOT EXISTS " + commitGraphTable + " (" +
+		"oid CHAR(40) PRIMARY KEY NOT NULL," +
+		"generation INT NOT NULL," +
+		// parents are separated by ",", like the referred column.
+		"parents TEXT NOT NULL," +
+		// incomplete is 1 if some parents are missing in database.
+		"incomplete INT NOT NULL)")
+}
+
+// createCommitGraphParentsTable creates the table recording parents of
+// commits in the commit graph. It is a migration step.
+//
+// The table is a reverse index of the parents column. It finds children of
+// commits, so incomplete commits waiting for a parent, and their
+// descendants, can be updated when the parent is written.
+func createCommitGraphParentsTable(db *sql.DB) (sql.Result, error) {
+	return db.Exec("CREATE TABLE IF NOT EXISTS " + commitGraphParentsTable + " (" +
+		"parent CHAR(40) NOT NULL," +
+		"oid CHAR(40) NOT NULL," +
+		"PRIMARY KEY (parent, oid))")
+}
+
+// fillCommitGraph rebuilds the commit graph table from existing commits. It
+// is a migration step.
+func fillCommitGraph(db *sql.DB, d Dialect) error {
+	sqlTx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	tx := &gitTx{sqlTx, settings{dialect: d}}
+	defer tx.Rollback()
+	for _, t := range []string{commitGraphTable, commitGraphParentsTable} {
+		if _, err := tx.Exec("DELETE FROM " + t); err != nil {
+			return err
+		}
+	}
+	parentsOf := make(map[Oid][]Oid)
+	rows, err := tx.Query("SELECT oid, referred FROM " + table + " WHERE type = 'commit'")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var oid string
+		var referred sql.NullString
+		if err := rows.Scan(&oid, &referred); err != nil {
+			return err
+		}
+		parentsOf[Oid(oid)] = commitParents(referred.String)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	if _, err := insertCommitGraph(tx, parentsOf); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// commitParents returns parents from the referred column of a commit. The
+// first referred oid is the tree.
+func commitParents(referred string) []Oid {
+	var parents []Oid
+	for i, s := range strings.Split(referred, ",") {
+		if i > 0 && len(s) > 0 {
+			parents = append(parents, Oid(s))
+		}
+	}
+	return parents
+}
+
+// graphNode is a row of the commit graph table. parents of incomplete
+// commits are empty.
+type graphNode struct {
+	generation int
+	parents    []Oid
+	incomplete bool
+}
+
+// insertCommitGraph writes commits, with parents in parentsOf, to the commit
+// graph table. Commits with parents neither in parentsOf nor in the table
+// are written as incomplete. Returns those missing parents. Incomplete
+// commits waiting for commits in parentsOf, and their descendants, are
+// updated.
+func insertCommitGraph(tx *gitTx, parentsOf map[Oid][]Oid) ([]Oid, error) {
+	if len(parentsOf) == 0 {
+		return nil, nil
+	}
+
+	// Read generation numbers of existing parents
+	var parents []Oid
+	for _, ps := range parentsOf {
+		for _, p := range ps {
+			if _, ok := parentsOf[p]; !ok {
+				parents = append(parents, p)
+			}
+		}
+	}
+	nodes, err := readCommitGraph(tx, uniqueOids(parents))
+	if err != nil {
+		return nil, err
+	}
+	generations := make(map[Oid]int, len(nodes)+len(parentsOf))
+	for oid, node := range nodes {
+		generations[oid] = node.generation
+	}
+	missing := make(map[Oid]bool)
+	var missingOids []Oid
+	for _, p := range parents {
+		if _, ok := nodes[p]; !ok && !missing[p] {
+			missing[p] = true
+			missingOids = append(missingOids, p)
+		}
+	}
+
+	stmt, err := tx.Prepare(tx.rebind(tx.dialect.InsertIgnore(commitGraphTable, []string{"oid", "generation", "parents", "incomplete"})))
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	parentStmt, err := tx.Prepare(tx.rebind(tx.dialect.InsertIgnore(commitGraphParentsTable, []string{"parent", "oid"})))
+	if err != nil {
+		return nil, err
+	}
+	defer parentStmt.Close()
+	err = computeGenerations(parentsOf, generations, missing, func(oid Oid, generation int, incomplete bool) error {
+		for _, p := range parentsOf[oid] {
+			if _, err := parentStmt.Exec(string(p), string(oid)); err != nil {
+				return err
+			}
+		}
+		flag := 0
+		if incomplete {
+			flag = 1
+		}
+		_, err := stmt.Exec(string(oid), generation, joinOids(parentsOf[oid], ","), flag)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Incomplete commits waiting for the commits written now are updated
+	oids := make([]Oid, 0, len(parentsOf))
+	for oid := range parentsOf {
+		oids = append(oids, oid)
+	}
+	children, err := childCommits(tx, oids, true)
+	if err != nil {
+		return nil, err
+	}
+	var waiting []Oid
+	for _, c := range children {
+		if _, ok := parentsOf[c]; !ok {
+			waiting = append(waiting, c)
+		}
+	}
+	if len(waiting) > 0 {
+		if err := updateCommitGraph(tx, waiting); err != nil {
+			return nil, err
+		}
+	}
+	return missingOids, nil
+}
+
+// childCommits returns commits in the commit graph table with any of oids
+// as a parent. With incompleteOnly, only incomplete commits are returned.
+func childCommits(tx *gitTx, oids []Oid, incompleteOnly bool) ([]Oid, error) {
+	query := "SELECT DISTINCT p.oid FROM " + commitGraphParentsTable + " p"
+	if incompleteOnly {
+		query += " JOIN " + commitGraphTable + " g ON g.oid = p.oid WHERE g.incomplete = 1 AND"
+	} else {
+		query += " WHERE"
+	}
+	var children []Oid
+	seen := make(map[Oid]bool)
+	batchSize := tx.dialect.MaxParams()
+	for i := 0; i < len(oids); i += batchSize {
+		j := min(i+batchSize, len(oids))
+		rows, err := tx.Query(tx.rebind(query+" p.parent IN ("+params(j-i)+")"), toInterfaces(oids[i:j])...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if oid := Oid(s); !seen[oid] {
+				seen[oid] = true
+				children = append(children, oid)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return children, nil
+}
+
+// computeGenerations computes generation numbers of commits in parentsOf,
+// and calls visit for each of them, parents before children. generations
+// has generation numbers of other commits, and is updated. Commits with
+// parents in missing are incomplete.
+func computeGenerations(parentsOf map[Oid][]Oid, generations map[Oid]int, missing map[Oid]bool, visit func(oid Oid, generation int, incomplete bool) error) error {
+	// No recursion since histories can be long
+	for oid := range parentsOf {
+		for stack := []Oid{oid}; len(stack) > 0; {
+			c := stack[len(stack)-1]
+			if _, ok := generations[c]; ok {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			ps := parentsOf[c]
+			generation, incomplete := 1, false
+			for _, p := range ps {
+				if missing[p] {
+					incomplete = true
+				}
+			}
+			for _, p := range ps {
+				if incomplete {
+					// Parents of incomplete commits are not walked
+					break
+				}
+				if g, ok := generations[p]; !ok {
+					stack = append(stack, p)
+					generation = 0
+				} else if generation > 0 && g >= generation {
+					generation = g + 1
+				}
+			}
+			if generation == 0 {
+				continue
+			}
+			generations[c] = generation
+			stack = stack[:len(stack)-1]
+			if err := visit(c, generation, incomplete); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateCommitGraph recomputes generation numbers of waiting commits,
+// incomplete commits whose missing parents were written, and their
+// descendants, so they get higher generation numbers. Descendants are found
+// by the parents table. Other commits are not read.
+func updateCommitGraph(tx *gitTx, waiting []Oid) error {
+	parentsOf := make(map[Oid][]Oid)
+	stored := make(map[Oid]*graphNode)
+	for curr := waiting; len(curr) > 0; {
+		err := queryCommitGraph(tx, curr, func(oid Oid, node *graphNode, parents []Oid) error {
+			parentsOf[oid] = parents
+			stored[oid] = node
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		children, err := childCommits(tx, curr, false)
+		if err != nil {
+			return err
+		}
+		curr = nil
+		for _, c := range children {
+			if _, ok := parentsOf[c]; !ok {
+				curr = append(curr, c)
+			}
+		}
+	}
+
+	// Generation numbers of other parents do not change
+	var others []Oid
+	for _, ps := range parentsOf {
+		for _, p := range ps {
+			if _, ok := parentsOf[p]; !ok {
+				others = append(others, p)
+			}
+		}
+	}
+	nodes, err := readCommitGraph(tx, uniqueOids(others))
+	if err != nil {
+		return err
+	}
+	generations := make(map[Oid]int, len(nodes)+len(parentsOf))
+	missing := make(map[Oid]bool)
+	for _, p := range others {
+		if node, ok := nodes[p]; ok {
+			generations[p] = node.generation
+		} else {
+			missing[p] = true
+		}
+	}
+
+	stmt, err := tx.Prepare(tx.rebind("UPDATE " + commitGraphTable + " SET generation = ?, incomplete = ? WHERE oid = ?"))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	return computeGenerations(parentsOf, generations, missing, func(oid Oid, generation int, incomplete bool) error {
+		if node := stored[oid]; node.generation == generation && node.incomplete == incomplete {
+			return nil
+		}
+		flag := 0
+		if incomplete {
+			flag = 1
+		}
+		_, err := stmt.Exec(generation, flag, string(oid))
+		return err
+	})
+}
+
+// readCommitGraph reads commit graph nodes of oids. Commits not in the table
+// are not in the returned map.
+func readCommitGraph(tx *gitTx, oids []Oid) (map[Oid]*graphNode, error) {
+	nodes := make(map[Oid]*graphNode, len(oids))
+	err := queryCommitGraph(tx, oids, func(oid Oid, node *graphNode, parents []Oid) error {
+		if !node.incomplete {
+			node.parents = parents
+		}
+		nodes[oid] = node
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// queryCommitGraph calls fn for rows of oids in the commit graph table.
+// parents are from the parents column, and are not empty for incomplete
+// commits, unlike node.parents, which is not set.
+func queryCommitGraph(tx *gitTx, oids []Oid, fn func(oid Oid, node *graphNode, parents []Oid) error) error {
+	batchSize := tx.dialect.MaxParams()
+	for i := 0; i < len(oids); i += batchSize {
+		j := min(i+batchSize, len(oids))
+		query := "SELECT oid, generation, parents, incomplete FROM " + commitGraphTable + " WHERE oid IN (" + params(j-i) + ")"
+		rows, err := tx.Query(tx.rebind(query), toInterfaces(oids[i:j])...)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var oid, parents string
+			var generation, incomplete int
+			if err := rows.Scan(&oid, &generation, &parents, &incomplete); err != nil {
+				rows.Close()
+				return err
+			}
+			var ps []Oid
+			for _, p := range strings.Split(parents, ",") {
+				if len(p) > 0 {
+					ps = append(ps, Oid(p))
+				}
+			}
+			if err := fn(Oid(oid), &graphNode{generation: generation, incomplete: incomplete != 0}, ps); err != nil {
+				rows.Close()
+				return err
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitGraph reads commit graph nodes on demand, and remembers them.
+type commitGraph struct {
+	tx    *gitTx
+	nodes map[Oid]*graphNode
+}
+
+// load reads nodes of oids not read before. Returns an error if any of
+// oids is not a commit in database.
+func (g *commitGraph) load(oids []Oid) error {
+	var missing []Oid
+	for _, oid := range oids {
+		if _, ok := g.nodes[oid]; !ok {
+			missing = append(missing, oid)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	nodes, err := readCommitGraph(g.tx, uniqueOids(missing))
+	if err != nil {
+		return err
+	}
+	for _, oid := range missing {
+		node, ok := nodes[oid]
+		if !ok {
+			return fmt.Errorf("commit not found: %s", oid)
+		}
+		g.nodes[oid] = node
+	}
+	return nil
+}
+
+// IsAncestor tests whether commit a is an ancestor of commit b, or the same
+// commit. It is like `git merge-base --is-ancestor a b` and is useful to
+// check whether updating a ref from a to b is a fast-forward.
+//
+// dt is either *sql.DB or *sql.Tx.
+//
+// Commits with generation numbers not greater than a's are not walked,
+// since they cannot have a as an ancestor. Commits written without their
+// parents, like the oldest commits of a shallow clone, are treated as root
+// commits.
+func IsAncestor(dt dbOrTx, a Oid, b Oid) (bool, error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return false, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	g := &commitGraph{tx: tx, nodes: make(map[Oid]*graphNode)}
+	if err := g.load([]Oid{a, b}); err != nil {
+		return false, err
+	}
+	return g.isAncestor(a, []Oid{b})
+}
+
+// isAncestor tests whether a is an ancestor of any of oids, which must be
+// loaded.
+func (g *commitGraph) isAncestor(a Oid, oids []Oid) (bool, error) {
+	generation := g.nodes[a].generation
+	visited := toSet(oids)
+	for curr := oids; len(curr) > 0; {
+		var next []Oid
+		for _, c := range curr {
+			if c == a {
+				return true, nil
+			}
+			if g.nodes[c].generation <= generation {
+				continue
+			}
+			for _, p := range g.nodes[c].parents {
+				if !visited[p] {
+					visited[p] = true
+					next = append(next, p)
+				}
+			}
+		}
+		if err := g.load(next); err != nil {
+			return false, err
+		}
+		curr = next
+	}
+	return false, nil
+}
+
+// MergeBase finds the best common ancestors of commits a and b. It is like
+// `git merge-base --all a b`.
+//
+// dt is either *sql.DB or *sql.Tx.
+//
+// Returns common ancestors that are not ancestors of other common
+// ancestors, ordered by generation numbers from high to low. Usually there
+// is only one. Returns an empty array if a and b have no common ancestors.
+// Like IsAncestor, commits written without their parents are treated as
+// root commits.
+func MergeBase(dt dbOrTx, a Oid, b Oid) ([]Oid, error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	g := &commitGraph{tx: tx, nodes: make(map[Oid]*graphNode)}
+	if err := g.load([]Oid{a, b}); err != nil {
+		return nil, err
+	}
+
+	// Paint commits reachable from a and b, from high generation numbers
+	// to low, like git's paint_down_to_common. Commits reachable from both
+	// are candidates. Their ancestors are stale and not candidates.
+	const (
+		fromA = 1 << iota
+		fromB
+		stale
+	)
+	flags := map[Oid]int{a: fromA}
+	flags[b] |= fromB
+	q := &generationQueue{}
+	heap.Push(q, generationQueueItem{a, g.nodes[a].generation})
+	if b != a {
+		heap.Push(q, generationQueueItem{b, g.nodes[b].generation})
+	}
+	var candidates []Oid
+	for q.Len() > 0 {
+		// Stop if only stale commits are left
+		active := false
+		for _, item := range q.items {
+			if flags[item.oid]&stale == 0 {
+				active = true
+				break
+			}
+		}
+		if !active {
+			break
+		}
+
+		c := heap.Pop(q).(generationQueueItem).oid
+		f := flags[c]
+		if f&(fromA|fromB) == fromA|fromB && f&stale == 0 {
+			candidates = append(candidates, c)
+			f |= stale
+		}
+		parents := g.nodes[c].parents
+		if err := g.load(parents); err != nil {
+			return nil, err
+		}
+		for _, p := range parents {
+			if flags[p]&f == f {
+				continue
+			}
+			if flags[p] == 0 {
+				heap.Push(q, generationQueueItem{p, g.nodes[p].generation})
+			}
+			flags[p] |= f
+		}
+	}
+
+	// Remove candidates reachable from other candidates
+	result := make([]Oid, 0, len(candidates))
+	for i, c := range candidates {
+		others := make([]Oid, 0, len(candidates)-1)
+		others = append(others, candidates[:i]...)
+		others = append(others, candidates[i+1:]...)
+		redundant, err := g.isAncestor(c, others)
+		if err != nil {
+			return nil, err
+		}
+		if !redundant {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// newCommits returns commits reachable from wants but not from haves, like
+// `git rev-list wants --not haves`. Commits are walked from high generation
+// numbers to low, and the walk stops when only commits reachable from haves
+// are left, so the history of haves is not walked.
+func (g *commitGraph) newCommits(wants []Oid, haves []Oid) ([]Oid, error) {
+	if err := g.load(append(append([]Oid{}, wants...), haves...)); err != nil {
+		return nil, err
+	}
+
+	const (
+		fromWant = 1 << iota
+		fromHave
+	)
+	flags := make(map[Oid]int)
+	q := &generationQueue{}
+	paint := func(oid Oid, f int) {
+		if flags[oid] == 0 {
+			heap.Push(q, generationQueueItem{oid, g.nodes[oid].generation})
+		}
+		flags[oid] |= f
+	}
+	for _, oid := range haves {
+		paint(oid, fromHave)
+	}
+	for _, oid := range wants {
+		paint(oid, fromWant)
+	}
+
+	var result []Oid
+	for q.Len() > 0 {
+		// Stop if only commits reachable from haves are left
+		active := false
+		for _, item := range q.items {
+			if flags[item.oid]&fromHave == 0 {
+				active = true
+				break
+			}
+		}
+		if !active {
+			break
+		}
+
+		c := heap.Pop(q).(generationQueueItem).oid
+		f := flags[c]
+		if f&fromHave == 0 {
+			result = append(result, c)
+		}
+		parents := g.nodes[c].parents
+		if err := g.load(parents); err != nil {
+			return nil, err
+		}
+		for _, p := range parents {
+			if flags[p]&f != f {
+				paint(p, f)
+			}
+		}
+	}
+	return result, nil
+}
+
+// generationQueue is a priority queue of commits, with the highest
+// generation number first.
+type generationQueue struct {
+	items []generationQueueItem
+}
+
+type generationQueueItem struct {
+	oid        Oid
+	generation int
+}
+
+func (q *generationQueue) Len() int      { return len(q.items) }
+func (q *generationQueue) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *generationQueue) Less(i, j int) bool {
+	if q.items[i].generation != q.items[j].generation {
+		return q.items[i].generation > q.items[j].generation
+	}
+	return q.items[i].oid < q.items[j].oid
+}
+func (q *generationQueue) Push(x interface{}) { q.items = append(q.items, x.(generationQueueItem)) }
+func (q *generationQueue) Pop() interface{} {
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return item
+}
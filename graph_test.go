@@ -0,0 +1,189 @@
+package gitdb
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIsAncestorAndMergeBase(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("commitGraph")
+	defer db.Close()
+
+	dir := createRandomRepo("graph", 60, true, true)
+	if _, _, e := Import(db, dir, "HEAD"); e != nil {
+		t.Fatal("Import error", e)
+	}
+	var commits []Oid
+	for _, s := range strings.Fields(runGit(t, dir, "rev-list", "--all")) {
+		commits = append(commits, Oid(s))
+	}
+
+	// Generation numbers of children are greater
+	tx := beginTx(db)
+	nodes, e := readCommitGraph(tx, commits)
+	tx.Rollback()
+	if e != nil || len(nodes) != len(commits) {
+		t.Fatal("readCommitGraph unexpected", len(nodes), e)
+	}
+	for oid, node := range nodes {
+		for _, p := range node.parents {
+			if nodes[p].generation >= node.generation {
+				t.Errorf("generation of %s is not greater than its parent %s", oid, p)
+			}
+		}
+	}
+
+	// Compare with git
+	if len(commits) > 12 {
+		commits = commits[:12]
+	}
+	for _, a := range commits {
+		for _, b := range commits {
+			expected := exec.Command("git", "-C", dir, "merge-base", "--is-ancestor", string(a), string(b)).Run() == nil
+			if actual, e := IsAncestor(db, a, b); e != nil || actual != expected {
+				t.Errorf("IsAncestor(%s, %s) = %v, %v, expected %v", a, b, actual, e, expected)
+			}
+
+			out, _ := exec.Command("git", "-C", dir, "merge-base", "--all", string(a), string(b)).Output()
+			expectedBases := strings.Fields(string(out))
+			sort.Strings(expectedBases)
+			bases, e := MergeBase(db, a, b)
+			if e != nil {
+				t.Fatal("MergeBase error", e)
+			}
+			if sortedOids(bases) != strings.Join(expectedBases, ",") {
+				t.Errorf("MergeBase(%s, %s) = %v, expected %v", a, b, bases, expectedBases)
+			}
+		}
+	}
+
+	// Migrate fills the commit graph of existing commits
+	db.Exec("DROP TABLE " + commitGraphTable)
+	db.Exec("UPDATE " + schemaTable + " SET version = 4")
+	if e := Migrate(db); e != nil {
+		t.Fatal("Migrate error", e)
+	}
+	tx = beginTx(db)
+	backfilled, e := readCommitGraph(tx, commits)
+	tx.Rollback()
+	if e != nil {
+		t.Fatal("readCommitGraph error", e)
+	}
+	for _, oid := range commits {
+		if backfilled[oid] == nil || backfilled[oid].generation != nodes[oid].generation {
+			t.Errorf("generation of %s is not backfilled", oid)
+		}
+	}
+	if _, e := IsAncestor(db, commits[0], Oid(strings.Repeat("0", 40))); e == nil {
+		t.Error("IsAncestor should fail for unknown commits")
+	}
+}
+
+func TestCommitGraphShallow(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("commitGraphShallow")
+	defer db.Close()
+
+	dir := createRandomRepo("graph", 60, true, true)
+	shallowDir := filepath.Join(repoDir, "graph-shallow")
+	os.RemoveAll(shallowDir)
+	runGit(t, repoDir, "clone", "-q", "--depth", "3", "file://"+dir, shallowDir)
+	_, head, e := Import(db, shallowDir, "HEAD")
+	if e != nil {
+		t.Fatal("Import of a shallow clone error", e)
+	}
+	data, e := ioutil.ReadFile(filepath.Join(shallowDir, ".git", "shallow"))
+	if e != nil {
+		t.Fatal("ReadFile error", e)
+	}
+	var boundaries []Oid
+	for _, s := range strings.Fields(string(data)) {
+		boundaries = append(boundaries, Oid(s))
+	}
+
+	// Commits with missing parents are incomplete boundaries
+	check := func() {
+		tx := beginTx(db)
+		nodes, e := readCommitGraph(tx, boundaries)
+		tx.Rollback()
+		if e != nil || len(nodes) != len(boundaries) {
+			t.Fatal("readCommitGraph unexpected", len(nodes), e)
+		}
+		for oid, node := range nodes {
+			if !node.incomplete || node.generation != 1 || len(node.parents) != 0 {
+				t.Errorf("%s should be an incomplete boundary: %+v", oid, node)
+			}
+		}
+		for _, b := range boundaries {
+			if ok, e := IsAncestor(db, b, head); e != nil || !ok {
+				t.Errorf("IsAncestor(%s, HEAD) = %v, %v", b, ok, e)
+			}
+			if bases, e := MergeBase(db, head, b); e != nil || len(bases) != 1 || bases[0] != b {
+				t.Errorf("MergeBase(HEAD, %s) = %v, %v", b, bases, e)
+			}
+		}
+	}
+	check()
+
+	// Migrate fills the commit graph of shallow histories
+	db.Exec("DELETE FROM " + commitGraphTable)
+	db.Exec("UPDATE " + schemaTable + " SET version = 4")
+	if e := Migrate(db); e != nil {
+		t.Fatal("Migrate error", e)
+	}
+	check()
+
+	// Commits of other histories are not updated when the shallow history
+	// is deepened. Their generation numbers are changed to detect updates.
+	_, other, e := Import(db, createRandomRepo("graph-other", 5, true, true), "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	db.Exec("UPDATE "+commitGraphTable+" SET generation = 999 WHERE oid = ?", string(other))
+
+	// Boundaries are complete after their parents are written
+	if _, _, e := Import(db, dir, "HEAD"); e != nil {
+		t.Fatal("Import error", e)
+	}
+	tx := beginTx(db)
+	nodes, e := readCommitGraph(tx, boundaries)
+	tx.Rollback()
+	if e != nil {
+		t.Fatal("readCommitGraph error", e)
+	}
+	for oid, node := range nodes {
+		if node.incomplete || node.generation <= 1 || len(node.parents) == 0 {
+			t.Errorf("%s should be complete: %+v", oid, node)
+		}
+	}
+	tx = beginTx(db)
+	nodes, e = readCommitGraph(tx, []Oid{other})
+	tx.Rollback()
+	if e != nil || nodes[other] == nil || nodes[other].generation != 999 {
+		t.Errorf("commits of other histories should not be updated: %+v, %v", nodes[other], e)
+	}
+	root := Oid(strings.Fields(runGit(t, dir, "rev-list", "--max-parents=0", "HEAD"))[0])
+	if ok, e := IsAncestor(db, root, head); e != nil || !ok {
+		t.Errorf("IsAncestor(root, HEAD) = %v, %v after deepening", ok, e)
+	}
+	tx = beginTx(db)
+	g := &commitGraph{tx: tx, nodes: make(map[Oid]*graphNode)}
+	commits, e := g.newCommits([]Oid{head}, nil)
+	tx.Rollback()
+	expected := strings.Fields(runGit(t, dir, "rev-list", "HEAD"))
+	if e != nil || len(commits) != len(expected) {
+		t.Errorf("newCommits(HEAD) = %d commits, %v, expected %d", len(commits), e, len(expected))
+	}
+}
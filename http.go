@@ -0,0 +1,729 @@
+package gitdb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const httpAgent = "agent=gitdb"
+
+// HTTPHandler serves repos stored in database over the git smart HTTP
+// protocol (version 0 and 2), so they can be cloned or fetched by git
+// without Export.
+//
+// The repo name, as used by UpdateRef, is the URL path without the service
+// suffix ("/info/refs", "/git-upload-pack") and the optional ".git" suffix.
+// For example, "http://host/foo/bar.git" serves refs of repo "foo/bar".
+// Use http.StripPrefix to mount the handler under a sub-path.
+//
+// Only objects reachable from refs can be fetched. Shallow clones, partial
+// clones and the dumb HTTP protocol are not supported.
+//
+// If ReceivePack is set, `git push` is also accepted. A push is applied in a
+// single transaction: either all objects and refs are written, or nothing.
+// HTTPHandler does not authenticate users. Wrap it to do so.
+type HTTPHandler struct {
+	// DB is the database storing git objects and refs.
+	DB *sql.DB
+
+	// ReceivePack enables git-receive-pack, used by `git push`.
+	ReceivePack bool
+
+	// MaxPushSize is the max size of a git-receive-pack request, after
+	// decompression. A push is read into memory before being written to
+	// database. Larger pushes are rejected. The default is 1GB.
+	MaxPushSize int64
+}
+
+// defaultMaxPushSize is the default of HTTPHandler.MaxPushSize.
+const defaultMaxPushSize = 1 << 30
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	repo, service := splitServicePath(req.URL.Path)
+	switch {
+	case service == "info/refs" && req.Method == "GET":
+		switch req.URL.Query().Get("service") {
+		case "git-upload-pack":
+			h.serveInfoRefs(w, req, repo)
+		case "git-receive-pack":
+			if !h.ReceivePack {
+				http.Error(w, "push is not enabled", http.StatusForbidden)
+				return
+			}
+			h.serveReceivePackInfoRefs(w, req, repo)
+		default:
+			http.Error(w, "only smart HTTP is supported", http.StatusForbidden)
+		}
+	case service == "git-upload-pack" && req.Method == "POST":
+		h.serveUploadPack(w, req, repo)
+	case service == "git-receive-pack" && req.Method == "POST":
+		if !h.ReceivePack {
+			http.Error(w, "push is not enabled", http.StatusForbidden)
+			return
+		}
+		h.serveReceivePack(w, req, repo)
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+// splitServicePath splits an URL path into repo name and service.
+func splitServicePath(path string) (repo string, service string) {
+	for _, s := range []string{"info/refs", "git-upload-pack", "git-receive-pack"} {
+		if strings.HasSuffix(path, "/"+s) {
+			repo = strings.Trim(strings.TrimSuffix(path, "/"+s), "/")
+			return strings.TrimSuffix(repo, ".git"), s
+		}
+	}
+	return "", ""
+}
+
+// isProtocolV2 tests whether the client requests git protocol version 2.
+func isProtocolV2(req *http.Request) bool {
+	for _, v := range strings.Split(req.Header.Get("Git-Protocol"), ":") {
+		if v == "version=2" {
+			return true
+		}
+	}
+	return false
+}
+
+// requestBody returns the request body, decompressing it if necessary.
+func requestBody(req *http.Request) (io.Reader, error) {
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		return gzip.NewReader(req.Body)
+	}
+	return req.Body, nil
+}
+
+func (h *HTTPHandler) serveInfoRefs(w http.ResponseWriter, req *http.Request, repo string) {
+	var buf bytes.Buffer
+	if isProtocolV2(req) {
+		writePktLinef(&buf, "version 2\n")
+		writePktLinef(&buf, "%s\n", httpAgent)
+		writePktLinef(&buf, "ls-refs\n")
+		writePktLinef(&buf, "fetch\n")
+		writePktFlush(&buf)
+	} else {
+		refs, err := advertisedRefs(h.DB, repo)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writePktLinef(&buf, "# service=git-upload-pack\n")
+		writePktFlush(&buf)
+		caps := "multi_ack_detailed side-band-64k ofs-delta no-progress include-tag " + httpAgent
+		if len(refs) == 0 {
+			writePktLinef(&buf, "%s capabilities^{}\x00%s\n", strings.Repeat("0", 40), caps)
+		}
+		for i, r := range refs {
+			if i == 0 {
+				if len(r.symref) > 0 {
+					caps += " symref=" + r.name + ":" + r.symref
+				}
+				writePktLinef(&buf, "%s %s\x00%s\n", r.oid, r.name, caps)
+			} else {
+				writePktLinef(&buf, "%s %s\n", r.oid, r.name)
+			}
+			if len(r.peeled) > 0 {
+				writePktLinef(&buf, "%s %s^{}\n", r.peeled, r.name)
+			}
+		}
+		writePktFlush(&buf)
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+func (h *HTTPHandler) serveUploadPack(w http.ResponseWriter, req *http.Request, repo string) {
+	body, err := requestBody(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-git-upload-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	if isProtocolV2(req) {
+		err = h.uploadPackV2(w, body, repo)
+	} else {
+		err = h.uploadPackV0(w, body, repo)
+	}
+	if err != nil {
+		if e, ok := err.(errBadRequest); ok {
+			http.Error(w, e.Error(), http.StatusBadRequest)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// uploadPackV0 serves a stateless git-upload-pack request in protocol v0.
+// Each request contains all wants and haves, followed by "done" in the
+// last round of negotiation.
+func (h *HTTPHandler) uploadPackV0(w io.Writer, body io.Reader, repo string) error {
+	var wants, haves []Oid
+	var done, sideband, includeTag bool
+	for {
+		kind, data, err := readPktLine(body)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errBadRequest(err.Error())
+		}
+		if kind != pktData {
+			continue
+		}
+		line := strings.TrimSuffix(string(data), "\n")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 2 && fields[0] == "want":
+			wants = append(wants, Oid(fields[1]))
+			for _, c := range fields[2:] {
+				if c == "side-band-64k" || c == "side-band" {
+					sideband = true
+				} else if c == "include-tag" {
+					includeTag = true
+				}
+			}
+		case len(fields) == 2 && fields[0] == "have":
+			haves = append(haves, Oid(fields[1]))
+		case line == "done":
+			done = true
+		default:
+			return errBadRequest("unsupported upload-pack request: " + line)
+		}
+	}
+
+	tx, _, err := getOrCreateTx(h.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	refs, err := advertisedRefs(tx, repo)
+	if err != nil {
+		return err
+	}
+	if err := checkWants(refs, wants); err != nil {
+		return err
+	}
+	common, err := commonOids(tx, refs, haves)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if !done {
+		for _, oid := range common {
+			writePktLinef(&buf, "ACK %s common\n", oid)
+		}
+		writePktLinef(&buf, "NAK\n")
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	if !includeTag {
+		refs = nil
+	}
+	oids, err := uploadPackObjects(tx, wants, common, refs)
+	if err != nil {
+		return err
+	}
+	if len(common) > 0 {
+		writePktLinef(&buf, "ACK %s\n", common[len(common)-1])
+	} else {
+		writePktLinef(&buf, "NAK\n")
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if !sideband {
+		return writeUploadPack(w, tx, oids, uploadPackBatchSize)
+	}
+	return writeSidebandPack(w, tx, oids)
+}
+
+// uploadPackV2 serves a git-upload-pack request in protocol v2. Supported
+// commands are "ls-refs" and "fetch".
+func (h *HTTPHandler) uploadPackV2(w io.Writer, body io.Reader, repo string) error {
+	var command string
+	var args []string
+	inArgs := false
+	for {
+		kind, data, err := readPktLine(body)
+		if err != nil {
+			return errBadRequest(err.Error())
+		}
+		if kind == pktFlush {
+			break
+		}
+		if kind == pktDelim {
+			inArgs = true
+			continue
+		}
+		line := strings.TrimSuffix(string(data), "\n")
+		if inArgs {
+			args = append(args, line)
+		} else if strings.HasPrefix(line, "command=") {
+			command = line[len("command="):]
+		}
+	}
+
+	switch command {
+	case "ls-refs":
+		return h.lsRefsV2(w, repo, args)
+	case "fetch":
+		return h.fetchV2(w, repo, args)
+	default:
+		return errBadRequest("unsupported command: " + command)
+	}
+}
+
+func (h *HTTPHandler) lsRefsV2(w io.Writer, repo string, args []string) error {
+	var prefixes []string
+	peel, symrefs := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "peel":
+			peel = true
+		case arg == "symrefs":
+			symrefs = true
+		case strings.HasPrefix(arg, "ref-prefix "):
+			prefixes = append(prefixes, arg[len("ref-prefix "):])
+		}
+	}
+
+	refs, err := advertisedRefs(h.DB, repo)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, r := range refs {
+		matched := len(prefixes) == 0
+		for _, p := range prefixes {
+			if strings.HasPrefix(r.name, p) {
+				matched = true
+			}
+		}
+		if !matched {
+			continue
+		}
+		line := string(r.oid) + " " + r.name
+		if symrefs && len(r.symref) > 0 {
+			line += " symref-target:" + r.symref
+		}
+		if peel && len(r.peeled) > 0 {
+			line += " peeled:" + string(r.peeled)
+		}
+		writePktLinef(&buf, "%s\n", line)
+	}
+	writePktFlush(&buf)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (h *HTTPHandler) fetchV2(w io.Writer, repo string, args []string) error {
+	var wants, haves []Oid
+	done, includeTag := false, false
+	for _, arg := range args {
+		fields := strings.Fields(arg)
+		switch {
+		case len(fields) == 2 && fields[0] == "want":
+			wants = append(wants, Oid(fields[1]))
+		case len(fields) == 2 && fields[0] == "have":
+			haves = append(haves, Oid(fields[1]))
+		case arg == "done":
+			done = true
+		case arg == "include-tag":
+			includeTag = true
+		case arg == "thin-pack", arg == "no-progress", arg == "ofs-delta":
+			// thin-pack: packs are never thin, which is always fine
+		default:
+			return errBadRequest("unsupported fetch argument: " + arg)
+		}
+	}
+
+	tx, _, err := getOrCreateTx(h.DB)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	refs, err := advertisedRefs(tx, repo)
+	if err != nil {
+		return err
+	}
+	if err := checkWants(refs, wants); err != nil {
+		return err
+	}
+	common, err := commonOids(tx, refs, haves)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if !done {
+		writePktLinef(&buf, "acknowledgments\n")
+		for _, oid := range common {
+			writePktLinef(&buf, "ACK %s\n", oid)
+		}
+		if len(common) == 0 {
+			writePktLinef(&buf, "NAK\n")
+		}
+		writePktFlush(&buf)
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+
+	if !includeTag {
+		refs = nil
+	}
+	oids, err := uploadPackObjects(tx, wants, common, refs)
+	if err != nil {
+		return err
+	}
+	writePktLinef(&buf, "packfile\n")
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	return writeSidebandPack(w, tx, oids)
+}
+
+// advertisedRef is a ref advertised to git clients.
+type advertisedRef struct {
+	name   string
+	oid    Oid
+	peeled Oid    // for annotated tags, the peeled object
+	symref string // for HEAD, the branch it points to
+}
+
+// advertisedRefs lists refs of a repo with HEAD first. If HEAD is not stored
+// in database, it is derived from "master" or "main" branches.
+func advertisedRefs(dt dbOrTx, repo string) ([]advertisedRef, error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	names, oids, err := ListRefs(tx, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	var refs []advertisedRef
+	var head *advertisedRef
+	var tagOids []Oid
+	for i, name := range names {
+		if name == "HEAD" {
+			head = &advertisedRef{name: name, oid: oids[i]}
+			continue
+		}
+		refs = append(refs, advertisedRef{name: name, oid: oids[i]})
+		if strings.HasPrefix(name, "refs/tags/") {
+			tagOids = append(tagOids, oids[i])
+		}
+	}
+
+	for _, branch := range []string{"refs/heads/master", "refs/heads/main"} {
+		for _, r := range refs {
+			if r.name != branch || (head != nil && head.oid != r.oid) {
+				continue
+			}
+			if head == nil {
+				head = &advertisedRef{name: "HEAD", oid: r.oid}
+			}
+			if len(head.symref) == 0 {
+				head.symref = r.name
+			}
+		}
+	}
+	if head != nil {
+		refs = append([]advertisedRef{*head}, refs...)
+	}
+
+	peeled, err := peelTags(tx, tagOids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range refs {
+		refs[i].peeled = peeled[refs[i].oid]
+	}
+	return refs, nil
+}
+
+// checkWants verifies wants are advertised refs, so objects not belonging
+// to the repo cannot be fetched.
+func checkWants(refs []advertisedRef, wants []Oid) error {
+	if len(wants) == 0 {
+		return errBadRequest("no wants")
+	}
+	tips := make(map[Oid]bool)
+	for _, r := range refs {
+		tips[r.oid] = true
+		tips[r.peeled] = true
+	}
+	for _, oid := range wants {
+		if !oid.IsValid() || !tips[oid] {
+			return errBadRequest("not our ref " + string(oid))
+		}
+	}
+	return nil
+}
+
+// peelTags returns a map from annotated tag oids to the non-tag objects they
+// point to. oids which are not annotated tags are not in the map.
+func peelTags(tx *gitTx, oids []Oid) (map[Oid]Oid, error) {
+	result := make(map[Oid]Oid)
+	tagOf := make(map[Oid]Oid)
+	for _, oid := range oids {
+		tagOf[oid] = oid
+	}
+	for len(oids) > 0 {
+		objs, err := readObjects(tx, oids)
+		if err != nil {
+			return nil, err
+		}
+		var next []Oid
+		nextTagOf := make(map[Oid]Oid)
+		for _, o := range objs {
+			if o.Type != "tag" {
+				if tag := tagOf[o.Oid]; tag != o.Oid {
+					result[tag] = o.Oid
+				}
+				continue
+			}
+			for _, target := range o.referredOids() {
+				next = append(next, target)
+				nextTagOf[target] = tagOf[o.Oid]
+			}
+		}
+		oids, tagOf = next, nextTagOf
+	}
+	return result, nil
+}
+
+// commonOids returns haves that are commits reachable from refs, so objects
+// of other repos sharing the database are not acknowledged. Commits with
+// generation numbers lower than all haves are not walked.
+func commonOids(tx *gitTx, refs []advertisedRef, haves []Oid) ([]Oid, error) {
+	g := &commitGraph{tx: tx}
+	var err error
+	if g.nodes, err = readCommitGraph(tx, uniqueOids(haves)); err != nil {
+		return nil, err
+	}
+	minGeneration := -1
+	for _, node := range g.nodes {
+		if minGeneration < 0 || node.generation < minGeneration {
+			minGeneration = node.generation
+		}
+	}
+	if minGeneration < 0 {
+		return []Oid{}, nil
+	}
+
+	// Tips might be tags, trees or blobs, which are not in the commit graph
+	var tips []Oid
+	for _, r := range refs {
+		tips = append(tips, r.oid, r.peeled)
+	}
+	tipNodes, err := readCommitGraph(tx, uniqueOids(tips))
+	if err != nil {
+		return nil, err
+	}
+	var curr []Oid
+	for oid, node := range tipNodes {
+		g.nodes[oid] = node
+		curr = append(curr, oid)
+	}
+
+	visited := toSet(curr)
+	for len(curr) > 0 {
+		var next []Oid
+		for _, c := range curr {
+			if g.nodes[c].generation <= minGeneration {
+				continue
+			}
+			for _, p := range g.nodes[c].parents {
+				if !visited[p] {
+					visited[p] = true
+					next = append(next, p)
+				}
+			}
+		}
+		if err := g.load(next); err != nil {
+			return nil, err
+		}
+		curr = next
+	}
+
+	common := make([]Oid, 0)
+	for _, oid := range haves {
+		if visited[oid] {
+			common = append(common, oid)
+		}
+	}
+	return common, nil
+}
+
+// uploadPackObjects returns oids of objects reachable from wants but not
+// from haves, which are commits. Commits reachable from haves, and trees and blobs of
+// haves, are not sent. The history of haves is not walked.
+//
+// If refs is not nil, annotated tags in refs pointing to sent objects are
+// sent too, like the include-tag capability.
+func uploadPackObjects(tx *gitTx, wants []Oid, haves []Oid, refs []advertisedRef) ([]Oid, error) {
+	// Annotated tags are sent with the objects they point to
+	var result, commits, others []Oid
+	for curr := uniqueOids(wants); len(curr) > 0; {
+		types, referred, err := readReferred(tx, curr)
+		if err != nil {
+			return nil, err
+		}
+		var next []Oid
+		for _, oid := range curr {
+			switch types[oid] {
+			case "":
+				return nil, errDbMissingObject(oid)
+			case "tag":
+				result = append(result, oid)
+				next = append(next, referred[oid]...)
+			case "commit":
+				commits = append(commits, oid)
+			default:
+				others = append(others, oid)
+			}
+		}
+		curr = next
+	}
+
+	g := &commitGraph{tx: tx, nodes: make(map[Oid]*graphNode)}
+	newCommits, err := g.newCommits(commits, haves)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, newCommits...)
+
+	// The first referred object of a commit is its tree
+	_, referred, err := readReferred(tx, newCommits)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range newCommits {
+		if len(referred[c]) == 0 {
+			return nil, fmt.Errorf("commit %s is illformed: no tree", c)
+		}
+		others = append(others, referred[c][0])
+	}
+	var skipOids []Oid
+	if len(haves) > 0 {
+		_, referred, err := readReferred(tx, haves)
+		if err != nil {
+			return nil, err
+		}
+		var trees []Oid
+		for _, c := range haves {
+			if len(referred[c]) == 0 {
+				return nil, fmt.Errorf("commit %s is illformed: no tree", c)
+			}
+			trees = append(trees, referred[c][0])
+		}
+		if skipOids, err = bfsOids(tx, uniqueOids(trees), nil); err != nil {
+			return nil, err
+		}
+	}
+	oids, err := bfsOids(tx, uniqueOids(minus(others, skipOids)), skipOids)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, oids...)
+
+	sent := toSet(result)
+	for _, r := range refs {
+		if strings.HasPrefix(r.name, "refs/tags/") && sent[r.peeled] && !sent[r.oid] {
+			sent[r.oid] = true
+			result = append(result, r.oid)
+		}
+	}
+	return uniqueOids(result), nil
+}
+
+// readReferred reads types and referred oids of objects. Missing objects are
+// not in the returned maps.
+func readReferred(tx *gitTx, oids []Oid) (map[Oid]string, map[Oid][]Oid, error) {
+	types := make(map[Oid]string, len(oids))
+	referred := make(map[Oid][]Oid, len(oids))
+	err := queryByOids(tx, "oid, type, referred", oids, func(scan rowScanFunc) error {
+		var oid, typ string
+		var s sql.NullString
+		if err := scan(&oid, &typ, &s); err != nil {
+			return err
+		}
+		types[Oid(oid)] = typ
+		for _, v := range strings.Split(s.String, ",") {
+			if len(v) > 0 {
+				referred[Oid(oid)] = append(referred[Oid(oid)], Oid(v))
+			}
+		}
+		return nil
+	})
+	return types, referred, err
+}
+
+// uploadPackBatchSize is the number of objects read from database at a time
+// when writing a pack to a client.
+const uploadPackBatchSize = 1000
+
+// writeUploadPack writes objects of oids as a delta-compressed pack. Objects
+// are read and written in batches of batchSize, so only a batch is in
+// memory. Objects are sorted for deltas within a batch.
+func writeUploadPack(w io.Writer, tx *gitTx, oids []Oid, batchSize int) error {
+	pw, err := newPackWriter(w, len(oids), true)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(oids); i += batchSize {
+		objs, err := readObjects(tx, oids[i:min(i+batchSize, len(oids))])
+		if err != nil {
+			return err
+		}
+		sortObjectsForDeltas(objs)
+		for _, o := range objs {
+			if err := pw.writeObject(o); err != nil {
+				return err
+			}
+		}
+	}
+	_, err = pw.close()
+	return err
+}
+
+// writeSidebandPack writes objects of oids as a pack multiplexed in
+// side-band 1, followed by a flush packet.
+func writeSidebandPack(w io.Writer, tx *gitTx, oids []Oid) error {
+	bw := bufio.NewWriterSize(&sidebandWriter{w: w, band: 1}, pktMaxData-1)
+	if err := writeUploadPack(bw, tx, oids, uploadPackBatchSize); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return writePktFlush(w)
+}
+
+type errBadRequest string
+
+func (e errBadRequest) Error() string {
+	return fmt.Sprintf("bad request: %s", string(e))
+}
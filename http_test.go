@@ -0,0 +1,398 @@
+package gitdb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// countingHandler counts bytes of responses to POST requests.
+type countingHandler struct {
+	h     http.Handler
+	bytes int
+}
+
+func (c *countingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method == "POST" {
+		rec := httptest.NewRecorder()
+		c.h.ServeHTTP(rec, req)
+		c.bytes += rec.Body.Len()
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+		return
+	}
+	c.h.ServeHTTP(w, req)
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal("git", args, "error", err, string(out))
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestHTTPUploadPack(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("httpUploadPack")
+	defer db.Close()
+
+	dir := createRandomRepo("hu", 40, true, true)
+	_, oid1, e := Import(db, dir, "HEAD~10")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, oid2, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	runGit(t, dir, "tag", "-f", "-a", "-m", "tag", "v1", string(oid1))
+	_, tagOid, e := Import(db, dir, "v1")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	if e := UpdateRef(db, "foo/r", "refs/heads/master", "", oid1); e != nil {
+		t.Fatal("UpdateRef error", e)
+	}
+	if e := UpdateRef(db, "foo/r", "refs/tags/v1", "", tagOid); e != nil {
+		t.Fatal("UpdateRef error", e)
+	}
+
+	handler := &countingHandler{h: &HTTPHandler{DB: db}}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, version := range []string{"0", "2"} {
+		proto := "protocol.version=" + version
+		clone := filepath.Join(repoDir, "hu-clone-v"+version)
+		os.RemoveAll(clone)
+
+		// Clone
+		runGit(t, repoDir, "-c", proto, "clone", "-q", server.URL+"/foo/r.git", clone)
+		if head := runGit(t, clone, "rev-parse", "HEAD"); head != string(oid1) {
+			t.Fatal("clone unexpected: HEAD is", head, "expected", oid1)
+		}
+		if tag := runGit(t, clone, "rev-parse", "v1"); tag != string(tagOid) {
+			t.Fatal("clone unexpected: tag is", tag, "expected", tagOid)
+		}
+		runGit(t, clone, "fsck", "--full", "--strict")
+
+		// Incremental fetch
+		if e := UpdateRef(db, "foo/r", "refs/heads/master", oid1, oid2); e != nil {
+			t.Fatal("UpdateRef error", e)
+		}
+		handler.bytes = 0
+		runGit(t, clone, "-c", proto, "fetch", "-q", "origin")
+		fetchBytes := handler.bytes
+		if fetched := runGit(t, clone, "rev-parse", "origin/master"); fetched != string(oid2) {
+			t.Fatal("fetch unexpected: origin/master is", fetched, "expected", oid2)
+		}
+		runGit(t, clone, "fsck", "--full", "--strict")
+
+		// A full clone of the new commit transfers more
+		fullClone := clone + "-full"
+		os.RemoveAll(fullClone)
+		handler.bytes = 0
+		runGit(t, repoDir, "-c", proto, "clone", "-q", server.URL+"/foo/r.git", fullClone)
+		if fetchBytes >= handler.bytes {
+			t.Error("fetch is not incremental: fetched", fetchBytes, "bytes, full clone fetched", handler.bytes)
+		}
+		if e := UpdateRef(db, "foo/r", "refs/heads/master", oid2, oid1); e != nil {
+			t.Fatal("UpdateRef error", e)
+		}
+
+		// Objects not reachable from refs cannot be fetched
+		cmd := exec.Command("git", "-c", proto, "fetch", "-q", "origin", string(oid2))
+		cmd.Dir = clone
+		if err := cmd.Run(); err == nil {
+			// git may have the object already; try a fresh repo.
+			empty := filepath.Join(repoDir, "hu-empty")
+			os.RemoveAll(empty)
+			runGit(t, repoDir, "init", "-q", empty)
+			cmd = exec.Command("git", "-c", proto, "fetch", "-q", server.URL+"/foo/r", string(oid2))
+			cmd.Dir = empty
+			if err := cmd.Run(); err == nil {
+				t.Error("fetching an object not reachable from refs should fail")
+			}
+		}
+	}
+
+	// Only haves reachable from refs of the repo are acknowledged
+	tx := beginTx(db)
+	defer tx.Rollback()
+	refs, e := advertisedRefs(tx, "foo/r")
+	if e != nil {
+		t.Fatal("advertisedRefs error", e)
+	}
+	if common, e := commonOids(tx, refs, []Oid{oid2, oid1}); e != nil || len(common) != 1 || common[0] != oid1 {
+		t.Error("commonOids should only return haves reachable from refs", common, e)
+	}
+
+	// Objects reachable from haves are not sent. With include-tag, tags
+	// pointing to sent objects are sent.
+	runGit(t, dir, "tag", "-f", "-a", "-m", "tag", "v2", "HEAD~1")
+	_, tag2Oid, e := Import(tx, dir, "v2")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	if e := UpdateRef(tx, "foo/r", "refs/tags/v2", "", tag2Oid); e != nil {
+		t.Fatal("UpdateRef error", e)
+	}
+	if refs, e = advertisedRefs(tx, "foo/r"); e != nil {
+		t.Fatal("advertisedRefs error", e)
+	}
+	n := len(strings.Split(runGit(t, dir, "rev-list", "--objects", "HEAD", "^"+string(oid1)), "\n"))
+	for _, includeTag := range []bool{false, true} {
+		tagRefs, expected := refs, n+1
+		if !includeTag {
+			tagRefs, expected = nil, n
+		}
+		oids, e := uploadPackObjects(tx, []Oid{oid2}, []Oid{oid1}, tagRefs)
+		if e != nil {
+			t.Fatal("uploadPackObjects error", e)
+		}
+		hasTag := false
+		for _, oid := range oids {
+			hasTag = hasTag || oid == tag2Oid
+		}
+		if hasTag != includeTag || len(oids) != expected {
+			t.Errorf("uploadPackObjects returned %d objects, expected %d, include-tag %v", len(oids), expected, includeTag)
+		}
+
+		// The pack is written in batches
+		var buf bytes.Buffer
+		if e := writeUploadPack(&buf, tx, oids, 3); e != nil {
+			t.Fatal("writeUploadPack error", e)
+		}
+		unpacked := filepath.Join(repoDir, "hu-unpack")
+		os.RemoveAll(unpacked)
+		runGit(t, repoDir, "init", "-q", "--bare", unpacked)
+		cmd := exec.Command("git", "index-pack", "--stdin")
+		cmd.Dir = unpacked
+		cmd.Stdin = &buf
+		if out, e := cmd.CombinedOutput(); e != nil {
+			t.Error("index-pack error", e, string(out))
+		}
+	}
+	tx.Rollback()
+
+	// Empty repo
+	empty := filepath.Join(repoDir, "hu-clone-empty")
+	os.RemoveAll(empty)
+	runGit(t, repoDir, "clone", "-q", server.URL+"/missing", empty)
+}
+
+// packOf returns a packfile containing the given objects read from a repo.
+func packOf(t *testing.T, dir string, oids []Oid) []byte {
+	objs, err := newRepo(dir).readObjects(oids)
+	if err != nil {
+		t.Fatal("readObjects error", err)
+	}
+	return packOfObjects(t, objs)
+}
+
+// packOfObjects returns a packfile containing objs.
+func packOfObjects(t *testing.T, objs []*gitObj) []byte {
+	var buf bytes.Buffer
+	pw, err := newPackWriter(&buf, len(objs), true)
+	if err != nil {
+		t.Fatal("newPackWriter error", err)
+	}
+	for _, obj := range objs {
+		if err := pw.writeObject(obj); err != nil {
+			t.Fatal("writeObject error", err)
+		}
+	}
+	if _, err := pw.close(); err != nil {
+		t.Fatal("close error", err)
+	}
+	return buf.Bytes()
+}
+
+func TestHTTPReceivePack(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("httpReceivePack")
+	defer db.Close()
+
+	dir := createRandomRepo("hr", 40, true, true)
+	oid1 := Oid(runGit(t, dir, "rev-parse", "HEAD~3"))
+	oid2 := Oid(runGit(t, dir, "rev-parse", "HEAD"))
+
+	handler := &HTTPHandler{DB: db}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	url := server.URL + "/foo/p.git"
+
+	// Push is disabled by default
+	cmd := exec.Command("git", "push", "-q", url, "HEAD:refs/heads/master")
+	cmd.Dir = dir
+	if err := cmd.Run(); err == nil {
+		t.Error("push should fail if ReceivePack is not set")
+	}
+	handler.ReceivePack = true
+
+	// Pushes larger than MaxPushSize are rejected
+	handler.MaxPushSize = 100
+	cmd = exec.Command("git", "push", "-q", url, "HEAD:refs/heads/master")
+	cmd.Dir = dir
+	if err := cmd.Run(); err == nil {
+		t.Error("push should fail if it is larger than MaxPushSize")
+	}
+	req, _ := http.NewRequest("POST", "/foo/p.git/git-receive-pack", strings.NewReader(strings.Repeat("0", 101)))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Error("large push should be rejected with 413, got", rec.Code)
+	}
+	handler.MaxPushSize = 0
+
+	// Push to an empty repo, then push incrementally (thin pack)
+	runGit(t, dir, "push", "-q", url, "HEAD~3:refs/heads/master")
+	if oid, _ := ResolveRef(db, "foo/p", "refs/heads/master"); oid != oid1 {
+		t.Fatal("push unexpected: master is", oid, "expected", oid1)
+	}
+	runGit(t, dir, "push", "-q", url, "HEAD:refs/heads/master", "HEAD~1:refs/heads/other")
+	if oid, _ := ResolveRef(db, "foo/p", "refs/heads/master"); oid != oid2 {
+		t.Fatal("push unexpected: master is", oid, "expected", oid2)
+	}
+
+	// Pushed objects can be cloned
+	clone := filepath.Join(repoDir, "hr-clone")
+	os.RemoveAll(clone)
+	runGit(t, repoDir, "clone", "-q", url, clone)
+	if head := runGit(t, clone, "rev-parse", "HEAD"); head != string(oid2) {
+		t.Fatal("clone unexpected: HEAD is", head, "expected", oid2)
+	}
+	runGit(t, clone, "fsck", "--full", "--strict")
+
+	// Pushed objects are owned by the repo
+	if _, _, _, e := (&Repo{ID: "foo/p"}).ReadTree(db, oid1); e != nil {
+		t.Error("pushed objects should be owned by the repo", e)
+	}
+
+	// Delete a ref
+	runGit(t, dir, "push", "-q", url, ":refs/heads/other")
+	if oid, _ := ResolveRef(db, "foo/p", "refs/heads/other"); oid != "" {
+		t.Error("ref should be deleted, but it is", oid)
+	}
+
+	// A failed ref update leaves nothing behind
+	runGit(t, dir, "commit", "-q", "--allow-empty", "-m", "new")
+	oid3 := Oid(runGit(t, dir, "rev-parse", "HEAD"))
+	packData := packOf(t, dir, []Oid{oid3})
+	cmds := []*receiveCommand{
+		{ref: "refs/heads/master", oldOid: oid2, newOid: oid3},
+		{ref: "refs/heads/x", oldOid: oid1, newOid: oid3},
+	}
+	if err := receivePack(db, "foo/p", cmds, packData, defaultMaxPushSize); err != nil {
+		t.Fatal("receivePack unpack error", err)
+	}
+	if cmds[0].err == nil || cmds[1].err == nil || !IsRefConflict(cmds[1].err) {
+		t.Error("ref updates should fail, got", cmds[0].err, cmds[1].err)
+	}
+	if oid, _ := ResolveRef(db, "foo/p", "refs/heads/master"); oid != oid2 {
+		t.Error("master should not change, but it is", oid)
+	}
+	if _, err := readObjects(db, []Oid{oid3}); err == nil {
+		t.Error("objects should not be written")
+	}
+
+	// Objects must be connected
+	runGit(t, dir, "commit", "-q", "-m", "new", "--allow-empty")
+	oid4 := Oid(runGit(t, dir, "rev-parse", "HEAD"))
+	packData = packOf(t, dir, []Oid{oid4})
+	cmds = []*receiveCommand{{ref: "refs/heads/master", oldOid: oid2, newOid: oid4}}
+	if err := receivePack(db, "foo/p", cmds, packData, defaultMaxPushSize); err == nil || cmds[0].err == nil {
+		t.Error("pushing disconnected objects should fail")
+	}
+
+	// Corrupted packs are rejected
+	packData = packOf(t, dir, []Oid{oid3, oid4})
+	packData[len(packData)/2] ^= 1
+	cmds = []*receiveCommand{{ref: "refs/heads/master", oldOid: oid2, newOid: oid4}}
+	if err := receivePack(db, "foo/p", cmds, packData, defaultMaxPushSize); err == nil || cmds[0].err == nil {
+		t.Error("pushing corrupted pack should fail")
+	}
+	if oid, _ := ResolveRef(db, "foo/p", "refs/heads/master"); oid != oid2 {
+		t.Error("master should not change, but it is", oid)
+	}
+
+	// Objects of other repos cannot be claimed by a push
+	secretDir := createRandomRepo("hr-secret", 5, true, true)
+	_, secret, e := (&Repo{ID: "other"}).Import(db, secretDir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	cmds = []*receiveCommand{{ref: "refs/heads/secret", newOid: secret}}
+	if err := receivePack(db, "foo/p", cmds, nil, defaultMaxPushSize); err != nil || cmds[0].err == nil {
+		t.Error("pushing a ref to objects of other repos should fail", err)
+	}
+	stolen := Oid(runGit(t, secretDir, "commit-tree", "-m", "stolen", "HEAD^{tree}"))
+	cmds = []*receiveCommand{{ref: "refs/heads/secret", newOid: stolen}}
+	if err := receivePack(db, "foo/p", cmds, packOf(t, secretDir, []Oid{stolen}), defaultMaxPushSize); err == nil || cmds[0].err == nil {
+		t.Error("pushing objects referring to objects of other repos should fail")
+	}
+	_, blobOids, _, e := ReadTree(db, secret)
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	blobs, e := ReadBlobs(db, blobOids[:1])
+	if e != nil {
+		t.Fatal("ReadBlobs error", e)
+	}
+	delta := computeDelta(blobs[0], append(blobs[0], 'x'))
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, []uint32{2, 1})
+	writePackObjHeader(&pack, packObjRefDelta, len(delta))
+	base, _ := hex.DecodeString(string(blobOids[0]))
+	pack.Write(base)
+	zw := zlib.NewWriter(&pack)
+	zw.Write(delta)
+	zw.Close()
+	sum := sha1.Sum(pack.Bytes())
+	pack.Write(sum[:])
+	if err := receivePack(db, "foo/p", nil, pack.Bytes(), defaultMaxPushSize); err == nil {
+		t.Error("pushing deltas against objects of other repos should fail")
+	}
+	if err := receivePack(db, "other", nil, pack.Bytes(), defaultMaxPushSize); err != nil {
+		t.Error("pushing deltas against objects of the repo should work", err)
+	}
+	if _, _, _, e := (&Repo{ID: "foo/p"}).ReadTree(db, secret); e == nil {
+		t.Error("objects of other repos should not be owned after pushes")
+	}
+
+	// Malformed objects are rejected
+	for _, o := range []*gitObj{
+		{Type: "commit", Body: []byte("tree 1234\n")},
+		{Type: "commit", Body: []byte("author A <a@example.com> 0 +0000\n\n")},
+		{Type: "tree", Body: []byte("100644 a\x00short")},
+		{Type: "tag", Body: []byte("type commit\n\n")},
+	} {
+		o.Oid = hashObject(o.Type, o.Body)
+		if err := receivePack(db, "foo/p", nil, packOfObjects(t, []*gitObj{o}), defaultMaxPushSize); err == nil {
+			t.Errorf("pushing malformed object %q should fail", o.Body)
+		}
+	}
+}
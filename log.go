@@ -0,0 +1,380 @@
+package gitdb
+
+import (
+	"container/heap"
+	"fmt"
+	"strings"
+)
+
+// LogOption customizes the behavior of Log.
+type LogOption func(*logConfig)
+
+type logConfig struct {
+	limit       int
+	firstParent bool
+	order       int
+	paths       []string
+}
+
+const (
+	logDefaultOrder = iota
+	logTopoOrder
+	logDateOrder
+)
+
+// Limit makes Log return at most n commits, like `git log -n`.
+// n <= 0 means no limit.
+func Limit(n int) LogOption {
+	return func(c *logConfig) {
+		c.limit = n
+	}
+}
+
+// FirstParent makes Log only follow the first parent of merge commits,
+// like `git log --first-parent`.
+func FirstParent() LogOption {
+	return func(c *logConfig) {
+		c.firstParent = true
+	}
+}
+
+// TopoOrder makes Log show no parents before all of their children, and
+// avoid intermixing lines of history, like `git log --topo-order`.
+// The whole history needs to be read before returning commits.
+func TopoOrder() LogOption {
+	return func(c *logConfig) {
+		c.order = logTopoOrder
+	}
+}
+
+// DateOrder makes Log show no parents before all of their children, and
+// otherwise show commits by committer date, like `git log --date-order`.
+// The whole history needs to be read before returning commits.
+func DateOrder() LogOption {
+	return func(c *logConfig) {
+		c.order = logDateOrder
+	}
+}
+
+// Paths makes Log only return commits touching the given slash-separated
+// paths, like `git log -- paths`. A path matches everything under it.
+//
+// History is simplified like git's default mode: a merge commit that does
+// not change the paths comparing to one of its parents is skipped, and only
+// that parent is followed.
+func Paths(paths ...string) LogOption {
+	return func(c *logConfig) {
+		c.paths = append(c.paths, paths...)
+	}
+}
+
+// Log walks commits reachable from a commit. It is like `git log` but
+// works directly in database. Only commits are read, unless Paths is used.
+//
+// dt is either *sql.DB or *sql.Tx.
+// oid is the git object ID of a commit.
+//
+// By default, commits are returned in reverse chronological order by
+// committer date. Parents of pending commits are read in one batch.
+// Commits with parents missing in database, like the oldest commits of a
+// shallow clone, are treated as root commits.
+func Log(dt dbOrTx, oid Oid, options ...LogOption) ([]*Commit, error) {
+	var cfg logConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	w := &logWalker{
+		tx:       tx,
+		cfg:      &cfg,
+		commits:  make(map[Oid]*Commit),
+		trees:    make(treeCache),
+		pathKeys: make(map[Oid]string),
+		missing:  make(map[Oid]bool),
+	}
+	if err := w.load([]Oid{oid}); err != nil {
+		return nil, err
+	}
+	if cfg.order == logDefaultOrder {
+		return w.walkByDate(w.commits[oid])
+	}
+	return w.walkSorted(w.commits[oid])
+}
+
+// logWalker holds state of a Log walk.
+type logWalker struct {
+	tx      *gitTx
+	cfg     *logConfig
+	commits map[Oid]*Commit
+	trees   treeCache
+
+	// pathKeys describe modes and oids of the paths in a commit. Commits
+	// having a same key do not differ in the paths.
+	pathKeys map[Oid]string
+
+	// missing are parents not in database. They are not followed.
+	missing map[Oid]bool
+}
+
+// load reads and parses commits not loaded yet in one batch.
+func (w *logWalker) load(oids []Oid) error {
+	var missing []Oid
+	for _, oid := range oids {
+		if w.commits[oid] == nil {
+			missing = append(missing, oid)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	objs, err := readObjects(w.tx, uniqueOids(missing))
+	if err != nil {
+		return err
+	}
+
+	var loaded []*Commit
+	for _, o := range objs {
+		if o.Type != "commit" {
+			return fmt.Errorf("%s is a %s, not a commit", o.Oid, o.Type)
+		}
+		c, err := parseCommit(o.Oid, o.Body)
+		if err != nil {
+			return err
+		}
+		w.commits[o.Oid] = c
+		loaded = append(loaded, c)
+	}
+
+	if len(w.cfg.paths) == 0 {
+		return nil
+	}
+	roots := make([]Oid, len(loaded))
+	for i, c := range loaded {
+		roots[i] = c.Tree
+	}
+	modes, pathOids, err := statTrees(w.tx, w.trees, roots, w.cfg.paths)
+	if err != nil {
+		return err
+	}
+	for i, c := range loaded {
+		var key []string
+		for j := range w.cfg.paths {
+			if len(pathOids[i][j]) > 0 {
+				key = append(key, fmt.Sprintf("%d %o %s", j, modes[i][j], pathOids[i][j]))
+			}
+		}
+		w.pathKeys[c.Oid] = strings.Join(key, ",")
+	}
+	return nil
+}
+
+// loaded tests if all commits are loaded.
+func (w *logWalker) loaded(oids []Oid) bool {
+	for _, oid := range oids {
+		if w.commits[oid] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadParents reads parents of the given commits in one batch.
+func (w *logWalker) loadParents(commits []*Commit) error {
+	var oids []Oid
+	for _, c := range commits {
+		for _, p := range w.parents(c) {
+			if w.commits[p] == nil {
+				oids = append(oids, p)
+			}
+		}
+	}
+	unseen, err := unseenOids(w.tx, uniqueOids(oids))
+	if err != nil {
+		return err
+	}
+	for _, oid := range unseen {
+		w.missing[oid] = true
+	}
+	return w.load(minus(oids, unseen))
+}
+
+// parents returns parents of a commit to follow, respecting FirstParent.
+// Missing parents are skipped.
+func (w *logWalker) parents(c *Commit) []Oid {
+	parents := c.Parents
+	if w.cfg.firstParent && len(parents) > 1 {
+		parents = parents[:1]
+	}
+	if len(w.missing) == 0 {
+		return parents
+	}
+	var result []Oid
+	for _, p := range parents {
+		if !w.missing[p] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// simplify decides whether a commit is included, and which of its parents
+// to follow. Parents must be loaded.
+func (w *logWalker) simplify(c *Commit) (included bool, parents []Oid) {
+	parents = w.parents(c)
+	if len(w.cfg.paths) == 0 {
+		return true, parents
+	}
+	if len(parents) == 0 {
+		return len(w.pathKeys[c.Oid]) > 0, nil
+	}
+	for _, p := range parents {
+		if w.pathKeys[p] == w.pathKeys[c.Oid] {
+			return false, []Oid{p}
+		}
+	}
+	return true, parents
+}
+
+// walkByDate walks commits using a queue ordered by committer date.
+func (w *logWalker) walkByDate(start *Commit) ([]*Commit, error) {
+	var result []*Commit
+	seen := map[Oid]bool{start.Oid: true}
+	queue := &commitQueue{}
+	queue.push(start)
+	for queue.Len() > 0 && (w.cfg.limit <= 0 || len(result) < w.cfg.limit) {
+		c := queue.pop()
+		if !w.loaded(w.parents(c)) {
+			// Read parents of all pending commits together
+			pending := []*Commit{c}
+			for _, item := range queue.items {
+				pending = append(pending, item.commit)
+			}
+			if err := w.loadParents(pending); err != nil {
+				return nil, err
+			}
+		}
+
+		included, parents := w.simplify(c)
+		if included {
+			result = append(result, c)
+		}
+		for _, p := range parents {
+			if !seen[p] {
+				seen[p] = true
+				queue.push(w.commits[p])
+			}
+		}
+	}
+	return result, nil
+}
+
+// walkSorted reads all reachable commits, one batch per depth, then sorts
+// them topologically.
+func (w *logWalker) walkSorted(start *Commit) ([]*Commit, error) {
+	included := make(map[Oid]bool)
+	edges := make(map[Oid][]Oid)
+	indegree := make(map[Oid]int)
+	seen := map[Oid]bool{start.Oid: true}
+	for wave := []*Commit{start}; len(wave) > 0; {
+		if err := w.loadParents(wave); err != nil {
+			return nil, err
+		}
+		var next []*Commit
+		for _, c := range wave {
+			var parents []Oid
+			included[c.Oid], parents = w.simplify(c)
+			edges[c.Oid] = parents
+			for _, p := range parents {
+				indegree[p]++
+				if !seen[p] {
+					seen[p] = true
+					next = append(next, w.commits[p])
+				}
+			}
+		}
+		wave = next
+	}
+
+	// Like git, --topo-order uses a stack so the last parent is shown
+	// first, and --date-order uses a queue ordered by committer date.
+	var result []*Commit
+	var stack []*Commit
+	queue := &commitQueue{}
+	push := func(c *Commit) {
+		if w.cfg.order == logTopoOrder {
+			stack = append(stack, c)
+		} else {
+			queue.push(c)
+		}
+	}
+	push(start)
+	for len(stack) > 0 || queue.Len() > 0 {
+		var c *Commit
+		if w.cfg.order == logTopoOrder {
+			c = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+		} else {
+			c = queue.pop()
+		}
+		if included[c.Oid] {
+			result = append(result, c)
+			if w.cfg.limit > 0 && len(result) >= w.cfg.limit {
+				break
+			}
+		}
+		for _, p := range edges[c.Oid] {
+			indegree[p]--
+			if indegree[p] == 0 {
+				push(w.commits[p])
+			}
+		}
+	}
+	return result, nil
+}
+
+// commitQueue is a priority queue of commits. Commits with a newer
+// committer date come first. Commits with a same date come in insertion
+// order.
+type commitQueue struct {
+	items []commitQueueItem
+	count int
+}
+
+type commitQueueItem struct {
+	commit *Commit
+	seq    int
+}
+
+func (q *commitQueue) push(c *Commit) {
+	heap.Push(q, commitQueueItem{c, q.count})
+	q.count++
+}
+
+func (q *commitQueue) pop() *Commit {
+	return heap.Pop(q).(commitQueueItem).commit
+}
+
+func (q *commitQueue) Len() int      { return len(q.items) }
+func (q *commitQueue) Swap(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] }
+func (q *commitQueue) Less(i, j int) bool {
+	a, b := q.items[i], q.items[j]
+	if ta, tb := a.commit.Committer.When.Unix(), b.commit.Committer.When.Unix(); ta != tb {
+		return ta > tb
+	}
+	return a.seq < b.seq
+}
+func (q *commitQueue) Push(x interface{}) { q.items = append(q.items, x.(commitQueueItem)) }
+func (q *commitQueue) Pop() interface{} {
+	n := len(q.items)
+	item := q.items[n-1]
+	q.items = q.items[:n-1]
+	return item
+}
@@ -0,0 +1,141 @@
+package gitdb
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("log")
+	defer db.Close()
+
+	// Build a history with merges and commits having a same date
+	commit := func(when int64, msg string, files map[string]string, parents ...Oid) Oid {
+		b := NewCommitBuilder(parents...)
+		for path, content := range files {
+			if len(content) == 0 {
+				b.Delete(path)
+			} else {
+				b.Put(path, ModeBlob, []byte(content))
+			}
+		}
+		b.Author = Signature{Name: "Alice", Email: "alice@example.com", When: time.Unix(when, 0)}
+		b.Message = msg + "\n"
+		oid, e := b.Commit(db)
+		if e != nil {
+			t.Fatal("Commit error", e)
+		}
+		return oid
+	}
+	c1 := commit(1000, "c1", map[string]string{"a": "1", "d/x": "1"})
+	c2 := commit(1100, "c2", map[string]string{"b": "1"}, c1)
+	c3 := commit(1050, "c3", map[string]string{"a": "2"}, c1)
+	c4 := commit(1200, "c4", map[string]string{"d/y": "1"}, c2)
+	m5 := commit(1300, "m5", map[string]string{"a": "2"}, c4, c3)
+	c6 := commit(1250, "c6", map[string]string{"d/x": "2"}, c3)
+	m7 := commit(1400, "m7", map[string]string{"a": "2", "d/x": "2"}, m5, c6)
+	c8 := commit(1400, "c8", map[string]string{"b": ""}, m7)
+	c9 := commit(1400, "c9", map[string]string{"e": "1"}, c1)
+	m10 := commit(1500, "m10", map[string]string{"a": "2", "d/x": "2", "d/y": "1", "e": "1"}, c8, c9)
+
+	dir := filepath.Join(repoDir, "log")
+	os.RemoveAll(dir)
+	if _, e := Export(db, dir, m10, "HEAD"); e != nil {
+		t.Fatal("Export error", e)
+	}
+
+	check := func(dir string, oid Oid, args []string, options ...LogOption) {
+		gitArgs := append([]string{"--git-dir", filepath.Join(dir, ".git"), "log", "--format=%H", string(oid)}, args...)
+		out, e := exec.Command("git", gitArgs...).Output()
+		if e != nil {
+			t.Fatal("git log error", e)
+		}
+		expected := strings.Fields(string(out))
+		commits, e := Log(db, oid, options...)
+		if e != nil {
+			t.Fatal("Log error", e)
+		}
+		var actual []string
+		for _, c := range commits {
+			actual = append(actual, string(c.Oid))
+		}
+		if strings.Join(actual, " ") != strings.Join(expected, " ") {
+			t.Errorf("Log %v = %v, expected %v", args, actual, expected)
+		}
+	}
+	for _, c := range []struct {
+		args    []string
+		options []LogOption
+	}{
+		{nil, nil},
+		{[]string{"--topo-order"}, []LogOption{TopoOrder()}},
+		{[]string{"--date-order"}, []LogOption{DateOrder()}},
+		{[]string{"--first-parent"}, []LogOption{FirstParent()}},
+		{[]string{"--topo-order", "--first-parent"}, []LogOption{TopoOrder(), FirstParent()}},
+		{[]string{"-n", "3"}, []LogOption{Limit(3)}},
+		{[]string{"--topo-order", "-n", "4"}, []LogOption{TopoOrder(), Limit(4)}},
+		{[]string{"--", "a"}, []LogOption{Paths("a")}},
+		{[]string{"--", "b"}, []LogOption{Paths("b")}},
+		{[]string{"--", "d"}, []LogOption{Paths("d")}},
+		{[]string{"--", "d/x", "e"}, []LogOption{Paths("d/x", "e")}},
+		{[]string{"--first-parent", "--", "a"}, []LogOption{FirstParent(), Paths("a")}},
+		{[]string{"--", "missing"}, []LogOption{Paths("missing")}},
+	} {
+		check(dir, m10, c.args, c.options...)
+	}
+
+	// Commits are parsed
+	commits, e := Log(db, c8, Limit(1))
+	if e != nil {
+		t.Fatal("Log error", e)
+	}
+	c := commits[0]
+	if c.Message != "c8\n" || len(c.Parents) != 1 || c.Parents[0] != m7 || c.Author.Name != "Alice" || c.Author.Email != "alice@example.com" || c.Committer.When.Unix() != 1400 {
+		t.Errorf("Log returned unexpected commit: %+v", c)
+	}
+	if _, tree, _ := Stat(db, c8, ""); c.Tree != tree {
+		t.Errorf("Commit tree = %s, expected %s", c.Tree, tree)
+	}
+
+	// Compare with a random repo
+	dir = createRandomRepo("log-random", 40, true, true)
+	_, head, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, _, paths, e := ReadTree(db, head)
+	if e != nil || len(paths) == 0 {
+		t.Fatal("ReadTree unexpected", e, paths)
+	}
+	check(dir, head, nil)
+	check(dir, head, []string{"--topo-order"}, TopoOrder())
+	check(dir, head, []string{"--date-order"}, DateOrder())
+	check(dir, head, []string{"--", paths[0]}, Paths(paths[0]))
+
+	// Errors
+	if _, e := Log(db, c.Tree); e == nil {
+		t.Error("Log should fail on a tree")
+	}
+
+	// Parents of a shallow clone are missing in database
+	shallowDir := filepath.Join(repoDir, "log-shallow")
+	os.RemoveAll(shallowDir)
+	runGit(t, repoDir, "clone", "-q", "--depth", "3", "file://"+dir, shallowDir)
+	db = createDb("log-shallow")
+	defer db.Close()
+	if _, head, e = Import(db, shallowDir, "HEAD"); e != nil {
+		t.Fatal("Import of a shallow clone error", e)
+	}
+	check(shallowDir, head, nil)
+	check(shallowDir, head, []string{"--topo-order"}, TopoOrder())
+	check(shallowDir, head, []string{"--first-parent"}, FirstParent())
+	check(shallowDir, head, []string{"--", paths[0]}, Paths(paths[0]))
+}
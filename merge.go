@@ -0,0 +1,445 @@
+package gitdb
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+)
+
+// MergeConflict is a path that cannot be merged automatically. Base, our
+// and their fields are empty if the path does not exist on that side, or is
+// a tree.
+type MergeConflict struct {
+	Path      string
+	BaseMode  int32
+	OurMode   int32
+	TheirMode int32
+	BaseOid   Oid
+	OurOid    Oid
+	TheirOid  Oid
+}
+
+// Conflict markers written to text files that cannot be merged.
+const (
+	conflictOurs   = "<<<<<<< ours\n"
+	conflictSep    = "=======\n"
+	conflictTheirs = ">>>>>>> theirs\n"
+)
+
+// MergeTrees merges changes from base to theirs into ours, like the
+// recursive part of `git merge-tree`, but works directly in database.
+//
+// dt is either *sql.DB or *sql.Tx.
+// base, ours and theirs are git object IDs of trees, commits or annotated
+// tags. An empty oid means an empty tree. base is usually found by
+// MergeBase.
+//
+// Sub-trees changed on only one side are taken by oid without being read.
+// Text files changed on both sides are merged line by line. New blobs and
+// trees are written to database.
+//
+// A text file is not merged line by line if the diff from base to either
+// side has more than 1024 inserted and deleted lines, not counting common
+// leading and trailing lines. Like a binary file, it is a conflict.
+//
+// Returns the merged tree oid, and conflicts sorted by path. If there are
+// conflicts, text files merged line by line contain conflict markers, and
+// other conflicting paths are taken from ours if they exist there. Use
+// CommitBuilder.SetTree to commit the tree.
+func MergeTrees(dt dbOrTx, base Oid, ours Oid, theirs Oid) (Oid, []*MergeConflict, error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return "", nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	m := &treeMerger{tx: tx, trees: make(map[Oid][]*TreeEntry)}
+	var roots [3]Oid
+	for i, oid := range []Oid{base, ours, theirs} {
+		if len(oid) == 0 {
+			continue
+		}
+		tree, err := peelToTree(tx, oid)
+		if err != nil {
+			return "", nil, err
+		}
+		roots[i] = tree.Oid
+	}
+	treeOid, err := m.mergeTree(roots[0], roots[1], roots[2], "")
+	if err != nil {
+		return "", nil, err
+	}
+	if len(treeOid) == 0 {
+		treeOid = m.writeTree(nil)
+	}
+
+	// Write objects not in database
+	oids := make([]Oid, len(m.objs))
+	for i, o := range m.objs {
+		oids[i] = o.Oid
+	}
+	newOids, err := unseenOids(tx, uniqueOids(oids))
+	if err != nil {
+		return "", nil, err
+	}
+	isNew := toSet(newOids)
+	var newObjs []*gitObj
+	for _, o := range m.objs {
+		if isNew[o.Oid] {
+			newObjs = append(newObjs, o)
+			isNew[o.Oid] = false
+		}
+	}
+	for _, o := range newObjs {
+		if err := checkObject(o); err != nil {
+			return "", nil, err
+		}
+	}
+	if err = insertObjects(tx, newObjs); err != nil {
+		return "", nil, err
+	}
+
+	if txByUs {
+		if err = tx.Commit(); err != nil {
+			return "", nil, err
+		}
+	}
+	sort.Sort(mergeConflictsByPath(m.conflicts))
+	return treeOid, m.conflicts, nil
+}
+
+// treeMerger keeps states of MergeTrees.
+type treeMerger struct {
+	tx        *gitTx
+	trees     map[Oid][]*TreeEntry
+	objs      []*gitObj
+	conflicts []*MergeConflict
+}
+
+// mergeTree merges trees. Empty oids mean empty trees. Returns the merged
+// tree oid, or an empty oid if the merged tree is empty.
+func (m *treeMerger) mergeTree(base, ours, theirs Oid, prefix string) (Oid, error) {
+	switch {
+	case ours == theirs || base == theirs:
+		return ours, nil
+	case base == ours:
+		return theirs, nil
+	}
+
+	if err := readTreesInto(m.tx, m.trees, []Oid{base, ours, theirs}); err != nil {
+		return "", err
+	}
+	var entries [3]map[string]*TreeEntry
+	var names []string
+	seen := make(map[string]bool)
+	for i, oid := range []Oid{base, ours, theirs} {
+		entries[i] = make(map[string]*TreeEntry)
+		for _, ti := range m.trees[oid] {
+			if !seen[ti.Name] {
+				seen[ti.Name] = true
+				names = append(names, ti.Name)
+			}
+			entries[i][ti.Name] = ti
+		}
+	}
+	sort.Strings(names)
+
+	var items []*TreeEntry
+	for _, name := range names {
+		path := name
+		if len(prefix) > 0 {
+			path = prefix + "/" + name
+		}
+		item, err := m.mergeEntry(entries[0][name], entries[1][name], entries[2][name], path)
+		if err != nil {
+			return "", err
+		}
+		if item != nil {
+			items = append(items, &TreeEntry{Oid: item.Oid, Name: name, Mode: item.Mode})
+		}
+	}
+
+	if len(items) == 0 {
+		return "", nil
+	}
+	return m.writeTree(items), nil
+}
+
+// writeTree remembers a new tree object to write. Returns its oid.
+func (m *treeMerger) writeTree(items []*TreeEntry) Oid {
+	body := formatTree(items)
+	oid := hashObject("tree", body)
+	m.objs = append(m.objs, &gitObj{Oid: oid, Type: "tree", Body: body})
+	return oid
+}
+
+// mergeEntry merges an entry of trees. Returns the merged entry, or nil if
+// the path is deleted.
+func (m *treeMerger) mergeEntry(base, ours, theirs *TreeEntry, path string) (*TreeEntry, error) {
+	switch {
+	case sameEntry(ours, theirs) || sameEntry(base, theirs):
+		return ours, nil
+	case sameEntry(base, ours):
+		return theirs, nil
+	}
+
+	// Trees are merged recursively. A deleted tree is an empty tree.
+	isTree := func(ti *TreeEntry) bool { return ti == nil || ti.IsTree() }
+	if isTree(base) && isTree(ours) && isTree(theirs) {
+		var oids [3]Oid
+		for i, ti := range []*TreeEntry{base, ours, theirs} {
+			if ti != nil {
+				oids[i] = ti.Oid
+			}
+		}
+		oid, err := m.mergeTree(oids[0], oids[1], oids[2], path)
+		if err != nil || len(oid) == 0 {
+			return nil, err
+		}
+		return &TreeEntry{Oid: oid, Mode: ModeTree}, nil
+	}
+
+	// Regular files changed on both sides are merged by content. A file
+	// added on both sides is merged with an empty base.
+	isFile := func(ti *TreeEntry) bool { return ti != nil && (ti.Mode == ModeBlob || ti.Mode == ModeExecutable) }
+	if isFile(ours) && isFile(theirs) && (base == nil || isFile(base)) {
+		var baseOid Oid
+		var baseMode int32
+		if base != nil {
+			baseOid, baseMode = base.Oid, base.Mode
+		}
+		mode, modeOk := ours.Mode, true
+		switch {
+		case ours.Mode == theirs.Mode || baseMode == theirs.Mode:
+		case baseMode == ours.Mode:
+			mode = theirs.Mode
+		default:
+			modeOk = false
+		}
+		oid, contentOk, err := m.mergeBlob(baseOid, ours.Oid, theirs.Oid)
+		if err != nil {
+			return nil, err
+		}
+		if !modeOk || !contentOk {
+			m.conflict(base, ours, theirs, path)
+		}
+		return &TreeEntry{Oid: oid, Mode: mode}, nil
+	}
+
+	// Modify/delete, file/directory, symlinks and gitlinks are not merged
+	m.conflict(base, ours, theirs, path)
+	if ours != nil {
+		return ours, nil
+	}
+	return theirs, nil
+}
+
+// mergeBlob merges blob contents line by line. Returns the merged blob oid,
+// and whether it is merged without conflicts. An empty base oid means an
+// empty blob. Binary blobs, and blobs with too many changed lines (see
+// diffMaxCost), are not merged, and ours is returned.
+func (m *treeMerger) mergeBlob(base, ours, theirs Oid) (Oid, bool, error) {
+	switch {
+	case ours == theirs || base == theirs:
+		return ours, true, nil
+	case base == ours:
+		return theirs, true, nil
+	}
+
+	oids := []Oid{ours, theirs}
+	if len(base) > 0 {
+		oids = append(oids, base)
+	}
+	objs, err := readObjects(m.tx, oids)
+	if err != nil {
+		return "", false, err
+	}
+	var contents [3][]byte
+	for i, o := range objs {
+		contents[(i+1)%3] = o.Body
+	}
+	for _, c := range contents {
+		if isBinary(c) {
+			return ours, false, nil
+		}
+	}
+
+	baseLines := splitLines(contents[0])
+	var sides [2][]mergeHunk
+	for i := range sides {
+		hunks, ok := diffHunks(baseLines, splitLines(contents[i+1]))
+		if !ok {
+			return ours, false, nil
+		}
+		sides[i] = hunks
+	}
+	merged, ok := mergeLines(baseLines, sides)
+	oid := hashObject("blob", merged)
+	m.objs = append(m.objs, &gitObj{Oid: oid, Type: "blob", Body: merged})
+	return oid, ok, nil
+}
+
+// conflict records a conflict.
+func (m *treeMerger) conflict(base, ours, theirs *TreeEntry, path string) {
+	c := &MergeConflict{Path: path}
+	for _, s := range []struct {
+		ti   *TreeEntry
+		mode *int32
+		oid  *Oid
+	}{{base, &c.BaseMode, &c.BaseOid}, {ours, &c.OurMode, &c.OurOid}, {theirs, &c.TheirMode, &c.TheirOid}} {
+		if s.ti != nil && !s.ti.IsTree() {
+			*s.mode, *s.oid = s.ti.Mode, s.ti.Oid
+		}
+	}
+	m.conflicts = append(m.conflicts, c)
+}
+
+// sameEntry tests whether tree entries have a same oid and mode. nil means
+// the entry does not exist.
+func sameEntry(a, b *TreeEntry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Oid == b.Oid && a.Mode == b.Mode
+}
+
+// mergeHunk replaces base lines [start, end) with lines.
+type mergeHunk struct {
+	start, end int
+	lines      []string
+}
+
+// diffHunks groups a line diff from base to a side into hunks. Returns
+// false if the diff is longer than diffMaxCost. See diffLines.
+func diffHunks(base []string, side []string) ([]mergeHunk, bool) {
+	var hunks []mergeHunk
+	var h *mergeHunk
+	i := 0
+	ops, ok := diffLines(base, side)
+	for _, op := range ops {
+		if op.kind == ' ' {
+			if h != nil {
+				hunks = append(hunks, *h)
+				h = nil
+			}
+			i++
+			continue
+		}
+		if h == nil {
+			h = &mergeHunk{start: i, end: i}
+		}
+		if op.kind == '-' {
+			i++
+			h.end = i
+		} else {
+			h.lines = append(h.lines, op.line)
+		}
+	}
+	if h != nil {
+		hunks = append(hunks, *h)
+	}
+	return hunks, ok
+}
+
+// applyHunks returns lines of a side in base range [start, end), given
+// hunks of the side within the range.
+func applyHunks(base []string, hunks []mergeHunk, start, end int) []string {
+	var lines []string
+	for _, h := range hunks {
+		lines = append(lines, base[start:h.start]...)
+		lines = append(lines, h.lines...)
+		start = h.end
+	}
+	return append(lines, base[start:end]...)
+}
+
+// mergeLines does a three-way merge of lines, like diff3. sides are hunks
+// of ours and theirs from diffHunks. Changes of both sides overlapping or
+// touching each other are conflicts, unless they are the same. Conflicts are
+// written with markers. Returns the merged content, and whether there are
+// no conflicts.
+func mergeLines(base []string, sides [2][]mergeHunk) ([]byte, bool) {
+	var b bytes.Buffer
+	clean := true
+	pos := 0
+	for len(sides[0]) > 0 || len(sides[1]) > 0 {
+		// Start a region with the first hunk, then extend it with hunks
+		// overlapping or touching it, from either side.
+		first := 0
+		if len(sides[0]) == 0 || len(sides[1]) > 0 && sides[1][0].start < sides[0][0].start {
+			first = 1
+		}
+		start, end := sides[first][0].start, sides[first][0].end
+		var taken [2][]mergeHunk
+		for extended := true; extended; {
+			extended = false
+			for i := range sides {
+				for len(sides[i]) > 0 && sides[i][0].start <= end {
+					h := sides[i][0]
+					if h.end > end {
+						end = h.end
+					}
+					taken[i] = append(taken[i], h)
+					sides[i] = sides[i][1:]
+					extended = true
+				}
+			}
+		}
+
+		for _, line := range base[pos:start] {
+			b.WriteString(line)
+		}
+		ourLines := applyHunks(base, taken[0], start, end)
+		theirLines := applyHunks(base, taken[1], start, end)
+		switch {
+		case len(taken[1]) == 0:
+			writeLines(&b, ourLines, false)
+		case len(taken[0]) == 0 || equalLines(ourLines, theirLines):
+			writeLines(&b, theirLines, false)
+		default:
+			clean = false
+			b.WriteString(conflictOurs)
+			writeLines(&b, ourLines, true)
+			b.WriteString(conflictSep)
+			writeLines(&b, theirLines, true)
+			b.WriteString(conflictTheirs)
+		}
+		pos = end
+	}
+	for _, line := range base[pos:] {
+		b.WriteString(line)
+	}
+	return b.Bytes(), clean
+}
+
+// writeLines writes lines. If terminate is true, a newline is added after
+// the last line if it does not end with one, so a conflict marker can
+// follow.
+func writeLines(b *bytes.Buffer, lines []string, terminate bool) {
+	for _, line := range lines {
+		b.WriteString(line)
+	}
+	if n := len(lines); terminate && n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+		b.WriteByte('\n')
+	}
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+type mergeConflictsByPath []*MergeConflict
+
+func (s mergeConflictsByPath) Len() int           { return len(s) }
+func (s mergeConflictsByPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s mergeConflictsByPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
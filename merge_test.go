@@ -0,0 +1,194 @@
+package gitdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeLines(t *testing.T) {
+	for _, c := range []struct {
+		base, ours, theirs string
+		expected           string
+		clean              bool
+	}{
+		{"a\nb\nc\nd\ne\n", "A\nb\nc\nd\ne\n", "a\nb\nc\nd\nE\n", "A\nb\nc\nd\nE\n", true},
+		{"a\nb\nc\n", "a\nB\nc\n", "a\nB\nc\n", "a\nB\nc\n", true},
+		{"a\nb\nc\n", "a\nc\n", "a\nb\nc\nd\n", "a\nc\nd\n", true},
+		{"", "a\n", "", "a\n", true},
+		{"a\nb\nc\n", "a\nX\nc\n", "a\nY\nc\n", "a\n<<<<<<< ours\nX\n=======\nY\n>>>>>>> theirs\nc\n", false},
+		{"a\nb\nc\n", "a\nX\nc\n", "a\nb\nY\n", "a\n<<<<<<< ours\nX\nc\n=======\nb\nY\n>>>>>>> theirs\n", false},
+		{"a", "b", "c", "<<<<<<< ours\nb\n=======\nc\n>>>>>>> theirs\n", false},
+		{"a\nb", "a\nb", "x\na\nb", "x\na\nb", true},
+	} {
+		base := splitLines([]byte(c.base))
+		var sides [2][]mergeHunk
+		for i, side := range []string{c.ours, c.theirs} {
+			sides[i], _ = diffHunks(base, splitLines([]byte(side)))
+		}
+		actual, clean := mergeLines(base, sides)
+		if string(actual) != c.expected || clean != c.clean {
+			t.Errorf("mergeLines(%q, %q, %q) = %q, %v, expected %q, %v", c.base, c.ours, c.theirs, actual, clean, c.expected, c.clean)
+		}
+	}
+}
+
+func TestMergeTrees(t *testing.T) {
+	db := createDb("mergeTrees")
+	defer db.Close()
+
+	author := Signature{Name: "Alice", Email: "alice@example.com", When: time.Unix(1500000000, 0)}
+	commit := func(parent Oid, files map[string]string, deleted ...string) Oid {
+		var b *CommitBuilder
+		if len(parent) > 0 {
+			b = NewCommitBuilder(parent)
+		} else {
+			b = NewCommitBuilder()
+		}
+		for path, content := range files {
+			mode := int32(ModeBlob)
+			if strings.HasSuffix(path, ".sh") {
+				mode = ModeExecutable
+				path = strings.TrimSuffix(path, ".sh")
+			}
+			b.Put(path, mode, []byte(content))
+		}
+		for _, path := range deleted {
+			b.Delete(path)
+		}
+		b.Author = author
+		oid, e := b.Commit(db)
+		if e != nil {
+			t.Fatal("Commit error", e)
+		}
+		return oid
+	}
+
+	base := commit("", map[string]string{
+		"a.txt":       "1\n2\n3\n4\n5\n",
+		"dir/b.txt":   "b\n",
+		"dir/c":       "c\n",
+		"keep/x.txt":  "x\n",
+		"del.txt":     "d\n",
+		"conflict.md": "same\n",
+		"bin":         "\x00a",
+		"my dir/a b":  "1\n",
+	})
+	ours := commit(base, map[string]string{
+		"a.txt":       "one\n2\n3\n4\n5\n",
+		"dir/b.txt":   "B\n",
+		"del.txt":     "changed\n",
+		"conflict.md": "ours\n",
+		"bin":         "\x00b",
+		"new/ours":    "o\n",
+		"my dir/a b":  "2\n",
+	})
+	theirs := commit(base, map[string]string{
+		"a.txt":       "1\n2\n3\n4\nfive\n",
+		"dir/c.sh":    "c\n",
+		"conflict.md": "theirs\n",
+		"bin":         "\x00c",
+		"new/theirs":  "t\n",
+		"my dir/c d":  "3\n",
+	}, "del.txt")
+
+	tree, conflicts, e := MergeTrees(db, base, ours, theirs)
+	if e != nil {
+		t.Fatal("MergeTrees error", e)
+	}
+
+	// Conflicts are reported with paths and blob oids
+	var paths []string
+	for _, c := range conflicts {
+		paths = append(paths, c.Path)
+	}
+	if strings.Join(paths, ",") != "bin,conflict.md,del.txt" {
+		t.Fatalf("MergeTrees conflicts = %v", paths)
+	}
+	_, ourDel, _ := Stat(db, ours, "del.txt")
+	_, baseDel, _ := Stat(db, base, "del.txt")
+	if c := conflicts[2]; c.OurOid != ourDel || c.BaseOid != baseDel || len(c.TheirOid) != 0 || c.TheirMode != 0 {
+		t.Errorf("modify/delete conflict = %+v", c)
+	}
+
+	for path, expected := range map[string]string{
+		"a.txt":       "one\n2\n3\n4\nfive\n",
+		"dir/b.txt":   "B\n",
+		"dir/c":       "c\n",
+		"del.txt":     "changed\n",
+		"conflict.md": "<<<<<<< ours\nours\n=======\ntheirs\n>>>>>>> theirs\n",
+		"bin":         "\x00b",
+		"new/ours":    "o\n",
+		"new/theirs":  "t\n",
+		"my dir/a b":  "2\n",
+		"my dir/c d":  "3\n",
+	} {
+		_, _, content, e := ReadPath(db, tree, path)
+		if e != nil || string(content) != expected {
+			t.Errorf("ReadPath(%s) = %q, %v, expected %q", path, content, e, expected)
+		}
+	}
+	if mode, _, _ := Stat(db, tree, "my dir"); mode != ModeTree {
+		t.Errorf("mode of my dir = %o, expected tree", mode)
+	}
+	if mode, _, _ := Stat(db, tree, "dir/c"); mode != ModeExecutable {
+		t.Errorf("mode of dir/c = %o, expected executable", mode)
+	}
+
+	// Unchanged sub-trees are taken by oid
+	_, baseKeep, _ := Stat(db, base, "keep")
+	if _, keep, _ := Stat(db, tree, "keep"); keep != baseKeep {
+		t.Errorf("keep = %s, expected %s", keep, baseKeep)
+	}
+
+	// Trivial merges
+	_, ourTree, _ := Stat(db, ours, "")
+	for _, c := range [][3]Oid{{base, ours, base}, {base, base, ours}, {base, ours, ours}} {
+		if tree, conflicts, e := MergeTrees(db, c[0], c[1], c[2]); tree != ourTree || len(conflicts) != 0 || e != nil {
+			t.Errorf("MergeTrees(%v) = %s, %v, %v, expected %s", c, tree, conflicts, e, ourTree)
+		}
+	}
+	if tree, _, e := MergeTrees(db, base, "", ""); e != nil || tree != hashObject("tree", nil) {
+		t.Errorf("MergeTrees of empty trees = %s, %v", tree, e)
+	}
+
+	// Files with too many changed lines are conflicts without markers
+	var lines, rewritten []string
+	for i := 0; i < diffMaxCost; i++ {
+		lines = append(lines, fmt.Sprintf("%d\n", i))
+		rewritten = append(rewritten, fmt.Sprintf("line %d\n", i))
+	}
+	big := commit("", map[string]string{"big.txt": strings.Join(lines, "")})
+	rewrite := commit(big, map[string]string{"big.txt": strings.Join(rewritten, "")})
+	lines[1] = "one\n"
+	small := commit(big, map[string]string{"big.txt": strings.Join(lines, "")})
+	_, ourBig, _ := Stat(db, rewrite, "big.txt")
+	_, theirBig, _ := Stat(db, small, "big.txt")
+	tree2, conflicts, e := MergeTrees(db, big, rewrite, small)
+	if e != nil || len(conflicts) != 1 || conflicts[0].OurOid != ourBig || conflicts[0].TheirOid != theirBig {
+		t.Errorf("MergeTrees of a rewritten file = %v, %v", conflicts, e)
+	}
+	if _, oid, _ := Stat(db, tree2, "big.txt"); oid != ourBig {
+		t.Errorf("big.txt = %s, expected ours %s", oid, ourBig)
+	}
+
+	// The merged tree can be committed
+	b := NewCommitBuilder(ours, theirs)
+	b.SetTree(tree)
+	b.Put("conflict.md", ModeBlob, []byte("resolved\n"))
+	b.Author = author
+	merge, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	if _, _, content, _ := ReadPath(db, merge, "conflict.md"); string(content) != "resolved\n" {
+		t.Errorf("conflict.md = %q after resolving", content)
+	}
+	if _, _, content, _ := ReadPath(db, merge, "new/theirs"); string(content) != "t\n" {
+		t.Errorf("new/theirs = %q in the merge commit", content)
+	}
+	if bases, e := MergeBase(db, merge, theirs); e != nil || len(bases) != 1 || bases[0] != theirs {
+		t.Errorf("MergeBase(merge, theirs) = %v, %v", bases, e)
+	}
+}
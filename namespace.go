@@ -0,0 +1,308 @@
+package gitdb
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const memberTable = "gitrepo_objects"
+
+// createMemberTable creates the table recording which repos own which
+// objects. It is a migration step.
+func createMemberTable(db *sql.DB) (sql.Result, error) {
+	return db.Exec("CREATE TABLE IF NOT EXISTS " + memberTable + " (" +
+		// repo is the application defined repo name. See Repo.
+		"repo VARCHAR(255) NOT NULL," +
+		"oid CHAR(40) NOT NULL," +
+		"PRIMARY KEY (repo, oid)," +
+		// The unique constraint is an index for finding owners of an
+		// object.
+		"UNIQUE (oid, repo))")
+}
+
+// Repo is a namespace of objects in database, so multiple repos (tenants)
+// can share the git objects table safely. Objects are still stored once,
+// while each repo records which objects it owns. Repo.GC only deletes
+// objects not owned by other repos.
+//
+// A repo owns objects written by Repo.Import and Repo.Add, and everything
+// reachable from them. Other methods refuse to read objects the repo does
+// not own.
+//
+// ID is also the repo name used by UpdateRef, ListRefs and ResolveRef. It
+// is at most 255 bytes.
+//
+// Objects written by Import, CommitBuilder, or before the namespace was
+// introduced, are owned by no repo until Repo.Add is called.
+type Repo struct {
+	ID string
+}
+
+// Import is like Import but also makes the repo own the imported objects.
+// Returned oids are objects new to the repo. They might exist in database
+// before if other repos own them.
+func (r *Repo) Import(dt dbOrTx, path string, ref string, options ...ImportOption) (oids []Oid, refOid Oid, err error) {
+	options = append([]ImportOption{func(c *importConfig) { c.repo = r }}, options...)
+	return Import(dt, path, ref, options...)
+}
+
+// Export is like Export but fails with a missing object error if oid is not
+// owned by the repo.
+func (r *Repo) Export(dt dbOrTx, path string, oid Oid, ref string, options ...ExportOption) ([]Oid, error) {
+	options = append([]ExportOption{func(c *exportConfig) { c.repo = r }}, options...)
+	return Export(dt, path, oid, ref, options...)
+}
+
+// ReadTree is like ReadTree but fails with a missing object error if oid is
+// not owned by the repo. With the RecurseSubmodules option, only submodules
+// owned by the repo are read.
+func (r *Repo) ReadTree(dt dbOrTx, oid Oid, options ...ReadTreeOption) (modes []int32, oids []Oid, paths []string, err error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+	if err := r.checkOwned(tx, []Oid{oid}); err != nil {
+		return nil, nil, nil, err
+	}
+	options = append([]ReadTreeOption{func(c *readTreeConfig) { c.repo = r }}, options...)
+	return ReadTree(tx, oid, options...)
+}
+
+// Add makes the repo own objects already in database, and everything
+// reachable from them. It is useful for commits created by CommitBuilder,
+// or objects written before the namespace was introduced.
+//
+// dt is either *sql.DB or *sql.Tx.
+func (r *Repo) Add(dt dbOrTx, oids []Oid) error {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	missing, err := unseenOids(tx, oids)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return errDbMissingObject(missing[0])
+	}
+	// Reachable objects of an owned object are owned too. Therefore the
+	// walk stops at owned objects.
+	visited := toSet(oids)
+	for curr := uniqueOids(oids); len(curr) > 0; {
+		curr, err = r.unowned(tx, curr)
+		if err != nil {
+			return err
+		}
+		if err := r.own(tx, curr); err != nil {
+			return err
+		}
+		next := make([]Oid, 0)
+		err = queryByOids(tx, "referred", curr, func(scan rowScanFunc) error {
+			var referred string
+			if err := scan(&referred); err != nil {
+				return err
+			}
+			for _, v := range strings.Split(referred, ",") {
+				if o := Oid(v); len(v) > 0 && !visited[o] {
+					visited[o] = true
+					next = append(next, o)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Objects missing in database, like parents of a shallow history,
+		// are not owned. They are owned once written by Repo.Import.
+		missing, err := unseenOids(tx, next)
+		if err != nil {
+			return err
+		}
+		curr = minus(next, missing)
+	}
+
+	if txByUs {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// GC makes the repo stop owning objects except for oids, refs of the repo
+// (see UpdateRef), and objects reachable from them. Objects no longer owned
+// by any repo are deleted from database. Objects owned by other repos, or by
+// no repo, are not deleted.
+//
+// dt is either *sql.DB or *sql.Tx. Like GC, with *sql.DB, objects owned by
+// the repo are swept in batches, each in its own transaction. GracePeriod,
+// BatchSize, DryRun and ReportProgress work like GC. Deleted in GCProgress
+// is the number of objects the repo no longer owns.
+//
+// Returns git object IDs the repo no longer owns.
+func (r *Repo) GC(dt dbOrTx, oids []Oid, options ...GCOption) ([]Oid, error) {
+	cfg, cutoff := newGCConfig(options)
+	_, refOids, err := ListRefs(dt, r.ID)
+	if err != nil {
+		return nil, err
+	}
+	m, err := markOids(dt, uniqueOids(append(oids, refOids...)), cutoff)
+	if err != nil {
+		return nil, err
+	}
+	return sweep(dt, &cfg, m, cutoff, func(tx *gitTx, after Oid) ([]Oid, []Oid, error) {
+		scanned, err := r.ownedAfter(tx, after, cfg.batchSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		disowned := make([]Oid, 0)
+		for _, oid := range scanned {
+			if m.unmarked(oid) {
+				disowned = append(disowned, oid)
+			}
+		}
+		if cfg.dryRun || len(disowned) == 0 {
+			return scanned, disowned, nil
+		}
+
+		batchSize := tx.dialect.MaxParams() - 1
+		for i := 0; i < len(disowned); i += batchSize {
+			j := min(i+batchSize, len(disowned))
+			args := append([]interface{}{r.ID}, toInterfaces(disowned[i:j])...)
+			_, err := tx.Exec(tx.rebind("DELETE FROM "+memberTable+" WHERE repo = ? AND oid IN ("+params(j-i)+")"), args...)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		// Objects owned by other repos are kept
+		ownedByOthers, err := ownedOids(tx, disowned)
+		if err != nil {
+			return nil, nil, err
+		}
+		_, err = deleteObjects(tx, minus(disowned, ownedByOthers), cutoff)
+		return scanned, disowned, err
+	})
+}
+
+// ownedAfter returns at most n oids owned by the repo, after the given oid,
+// in order.
+func (r *Repo) ownedAfter(tx *gitTx, after Oid, n int) ([]Oid, error) {
+	query := "SELECT oid FROM " + memberTable + " WHERE repo = ? AND oid > ? ORDER BY oid LIMIT " + strconv.Itoa(n)
+	rows, err := tx.Query(tx.rebind(query), r.ID, string(after))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]Oid, 0)
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		result = append(result, Oid(s))
+	}
+	return result, rows.Err()
+}
+
+// unowned removes oids owned by the repo.
+func (r *Repo) unowned(tx *gitTx, oids []Oid) ([]Oid, error) {
+	owned := make([]Oid, 0)
+	batchSize := tx.dialect.MaxParams() - 1
+	for i := 0; i < len(oids); i += batchSize {
+		j := min(i+batchSize, len(oids))
+		args := append([]interface{}{r.ID}, toInterfaces(oids[i:j])...)
+		rows, err := tx.Query(tx.rebind("SELECT oid FROM "+memberTable+" WHERE repo = ? AND oid IN ("+params(j-i)+")"), args...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			owned = append(owned, Oid(s))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return minus(oids, owned), nil
+}
+
+// checkOwned returns a missing object error if any of oids is not owned by
+// the repo. Objects of other repos are indistinguishable from missing ones.
+func (r *Repo) checkOwned(tx *gitTx, oids []Oid) error {
+	unowned, err := r.unowned(tx, oids)
+	if err != nil {
+		return err
+	}
+	if len(unowned) > 0 {
+		return errDbMissingObject(unowned[0])
+	}
+	return nil
+}
+
+// own makes the repo own oids. The objects must exist in database.
+func (r *Repo) own(tx *gitTx, oids []Oid) error {
+	if len(oids) == 0 {
+		return nil
+	}
+	if err := checkRepoID(r.ID); err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(tx.rebind(tx.dialect.InsertIgnore(memberTable, []string{"repo", "oid"})))
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, oid := range oids {
+		if _, err := stmt.Exec(r.ID, string(oid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkRepoID returns an error if a repo ID does not fit in the database.
+func checkRepoID(id string) error {
+	if len(id) > maxNameLength {
+		return fmt.Errorf("repo ID is longer than %d bytes: %s", maxNameLength, id)
+	}
+	return nil
+}
+
+// ownedOids returns oids owned by any repo.
+func ownedOids(tx *gitTx, oids []Oid) ([]Oid, error) {
+	result := make([]Oid, 0)
+	batchSize := tx.dialect.MaxParams()
+	for i := 0; i < len(oids); i += batchSize {
+		j := min(i+batchSize, len(oids))
+		rows, err := tx.Query(tx.rebind("SELECT DISTINCT oid FROM "+memberTable+" WHERE oid IN ("+params(j-i)+")"), toInterfaces(oids[i:j])...)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var s string
+			if err := rows.Scan(&s); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			result = append(result, Oid(s))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
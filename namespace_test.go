@@ -0,0 +1,165 @@
+package gitdb
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepoNamespace(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("namespace")
+	defer db.Close()
+
+	a, b, c := &Repo{ID: "a"}, &Repo{ID: "b"}, &Repo{ID: "c"}
+	dir := createRandomRepo("ns", 10, true, true)
+	oidsA, head, e := a.Import(db, dir, "HEAD")
+	if e != nil || len(oidsA) == 0 {
+		t.Fatal("Import error", e)
+	}
+	n := countObjects(db)
+
+	// Objects are shared, but new to the repo
+	oidsB, _, e := b.Import(db, dir, "HEAD")
+	if e != nil || len(oidsB) != len(oidsA) {
+		t.Fatal("Import should return objects new to the repo", len(oidsB), len(oidsA), e)
+	}
+	if countObjects(db) != n {
+		t.Error("Import should not write existing objects")
+	}
+	if oids, _, e := b.Import(db, dir, "HEAD"); e != nil || len(oids) != 0 {
+		t.Error("Import should skip objects owned by the repo", oids, e)
+	}
+
+	// Objects of other repos are not visible
+	if _, _, _, e := a.ReadTree(db, head); e != nil {
+		t.Error("ReadTree error", e)
+	}
+	if _, _, _, e := c.ReadTree(db, head); e == nil {
+		t.Error("ReadTree should fail for objects of other repos")
+	}
+	dir2 := filepath.Join(repoDir, "ns-export")
+	os.RemoveAll(dir2)
+	if _, e := c.Export(db, dir2, head, "HEAD"); e == nil {
+		t.Error("Export should fail for objects of other repos")
+	}
+	if _, e := a.Export(db, dir2, head, "HEAD"); e != nil {
+		t.Error("Export error", e)
+	}
+
+	// Add makes a repo own existing objects
+	if e := c.Add(db, []Oid{head}); e != nil {
+		t.Fatal("Add error", e)
+	}
+	if _, _, _, e := c.ReadTree(db, head); e != nil {
+		t.Error("ReadTree error after Add", e)
+	}
+
+	// GC without a repo keeps objects owned by repos
+	if oids, e := GC(db, nil); e != nil || len(oids) != 0 || countObjects(db) != n {
+		t.Error("GC should keep objects owned by repos", oids, e)
+	}
+
+	// GC of a repo keeps recent objects, and supports dry runs
+	if oids, e := a.GC(db, nil, GracePeriod(time.Hour)); e != nil || len(oids) != 0 {
+		t.Error("GC should keep recent objects", oids, e)
+	}
+	if oids, e := a.GC(db, nil, DryRun()); e != nil || len(oids) != len(oidsA) {
+		t.Error("GC dry run unexpected", len(oids), e)
+	}
+	if _, _, _, e := a.ReadTree(db, head); e != nil {
+		t.Error("GC dry run should not disown objects", e)
+	}
+
+	// GC of a repo does not delete objects owned by others
+	gc := func(r *Repo) []Oid {
+		oids, e := r.GC(db, nil, BatchSize(3))
+		if e != nil {
+			t.Fatal("GC error", e)
+		}
+		return oids
+	}
+	if oids := gc(a); len(oids) != len(oidsA) {
+		t.Error("GC should disown all objects", len(oids), len(oidsA))
+	}
+	if countObjects(db) != n {
+		t.Error("GC should keep objects owned by other repos")
+	}
+	if _, _, _, e := a.ReadTree(db, head); e == nil {
+		t.Error("ReadTree should fail after GC")
+	}
+
+	// Refs of a repo are kept by GC
+	if e := UpdateRef(db, b.ID, "HEAD", "", head); e != nil {
+		t.Fatal("UpdateRef error", e)
+	}
+	if oids := gc(b); len(oids) != 0 {
+		t.Error("GC should keep objects reachable from refs", oids)
+	}
+	if e := UpdateRef(db, b.ID, "HEAD", head, ""); e != nil {
+		t.Fatal("UpdateRef error", e)
+	}
+	gc(b)
+	gc(c)
+	if m := countObjects(db); m != 0 {
+		t.Errorf("GC should delete objects owned by no repo, %d left", m)
+	}
+}
+
+func TestRepoAddShallow(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("namespaceShallow")
+	defer db.Close()
+
+	r := &Repo{ID: "a"}
+	dir := createRandomRepo("ns-shallow", 20, true, true)
+	shallowDir := filepath.Join(repoDir, "ns-shallow-clone")
+	os.RemoveAll(shallowDir)
+	runGit(t, repoDir, "clone", "-q", "--depth", "3", "file://"+dir, shallowDir)
+	_, head, e := Import(db, shallowDir, "HEAD")
+	if e != nil {
+		t.Fatal("Import of a shallow clone error", e)
+	}
+	if e := r.Add(db, []Oid{head}); e != nil {
+		t.Fatal("Add error", e)
+	}
+
+	// Missing parents are not owned
+	tx := beginTx(db)
+	owned, e := r.ownedAfter(tx, "", countObjects(db)+1)
+	tx.Rollback()
+	if e != nil || len(owned) != countObjects(db) {
+		t.Errorf("Add should own existing objects only, owned %d of %d, %v", len(owned), countObjects(db), e)
+	}
+
+	// Deepening writes and owns the missing history, which is kept by GC
+	if _, _, e := r.Import(db, dir, "HEAD"); e != nil {
+		t.Fatal("Import error", e)
+	}
+	if e := UpdateRef(db, r.ID, "HEAD", "", head); e != nil {
+		t.Fatal("UpdateRef error", e)
+	}
+	if oids, e := r.GC(db, nil); e != nil || len(oids) != 0 {
+		t.Error("GC should keep objects reachable from refs", oids, e)
+	}
+	expected := strings.Split(runGit(t, dir, "rev-list", "--objects", "HEAD"), "\n")
+	if n := countObjects(db); n != len(expected) {
+		t.Errorf("GC should keep the deepened history, %d objects left, expected %d", n, len(expected))
+	}
+	dir2 := filepath.Join(repoDir, "ns-shallow-export")
+	os.RemoveAll(dir2)
+	if _, e := r.Export(db, dir2, head, "HEAD"); e != nil {
+		t.Error("Export error", e)
+	}
+	if n := len(strings.Split(runGit(t, dir2, "rev-list", "--objects", "HEAD"), "\n")); n != len(expected) {
+		t.Errorf("Export should write the deepened history, %d objects, expected %d", n, len(expected))
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"regexp"
+	"strings"
 )
 
 // Oid is a 40-char sha1sum in hex form, used as the ID of a git object.
@@ -20,6 +21,37 @@ type gitObj struct {
 	Body []byte
 }
 
+// Object is a parsed git object: *Blob, *Tree, *Commit or *Tag.
+type Object interface {
+	// Type returns the git object type: "blob", "tree", "commit" or "tag".
+	Type() string
+	// Bytes serializes the object into its canonical git object body.
+	Bytes() []byte
+}
+
+// Blob is a git blob object.
+type Blob struct {
+	Oid  Oid
+	Data []byte
+}
+
+// Type returns "blob".
+func (b *Blob) Type() string {
+	return "blob"
+}
+
+// Bytes returns the content of the blob.
+func (b *Blob) Bytes() []byte {
+	return b.Data
+}
+
+// Header is a header of a commit or tag object. Value of a multi-line
+// header, like "gpgsig" or "mergetag", contains "\n".
+type Header struct {
+	Key   string
+	Value string
+}
+
 var oidRegex *regexp.Regexp = regexp.MustCompile("^[0-9a-f]{40}$")
 
 // IsValid tests whether o is valid by checking whether it is 40-char sha1sum.
@@ -30,28 +62,39 @@ func (o Oid) IsValid() bool {
 // referredOids returns oids the git object depends on.
 // For blob object, returns empty array.
 // For commit object, returns tree oid, followed by parent oids.
-// For tree object, returns tree and blob oids referred directly.
+// For tree object, returns tree and blob oids referred directly, excluding
+// gitlinks.
+// For tag object, returns the tagged object oid.
 // For other (unsupported) objects, returns empty array.
 func (o *gitObj) referredOids() []Oid {
 	var oids []Oid
 	switch o.Type {
 	case "tree":
-		// mode + " " + name + "\0" + binOid (20 bytes)
-		for i := 0; i < len(o.Body)-20; i++ {
-			if o.Body[i] == 0 {
-				oids = append(oids, Oid(hex.EncodeToString(o.Body[i+1:i+21])))
-				i += 20
+		// gitlinks are skipped since the commits usually belong to other
+		// repos and are not stored along with the tree.
+		for _, ti := range parseTree(o.Body) {
+			if !ti.IsGitlink() {
+				oids = append(oids, ti.Oid)
 			}
 		}
 	case "commit":
 		// first line: "tree " + oid + "\n"
 		// followed by 0 or more: "parent " + oid + "\n"
-		for i := len("tree "); i < len(o.Body); i += len("parent \n") + 40 {
-			oid := Oid(o.Body[i : i+40])
+		body, prefix := o.Body, "tree "
+		for len(body) > len(prefix)+40 && string(body[:len(prefix)]) == prefix && body[len(prefix)+40] == '\n' {
+			oid := Oid(body[len(prefix) : len(prefix)+40])
+			if !oid.IsValid() {
+				break
+			}
+			oids = append(oids, oid)
+			body, prefix = body[len(prefix)+41:], "parent "
+		}
+	case "tag":
+		// first line: "object " + oid + "\n"
+		if len(o.Body) >= len("object ")+40 && bytes.HasPrefix(o.Body, []byte("object ")) {
+			oid := Oid(o.Body[len("object ") : len("object ")+40])
 			if oid.IsValid() {
 				oids = append(oids, oid)
-			} else {
-				break
 			}
 		}
 	case "blob":
@@ -60,6 +103,112 @@ func (o *gitObj) referredOids() []Oid {
 	return oids
 }
 
+// checkObject checks whether a commit, tree or tag object is well formed,
+// so objects from untrusted sources, like `git push`, can be written to
+// database. Other code assumes commits have trees, for example.
+func checkObject(o *gitObj) error {
+	switch o.Type {
+	case "blob":
+		return nil
+	case "tree":
+		return checkTree(o.Oid, o.Body)
+	case "commit":
+		c, err := parseCommit(o.Oid, o.Body)
+		if err != nil {
+			return err
+		}
+		// referredOids only reads the leading tree and parent lines
+		referred := o.referredOids()
+		if len(referred) != len(c.Parents)+1 || referred[0] != c.Tree {
+			return fmt.Errorf("commit %s is illformed: tree and parents must come first", o.Oid)
+		}
+		return nil
+	case "tag":
+		t, err := parseTag(o.Oid, o.Body)
+		if err != nil {
+			return err
+		}
+		if referred := o.referredOids(); len(referred) != 1 || referred[0] != t.Object {
+			return fmt.Errorf("tag %s is illformed: object must come first", o.Oid)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s has unsupported type %s", o.Oid, o.Type)
+}
+
+// parseObject parses a gitObj into a typed Object.
+func parseObject(o *gitObj) (Object, error) {
+	switch o.Type {
+	case "blob":
+		return &Blob{Oid: o.Oid, Data: o.Body}, nil
+	case "tree":
+		return &Tree{Oid: o.Oid, Entries: parseTree(o.Body)}, nil
+	case "commit":
+		return parseCommit(o.Oid, o.Body)
+	case "tag":
+		return parseTag(o.Oid, o.Body)
+	}
+	return nil, fmt.Errorf("%s has unsupported type %s", o.Oid, o.Type)
+}
+
+// parseHeaders parses headers and the message of a commit or tag object.
+// Lines starting with a space continue the value of the previous header.
+// Headers end at an empty line, followed by the message. noSeparator is
+// true if there is no empty line, which git accepts for objects without
+// messages.
+func parseHeaders(body []byte) (headers []Header, message string, noSeparator bool, err error) {
+	text := string(body)
+	for len(text) > 0 {
+		i := strings.IndexByte(text, '\n')
+		if i < 0 {
+			return nil, "", false, fmt.Errorf("header does not end with newline")
+		}
+		line := text[:i]
+		text = text[i+1:]
+		switch {
+		case len(line) == 0:
+			return headers, text, false, nil
+		case line[0] == ' ':
+			if len(headers) == 0 {
+				return nil, "", false, fmt.Errorf("unexpected continuation line")
+			}
+			headers[len(headers)-1].Value += "\n" + line[1:]
+		default:
+			space := strings.IndexByte(line, ' ')
+			if space <= 0 {
+				return nil, "", false, fmt.Errorf("illformed header: %q", line)
+			}
+			headers = append(headers, Header{line[:space], line[space+1:]})
+		}
+	}
+	return headers, "", true, nil
+}
+
+// formatHeaders is the reverse of parseHeaders.
+func formatHeaders(headers []Header, message string, noSeparator bool) []byte {
+	var b bytes.Buffer
+	for _, h := range headers {
+		b.WriteString(h.Key)
+		b.WriteByte(' ')
+		b.WriteString(strings.Replace(h.Value, "\n", "\n ", -1))
+		b.WriteByte('\n')
+	}
+	if !noSeparator || len(message) > 0 {
+		b.WriteByte('\n')
+	}
+	b.WriteString(message)
+	return b.Bytes()
+}
+
+// hashObject calculates the git object ID of an object from its type and
+// body. It is like `git hash-object -t typ`.
+func hashObject(typ string, body []byte) Oid {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", typ, len(body))
+	h.Write(body)
+	return Oid(hex.EncodeToString(h.Sum(nil)))
+}
+
 // zcontent returns zlib compressed git object header + body.
 func (o *gitObj) zcontent() []byte {
 	var b bytes.Buffer
@@ -79,15 +228,23 @@ func (e errInvalidZcontent) Error() string {
 // newGitObjFromZcontent constructs a new gitObj using zcontent.
 // zcontent has the same format as the file of a unpacked git object.
 func newGitObjFromZcontent(zcontent []byte) (*gitObj, error) {
+	return newGitObjFromZreader(bytes.NewReader(zcontent))
+}
+
+// newGitObjFromZreader is like newGitObjFromZcontent, but reads zcontent
+// from a reader.
+func newGitObjFromZreader(zcontent io.Reader) (*gitObj, error) {
 	// Uncompress
-	r, err := zlib.NewReader(bytes.NewReader(zcontent))
+	r, err := zlib.NewReader(zcontent)
 	if err != nil {
 		return nil, err
 	}
 	defer r.Close()
 
 	var out bytes.Buffer
-	io.Copy(&out, r)
+	if _, err := io.Copy(&out, r); err != nil {
+		return nil, err
+	}
 	b := out.Bytes()
 
 	// Find header delimiter
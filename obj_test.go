@@ -2,6 +2,7 @@ package gitdb
 
 import (
 	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -44,6 +45,17 @@ func TestReferredOids(t *testing.T) {
 		t.Errorf("ReferredOids for tree object is incorrect")
 	}
 
+	// tree with a gitlink
+	obj = gitObj{
+		Type: "tree",
+		Body: []byte("160000 m\x00\x01\x00\x02\x00\x03\x00\x04\x00\x05\x00\x06\x00\x07\x00\x08\x00\x09\x00\x00\x00" +
+			"40000 t\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xf1"),
+	}
+	referredOids = obj.referredOids()
+	if joinOids(referredOids, ",") != "00000000000000000000000000000000000000f1" {
+		t.Errorf("ReferredOids for tree object with gitlinks is incorrect")
+	}
+
 	// commit
 	oids := []Oid{
 		"d318a662507e9592830be3a3cbbb2f670b6ce7a5",
@@ -67,6 +79,30 @@ func TestReferredOids(t *testing.T) {
 		t.Errorf("ReferredOids for commit object is incorrect")
 	}
 
+	// tag
+	obj = gitObj{
+		Type: "tag",
+		Body: []byte("" +
+			"object " + oids[1] + "\n" +
+			"type commit\n" +
+			"tag v1.0\n" +
+			"tagger Foo <a@example.com> 1433758557 +0800\n" +
+			"\n" +
+			"Release 1.0\n"),
+	}
+	referredOids = obj.referredOids()
+	if len(referredOids) != 1 || referredOids[0] != oids[1] {
+		t.Errorf("ReferredOids for tag object is incorrect")
+	}
+
+	// truncated commits
+	for _, body := range []string{"tree ", "tree " + string(oids[0]), "tree " + string(oids[0]) + "\nparent " + string(oids[1][:20]), "author Foo\n"} {
+		obj = gitObj{Type: "commit", Body: []byte(body)}
+		if referredOids = obj.referredOids(); len(referredOids) > 1 || (len(referredOids) == 1 && referredOids[0] != oids[0]) {
+			t.Errorf("ReferredOids for commit %q is incorrect: %v", body, referredOids)
+		}
+	}
+
 	// other
 	obj = gitObj{Type: "unknown"}
 	referredOids = obj.referredOids()
@@ -92,3 +128,226 @@ func TestZcontent(t *testing.T) {
 		t.Errorf("Git object differs after encoding to zcontent and decoding: %v %v", obj, obj2)
 	}
 }
+
+func TestParseObject(t *testing.T) {
+	oids := []Oid{
+		"d318a662507e9592830be3a3cbbb2f670b6ce7a5",
+		"7b9fe328531202c2f5c2906b21b3a2677a799c40",
+		"0702d34643a8b644846748a00c425ef76a4634d3",
+	}
+
+	// Signed merge commit with extra headers
+	body := []byte("" +
+		"tree " + oids[0] + "\n" +
+		"parent " + oids[1] + "\n" +
+		"parent " + oids[2] + "\n" +
+		"author Foo <a@example.com> 1433758557 +0800\n" +
+		"committer Foo Wu <a@example.com> 1433758557 -0000\n" +
+		"encoding ISO-8859-1\n" +
+		"mergetag object " + oids[2] + "\n" +
+		" type commit\n" +
+		" tag v1.0\n" +
+		" \n" +
+		" Release 1.0\n" +
+		"gpgsig -----BEGIN PGP SIGNATURE-----\n" +
+		" \n" +
+		" iQEzBAABCAAdFiEE\n" +
+		" -----END PGP SIGNATURE-----\n" +
+		"\n" +
+		"Merge branch 'bbb' into aaa\n")
+	obj, err := parseObject(&gitObj{Oid: oids[0], Type: "commit", Body: body})
+	if err != nil {
+		t.Fatal("parseObject error", err)
+	}
+	c, ok := obj.(*Commit)
+	if !ok || c.Tree != oids[0] || len(c.Parents) != 2 || c.Parents[1] != oids[2] {
+		t.Fatalf("parseObject returned unexpected commit: %+v", obj)
+	}
+	if c.Author.Name != "Foo" || c.Author.Email != "a@example.com" || c.Author.When.Unix() != 1433758557 {
+		t.Errorf("Author is incorrect: %+v", c.Author)
+	}
+	if _, offset := c.Author.When.Zone(); offset != 8*3600 {
+		t.Errorf("Author timezone offset is %d, expected %d", offset, 8*3600)
+	}
+	if c.Encoding != "ISO-8859-1" || c.Gpgsig != "-----BEGIN PGP SIGNATURE-----\n\niQEzBAABCAAdFiEE\n-----END PGP SIGNATURE-----" {
+		t.Errorf("Encoding or Gpgsig is incorrect: %q %q", c.Encoding, c.Gpgsig)
+	}
+	if len(c.ExtraHeaders) != 1 || c.ExtraHeaders[0].Key != "mergetag" || c.ExtraHeaders[0].Value != "object "+string(oids[2])+"\ntype commit\ntag v1.0\n\nRelease 1.0" {
+		t.Errorf("ExtraHeaders is incorrect: %q", c.ExtraHeaders)
+	}
+	if c.Message != "Merge branch 'bbb' into aaa\n" {
+		t.Errorf("Message is incorrect: %q", c.Message)
+	}
+	if !bytes.Equal(c.Bytes(), body) {
+		t.Errorf("Commit.Bytes() = %q, expected %q", c.Bytes(), body)
+	}
+
+	// Tag without tagger
+	body = []byte("" +
+		"object " + oids[1] + "\n" +
+		"type commit\n" +
+		"tag v0.1\n" +
+		"\n" +
+		"Old tag\n")
+	obj, err = parseObject(&gitObj{Oid: oids[0], Type: "tag", Body: body})
+	if err != nil {
+		t.Fatal("parseObject error", err)
+	}
+	tag, ok := obj.(*Tag)
+	if !ok || tag.Object != oids[1] || tag.ObjectType != "commit" || tag.Name != "v0.1" || tag.Tagger != nil || tag.Message != "Old tag\n" {
+		t.Errorf("parseObject returned unexpected tag: %+v", obj)
+	}
+	if !bytes.Equal(tag.Bytes(), body) {
+		t.Errorf("Tag.Bytes() = %q, expected %q", tag.Bytes(), body)
+	}
+
+	// Illformed objects
+	for _, o := range []*gitObj{
+		{Type: "commit", Body: []byte("parent " + oids[1] + "\n\n")},
+		{Type: "commit", Body: []byte(" tree " + oids[0] + "\n\n")},
+		{Type: "tag", Body: []byte("type commit\n\n")},
+		{Type: "unknown"},
+	} {
+		if _, err := parseObject(o); err == nil {
+			t.Errorf("parseObject(%q) should fail", o.Body)
+		}
+	}
+}
+
+func TestParseOddObjects(t *testing.T) {
+	db := createDb("oddObjects")
+	defer db.Close()
+
+	// Objects git accepts, though some fail `git fsck`
+	tree := &gitObj{Type: "tree", Body: formatTree([]*TreeEntry{
+		{Oid: hashObject("blob", nil), Name: "my file.txt", Mode: ModeBlob},
+		{Oid: hashObject("tree", nil), Name: "my dir", Mode: ModeTree},
+	})}
+	tree.Oid = hashObject("tree", tree.Body)
+	objs := []*gitObj{tree, {Oid: hashObject("tree", nil), Type: "tree"}, {Oid: hashObject("blob", nil), Type: "blob"}}
+	var head Oid
+	nCommits := 0
+	for _, body := range []string{
+		// No empty line after headers
+		"tree " + string(tree.Oid) + "\nauthor A <a@example.com> 1 +0000\ncommitter A <a@example.com> 1 +0000\n",
+		// Missing timezone, timestamp or email
+		"tree " + string(tree.Oid) + "\nauthor A <a@example.com> 1\ncommitter A <a@example.com>\n\nx\n",
+		"tree " + string(tree.Oid) + "\nauthor A\ncommitter <> 1 +0000\n\nx\n",
+		// Odd spaces and timezones
+		"tree " + string(tree.Oid) + "\nauthor  A  B  <a@example.com>  2  +0000\ncommitter A <a@example.com> 2 +05:30\n\n",
+		"tree " + string(tree.Oid) + "\nauthor A <a@example.com> 3 +0000 extra\ncommitter A <a> b> 99999999999 -1400\n\nx",
+		// Repeated, missing or reordered headers
+		"tree " + string(tree.Oid) + "\nauthor A <a@example.com> 4 +0000\nauthor B <b@example.com> 4 +0000\ncommitter A <a@example.com> 4 +0000\n\nx\n",
+		"tree " + string(tree.Oid) + "\nauthor A <a@example.com> 5 +0000\n\nx\n",
+		"tree " + string(tree.Oid) + "\nencoding latin1\nauthor A <a@example.com> 6 +0000\ncommitter A <a@example.com> 6 +0000\n\nx\n",
+	} {
+		body := []byte(body)
+		if len(head) > 0 {
+			// Chain commits so Log walks all of them
+			i := bytes.IndexByte(body, '\n') + 1
+			body = append(append(append([]byte{}, body[:i]...), "parent "+string(head)+"\n"...), body[i:]...)
+		}
+		o := &gitObj{Oid: hashObject("commit", body), Type: "commit", Body: body}
+		obj, err := parseObject(o)
+		if err != nil {
+			t.Errorf("parseObject(%q) error %v", body, err)
+			continue
+		}
+		if !bytes.Equal(obj.Bytes(), body) {
+			t.Errorf("Commit.Bytes() = %q, expected %q", obj.Bytes(), body)
+		}
+		objs = append(objs, o)
+		head = o.Oid
+		nCommits++
+	}
+	for _, body := range []string{
+		"object " + string(tree.Oid) + "\ntype tree\ntag t\ntagger T <t@example.com>\n",
+		"object " + string(tree.Oid) + "\ntype tree\ntag t\ntagger T <t@example.com> 1 +0100\n\nmessage\n",
+		"object " + string(tree.Oid) + "\ntag t\ntype tree\ntagger T <t@example.com> 1 +0100\ntagger U <u@example.com> 1 +0100\n\nmessage\n",
+	} {
+		o := &gitObj{Oid: hashObject("tag", []byte(body)), Type: "tag", Body: []byte(body)}
+		if obj, err := parseObject(o); err != nil || string(obj.Bytes()) != body {
+			t.Errorf("parseObject(%q) = %v, %v", body, obj, err)
+		}
+		objs = append(objs, o)
+	}
+
+	// Tree entries with spaces
+	obj, err := parseObject(tree)
+	if err != nil || !bytes.Equal(obj.Bytes(), tree.Body) || len(obj.(*Tree).Entries) != 2 || obj.(*Tree).Entries[1].Name != "my file.txt" {
+		t.Errorf("parseObject(tree) = %+v, %v", obj, err)
+	}
+
+	// Changed signatures are formatted again
+	c, _ := parseCommit("", objs[4].Body)
+	if c.Author.String() != "A <a@example.com> 1" {
+		t.Errorf("Author.String() = %q", c.Author.String())
+	}
+	c.Author.Email = "b@example.com"
+	if c.Author.String() != "A <b@example.com> 1 +0000" {
+		t.Errorf("Author.String() = %q after change", c.Author.String())
+	}
+
+	// Repeated headers are kept when other fields are changed
+	c, _ = parseCommit("", objs[len(objs)-6].Body)
+	if c.Author.Name != "A" || len(c.ExtraHeaders) != 1 || c.ExtraHeaders[0].Value != "B <b@example.com> 4 +0000" {
+		t.Errorf("parseCommit with a repeated author = %+v", c)
+	}
+	c.Message = "y\n"
+	if body := string(c.Bytes()); !strings.Contains(body, "\nauthor B <b@example.com> 4 +0000\n") || !strings.HasSuffix(body, "\n\ny\n") {
+		t.Errorf("Commit.Bytes() = %q after change", body)
+	}
+
+	// ReadObject and Log work with them
+	tx := beginTx(db)
+	if err := insertObjects(tx, objs); err != nil {
+		t.Fatal("insertObjects error", err)
+	}
+	tx.Commit()
+	for _, o := range objs {
+		if obj, err := ReadObject(db, o.Oid); err != nil || !bytes.Equal(obj.Bytes(), o.Body) {
+			t.Errorf("ReadObject(%s) = %v, %v", o.Oid, obj, err)
+		}
+	}
+	if commits, err := Log(db, head); err != nil || len(commits) != nCommits {
+		t.Errorf("Log returned %d commits, %v", len(commits), err)
+	}
+}
+
+func TestReadObject(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("readObject")
+	defer db.Close()
+
+	dir := createRandomRepo("ro", 30, true, true)
+	oids, head, err := Import(db, dir, "HEAD")
+	if err != nil {
+		t.Fatal("Import error", err)
+	}
+
+	// Every object serializes back to its original body
+	objs, err := ReadObjects(db, oids)
+	if err != nil {
+		t.Fatal("ReadObjects error", err)
+	}
+	bodies, err := ReadBlobs(db, oids)
+	if err != nil {
+		t.Fatal("ReadBlobs error", err)
+	}
+	for i, obj := range objs {
+		if hashObject(obj.Type(), obj.Bytes()) != oids[i] || !bytes.Equal(obj.Bytes(), bodies[i]) {
+			t.Errorf("%s %s does not serialize back to its body", obj.Type(), oids[i])
+		}
+	}
+
+	obj, err := ReadObject(db, head)
+	if err != nil {
+		t.Fatal("ReadObject error", err)
+	}
+	if c, ok := obj.(*Commit); !ok || c.Oid != head {
+		t.Errorf("ReadObject(%s) returned unexpected %+v", head, obj)
+	}
+}
@@ -0,0 +1,648 @@
+package gitdb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+// Object types used in packfiles.
+const (
+	packObjCommit   = 1
+	packObjTree     = 2
+	packObjBlob     = 3
+	packObjTag      = 4
+	packObjOfsDelta = 6
+	packObjRefDelta = 7
+)
+
+var packObjTypes = map[int]string{
+	packObjCommit: "commit",
+	packObjTree:   "tree",
+	packObjBlob:   "blob",
+	packObjTag:    "tag",
+}
+
+// packCacheSize limits the total size of delta bases cached in memory.
+const packCacheSize = 32 << 20
+
+// maxZlibRatio is the max ratio of inflated size to compressed size. zlib
+// cannot compress data better than about 1032:1.
+const maxZlibRatio = 1032
+
+// maxDeltaDepth limits the length of delta chains, so REF_DELTA bases
+// referring to each other fail instead of recursing forever. git does not
+// write chains longer than 4095.
+const maxDeltaDepth = 4095
+
+// pack is a git packfile and its index stored in local filesystem.
+// It supports index version 1 and 2, and pack version 2 and 3.
+type pack struct {
+	path  string // path of the .pack file
+	file  *os.File
+	size  int64 // size of the .pack file
+	idx   []byte
+	v2    bool
+	count int
+
+	// cache caches objects by offset so delta chains sharing a same base
+	// do not decompress the base repeatedly.
+	cache     map[int64]*packCacheEntry
+	cacheSize int
+}
+
+type packCacheEntry struct {
+	typ  string
+	body []byte
+}
+
+// openPack opens a packfile using the path of its index file.
+func openPack(idxPath string) (*pack, error) {
+	idx, err := ioutil.ReadFile(idxPath)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &pack{path: strings.TrimSuffix(idxPath, ".idx") + ".pack", idx: idx}
+	fanoutPos := 0
+	if len(idx) >= 8 && bytes.Equal(idx[0:4], []byte("\377tOc")) {
+		if v := binary.BigEndian.Uint32(idx[4:8]); v != 2 {
+			return nil, errCorruptedPack{idxPath, fmt.Sprintf("unsupported index version %d", v)}
+		}
+		p.v2 = true
+		fanoutPos = 8
+	}
+	if len(idx) < fanoutPos+1024 {
+		return nil, errCorruptedPack{idxPath, "index is too short"}
+	}
+	p.count = int(binary.BigEndian.Uint32(idx[fanoutPos+1020:]))
+	// Lookups use fanout entries as indexes into the oid table. The last
+	// entry is the count, so entries not decreasing do not exceed it.
+	for i, prev := 0, 0; i < 256; i++ {
+		n := int(binary.BigEndian.Uint32(idx[fanoutPos+i*4:]))
+		if n < prev {
+			return nil, errCorruptedPack{idxPath, "fanout table is not sorted"}
+		}
+		prev = n
+	}
+
+	// v1: fanout, (offset + oid) * count, trailer
+	// v2: header, fanout, oid * count, crc32 * count, offset * count,
+	//     large offsets, trailer
+	minSize := fanoutPos + 1024 + p.count*24 + 40
+	if p.v2 {
+		minSize = fanoutPos + 1024 + p.count*28 + 40
+	}
+	if len(idx) < minSize {
+		return nil, errCorruptedPack{idxPath, "index is too short"}
+	}
+	if p.v2 {
+		// Offsets with the MSB set are indexes into the large offset table,
+		// which has no count of its own.
+		large := 0
+		for i := 0; i < p.count; i++ {
+			offset := binary.BigEndian.Uint32(idx[1032+p.count*24+i*4:])
+			if offset&0x80000000 != 0 && int(offset&0x7fffffff) >= large {
+				large = int(offset&0x7fffffff) + 1
+			}
+		}
+		if large > (len(idx)-minSize)/8 {
+			return nil, errCorruptedPack{idxPath, "large offset table is too short"}
+		}
+	}
+
+	p.file, err = os.Open(p.path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := p.file.Stat()
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	p.size = fi.Size()
+	var header [12]byte
+	if _, err := p.file.ReadAt(header[:], 0); err != nil {
+		p.close()
+		return nil, errCorruptedPack{p.path, err.Error()}
+	}
+	if v := binary.BigEndian.Uint32(header[4:8]); string(header[0:4]) != "PACK" || (v != 2 && v != 3) {
+		p.close()
+		return nil, errCorruptedPack{p.path, "bad header"}
+	}
+	if n := int(binary.BigEndian.Uint32(header[8:12])); n != p.count {
+		p.close()
+		return nil, errCorruptedPack{p.path, fmt.Sprintf("pack has %d objects but index has %d", n, p.count)}
+	}
+	return p, nil
+}
+
+func (p *pack) close() error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	return err
+}
+
+// fanout returns the number of objects with first byte <= b.
+func (p *pack) fanout(b int) int {
+	if b < 0 {
+		return 0
+	}
+	pos := b * 4
+	if p.v2 {
+		pos += 8
+	}
+	return int(binary.BigEndian.Uint32(p.idx[pos:]))
+}
+
+// binOidAt returns the binary oid of the i-th object in the index.
+func (p *pack) binOidAt(i int) []byte {
+	if p.v2 {
+		pos := 1032 + i*20
+		return p.idx[pos : pos+20]
+	}
+	pos := 1024 + i*24 + 4
+	return p.idx[pos : pos+20]
+}
+
+// offsetAt returns the offset in the packfile of the i-th object in the
+// index.
+func (p *pack) offsetAt(i int) int64 {
+	if !p.v2 {
+		return int64(binary.BigEndian.Uint32(p.idx[1024+i*24:]))
+	}
+	pos := 1032 + p.count*24 + i*4
+	offset := binary.BigEndian.Uint32(p.idx[pos:])
+	if offset&0x80000000 == 0 {
+		return int64(offset)
+	}
+	pos = 1032 + p.count*28 + int(offset&0x7fffffff)*8
+	return int64(binary.BigEndian.Uint64(p.idx[pos:]))
+}
+
+// find returns the offset of an object in the packfile.
+func (p *pack) find(oid Oid) (offset int64, ok bool) {
+	bin, err := hex.DecodeString(string(oid))
+	if err != nil || len(bin) != 20 {
+		return 0, false
+	}
+	lo, hi := p.fanout(int(bin[0])-1), p.fanout(int(bin[0]))
+	for lo < hi {
+		mid := (lo + hi) / 2
+		switch c := bytes.Compare(p.binOidAt(mid), bin); {
+		case c == 0:
+			return p.offsetAt(mid), true
+		case c < 0:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+	return 0, false
+}
+
+// findPrefix returns oids in the index starting with a hex prefix.
+func (p *pack) findPrefix(prefix string) []Oid {
+	if len(prefix) < 2 {
+		return nil
+	}
+	first, err := hex.DecodeString(prefix[0:2])
+	if err != nil {
+		return nil
+	}
+	var result []Oid
+	for i := p.fanout(int(first[0]) - 1); i < p.fanout(int(first[0])); i++ {
+		oid := hex.EncodeToString(p.binOidAt(i))
+		if strings.HasPrefix(oid, prefix) {
+			result = append(result, Oid(oid))
+		}
+	}
+	return result
+}
+
+// read reads an object at offset, resolving deltas. resolve is used to read
+// bases of REF_DELTA objects that are not in this pack. depth is the number
+// of deltas already being resolved, and is passed to resolve incremented.
+func (p *pack) read(offset int64, depth int, resolve func(oid Oid, depth int) (string, []byte, error)) (typ string, body []byte, err error) {
+	if e, ok := p.cache[offset]; ok {
+		return e.typ, e.body, nil
+	}
+	if depth > maxDeltaDepth {
+		return "", nil, errCorruptedPack{p.path, fmt.Sprintf("delta chain is too deep at %d", offset)}
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(p.file, offset, 1<<62))
+	objType, size, err := readPackObjHeader(r)
+	if err != nil {
+		return "", nil, errCorruptedPack{p.path, err.Error()}
+	}
+
+	var baseOffset int64 = -1
+	var baseOid Oid
+	switch objType {
+	case packObjOfsDelta:
+		rel, err := readOfsDeltaOffset(r)
+		if err != nil || rel <= 0 || rel > offset {
+			return "", nil, errCorruptedPack{p.path, fmt.Sprintf("bad delta base offset at %d", offset)}
+		}
+		baseOffset = offset - rel
+	case packObjRefDelta:
+		var bin [20]byte
+		if _, err := io.ReadFull(r, bin[:]); err != nil {
+			return "", nil, errCorruptedPack{p.path, err.Error()}
+		}
+		baseOid = Oid(hex.EncodeToString(bin[:]))
+	default:
+		if typ = packObjTypes[objType]; typ == "" {
+			return "", nil, errCorruptedPack{p.path, fmt.Sprintf("unknown object type %d at %d", objType, offset)}
+		}
+	}
+
+	data, err := readZlib(r, size, (p.size-offset)*maxZlibRatio)
+	if err != nil {
+		return "", nil, errCorruptedPack{p.path, fmt.Sprintf("cannot inflate object at %d: %s", offset, err)}
+	}
+
+	if len(typ) == 0 {
+		// Delta object. Resolve its base first.
+		var base []byte
+		if baseOffset >= 0 {
+			typ, base, err = p.read(baseOffset, depth+1, resolve)
+		} else if baseOffset, ok := p.find(baseOid); ok {
+			typ, base, err = p.read(baseOffset, depth+1, resolve)
+		} else {
+			typ, base, err = resolve(baseOid, depth+1)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		// Packs in local filesystem are trusted. Only the size a delta can
+		// express limits the result.
+		if data, err = applyDelta(base, data, math.MaxInt64); err != nil {
+			return "", nil, errCorruptedPack{p.path, fmt.Sprintf("cannot apply delta at %d: %s", offset, err)}
+		}
+	}
+	p.cacheObject(offset, typ, data)
+	return typ, data, nil
+}
+
+// cacheObject remembers an object so it can be used as a delta base later.
+func (p *pack) cacheObject(offset int64, typ string, body []byte) {
+	if len(body) > packCacheSize/4 {
+		return
+	}
+	if p.cache == nil || p.cacheSize+len(body) > packCacheSize {
+		p.cache = make(map[int64]*packCacheEntry)
+		p.cacheSize = 0
+	}
+	p.cache[offset] = &packCacheEntry{typ: typ, body: body}
+	p.cacheSize += len(body)
+}
+
+// readPackObjHeader reads the type and inflated size of a packed object.
+func readPackObjHeader(r io.ByteReader) (objType int, size int64, err error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	objType = int(c>>4) & 7
+	size = int64(c & 15)
+	for shift := uint(4); c&0x80 != 0; shift += 7 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, 0, err
+		}
+		if shift > 56 {
+			return 0, 0, fmt.Errorf("object size overflow")
+		}
+		size |= int64(c&0x7f) << shift
+	}
+	return objType, size, nil
+}
+
+// readOfsDeltaOffset reads the relative base offset of an OFS_DELTA object.
+func readOfsDeltaOffset(r io.ByteReader) (int64, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	offset := int64(c & 0x7f)
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+		if offset > 1<<55 {
+			return 0, fmt.Errorf("offset overflow")
+		}
+		offset = ((offset + 1) << 7) | int64(c&0x7f)
+	}
+	return offset, nil
+}
+
+// readZlib inflates exactly size bytes from r. size must not exceed limit, so
+// a corrupted size does not allocate too much memory.
+func readZlib(r io.Reader, size int64, limit int64) ([]byte, error) {
+	if size < 0 || size > limit {
+		return nil, fmt.Errorf("size %d exceeds %d", size, limit)
+	}
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	data := make([]byte, size)
+	if _, err := io.ReadFull(z, data); err != nil {
+		return nil, err
+	}
+	// Read to the end so the checksum gets verified, and r is positioned
+	// right after the compressed data.
+	if n, err := io.Copy(ioutil.Discard, z); err != nil {
+		return nil, err
+	} else if n > 0 {
+		return nil, fmt.Errorf("inflated size exceeds %d", size)
+	}
+	return data, nil
+}
+
+// packEntry is an object in a packfile being parsed by parsePack.
+type packEntry struct {
+	offset     int64
+	obj        *gitObj // nil if it is an unresolved delta
+	delta      []byte
+	baseOffset int64
+	baseOid    Oid
+}
+
+// parsePack parses a complete packfile in memory, like the one sent by
+// `git push`, and returns objects in it with deltas resolved. Object IDs are
+// calculated from object contents, so they can be trusted.
+//
+// resolve is used to read bases of REF_DELTA objects that are not in the
+// pack. They are not part of the result.
+//
+// maxSize limits the size of each object after inflating and applying
+// deltas, so a small pack claiming large objects is rejected before memory
+// is allocated for them.
+func parsePack(data []byte, maxSize int64, resolve func(Oid) (string, []byte, error)) ([]*gitObj, error) {
+	const path = "(stream)"
+	if len(data) < 32 {
+		return nil, errCorruptedPack{path, "pack is too short"}
+	}
+	if v := binary.BigEndian.Uint32(data[4:8]); string(data[0:4]) != "PACK" || (v != 2 && v != 3) {
+		return nil, errCorruptedPack{path, "bad header"}
+	}
+	body, trailer := data[:len(data)-20], data[len(data)-20:]
+	if sum := sha1.Sum(body); !bytes.Equal(sum[:], trailer) {
+		return nil, errCorruptedPack{path, "checksum mismatch"}
+	}
+	count := int(binary.BigEndian.Uint32(data[8:12]))
+	if count > len(body)-12 {
+		// Each object takes at least one byte
+		return nil, errCorruptedPack{path, fmt.Sprintf("pack is too short for %d objects", count)}
+	}
+
+	r := bytes.NewReader(body[12:])
+	entries := make([]*packEntry, 0, count)
+	byOffset := make(map[int64]*packEntry, count)
+	byOid := make(map[Oid]*gitObj, count)
+	for i := 0; i < count; i++ {
+		offset := int64(len(body) - r.Len())
+		objType, size, err := readPackObjHeader(r)
+		if err != nil {
+			return nil, errCorruptedPack{path, err.Error()}
+		}
+		e := &packEntry{offset: offset, baseOffset: -1}
+		typ := ""
+		switch objType {
+		case packObjOfsDelta:
+			rel, err := readOfsDeltaOffset(r)
+			if err != nil || rel <= 0 || rel > offset {
+				return nil, errCorruptedPack{path, fmt.Sprintf("bad delta base offset at %d", offset)}
+			}
+			e.baseOffset = offset - rel
+		case packObjRefDelta:
+			var bin [20]byte
+			if _, err := io.ReadFull(r, bin[:]); err != nil {
+				return nil, errCorruptedPack{path, err.Error()}
+			}
+			e.baseOid = Oid(hex.EncodeToString(bin[:]))
+		default:
+			if typ = packObjTypes[objType]; typ == "" {
+				return nil, errCorruptedPack{path, fmt.Sprintf("unknown object type %d at %d", objType, offset)}
+			}
+		}
+		limit := int64(r.Len()) * maxZlibRatio
+		if limit > maxSize {
+			limit = maxSize
+		}
+		content, err := readZlib(r, size, limit)
+		if err != nil {
+			return nil, errCorruptedPack{path, fmt.Sprintf("cannot inflate object at %d: %s", offset, err)}
+		}
+		if len(typ) > 0 {
+			e.obj = &gitObj{Oid: hashObject(typ, content), Type: typ, Body: content}
+			byOid[e.obj.Oid] = e.obj
+		} else {
+			e.delta = content
+		}
+		entries = append(entries, e)
+		byOffset[offset] = e
+	}
+	if r.Len() != 0 {
+		return nil, errCorruptedPack{path, "unexpected data after objects"}
+	}
+
+	// Resolve deltas. Bases usually precede deltas so this takes very few
+	// rounds. Bases not in the pack are read using resolve.
+	pending := make([]*packEntry, 0)
+	for _, e := range entries {
+		if e.obj == nil {
+			pending = append(pending, e)
+		}
+	}
+	external := make(map[Oid]*gitObj)
+	externalCount := 0
+	for len(pending) > 0 {
+		next := pending[:0:0]
+		for _, e := range pending {
+			var base *gitObj
+			if e.baseOffset >= 0 {
+				if b, ok := byOffset[e.baseOffset]; ok {
+					base = b.obj
+				} else {
+					return nil, errCorruptedPack{path, fmt.Sprintf("bad delta base offset at %d", e.offset)}
+				}
+			} else if base = byOid[e.baseOid]; base == nil {
+				base = external[e.baseOid]
+			}
+			if base == nil {
+				next = append(next, e)
+				continue
+			}
+			content, err := applyDelta(base.Body, e.delta, maxSize)
+			if err != nil {
+				return nil, errCorruptedPack{path, fmt.Sprintf("cannot apply delta at %d: %s", e.offset, err)}
+			}
+			e.obj = &gitObj{Oid: hashObject(base.Type, content), Type: base.Type, Body: content}
+			e.delta = nil
+			byOid[e.obj.Oid] = e.obj
+		}
+
+		if len(next) == len(pending) {
+			// No progress. Read REF_DELTA bases outside the pack. Some
+			// of them might be unresolved deltas in the pack, so only
+			// fail if none can be read.
+			var firstErr error
+			for _, e := range next {
+				if e.baseOffset >= 0 || external[e.baseOid] != nil {
+					continue
+				}
+				typ, content, err := resolve(e.baseOid)
+				if err != nil {
+					if firstErr == nil {
+						firstErr = err
+					}
+					continue
+				}
+				external[e.baseOid] = &gitObj{Oid: e.baseOid, Type: typ, Body: content}
+				firstErr = nil
+				break
+			}
+			if firstErr != nil {
+				return nil, firstErr
+			}
+			if len(external) == externalCount {
+				return nil, errCorruptedPack{path, "cyclic deltas"}
+			}
+			externalCount = len(external)
+		}
+		pending = next
+	}
+
+	objs := make([]*gitObj, 0, len(entries))
+	seen := make(map[Oid]bool, len(entries))
+	for _, e := range entries {
+		if !seen[e.obj.Oid] {
+			objs = append(objs, e.obj)
+			seen[e.obj.Oid] = true
+		}
+	}
+	return objs, nil
+}
+
+// applyDelta applies a git delta to base and returns the result. The size of
+// the result must not exceed limit.
+func applyDelta(base []byte, delta []byte, limit int64) ([]byte, error) {
+	pos := 0
+	readSize := func() (int, error) {
+		size, shift := 0, uint(0)
+		for {
+			if pos >= len(delta) || shift > 56 {
+				return 0, fmt.Errorf("truncated delta header")
+			}
+			c := delta[pos]
+			pos++
+			size |= int(c&0x7f) << shift
+			shift += 7
+			if size < 0 {
+				return 0, fmt.Errorf("delta size overflows")
+			}
+			if c&0x80 == 0 {
+				return size, nil
+			}
+		}
+	}
+
+	baseSize, err := readSize()
+	if err != nil {
+		return nil, err
+	}
+	if baseSize != len(base) {
+		return nil, fmt.Errorf("base size mismatch: claimed %d, actual %d", baseSize, len(base))
+	}
+	resultSize, err := readSize()
+	if err != nil {
+		return nil, err
+	}
+	// Each instruction byte produces at most len(base) bytes, or 127
+	// bytes inserted from the delta.
+	perByte := len(base)
+	if perByte < 0x7f {
+		perByte = 0x7f
+	}
+	if int64(resultSize) > limit || int64(resultSize) > int64(len(delta)-pos)*int64(perByte) {
+		return nil, fmt.Errorf("result size %d is too large", resultSize)
+	}
+
+	result := make([]byte, 0, resultSize)
+	for pos < len(delta) {
+		op := delta[pos]
+		pos++
+		switch {
+		case op&0x80 != 0:
+			// copy from base: offset and size are encoded in little
+			// endian, with bytes present indicated by bits in op.
+			var offset, size int
+			for i := uint(0); i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				if pos >= len(delta) {
+					return nil, fmt.Errorf("truncated copy instruction")
+				}
+				if i < 4 {
+					offset |= int(delta[pos]) << (8 * i)
+				} else {
+					size |= int(delta[pos]) << (8 * (i - 4))
+				}
+				pos++
+			}
+			if size == 0 {
+				size = 0x10000
+			}
+			if offset+size > len(base) || offset+size < offset {
+				return nil, fmt.Errorf("copy instruction out of range")
+			}
+			if len(result)+size > resultSize {
+				return nil, fmt.Errorf("result exceeds claimed size %d", resultSize)
+			}
+			result = append(result, base[offset:offset+size]...)
+		case op != 0:
+			// insert op bytes from delta
+			if pos+int(op) > len(delta) {
+				return nil, fmt.Errorf("truncated insert instruction")
+			}
+			if len(result)+int(op) > resultSize {
+				return nil, fmt.Errorf("result exceeds claimed size %d", resultSize)
+			}
+			result = append(result, delta[pos:pos+int(op)]...)
+			pos += int(op)
+		default:
+			return nil, fmt.Errorf("reserved instruction")
+		}
+	}
+	if len(result) != resultSize {
+		return nil, fmt.Errorf("result size mismatch: claimed %d, actual %d", resultSize, len(result))
+	}
+	return result, nil
+}
+
+type errCorruptedPack struct {
+	path   string
+	reason string
+}
+
+func (e errCorruptedPack) Error() string {
+	return fmt.Sprintf("corrupted pack %s: %s", e.path, e.reason)
+}
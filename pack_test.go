@@ -0,0 +1,309 @@
+package gitdb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("0123456789abcdef")
+	cases := []struct {
+		Delta    []byte
+		Expected string
+		Valid    bool
+	}{
+		// copy 10 bytes from offset 0, insert "xy", copy 6 bytes from offset 10
+		{[]byte{16, 18, 0x90, 10, 2, 'x', 'y', 0x91, 10, 6}, "0123456789xyabcdef", true},
+		// insert only
+		{[]byte{16, 3, 3, 'f', 'o', 'o'}, "foo", true},
+		// base size mismatch
+		{[]byte{15, 3, 3, 'f', 'o', 'o'}, "", false},
+		// result size mismatch
+		{[]byte{16, 4, 3, 'f', 'o', 'o'}, "", false},
+		// copy more than the result size
+		{[]byte{16, 2, 0x90, 10}, "", false},
+		// insert more than the result size
+		{[]byte{16, 2, 3, 'f', 'o', 'o'}, "", false},
+		// copy out of range
+		{[]byte{16, 4, 0x91, 14, 4}, "", false},
+		// truncated insert
+		{[]byte{16, 3, 3, 'f'}, "", false},
+		// reserved instruction
+		{[]byte{16, 0, 0}, "", false},
+	}
+	for _, c := range cases {
+		result, err := applyDelta(base, c.Delta, math.MaxInt64)
+		if (err == nil) != c.Valid || (c.Valid && string(result) != c.Expected) {
+			t.Errorf("applyDelta(%v) = %q, %v; expected %q", c.Delta, result, err, c.Expected)
+		}
+	}
+
+	// Instructions are not applied past the result size
+	big := make([]byte, 0x10000)
+	delta := []byte{0x80, 0x80, 4, 1}
+	for i := 0; i < 1000; i++ {
+		delta = append(delta, 0x80)
+	}
+	if _, err := applyDelta(big, delta, math.MaxInt64); err == nil || !strings.Contains(err.Error(), "exceeds") {
+		t.Error("applyDelta should stop at the result size", err)
+	}
+}
+
+func TestPackIndexVersions(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	dir := createRandomRepo("p", 30, false, true)
+	gitDir := filepath.Join(dir, ".git")
+	if err := exec.Command("git", "--git-dir", gitDir, "repack", "-a", "-d", "-f", "--depth=20").Run(); err != nil {
+		t.Fatal("git repack error", err)
+	}
+	packPaths, _ := filepath.Glob(filepath.Join(gitDir, "objects", "pack", "*.pack"))
+	if len(packPaths) != 1 {
+		t.Fatal("unexpected number of packs", packPaths)
+	}
+
+	expected := newRepo(dir)
+	expected.gitBinary = true
+	head, _ := expected.resolveRef("HEAD")
+	oids, e := expected.listOids([]Oid{head})
+	if e != nil {
+		t.Fatal("Failed to listOids: ", e)
+	}
+	objs, e := expected.readObjects(oids)
+	if e != nil {
+		t.Fatal("Failed to readObjects: ", e)
+	}
+
+	for _, version := range []string{"1", "2"} {
+		packPath := filepath.Join(dir, "v"+version+".pack")
+		os.Remove(packPath)
+		if err := os.Link(packPaths[0], packPath); err != nil {
+			t.Fatal("link error", err)
+		}
+		idxPath := filepath.Join(dir, "v"+version+".idx")
+		if err := exec.Command("git", "index-pack", "--index-version="+version, "-o", idxPath, packPath).Run(); err != nil {
+			t.Fatal("git index-pack error", err)
+		}
+		p, e := openPack(idxPath)
+		if e != nil {
+			t.Fatal("openPack error", e)
+		}
+		if p.count != len(oids) {
+			t.Error("pack count = ", p.count, " expected ", len(oids))
+		}
+		for _, o := range objs {
+			offset, ok := p.find(o.Oid)
+			if !ok {
+				t.Fatal("object not found in pack", o.Oid)
+			}
+			typ, body, e := p.read(offset, 0, nil)
+			if e != nil {
+				t.Fatal("pack read error", e)
+			}
+			if typ != o.Type || !bytes.Equal(body, o.Body) {
+				t.Error("pack read returns different object", o.Oid)
+			}
+		}
+		if found := p.findPrefix(string(head[0:6])); len(found) != 1 || found[0] != head {
+			t.Error("findPrefix unexpected: ", found)
+		}
+		p.close()
+	}
+}
+
+func TestComputeDelta(t *testing.T) {
+	base := randomBytes(5000, "base")
+	targets := [][]byte{
+		base,
+		{},
+		[]byte("unrelated"),
+		append(append([]byte("prefix"), base[100:3000]...), base[10:200]...),
+		append(append(base[0:2500:2500], []byte("inserted")...), base[2500:]...),
+		bytes.Repeat(base, 5),
+	}
+	for i, target := range targets {
+		delta := computeDelta(base, target)
+		result, err := applyDelta(base, delta, math.MaxInt64)
+		if err != nil || !bytes.Equal(result, target) {
+			t.Errorf("applyDelta(computeDelta) does not round-trip for case %d: %v", i, err)
+		}
+	}
+	if delta := computeDelta(base, targets[4]); len(delta) > 100 {
+		t.Errorf("computeDelta produces a large delta (%d bytes) for a small change", len(delta))
+	}
+}
+
+func TestPackWriter(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	dir := createRandomRepo("pw", 30, true, true)
+	r := newRepo(dir)
+	head, _ := r.resolveRef("HEAD")
+	oids, e := r.listOids([]Oid{head})
+	if e != nil {
+		t.Fatal("Failed to listOids: ", e)
+	}
+	objs, e := r.readObjects(oids)
+	if e != nil {
+		t.Fatal("Failed to readObjects: ", e)
+	}
+
+	for _, deltas := range []bool{false, true} {
+		out := createRandomRepo("pw-out", 0, false, true)
+		w := newRepo(out)
+		if e := w.writePack(objs, deltas); e != nil {
+			t.Fatal("writePack error", e)
+		}
+		idxPaths, _ := filepath.Glob(filepath.Join(w.dir, "objects", "pack", "*.idx"))
+		if len(idxPaths) != 1 {
+			t.Fatal("unexpected number of pack indexes", idxPaths)
+		}
+		if err := exec.Command("git", "verify-pack", idxPaths[0]).Run(); err != nil {
+			t.Fatal("git verify-pack error", err)
+		}
+
+		for _, o := range objs {
+			read, e := w.readObject(o.Oid)
+			if e != nil {
+				t.Fatal("readObject error", e)
+			}
+			if read.Type != o.Type || !bytes.Equal(read.Body, o.Body) {
+				t.Error("packed object differs", o.Oid)
+			}
+		}
+		w.close()
+	}
+}
+
+func TestPackCorrupted(t *testing.T) {
+	dir := filepath.Join(repoDir, "corrupted-pack")
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal("mkdir error", err)
+	}
+
+	// The only object is a REF_DELTA whose base is itself
+	oid := hashObject("blob", []byte("cycle"))
+	delta := []byte{5, 5, 0x90, 5}
+	pw, e := newPackWriter(ioutil.Discard, 1, false)
+	if e != nil {
+		t.Fatal("newPackWriter error", e)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("PACK\x00\x00\x00\x02\x00\x00\x00\x01")
+	writePackObjHeader(&buf, packObjRefDelta, len(delta))
+	bin, _ := hex.DecodeString(string(oid))
+	buf.Write(bin)
+	z := zlib.NewWriter(&buf)
+	z.Write(delta)
+	z.Close()
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	packPath := filepath.Join(dir, "cycle.pack")
+	if e := ioutil.WriteFile(packPath, buf.Bytes(), 0644); e != nil {
+		t.Fatal("write error", e)
+	}
+
+	pw.entries = []packIndexEntry{{oid: oid, offset: 12}}
+	var idx bytes.Buffer
+	if e := pw.writeIndex(&idx, sum[:]); e != nil {
+		t.Fatal("writeIndex error", e)
+	}
+	idxPath := filepath.Join(dir, "cycle.idx")
+	if e := ioutil.WriteFile(idxPath, idx.Bytes(), 0644); e != nil {
+		t.Fatal("write error", e)
+	}
+	p, e := openPack(idxPath)
+	if e != nil {
+		t.Fatal("openPack error", e)
+	}
+	offset, ok := p.find(oid)
+	if !ok {
+		t.Fatal("object not found in pack", oid)
+	}
+	if _, _, e := p.read(offset, 0, nil); e == nil || !strings.Contains(e.Error(), "too deep") {
+		t.Error("read of cyclic REF_DELTA returns", e)
+	}
+	p.close()
+
+	// An offset pointing past the large offset table
+	b := idx.Bytes()
+	binary.BigEndian.PutUint32(b[8+1024+20+4:], 0x80000000)
+	if e := ioutil.WriteFile(idxPath, b, 0644); e != nil {
+		t.Fatal("write error", e)
+	}
+	if p, e := openPack(idxPath); e == nil {
+		p.close()
+		t.Error("openPack does not check large offsets")
+	}
+
+	// A fanout entry larger than the object count
+	binary.BigEndian.PutUint32(b[8+1024+20+4:], 12)
+	binary.BigEndian.PutUint32(b[8:], 2)
+	if e := ioutil.WriteFile(idxPath, b, 0644); e != nil {
+		t.Fatal("write error", e)
+	}
+	if p, e := openPack(idxPath); e == nil {
+		p.close()
+		t.Error("openPack does not check the fanout table")
+	}
+}
+
+func TestParsePackLimits(t *testing.T) {
+	// pack returns a pack with the given count and raw object data
+	pack := func(count uint32, objects ...[]byte) []byte {
+		var buf bytes.Buffer
+		buf.WriteString("PACK\x00\x00\x00\x02")
+		binary.Write(&buf, binary.BigEndian, count)
+		for _, o := range objects {
+			buf.Write(o)
+		}
+		sum := sha1.Sum(buf.Bytes())
+		return append(buf.Bytes(), sum[:]...)
+	}
+	// object returns a packed object with a claimed size and content.
+	// Deltas use blob as the base.
+	blob := []byte("0123456789")
+	object := func(objType int, size int, content []byte) []byte {
+		var buf bytes.Buffer
+		writePackObjHeader(&buf, objType, size)
+		if objType == packObjRefDelta {
+			bin, _ := hex.DecodeString(string(hashObject("blob", blob)))
+			buf.Write(bin)
+		}
+		z := zlib.NewWriter(&buf)
+		z.Write(content)
+		z.Close()
+		return buf.Bytes()
+	}
+
+	hugeDelta := []byte{10, 0xff, 0xff, 0xff, 0xff, 0x7f, 0x90, 10}
+	for i, data := range [][]byte{
+		pack(0xffffffff),
+		pack(1, object(packObjBlob, 1<<62, blob)),
+		pack(1, object(packObjBlob, 1<<20, blob)),
+		pack(2, object(packObjBlob, len(blob), blob), object(packObjRefDelta, len(hugeDelta), hugeDelta)),
+	} {
+		if _, err := parsePack(data, 1<<20, nil); err == nil {
+			t.Errorf("parsePack does not reject case %d", i)
+		}
+	}
+	delta := []byte{10, 10, 0x90, 10}
+	if objs, err := parsePack(pack(2, object(packObjBlob, len(blob), blob), object(packObjRefDelta, len(delta), delta)), int64(len(blob)), nil); err != nil || len(objs) != 1 {
+		t.Error("parsePack rejects objects within the limit", err)
+	}
+}
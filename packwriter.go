@@ -0,0 +1,350 @@
+package gitdb
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+const (
+	// deltaWindow is the number of recently written objects of a same type
+	// tried as delta bases.
+	deltaWindow = 10
+	// deltaMaxDepth limits the length of delta chains.
+	deltaMaxDepth = 10
+	// deltaMinSize is the minimal size of objects to be deltified.
+	deltaMinSize = 64
+)
+
+// packWriter writes git objects to a packfile (version 2) and collects
+// information needed by its index.
+type packWriter struct {
+	w       io.Writer
+	hash    hash.Hash
+	offset  int64
+	count   int
+	entries []packIndexEntry
+
+	// deltas enables delta compression using OFS_DELTA.
+	deltas bool
+	window map[string][]*packWindowEntry
+}
+
+type packIndexEntry struct {
+	oid    Oid
+	offset int64
+	crc    uint32
+}
+
+type packWindowEntry struct {
+	body   []byte
+	offset int64
+	depth  int
+}
+
+// newPackWriter writes the pack header and returns a packWriter. count is the
+// number of objects that will be written.
+func newPackWriter(w io.Writer, count int, deltas bool) (*packWriter, error) {
+	pw := &packWriter{hash: sha1.New(), count: count, deltas: deltas}
+	pw.w = io.MultiWriter(w, pw.hash)
+	if deltas {
+		pw.window = make(map[string][]*packWindowEntry)
+	}
+
+	var header [12]byte
+	copy(header[0:4], "PACK")
+	binary.BigEndian.PutUint32(header[4:8], 2)
+	binary.BigEndian.PutUint32(header[8:12], uint32(count))
+	if _, err := pw.w.Write(header[:]); err != nil {
+		return nil, err
+	}
+	pw.offset = 12
+	return pw, nil
+}
+
+// writeObject writes a git object to the pack. If delta compression is
+// enabled, the object may be written as a delta against a recently written
+// object of the same type.
+func (pw *packWriter) writeObject(o *gitObj) error {
+	objType := 0
+	for t, name := range packObjTypes {
+		if name == o.Type {
+			objType = t
+		}
+	}
+	if objType == 0 {
+		return errInvalidZcontent("unsupported object type " + o.Type)
+	}
+
+	data := o.Body
+	var header bytes.Buffer
+	var base *packWindowEntry
+	if pw.deltas && len(o.Body) >= deltaMinSize {
+		// Pick the base producing the smallest delta. Deltas not saving
+		// at least half of the size are not worthy.
+		for _, candidate := range pw.window[o.Type] {
+			if candidate.depth >= deltaMaxDepth {
+				continue
+			}
+			delta := computeDelta(candidate.body, o.Body)
+			if len(delta) < len(o.Body)/2 && len(delta) < len(data) {
+				data, base = delta, candidate
+			}
+		}
+	}
+
+	if base == nil {
+		writePackObjHeader(&header, objType, len(data))
+	} else {
+		writePackObjHeader(&header, packObjOfsDelta, len(data))
+		writeOfsDeltaOffset(&header, pw.offset-base.offset)
+	}
+	z := zlib.NewWriter(&header)
+	z.Write(data)
+	z.Close()
+
+	entry := packIndexEntry{oid: o.Oid, offset: pw.offset, crc: crc32.ChecksumIEEE(header.Bytes())}
+	if _, err := pw.w.Write(header.Bytes()); err != nil {
+		return err
+	}
+	pw.entries = append(pw.entries, entry)
+
+	if pw.deltas {
+		depth := 0
+		if base != nil {
+			depth = base.depth + 1
+		}
+		w := append(pw.window[o.Type], &packWindowEntry{body: o.Body, offset: pw.offset, depth: depth})
+		if len(w) > deltaWindow {
+			w = w[1:]
+		}
+		pw.window[o.Type] = w
+	}
+	pw.offset += int64(header.Len())
+	return nil
+}
+
+// close writes the pack trailer and returns the pack checksum.
+func (pw *packWriter) close() ([]byte, error) {
+	if len(pw.entries) != pw.count {
+		return nil, errCorruptedPack{"(writing)", "number of objects does not match header"}
+	}
+	sum := pw.hash.Sum(nil)
+	if _, err := pw.w.Write(sum); err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+// writeIndex writes a version 2 pack index.
+func (pw *packWriter) writeIndex(w io.Writer, packChecksum []byte) error {
+	entries := make([]packIndexEntry, len(pw.entries))
+	copy(entries, pw.entries)
+	sort.Sort(packIndexEntries(entries))
+
+	// The index is small (about 28 bytes per object). Build it in memory.
+	var buf bytes.Buffer
+	put32 := func(v uint32) {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], v)
+		buf.Write(b[:])
+	}
+
+	buf.WriteString("\377tOc")
+	put32(2)
+
+	var fanout [256]uint32
+	binOids := make([][]byte, len(entries))
+	for i, e := range entries {
+		b, err := hex.DecodeString(string(e.oid))
+		if err != nil || len(b) != 20 {
+			return fmt.Errorf("invalid oid: %s", e.oid)
+		}
+		binOids[i] = b
+		fanout[b[0]]++
+	}
+	total := uint32(0)
+	for _, n := range fanout {
+		total += n
+		put32(total)
+	}
+
+	for _, b := range binOids {
+		buf.Write(b)
+	}
+	for _, e := range entries {
+		put32(e.crc)
+	}
+	var largeOffsets []int64
+	for _, e := range entries {
+		if e.offset < 0x80000000 {
+			put32(uint32(e.offset))
+		} else {
+			put32(0x80000000 | uint32(len(largeOffsets)))
+			largeOffsets = append(largeOffsets, e.offset)
+		}
+	}
+	for _, offset := range largeOffsets {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(offset))
+		buf.Write(b[:])
+	}
+	buf.Write(packChecksum)
+
+	sum := sha1.Sum(buf.Bytes())
+	buf.Write(sum[:])
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+type packIndexEntries []packIndexEntry
+
+func (s packIndexEntries) Len() int           { return len(s) }
+func (s packIndexEntries) Less(i, j int) bool { return s[i].oid < s[j].oid }
+func (s packIndexEntries) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// sortObjectsForDeltas sorts objects so similar objects are near to each
+// other: grouped by type, larger objects first. Larger objects are better
+// delta bases since deleting is cheaper than inserting.
+func sortObjectsForDeltas(objs []*gitObj) {
+	order := map[string]int{"commit": 0, "tag": 1, "tree": 2, "blob": 3}
+	sort.Stable(objsByTypeAndSize{objs, order})
+}
+
+type objsByTypeAndSize struct {
+	objs  []*gitObj
+	order map[string]int
+}
+
+func (s objsByTypeAndSize) Len() int      { return len(s.objs) }
+func (s objsByTypeAndSize) Swap(i, j int) { s.objs[i], s.objs[j] = s.objs[j], s.objs[i] }
+func (s objsByTypeAndSize) Less(i, j int) bool {
+	a, b := s.objs[i], s.objs[j]
+	if a.Type != b.Type {
+		return s.order[a.Type] < s.order[b.Type]
+	}
+	return len(a.Body) > len(b.Body)
+}
+
+// writePackObjHeader writes the type and inflated size of a packed object.
+func writePackObjHeader(w *bytes.Buffer, objType int, size int) {
+	c := byte(objType<<4) | byte(size&15)
+	size >>= 4
+	for size > 0 {
+		w.WriteByte(c | 0x80)
+		c = byte(size & 0x7f)
+		size >>= 7
+	}
+	w.WriteByte(c)
+}
+
+// writeOfsDeltaOffset writes the relative base offset of an OFS_DELTA
+// object. It is the reverse of readOfsDeltaOffset.
+func writeOfsDeltaOffset(w *bytes.Buffer, offset int64) {
+	var buf [10]byte
+	pos := len(buf) - 1
+	buf[pos] = byte(offset & 0x7f)
+	for offset >>= 7; offset > 0; offset >>= 7 {
+		offset--
+		pos--
+		buf[pos] = 0x80 | byte(offset&0x7f)
+	}
+	w.Write(buf[pos:])
+}
+
+// computeDelta computes a git delta which transforms base to target.
+// It indexes base by 16-byte blocks and extends matches greedily.
+func computeDelta(base []byte, target []byte) []byte {
+	const block = 16
+	var delta bytes.Buffer
+	writeSize := func(size int) {
+		for size >= 0x80 {
+			delta.WriteByte(byte(size&0x7f) | 0x80)
+			size >>= 7
+		}
+		delta.WriteByte(byte(size))
+	}
+	writeSize(len(base))
+	writeSize(len(target))
+
+	index := make(map[string]int, len(base)/block)
+	for i := 0; i+block <= len(base); i += block {
+		key := string(base[i : i+block])
+		if _, ok := index[key]; !ok {
+			index[key] = i
+		}
+	}
+
+	var insert []byte
+	flushInsert := func() {
+		for len(insert) > 0 {
+			n := len(insert)
+			if n > 0x7f {
+				n = 0x7f
+			}
+			delta.WriteByte(byte(n))
+			delta.Write(insert[:n])
+			insert = insert[n:]
+		}
+	}
+
+	for i := 0; i < len(target); {
+		offset, ok := -1, false
+		if i+block <= len(target) {
+			offset, ok = index[string(target[i:i+block])]
+		}
+		if !ok {
+			insert = append(insert, target[i])
+			i++
+			continue
+		}
+
+		// Extend the match forward, then backward into pending inserts.
+		size := block
+		for i+size < len(target) && offset+size < len(base) && target[i+size] == base[offset+size] {
+			size++
+		}
+		for len(insert) > 0 && offset > 0 && insert[len(insert)-1] == base[offset-1] {
+			insert = insert[:len(insert)-1]
+			offset--
+			i--
+			size++
+		}
+		flushInsert()
+		i += size
+
+		for size > 0 {
+			n := size
+			if n > 0xffffff {
+				n = 0xffffff
+			}
+			op := byte(0x80)
+			var args []byte
+			for j := uint(0); j < 4; j++ {
+				if b := byte(offset >> (8 * j)); b != 0 {
+					op |= 1 << j
+					args = append(args, b)
+				}
+			}
+			for j := uint(0); j < 3; j++ {
+				if b := byte(n >> (8 * j)); b != 0 {
+					op |= 1 << (4 + j)
+					args = append(args, b)
+				}
+			}
+			delta.WriteByte(op)
+			delta.Write(args)
+			offset += n
+			size -= n
+		}
+	}
+	flushInsert()
+	return delta.Bytes()
+}
@@ -0,0 +1,400 @@
+package gitdb
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// PatchOption customizes the behavior of WritePatch.
+type PatchOption func(*patchConfig)
+
+type patchConfig struct {
+	context   int
+	fullIndex bool
+}
+
+// ContextLines sets the number of context lines around changes. The default
+// is 3, like `git diff -U3`. Negative n is treated as 0.
+func ContextLines(n int) PatchOption {
+	return func(c *patchConfig) {
+		if n < 0 {
+			n = 0
+		}
+		c.context = n
+	}
+}
+
+// FullIndex makes WritePatch write full oids in "index" lines, like
+// `git diff --full-index`. By default, oids are abbreviated to 7 chars.
+func FullIndex() PatchOption {
+	return func(c *patchConfig) {
+		c.fullIndex = true
+	}
+}
+
+// WritePatch writes changes returned by DiffTrees as an unified patch, like
+// `git diff`.
+//
+// dt is either *sql.DB or *sql.Tx.
+//
+// Blobs are read from database in one batch. A blob is treated as binary if
+// it has a NUL byte in its first 8000 bytes, like git does. Changes to
+// binary blobs are written as "Binary files ... differ" without their
+// content. Paths are written as-is, while git quotes paths having special
+// chars like tabs, newlines or non-ASCII chars. The patch can be applied
+// using `git apply` if it has neither binary changes nor such paths.
+func WritePatch(w io.Writer, dt dbOrTx, entries []*DiffEntry, options ...PatchOption) error {
+	cfg := patchConfig{context: 3}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	// Read blobs. Gitlinks are shown as "Subproject commit <oid>".
+	var oids []Oid
+	for _, e := range entries {
+		for _, b := range []struct {
+			mode int32
+			oid  Oid
+		}{{e.OldMode, e.OldOid}, {e.NewMode, e.NewOid}} {
+			if len(b.oid) > 0 && b.mode != ModeGitlink {
+				oids = append(oids, b.oid)
+			}
+		}
+	}
+	oids = uniqueOids(oids)
+	contents, err := ReadBlobs(dt, oids)
+	if err != nil {
+		return err
+	}
+	blobs := make(map[Oid][]byte, len(oids))
+	for i, oid := range oids {
+		blobs[oid] = contents[i]
+	}
+	content := func(mode int32, oid Oid) []byte {
+		if mode == ModeGitlink {
+			return []byte(fmt.Sprintf("Subproject commit %s\n", oid))
+		}
+		return blobs[oid]
+	}
+
+	var buf bytes.Buffer
+	for _, e := range entries {
+		if (e.Status == DiffModified || e.Status == DiffModeChanged) && e.OldMode&0170000 != e.NewMode&0170000 {
+			// Type changes (ex. file to symlink) are written as a
+			// deletion followed by an addition, like git does.
+			writeFilePatch(&buf, &cfg, &DiffEntry{Status: DiffDeleted, OldPath: e.OldPath, OldMode: e.OldMode, OldOid: e.OldOid}, content(e.OldMode, e.OldOid), nil)
+			writeFilePatch(&buf, &cfg, &DiffEntry{Status: DiffAdded, NewPath: e.NewPath, NewMode: e.NewMode, NewOid: e.NewOid}, nil, content(e.NewMode, e.NewOid))
+			continue
+		}
+		writeFilePatch(&buf, &cfg, e, content(e.OldMode, e.OldOid), content(e.NewMode, e.NewOid))
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// writeFilePatch writes the patch of a single file.
+func writeFilePatch(w *bytes.Buffer, cfg *patchConfig, e *DiffEntry, oldContent []byte, newContent []byte) {
+	oldPath, newPath := e.OldPath, e.NewPath
+	if len(oldPath) == 0 {
+		oldPath = newPath
+	}
+	if len(newPath) == 0 {
+		newPath = oldPath
+	}
+	abbrev := func(oid Oid) string {
+		if len(oid) == 0 {
+			oid = zeroOid
+		}
+		if cfg.fullIndex {
+			return string(oid)
+		}
+		return string(oid[:7])
+	}
+
+	fmt.Fprintf(w, "diff --git a/%s b/%s\n", oldPath, newPath)
+	switch e.Status {
+	case DiffAdded:
+		fmt.Fprintf(w, "new file mode %06o\n", e.NewMode)
+	case DiffDeleted:
+		fmt.Fprintf(w, "deleted file mode %06o\n", e.OldMode)
+	default:
+		if e.OldMode != e.NewMode {
+			fmt.Fprintf(w, "old mode %06o\nnew mode %06o\n", e.OldMode, e.NewMode)
+		}
+		if e.Status == DiffRenamed {
+			// Only exact renames are detected.
+			fmt.Fprintf(w, "similarity index 100%%\nrename from %s\nrename to %s\n", oldPath, newPath)
+		}
+	}
+	if e.OldOid == e.NewOid {
+		return
+	}
+	if e.Status == DiffAdded || e.Status == DiffDeleted || e.OldMode != e.NewMode {
+		fmt.Fprintf(w, "index %s..%s\n", abbrev(e.OldOid), abbrev(e.NewOid))
+	} else {
+		fmt.Fprintf(w, "index %s..%s %06o\n", abbrev(e.OldOid), abbrev(e.NewOid), e.NewMode)
+	}
+
+	aPath, bPath := "a/"+oldPath, "b/"+newPath
+	if e.Status == DiffAdded {
+		aPath = "/dev/null"
+	} else if e.Status == DiffDeleted {
+		bPath = "/dev/null"
+	}
+	if isBinary(oldContent) || isBinary(newContent) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", aPath, bPath)
+		return
+	}
+	if len(oldContent) == 0 && len(newContent) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", aPath, bPath)
+	writeHunks(w, splitLines(oldContent), splitLines(newContent), cfg.context)
+}
+
+// isBinary tests whether content looks binary, like git does.
+func isBinary(content []byte) bool {
+	if len(content) > 8000 {
+		content = content[:8000]
+	}
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// splitLines splits content into lines. Each line keeps its "\n", except
+// for the last line if content does not end with "\n".
+func splitLines(content []byte) []string {
+	var lines []string
+	for len(content) > 0 {
+		i := bytes.IndexByte(content, '\n')
+		if i < 0 {
+			i = len(content) - 1
+		}
+		lines = append(lines, string(content[:i+1]))
+		content = content[i+1:]
+	}
+	return lines
+}
+
+// diffOp is an edit operation produced by diffLines.
+type diffOp struct {
+	kind byte // ' ', '-', or '+'
+	line string
+	// Line indexes (0-based) in the old and new files before this
+	// operation.
+	oldIndex, newIndex int
+}
+
+// writeHunks writes unified diff hunks.
+func writeHunks(w *bytes.Buffer, a []string, b []string, context int) {
+	ops, _ := diffLines(a, b)
+	for i := 0; i < len(ops); {
+		// Find the next change.
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+
+		// Extend the hunk until there are more than 2 * context
+		// unchanged lines between changes.
+		start := i - context
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*context {
+				break
+			}
+		}
+		i = end
+		end += context
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		hunk := ops[start:end]
+		oldCount, newCount := 0, 0
+		for _, op := range hunk {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@", hunkRange(hunk[0].oldIndex, oldCount), hunkRange(hunk[0].newIndex, newCount))
+		if f := funcName(a, hunk[0].oldIndex); len(f) > 0 {
+			fmt.Fprintf(w, " %s", f)
+		}
+		w.WriteByte('\n')
+		for _, op := range hunk {
+			w.WriteByte(op.kind)
+			w.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				w.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+}
+
+// hunkRange formats a range in the hunk header. index is 0-based.
+func hunkRange(index int, count int) string {
+	switch count {
+	case 0:
+		return fmt.Sprintf("%d,0", index)
+	case 1:
+		return fmt.Sprintf("%d", index+1)
+	}
+	return fmt.Sprintf("%d,%d", index+1, count)
+}
+
+// funcName finds the "function name" shown in hunk headers: the last line
+// before index starting with a letter, "_" or "$", like git's default.
+func funcName(lines []string, index int) string {
+	for i := index - 1; i >= 0; i-- {
+		line := lines[i]
+		if len(line) == 0 {
+			continue
+		}
+		if c := line[0]; c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			if len(line) > 80 {
+				line = line[:80]
+			}
+			return strings.TrimRight(line, " \t\r\n")
+		}
+	}
+	return ""
+}
+
+// diffLines computes a shortest edit script from a to b using the Myers
+// algorithm. Common prefix and suffix are stripped first. Returns false if
+// the script is longer than diffMaxCost, and replaces all lines between the
+// prefix and suffix instead. See myers.
+func diffLines(a []string, b []string) ([]diffOp, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for i := 0; i < prefix; i++ {
+		ops = append(ops, diffOp{' ', a[i], i, i})
+	}
+	middle, ok := myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], prefix, prefix)
+	ops = append(ops, middle...)
+	for i := 0; i < suffix; i++ {
+		ai, bi := len(a)-suffix+i, len(b)-suffix+i
+		ops = append(ops, diffOp{' ', a[ai], ai, bi})
+	}
+	return ops, ok
+}
+
+// diffMaxCost limits the number of edits myers searches for. Memory used by
+// myers is O(diffMaxCost^2).
+const diffMaxCost = 1024
+
+// myers implements the Myers O(ND) diff algorithm. offsetA and offsetB are
+// added to line indexes in the result. If the edit script is too long, all
+// lines in a are deleted, and all lines in b are inserted instead, and false
+// is returned.
+func myers(a []string, b []string, offsetA int, offsetB int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil, true
+	}
+
+	// v[k+max] is the furthest x on diagonal k. trace keeps v of every d
+	// to backtrack the path.
+	v := make([]int, 2*max+2)
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		snapshot := make([]int, 2*d+1)
+		copy(snapshot, v[max-d:max+d+1])
+		trace = append(trace, snapshot)
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[max+k-1] < v[max+k+1]) {
+				x = v[max+k+1]
+			} else {
+				x = v[max+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[max+k] = x
+			if x >= n && y >= m {
+				return myersBacktrack(a, b, trace, d, offsetA, offsetB), true
+			}
+		}
+		if d >= diffMaxCost {
+			break
+		}
+	}
+
+	ops := make([]diffOp, 0, max)
+	for i, line := range a {
+		ops = append(ops, diffOp{'-', line, i + offsetA, offsetB})
+	}
+	for i, line := range b {
+		ops = append(ops, diffOp{'+', line, n + offsetA, i + offsetB})
+	}
+	return ops, false
+}
+
+// myersBacktrack follows the trace of myers backwards to build the edit
+// script.
+func myersBacktrack(a []string, b []string, trace [][]int, d int, offsetA int, offsetB int) []diffOp {
+	var ops []diffOp
+	x, y := len(a), len(b)
+	for ; d >= 0; d-- {
+		// trace[d] is v before step d, covering diagonals -d..d.
+		prev := trace[d]
+		k := x - y
+		prevK, prevX := 0, 0
+		if d > 0 {
+			if k == -d || (k != d && prev[k-1+d] < prev[k+1+d]) {
+				prevK = k + 1
+			} else {
+				prevK = k - 1
+			}
+			prevX = prev[prevK+d]
+		}
+		prevY := prevX - prevK
+
+		// Diagonal moves
+		for x > prevX && y > prevY {
+			x--
+			y--
+			ops = append(ops, diffOp{' ', a[x], x + offsetA, y + offsetB})
+		}
+		if d > 0 {
+			if x == prevX {
+				// Insertion
+				y--
+				ops = append(ops, diffOp{'+', b[y], x + offsetA, y + offsetB})
+			} else {
+				x--
+				ops = append(ops, diffOp{'-', a[x], x + offsetA, y + offsetB})
+			}
+		}
+	}
+
+	// Reverse
+	for i, j := 0, len(ops)-1; i < j; i, j = i+1, j-1 {
+		ops[i], ops[j] = ops[j], ops[i]
+	}
+	return ops
+}
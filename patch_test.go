@@ -0,0 +1,164 @@
+package gitdb
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiffLines(t *testing.T) {
+	for _, c := range [][2]string{
+		{"", ""},
+		{"", "a\nb\n"},
+		{"a\nb\n", ""},
+		{"a\nb\nc\n", "a\nc\n"},
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n"},
+		{"a\nb", "a\nb\n"},
+	} {
+		a, b := splitLines([]byte(c[0])), splitLines([]byte(c[1]))
+		var oldLines, newLines []string
+		ops, ok := diffLines(a, b)
+		if !ok {
+			t.Errorf("diffLines(%q, %q) should not hit the cost limit", c[0], c[1])
+		}
+		for _, op := range ops {
+			if op.kind != '+' {
+				oldLines = append(oldLines, op.line)
+			}
+			if op.kind != '-' {
+				newLines = append(newLines, op.line)
+			}
+		}
+		if strings.Join(oldLines, "") != c[0] || strings.Join(newLines, "") != c[1] {
+			t.Errorf("diffLines(%q, %q) is incorrect", c[0], c[1])
+		}
+	}
+}
+
+func TestWritePatch(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("writePatch")
+	defer db.Close()
+
+	lines := func(prefix string, n int) string {
+		var b bytes.Buffer
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "%s %d\n", prefix, i)
+		}
+		return b.String()
+	}
+	author := Signature{Name: "Alice", Email: "alice@example.com"}
+	b := NewCommitBuilder()
+	b.Put("mod.txt", ModeBlob, []byte("func main\n"+lines("  line", 30)))
+	b.Put("del.txt", ModeBlob, []byte(lines("del", 3)))
+	b.Put("chmod.sh", ModeBlob, []byte(lines("sh", 2)))
+	b.Put("old/name", ModeBlob, []byte(lines("rename", 2)))
+	b.Put("eol.txt", ModeBlob, []byte("a\nb"))
+	b.Put("bin", ModeBlob, []byte("\x00\x01"))
+	b.Put("link", ModeBlob, []byte("target"))
+	b.Author = author
+	oid1, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+	b = NewCommitBuilder(oid1)
+	b.Put("mod.txt", ModeBlob, []byte("func main\n"+strings.Replace(strings.Replace(lines("  line", 30), "line 3\n", "changed 3\n", 1), "line 25\n", "changed 25\n", 1)))
+	b.Delete("del.txt")
+	b.Put("add.txt", ModeBlob, []byte(lines("add", 2)))
+	b.Put("empty", ModeBlob, nil)
+	b.Put("chmod.sh", ModeExecutable, []byte(lines("sh", 2)))
+	b.Delete("old/name")
+	b.Put("new/name", ModeBlob, []byte(lines("rename", 2)))
+	b.Put("eol.txt", ModeBlob, []byte("a\nc"))
+	b.Put("bin", ModeBlob, []byte("\x00\x02"))
+	b.Put("link", ModeSymlink, []byte("target2"))
+	b.Author = author
+	oid2, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+
+	entries, e := DiffTrees(db, oid1, oid2, DetectRenames())
+	if e != nil {
+		t.Fatal("DiffTrees error", e)
+	}
+	var patch bytes.Buffer
+	if e := WritePatch(&patch, db, entries); e != nil {
+		t.Fatal("WritePatch error", e)
+	}
+
+	dir := filepath.Join(repoDir, "wp")
+	os.RemoveAll(dir)
+	if _, e := Export(db, dir, oid2, "HEAD"); e != nil {
+		t.Fatal("Export error", e)
+	}
+	out, e := exec.Command("git", "--git-dir", filepath.Join(dir, ".git"), "diff", "--no-color", "--no-indent-heuristic", "-M100%", string(oid1), string(oid2)).Output()
+	if e != nil {
+		t.Fatal("git diff error", e)
+	}
+	if patch.String() != string(out) {
+		t.Errorf("WritePatch unexpected:\n%s\ngit diff:\n%s", patch.String(), out)
+	}
+
+	// Patches of a random repo can be applied by git
+	dir = createRandomRepo("wp-random", 40, true, true)
+	if _, _, e := Import(db, dir, "HEAD"); e != nil {
+		t.Fatal("Import error", e)
+	}
+	r := newRepo(dir)
+	oldOid, _ := r.resolveRef("HEAD~3")
+	newOid, _ := r.resolveRef("HEAD")
+	entries, e = DiffTrees(db, oldOid, newOid)
+	if e != nil {
+		t.Fatal("DiffTrees error", e)
+	}
+	for _, context := range []int{0, 3} {
+		patch.Reset()
+		if e := WritePatch(&patch, db, entries, ContextLines(context), FullIndex()); e != nil {
+			t.Fatal("WritePatch error", e)
+		}
+		git := func(stdin []byte, args ...string) string {
+			cmd := exec.Command("git", args...)
+			cmd.Dir = dir
+			cmd.Env = append(os.Environ(), "GIT_INDEX_FILE="+filepath.Join(dir, ".git", "test-index"))
+			cmd.Stdin = bytes.NewReader(stdin)
+			out, err := cmd.CombinedOutput()
+			if err != nil {
+				t.Fatal("git", args, "error", err, string(out))
+			}
+			return strings.TrimSpace(string(out))
+		}
+		git(nil, "read-tree", string(oldOid))
+		git(patch.Bytes(), "apply", "--cached", "--unidiff-zero", "-")
+		if tree, expected := git(nil, "write-tree"), git(nil, "rev-parse", string(newOid)+"^{tree}"); tree != expected {
+			t.Errorf("Applying patch (context %d) results in tree %s, expected %s", context, tree, expected)
+		}
+	}
+
+	// Negative context is treated as 0
+	var patch0 bytes.Buffer
+	WritePatch(&patch0, db, entries, ContextLines(0))
+	patch.Reset()
+	if e := WritePatch(&patch, db, entries, ContextLines(-2)); e != nil || patch.String() != patch0.String() {
+		t.Error("WritePatch with negative context unexpected", e)
+	}
+}
+
+func TestDiffLinesMaxCost(t *testing.T) {
+	var a, b []string
+	for i := 0; i < diffMaxCost; i++ {
+		a = append(a, fmt.Sprintf("a%d\n", i))
+		b = append(b, fmt.Sprintf("b%d\n", i))
+	}
+	ops, ok := diffLines(a, b)
+	if ok || len(ops) != len(a)+len(b) || ops[0].kind != '-' || ops[len(ops)-1].kind != '+' {
+		t.Error("diffLines should fall back to replacing all lines")
+	}
+}
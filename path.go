@@ -0,0 +1,186 @@
+package gitdb
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Stat looks up a path in a tree without reading unrelated trees.
+// It is like `git ls-tree oid path` but works directly in database.
+//
+// dt is either *sql.DB or *sql.Tx.
+// oid is the git object ID of a git tree, commit or annotated tag.
+// path is a slash-separated path. An empty path refers to the root tree.
+//
+// Returns mode and oid of the path. If the path does not exist, returns 0
+// and an empty oid.
+func Stat(dt dbOrTx, oid Oid, path string) (mode int32, pathOid Oid, err error) {
+	modes, oids, err := StatPaths(dt, oid, []string{path})
+	if err != nil {
+		return 0, "", err
+	}
+	return modes[0], oids[0], nil
+}
+
+// StatPaths is like Stat but looks up multiple paths. Trees at a same depth
+// are read in one batch.
+func StatPaths(dt dbOrTx, oid Oid, paths []string) (modes []int32, oids []Oid, err error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	root, err := peelToTree(tx, oid)
+	if err != nil {
+		return nil, nil, err
+	}
+	trees := make(treeCache)
+	if err := trees.add(root); err != nil {
+		return nil, nil, err
+	}
+	allModes, allOids, err := statTrees(tx, trees, []Oid{root.Oid}, paths)
+	if err != nil {
+		return nil, nil, err
+	}
+	return allModes[0], allOids[0], nil
+}
+
+// treeCache caches parsed trees, indexed by names of their entries.
+type treeCache map[Oid]map[string]*TreeEntry
+
+// add parses and adds a tree object to the cache.
+func (c treeCache) add(o *gitObj) error {
+	if o.Type != "tree" {
+		return fmt.Errorf("%s is a %s, not a tree", o.Oid, o.Type)
+	}
+	items := make(map[string]*TreeEntry)
+	for _, ti := range parseTree(o.Body) {
+		items[ti.Name] = ti
+	}
+	c[o.Oid] = items
+	return nil
+}
+
+// statTrees looks up paths in multiple root trees. Trees at a same depth
+// are read in one batch. Returns modes[i][j] and oids[i][j] for paths[j] in
+// roots[i].
+func statTrees(tx *gitTx, trees treeCache, roots []Oid, paths []string) (modes [][]int32, oids [][]Oid, err error) {
+	// Lookup state of a path: the tree to look into, and remaining names.
+	type lookup struct {
+		root, index int
+		treeOid     Oid
+		names       []string
+	}
+	var active []lookup
+	modes = make([][]int32, len(roots))
+	oids = make([][]Oid, len(roots))
+	for r, rootOid := range roots {
+		modes[r] = make([]int32, len(paths))
+		oids[r] = make([]Oid, len(paths))
+		for i, p := range paths {
+			var names []string
+			for _, name := range strings.Split(p, "/") {
+				if len(name) > 0 {
+					names = append(names, name)
+				}
+			}
+			if len(names) == 0 {
+				modes[r][i], oids[r][i] = ModeTree, rootOid
+			} else {
+				active = append(active, lookup{r, i, rootOid, names})
+			}
+		}
+	}
+
+	for len(active) > 0 {
+		var treeOids []Oid
+		for _, l := range active {
+			if trees[l.treeOid] == nil {
+				treeOids = append(treeOids, l.treeOid)
+			}
+		}
+		if len(treeOids) > 0 {
+			objs, err := readObjects(tx, uniqueOids(treeOids))
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, o := range objs {
+				if err := trees.add(o); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+
+		next := active[:0]
+		for _, l := range active {
+			ti := trees[l.treeOid][l.names[0]]
+			switch {
+			case ti == nil:
+				// not found
+			case len(l.names) == 1:
+				modes[l.root][l.index], oids[l.root][l.index] = ti.Mode, ti.Oid
+			case ti.IsTree():
+				next = append(next, lookup{l.root, l.index, ti.Oid, l.names[1:]})
+			}
+		}
+		active = next
+	}
+	return modes, oids, nil
+}
+
+// ReadPath reads a file in a tree without reading unrelated trees.
+// It is like `git cat-file -p oid:path` but works directly in database.
+//
+// dt is either *sql.DB or *sql.Tx.
+// oid is the git object ID of a git tree, commit or annotated tag.
+//
+// Returns mode, oid and content of the path. content is nil if the path is
+// a tree or a gitlink. If the path does not exist, returns 0 and an empty
+// oid.
+func ReadPath(dt dbOrTx, oid Oid, path string) (mode int32, pathOid Oid, content []byte, err error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return 0, "", nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	mode, pathOid, err = Stat(tx, oid, path)
+	if err != nil || len(pathOid) == 0 || mode == ModeTree || mode == ModeGitlink {
+		return mode, pathOid, nil, err
+	}
+	contents, err := ReadBlobs(tx, []Oid{pathOid})
+	if err != nil {
+		return 0, "", nil, err
+	}
+	return mode, pathOid, contents[0], nil
+}
+
+// peelToTree peels annotated tags and commits until a tree is found.
+// Returns the tree object.
+func peelToTree(tx *gitTx, oid Oid) (*gitObj, error) {
+	for {
+		objs, err := readObjects(tx, []Oid{oid})
+		if err != nil {
+			return nil, err
+		}
+		o := objs[0]
+		switch o.Type {
+		case "tree":
+			return o, nil
+		case "commit", "tag":
+			// The first referred oid of a commit is its tree.
+			referred := o.referredOids()
+			if len(referred) == 0 {
+				return nil, fmt.Errorf("%s %s is illformed", o.Type, oid)
+			}
+			oid = referred[0]
+		default:
+			return nil, fmt.Errorf("%s is a %s, not a tree", oid, o.Type)
+		}
+	}
+}
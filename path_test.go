@@ -0,0 +1,89 @@
+package gitdb
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadPath(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("readPath")
+	defer db.Close()
+
+	dir := createRandomRepo("rp", 30, true, true)
+	_, parent, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	b := NewCommitBuilder(parent)
+	b.Put("a/b/c.txt", ModeBlob, []byte("c\n"))
+	b.Put("a/b/d.sh", ModeExecutable, []byte("d\n"))
+	b.Put("a/e", ModeSymlink, []byte("b/c.txt"))
+	b.Put("a/sub", ModeGitlink, []byte(parent))
+	b.Put("a/my dir/my file.txt", ModeBlob, []byte("spaces\n"))
+	b.Author = Signature{Name: "Alice", Email: "alice@example.com"}
+	oid, e := b.Commit(db)
+	if e != nil {
+		t.Fatal("Commit error", e)
+	}
+
+	// Every file from ReadTree can be read by ReadPath
+	modes, oids, paths, e := ReadTree(db, oid)
+	if e != nil {
+		t.Fatal("ReadTree error", e)
+	}
+	contents, e := ReadBlobs(db, oids)
+	if e != nil {
+		t.Fatal("ReadBlobs error", e)
+	}
+	for i, p := range paths {
+		mode, pathOid, content, e := ReadPath(db, oid, p)
+		if e != nil || mode != modes[i] || pathOid != oids[i] || !bytes.Equal(content, contents[i]) {
+			t.Errorf("ReadPath(%s) = %o %s %d bytes %v, expected %o %s %d bytes", p, mode, pathOid, len(content), e, modes[i], oids[i], len(contents[i]))
+		}
+	}
+
+	// Batched lookups
+	statModes, statOids, e := StatPaths(db, oid, paths)
+	if e != nil {
+		t.Fatal("StatPaths error", e)
+	}
+	for i := range paths {
+		if statModes[i] != modes[i] || statOids[i] != oids[i] {
+			t.Errorf("StatPaths unexpected for %s", paths[i])
+		}
+	}
+
+	// Trees, gitlinks and missing paths
+	for _, c := range []struct {
+		path  string
+		mode  int32
+		found bool
+	}{
+		{"", ModeTree, true},
+		{"/a/b/", ModeTree, true},
+		{"a/sub", ModeGitlink, true},
+		{"a/my dir", ModeTree, true},
+		{"a/my", 0, false},
+		{"a/dir", 0, false},
+		{"a/b/c.txt/x", 0, false},
+		{"a/sub/x", 0, false},
+		{"a/missing", 0, false},
+		{"missing/x", 0, false},
+	} {
+		mode, pathOid, content, e := ReadPath(db, oid, c.path)
+		if e != nil || mode != c.mode || (len(pathOid) > 0) != c.found || content != nil {
+			t.Errorf("ReadPath(%q) = %o %s %v, expected mode %o, found %v", c.path, mode, pathOid, e, c.mode, c.found)
+		}
+	}
+	if mode, _, content, e := ReadPath(db, oid, "a/my dir/my file.txt"); e != nil || mode != ModeBlob || string(content) != "spaces\n" {
+		t.Errorf("ReadPath of a name with spaces = %o %q %v", mode, content, e)
+	}
+	commits, _ := ReadBlobs(db, []Oid{oid})
+	if _, pathOid, _ := Stat(db, oid, ""); pathOid != Oid(commits[0][5:45]) {
+		t.Error("Stat of root should return the root tree")
+	}
+}
@@ -0,0 +1,96 @@
+package gitdb
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// pkt-line is the framing format used by git network protocols. Each line
+// starts with 4 hex digits of its length, including the 4 digits themselves.
+// Special lengths: "0000" is a flush packet, "0001" is a delimiter packet
+// (protocol v2 only).
+
+const (
+	pktFlush = iota
+	pktDelim
+	pktData
+)
+
+// pktMaxData is the maximum data length of a pkt-line.
+const pktMaxData = 65516
+
+// readPktLine reads a pkt-line. kind is one of pktFlush, pktDelim, pktData.
+func readPktLine(r io.Reader) (kind int, data []byte, err error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n, err := strconv.ParseUint(string(header[:]), 16, 16)
+	if err != nil {
+		return 0, nil, fmt.Errorf("illformed pkt-line header: %q", header)
+	}
+	switch {
+	case n == 0:
+		return pktFlush, nil, nil
+	case n == 1:
+		return pktDelim, nil, nil
+	case n < 4:
+		return 0, nil, fmt.Errorf("illformed pkt-line header: %q", header)
+	}
+	data = make([]byte, n-4)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return 0, nil, err
+	}
+	return pktData, data, nil
+}
+
+// writePktLine writes data as a pkt-line.
+func writePktLine(w io.Writer, data []byte) error {
+	if len(data) > pktMaxData {
+		return fmt.Errorf("pkt-line too long: %d bytes", len(data))
+	}
+	if _, err := fmt.Fprintf(w, "%04x", len(data)+4); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// writePktLinef writes a formatted string as a pkt-line.
+func writePktLinef(w io.Writer, format string, args ...interface{}) error {
+	return writePktLine(w, []byte(fmt.Sprintf(format, args...)))
+}
+
+func writePktFlush(w io.Writer) error {
+	_, err := io.WriteString(w, "0000")
+	return err
+}
+
+func writePktDelim(w io.Writer) error {
+	_, err := io.WriteString(w, "0001")
+	return err
+}
+
+// sidebandWriter multiplexes data into pkt-lines of a side-band channel.
+// Band 1 is pack data, band 2 is progress messages, band 3 is fatal errors.
+type sidebandWriter struct {
+	w    io.Writer
+	band byte
+}
+
+func (s *sidebandWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > pktMaxData-1 {
+			n = pktMaxData - 1
+		}
+		if err := writePktLine(s.w, append([]byte{s.band}, p[:n]...)); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,37 @@
+//go:build postgres
+// +build postgres
+
+package gitdb
+
+import (
+	"database/sql"
+	"os"
+
+	_ "github.com/lib/pq"
+)
+
+// Tests run against PostgreSQL with the "postgres" build tag and a DSN:
+//
+//	GITDB_TEST_POSTGRES="dbname=gitdb_test sslmode=disable" go test -tags postgres
+//
+// Tables in the database are dropped by each test.
+func init() {
+	dsn := os.Getenv("GITDB_TEST_POSTGRES")
+	if len(dsn) == 0 {
+		return
+	}
+	testDialect = PostgreSQL
+	openTestDb = func(name string) (*sql.DB, error) {
+		db, err := sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range []string{table, chunkTable, edgeTable, refTable, memberTable, commitCacheTable, commitGraphTable, commitGraphParentsTable, schemaTable, settingsTable} {
+			if _, err := db.Exec("DROP TABLE IF EXISTS " + t); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		return db, nil
+	}
+}
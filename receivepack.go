@@ -0,0 +1,277 @@
+package gitdb
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// zeroOid is used by git network protocols to mean "no object".
+const zeroOid = "0000000000000000000000000000000000000000"
+
+// receiveCommand is a ref update requested by `git push`.
+type receiveCommand struct {
+	ref    string
+	oldOid Oid // empty: create the ref
+	newOid Oid // empty: delete the ref
+	err    error
+}
+
+func (h *HTTPHandler) serveReceivePackInfoRefs(w http.ResponseWriter, req *http.Request, repo string) {
+	names, oids, err := ListRefs(h.DB, repo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// receive-pack only speaks protocol v0. HEAD is not advertised since
+	// pushes update branches and tags.
+	var buf bytes.Buffer
+	writePktLinef(&buf, "# service=git-receive-pack\n")
+	writePktFlush(&buf)
+	caps := "report-status delete-refs side-band-64k ofs-delta atomic " + httpAgent
+	for i, name := range names {
+		if name == "HEAD" {
+			continue
+		}
+		if len(caps) > 0 {
+			writePktLinef(&buf, "%s %s\x00%s\n", oids[i], name, caps)
+			caps = ""
+		} else {
+			writePktLinef(&buf, "%s %s\n", oids[i], name)
+		}
+	}
+	if len(caps) > 0 {
+		writePktLinef(&buf, "%s capabilities^{}\x00%s\n", zeroOid, caps)
+	}
+	writePktFlush(&buf)
+
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-advertisement")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(buf.Bytes())
+}
+
+func (h *HTTPHandler) serveReceivePack(w http.ResponseWriter, req *http.Request, repo string) {
+	body, err := requestBody(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	maxSize := h.MaxPushSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxPushSize
+	}
+	// Reading one more byte than maxSize means the request is too large
+	limited := &io.LimitedReader{R: body, N: maxSize + 1}
+	badRequest := func(err error) {
+		if limited.N <= 0 {
+			http.Error(w, fmt.Sprintf("push is larger than %d bytes", maxSize), http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}
+
+	// Commands, followed by a packfile unless all commands are deletions.
+	var cmds []*receiveCommand
+	sideband := false
+	for {
+		kind, data, err := readPktLine(limited)
+		if err != nil {
+			badRequest(err)
+			return
+		}
+		if kind == pktFlush {
+			break
+		}
+		line := strings.TrimSuffix(string(data), "\n")
+		if i := strings.IndexByte(line, 0); i >= 0 {
+			for _, c := range strings.Fields(line[i+1:]) {
+				if c == "side-band-64k" {
+					sideband = true
+				}
+			}
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 3 || len(fields[0]) != 40 || len(fields[1]) != 40 {
+			http.Error(w, "unsupported receive-pack request: "+line, http.StatusBadRequest)
+			return
+		}
+		cmd := &receiveCommand{ref: fields[2], oldOid: Oid(fields[0]), newOid: Oid(fields[1])}
+		for _, oid := range []*Oid{&cmd.oldOid, &cmd.newOid} {
+			if *oid == zeroOid {
+				*oid = ""
+			} else if !oid.IsValid() {
+				http.Error(w, "invalid object name: "+string(*oid), http.StatusBadRequest)
+				return
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	packData, err := ioutil.ReadAll(limited)
+	if err != nil || limited.N <= 0 {
+		badRequest(err)
+		return
+	}
+
+	unpackErr := receivePack(h.DB, repo, cmds, packData, maxSize)
+
+	// Report status. Errors are reported to the client instead of using
+	// HTTP status codes.
+	var report bytes.Buffer
+	if unpackErr == nil {
+		writePktLinef(&report, "unpack ok\n")
+	} else {
+		writePktLinef(&report, "unpack %s\n", oneLine(unpackErr))
+	}
+	for _, cmd := range cmds {
+		if cmd.err == nil {
+			writePktLinef(&report, "ok %s\n", cmd.ref)
+		} else {
+			writePktLinef(&report, "ng %s %s\n", cmd.ref, oneLine(cmd.err))
+		}
+	}
+	writePktFlush(&report)
+
+	w.Header().Set("Content-Type", "application/x-git-receive-pack-result")
+	w.Header().Set("Cache-Control", "no-cache")
+	if !sideband {
+		w.Write(report.Bytes())
+		return
+	}
+	var buf bytes.Buffer
+	(&sidebandWriter{&buf, 1}).Write(report.Bytes())
+	writePktFlush(&buf)
+	w.Write(buf.Bytes())
+}
+
+// receivePack writes objects in packData and applies ref updates in a
+// single transaction. Errors related to objects are returned. Errors related
+// to ref updates are stored in cmds. If any error happens, nothing is
+// written. maxSize limits the size of each object. See parsePack.
+func receivePack(db *sql.DB, repo string, cmds []*receiveCommand, packData []byte, maxSize int64) error {
+	tx, _, err := getOrCreateTx(db)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	failAll := func(err error) {
+		for _, cmd := range cmds {
+			if cmd.err == nil {
+				cmd.err = err
+			}
+		}
+	}
+
+	r := &Repo{ID: repo}
+	var received []Oid
+	if len(packData) > 0 {
+		if received, err = receiveObjects(tx, r, packData, maxSize); err != nil {
+			failAll(fmt.Errorf("unpacker error"))
+			return err
+		}
+	}
+
+	// New ref values not in the pack must be owned by the repo, so a push
+	// cannot claim objects of other repos.
+	isReceived := toSet(received)
+	failed := false
+	for _, cmd := range cmds {
+		if len(cmd.newOid) > 0 && !isReceived[cmd.newOid] {
+			cmd.err = r.checkOwned(tx, []Oid{cmd.newOid})
+		}
+		if cmd.err == nil {
+			cmd.err = UpdateRef(tx, repo, cmd.ref, cmd.oldOid, cmd.newOid)
+		}
+		if cmd.err != nil {
+			failed = true
+		}
+	}
+	if failed {
+		failAll(fmt.Errorf("atomic transaction failed"))
+		return nil
+	}
+
+	// Pushed objects are owned by the repo. See Repo.
+	var tips []Oid
+	for _, cmd := range cmds {
+		if len(cmd.newOid) > 0 {
+			tips = append(tips, cmd.newOid)
+		}
+	}
+	if err := r.Add(tx, tips); err != nil {
+		failAll(err)
+		return nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		failAll(err)
+	}
+	return nil
+}
+
+// receiveObjects parses a packfile and writes objects not in database.
+// Returns oids of objects in the pack.
+//
+// Objects must be connected: objects they refer to must be either in the
+// pack or owned by the repo. Deltas can only use objects owned by the repo
+// as bases. Objects of other repos are treated as missing.
+func receiveObjects(tx *gitTx, r *Repo, packData []byte, maxSize int64) ([]Oid, error) {
+	objs, err := parsePack(packData, maxSize, func(oid Oid) (string, []byte, error) {
+		// Thin packs have deltas against objects in database.
+		if err := r.checkOwned(tx, []Oid{oid}); err != nil {
+			return "", nil, err
+		}
+		objs, err := readObjects(tx, []Oid{oid})
+		if err != nil {
+			return "", nil, err
+		}
+		return objs[0].Type, objs[0].Body, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, obj := range objs {
+		if err := checkObject(obj); err != nil {
+			return nil, err
+		}
+	}
+
+	oids := make([]Oid, len(objs))
+	var referred []Oid
+	for i, obj := range objs {
+		oids[i] = obj.Oid
+		referred = append(referred, obj.referredOids()...)
+	}
+	newOids, err := unseenOids(tx, oids)
+	if err != nil {
+		return nil, err
+	}
+	isNew := toSet(newOids)
+	newObjs := make([]*gitObj, 0, len(newOids))
+	for _, obj := range objs {
+		if isNew[obj.Oid] {
+			newObjs = append(newObjs, obj)
+		}
+	}
+
+	// Objects in the pack are owned by the repo after the push, so are
+	// objects they refer to. Those not in the pack must be owned already,
+	// even if the referring object exists in database.
+	if err := r.checkOwned(tx, minus(uniqueOids(referred), oids)); err != nil {
+		return nil, err
+	}
+
+	return oids, insertObjects(tx, newObjs)
+}
+
+// oneLine returns the error message without line breaks so it can be used
+// in a pkt-line.
+func oneLine(err error) string {
+	return strings.Replace(err.Error(), "\n", " ", -1)
+}
@@ -0,0 +1,228 @@
+package gitdb
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const refTable = "gitrefs"
+
+// createRefTable creates the refs table. It is a migration step.
+func createRefTable(db *sql.DB) (sql.Result, error) {
+	return db.Exec("CREATE TABLE IF NOT EXISTS " + refTable + " (" +
+		// repo is an application defined name. gitdb does not interpret it.
+		// It makes it possible to store refs of multiple repos in a
+		// single table.
+		"repo VARCHAR(255) NOT NULL," +
+		"name VARCHAR(255) NOT NULL," +
+		"oid CHAR(40) NOT NULL," +
+		"PRIMARY KEY (repo, name))")
+}
+
+// maxNameLength is the max length of repo IDs and ref names, which are
+// stored in VARCHAR(255) columns.
+const maxNameLength = 255
+
+// UpdateRef updates a ref stored in database using compare-and-swap.
+// It is like `git push --force-with-lease=ref:oldOid`.
+//
+// dt is either *sql.DB or *sql.Tx.
+// repo is an application defined repo name, at most 255 bytes.
+// ref is the reference name. It is either "HEAD" or starts with "refs/",
+// and is at most 255 bytes.
+// oldOid is the expected current value of ref. Use an empty Oid to require
+// ref to not exist.
+// newOid is the new value of ref. It must exist in database. Use an empty
+// Oid to delete ref.
+//
+// If ref does not match oldOid, nothing is changed and an error satisfying
+// IsRefConflict is returned.
+func UpdateRef(dt dbOrTx, repo string, ref string, oldOid Oid, newOid Oid) error {
+	if !isValidRefName(ref) {
+		return errUnsafeRefName(ref)
+	}
+	if err := checkRepoID(repo); err != nil {
+		return err
+	}
+	for _, oid := range []Oid{oldOid, newOid} {
+		if len(oid) > 0 && !oid.IsValid() {
+			return fmt.Errorf("invalid oid: %s", oid)
+		}
+	}
+
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+
+	// Refresh the new object so a concurrent GC keeps it. It fails if the
+	// object is missing.
+	if len(newOid) > 0 {
+		if err := touchObjects(tx, []Oid{newOid}, time.Now().Unix()); err != nil {
+			return err
+		}
+	}
+
+	conflict := errRefConflict{repo: repo, ref: ref, expected: oldOid}
+	switch {
+	case oldOid == newOid:
+		// Nothing to write. But the lease still needs to be checked.
+		// UPDATE cannot be used since MySQL reports 0 affected rows if
+		// the value is not changed.
+		current, err := ResolveRef(tx, repo, ref)
+		if err != nil {
+			return err
+		}
+		if current != oldOid {
+			return conflict
+		}
+	case len(oldOid) == 0:
+		// The primary key guarantees at most one concurrent INSERT wins.
+		// Conflicting rows are skipped instead of failing the statement,
+		// since PostgreSQL aborts the transaction on errors.
+		result, err := tx.Exec(tx.rebind(tx.dialect.InsertIgnore(refTable, []string{"repo", "name", "oid"})), repo, ref, string(newOid))
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n != 1 {
+			return conflict
+		}
+	default:
+		var result sql.Result
+		if len(newOid) == 0 {
+			result, err = tx.Exec(tx.rebind("DELETE FROM "+refTable+" WHERE repo = ? AND name = ? AND oid = ?"), repo, ref, string(oldOid))
+		} else {
+			result, err = tx.Exec(tx.rebind("UPDATE "+refTable+" SET oid = ? WHERE repo = ? AND name = ? AND oid = ?"), string(newOid), repo, ref, string(oldOid))
+		}
+		if err != nil {
+			return err
+		}
+		if n, err := result.RowsAffected(); err != nil {
+			return err
+		} else if n != 1 {
+			return conflict
+		}
+	}
+
+	if txByUs {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// ListRefs lists refs of a repo stored in database, sorted by name.
+// It is like `git show-ref` but works directly in database.
+//
+// dt is either *sql.DB or *sql.Tx.
+// repo is the application defined repo name used by UpdateRef.
+//
+// Returns names and oids of the refs.
+func ListRefs(dt dbOrTx, repo string) (names []string, oids []Oid, err error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+	rows, err := tx.Query(tx.rebind("SELECT name, oid FROM "+refTable+" WHERE repo = ? ORDER BY name"), repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, oid string
+		if err := rows.Scan(&name, &oid); err != nil {
+			return nil, nil, err
+		}
+		names = append(names, name)
+		oids = append(oids, Oid(oid))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	return names, oids, nil
+}
+
+// ResolveRef reads the git object ID a ref points to from database.
+// It is like `git rev-parse --verify ref` but works directly in database.
+//
+// dt is either *sql.DB or *sql.Tx.
+// repo is the application defined repo name used by UpdateRef.
+//
+// Returns an empty Oid if ref does not exist.
+func ResolveRef(dt dbOrTx, repo string, ref string) (Oid, error) {
+	tx, txByUs, err := getOrCreateTx(dt)
+	if err != nil {
+		return "", err
+	}
+	if txByUs {
+		defer tx.Rollback()
+	}
+	rows, err := tx.Query(tx.rebind("SELECT oid FROM "+refTable+" WHERE repo = ? AND name = ?"), repo, ref)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var oid string
+	if rows.Next() {
+		if err := rows.Scan(&oid); err != nil {
+			return "", err
+		}
+	}
+	return Oid(oid), rows.Err()
+}
+
+// IsRefConflict tests whether err is returned by UpdateRef because the ref
+// does not match the expected old value.
+func IsRefConflict(err error) bool {
+	_, ok := err.(errRefConflict)
+	return ok
+}
+
+// isValidRefName tests whether ref is "HEAD" or a name under "refs/"
+// following the rules of `git check-ref-format`.
+func isValidRefName(ref string) bool {
+	if ref == "HEAD" {
+		return true
+	}
+	if len(ref) > maxNameLength || !strings.HasPrefix(ref, "refs/") {
+		return false
+	}
+	if strings.Contains(ref, "..") || strings.Contains(ref, "@{") || strings.HasSuffix(ref, ".") {
+		return false
+	}
+	for i := 0; i < len(ref); i++ {
+		if c := ref[i]; c < 0x20 || c == 0x7f || strings.IndexByte(" ~^:?*[\\", c) >= 0 {
+			return false
+		}
+	}
+	for _, component := range strings.Split(ref, "/") {
+		if len(component) == 0 || component[0] == '.' || strings.HasSuffix(component, ".lock") {
+			return false
+		}
+	}
+	return true
+}
+
+type errRefConflict struct {
+	repo     string
+	ref      string
+	expected Oid
+}
+
+func (e errRefConflict) Error() string {
+	if len(e.expected) == 0 {
+		return fmt.Sprintf("ref %s of repo %s already exists", e.ref, e.repo)
+	}
+	return fmt.Sprintf("ref %s of repo %s does not match %s", e.ref, e.repo, e.expected)
+}
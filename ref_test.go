@@ -0,0 +1,102 @@
+package gitdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRefs(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("refs")
+	defer db.Close()
+
+	dir := createRandomRepo("refs", 20, true, true)
+	_, oid1, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+	_, oid2, e := Import(db, dir, "HEAD^")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	// Create
+	if e := UpdateRef(db, "r", "refs/heads/master", "", oid1); e != nil {
+		t.Fatal("UpdateRef (create) error", e)
+	}
+	if e := UpdateRef(db, "r", "refs/heads/master", "", oid2); !IsRefConflict(e) {
+		t.Fatal("UpdateRef unexpected: create an existing ref should conflict", e)
+	}
+
+	// Update
+	if e := UpdateRef(db, "r", "refs/heads/master", oid2, oid2); !IsRefConflict(e) {
+		t.Fatal("UpdateRef unexpected: wrong oldOid should conflict", e)
+	}
+	if e := UpdateRef(db, "r", "refs/heads/master", oid1, oid2); e != nil {
+		t.Fatal("UpdateRef (update) error", e)
+	}
+	if e := UpdateRef(db, "r", "refs/heads/master", oid2, oid2); e != nil {
+		t.Fatal("UpdateRef (no-op) error", e)
+	}
+	if e := UpdateRef(db, "r", "refs/heads/master", oid1, oid2); !IsRefConflict(e) {
+		t.Fatal("UpdateRef unexpected: stale oldOid should conflict", e)
+	}
+
+	// Refs in other repos are independent
+	if e := UpdateRef(db, "r2", "refs/heads/master", "", oid1); e != nil {
+		t.Fatal("UpdateRef (create) error", e)
+	}
+	if e := UpdateRef(db, "r", "HEAD", "", oid1); e != nil {
+		t.Fatal("UpdateRef (create) error", e)
+	}
+
+	names, oids, e := ListRefs(db, "r")
+	if e != nil {
+		t.Fatal("ListRefs error", e)
+	}
+	if len(names) != 2 || names[0] != "HEAD" || names[1] != "refs/heads/master" || oids[0] != oid1 || oids[1] != oid2 {
+		t.Fatal("ListRefs unexpected: ", names, oids)
+	}
+
+	if oid, e := ResolveRef(db, "r2", "refs/heads/master"); e != nil || oid != oid1 {
+		t.Fatal("ResolveRef unexpected: ", oid, e)
+	}
+	if oid, e := ResolveRef(db, "r2", "refs/heads/missing"); e != nil || oid != "" {
+		t.Fatal("ResolveRef unexpected: ", oid, e)
+	}
+
+	// Delete
+	if e := UpdateRef(db, "r2", "refs/heads/master", oid1, ""); e != nil {
+		t.Fatal("UpdateRef (delete) error", e)
+	}
+	if e := UpdateRef(db, "r2", "refs/heads/master", oid1, ""); !IsRefConflict(e) {
+		t.Fatal("UpdateRef unexpected: deleting a missing ref should conflict", e)
+	}
+
+	// Sanity checks
+	missing := Oid("0000000000000000000000000000000000000000")
+	if e := UpdateRef(db, "r", "refs/heads/x", "", missing); e == nil {
+		t.Fatal("UpdateRef unexpected: ref pointing to missing object accepted")
+	}
+	unsafeRefs := []string{
+		"master", "refs/heads/../x", "refs/heads/", "/refs/heads/x", "refs/heads//x", "refs/heads/" + strings.Repeat("x", 250),
+		"refs/heads/a\nb", "refs/heads/a\rb", "refs/heads/a\tb", "refs/heads/a\x00b", "refs/heads/a\x7fb", "refs/heads/a b",
+		"refs/heads/a@{1}", "refs/heads/.x", "refs/heads/x.lock", "refs/heads/x.", "refs/heads/a\\b", "refs/heads/a:b",
+	}
+	for _, ref := range unsafeRefs {
+		if e := UpdateRef(db, "r", ref, "", oid1); e == nil {
+			t.Fatal("UpdateRef unexpected: unsafe ref name accepted", ref)
+		}
+	}
+	for _, ref := range []string{"refs/heads/a.b", "refs/heads/a@b", "refs/heads/x.locked", "refs/tags/v1.0"} {
+		if e := UpdateRef(db, "r", ref, "", oid1); e != nil {
+			t.Fatal("UpdateRef error: valid ref name rejected", ref, e)
+		}
+	}
+	if e := UpdateRef(db, strings.Repeat("r", 256), "HEAD", "", oid1); e == nil {
+		t.Fatal("UpdateRef unexpected: too long repo ID accepted")
+	}
+}
@@ -3,18 +3,29 @@ package gitdb
 import (
 	"bufio"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"math/rand"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 // repo describes a git repository stored in local filesystem.
+// Objects are read directly from loose object files and packfiles, unless
+// gitBinary is set.
 type repo struct {
 	dir string
+
+	// gitBinary makes repo run the external git binary to resolve refs,
+	// list and read objects.
+	gitBinary bool
+
+	objDirs    []string
+	packs      []*pack
+	packsRead  bool
+	packedRefs map[string]Oid
+	shallow    map[Oid]bool
 }
 
 // newRepo returns a new Repo that mapped to a git repo in local filesystem.
@@ -27,84 +38,621 @@ func newRepo(dir string) *repo {
 	}
 }
 
-// listOids lists the git object IDs in hex form.
-// ref is a git commit, for example, "HEAD", "master", "17ae1d07" etc.
-func (r *repo) listOids(ref string) (oids []Oid, err error) {
-	cmd := exec.Command("git", "--git-dir", r.dir, "rev-list", "--objects", ref)
-	out, err := cmd.StdoutPipe()
+// openOrInitRepo returns a new Repo like newRepo. If dir does not exist or
+// is empty, an empty non-bare repository is created first, like `git init`.
+func openOrInitRepo(dir string) (*repo, error) {
+	if entries, err := ioutil.ReadDir(dir); err == nil && len(entries) > 0 {
+		return newRepo(dir), nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	gitDir := filepath.Join(dir, ".git")
+	for _, d := range []string{"objects/info", "objects/pack", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(filepath.Join(gitDir, filepath.FromSlash(d)), 0755); err != nil {
+			return nil, err
+		}
+	}
+	files := map[string]string{
+		"HEAD":   "ref: refs/heads/master\n",
+		"config": "[core]\n\trepositoryformatversion = 0\n\tfilemode = true\n\tbare = false\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(gitDir, name), []byte(content), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return &repo{dir: gitDir}, nil
+}
+
+// close closes opened packfiles.
+func (r *repo) close() {
+	for _, p := range r.packs {
+		p.close()
+	}
+	r.packs = nil
+	r.packsRead = false
+}
+
+// objectDirs returns the objects directory and its alternates. Alternates
+// are read once.
+func (r *repo) objectDirs() []string {
+	if r.objDirs != nil {
+		return r.objDirs
+	}
+	dirs := []string{filepath.Join(r.dir, "objects")}
+	seen := map[string]bool{dirs[0]: true}
+	for i := 0; i < len(dirs); i++ {
+		content, err := ioutil.ReadFile(filepath.Join(dirs[i], "info", "alternates"))
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			if !filepath.IsAbs(line) {
+				line = filepath.Join(dirs[i], line)
+			}
+			if line = filepath.Clean(line); !seen[line] {
+				seen[line] = true
+				dirs = append(dirs, line)
+			}
+		}
+	}
+	r.objDirs = dirs
+	return dirs
+}
+
+// openPacks opens packfiles on demand.
+func (r *repo) openPacks() ([]*pack, error) {
+	if r.packsRead {
+		return r.packs, nil
+	}
+	for _, dir := range r.objectDirs() {
+		idxPaths, err := filepath.Glob(filepath.Join(dir, "pack", "*.idx"))
+		if err != nil {
+			return nil, err
+		}
+		for _, idxPath := range idxPaths {
+			p, err := openPack(idxPath)
+			if err != nil {
+				r.close()
+				return nil, err
+			}
+			r.packs = append(r.packs, p)
+		}
+	}
+	r.packsRead = true
+	return r.packs, nil
+}
+
+// looseObjectPath returns the path of a loose object if it exists.
+func (r *repo) looseObjectPath(oid Oid) (string, bool) {
+	for _, dir := range r.objectDirs() {
+		path := filepath.Join(dir, string(oid)[0:2], string(oid)[2:])
+		if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// readRawObject reads type and body of a git object, without verifying its
+// SHA1.
+func (r *repo) readRawObject(oid Oid) (typ string, body []byte, err error) {
+	return r.readRawObjectAt(oid, 0)
+}
+
+// readRawObjectAt is like readRawObject. depth is the length of the delta
+// chain that needs the object as a base, so chains crossing packs are
+// limited too.
+func (r *repo) readRawObjectAt(oid Oid, depth int) (typ string, body []byte, err error) {
+	if !oid.IsValid() {
+		return "", nil, fmt.Errorf("invalid oid: %s", oid)
+	}
+	if path, ok := r.looseObjectPath(oid); ok {
+		zcontent, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", nil, err
+		}
+		o, err := newGitObjFromZcontent(zcontent)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot read object %s: %s", path, err)
+		}
+		return o.Type, o.Body, nil
+	}
+
+	packs, err := r.openPacks()
+	if err != nil {
+		return "", nil, err
+	}
+	for _, p := range packs {
+		if offset, ok := p.find(oid); ok {
+			return p.read(offset, depth, r.readRawObjectAt)
+		}
+	}
+	return "", nil, errRepoMissingObject(oid)
+}
+
+// readObject reads a git object and verifies its SHA1.
+func (r *repo) readObject(oid Oid) (*gitObj, error) {
+	typ, body, err := r.readRawObject(oid)
 	if err != nil {
 		return nil, err
 	}
-	if err = cmd.Start(); err != nil {
+	if actual := hashObject(typ, body); actual != oid {
+		return nil, fmt.Errorf("sha1 mismatch: oid = %s, sha1(content) = %s", oid, actual)
+	}
+	return &gitObj{Oid: oid, Type: typ, Body: body}, nil
+}
+
+// readObjects reads git objects in batch and returns an array of GitObject.
+func (r *repo) readObjects(oids []Oid) (objs []*gitObj, err error) {
+	if r.gitBinary {
+		return r.readObjectsUsingGit(oids)
+	}
+	objs = make([]*gitObj, 0, len(oids))
+	for _, oid := range oids {
+		o, err := r.readObject(oid)
+		if err != nil {
+			return nil, err
+		}
+		objs = append(objs, o)
+	}
+	return objs, nil
+}
+
+// hasOid checks whether an object exists or not.
+func (r *repo) hasOid(oid Oid) bool {
+	if !oid.IsValid() {
+		return false
+	}
+	if _, ok := r.looseObjectPath(oid); ok {
+		return true
+	}
+	packs, err := r.openPacks()
+	if err != nil {
+		return false
+	}
+	for _, p := range packs {
+		if _, ok := p.find(oid); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// listOids lists oids of objects reachable from the given oids, including
+// themselves. It is like `git rev-list --objects`, but the order is
+// different. Parents of commits in the shallow file are not listed.
+func (r *repo) listOids(oids []Oid) ([]Oid, error) {
+	result, _, err := r.listObjects(oids)
+	return result, err
+}
+
+// listObjects is like listOids, and also returns objects read while walking,
+// which are all listed objects except blobs, so they do not need to be read
+// again. No objects are returned if gitBinary is set.
+func (r *repo) listObjects(oids []Oid) ([]Oid, map[Oid]*gitObj, error) {
+	if r.gitBinary {
+		result, err := r.listOidsUsingGit(oids)
+		return result, nil, err
+	}
+	shallow, err := r.readShallow()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// typ is an empty string if the object type is unknown. Blobs are not
+	// read since they do not refer to other objects.
+	type pending struct {
+		oid Oid
+		typ string
+	}
+	queue := make([]pending, 0, len(oids))
+	for _, oid := range oids {
+		queue = append(queue, pending{oid, ""})
+	}
+
+	var result []Oid
+	visited := make(map[Oid]bool)
+	objs := make(map[Oid]*gitObj)
+	for i := 0; i < len(queue); i++ {
+		p := queue[i]
+		if visited[p.oid] {
+			continue
+		}
+		visited[p.oid] = true
+		result = append(result, p.oid)
+		if p.typ == "blob" {
+			continue
+		}
+
+		o, err := r.readObject(p.oid)
+		if err != nil {
+			return nil, nil, err
+		}
+		objs[o.Oid] = o
+		if len(p.typ) > 0 && p.typ != o.Type {
+			return nil, nil, fmt.Errorf("object %s is a %s, not a %s", o.Oid, o.Type, p.typ)
+		}
+		switch o.Type {
+		case "commit":
+			for j, oid := range o.referredOids() {
+				typ := "commit"
+				if j == 0 {
+					typ = "tree"
+				} else if shallow[p.oid] {
+					break
+				}
+				queue = append(queue, pending{oid, typ})
+			}
+		case "tree":
+			for _, ti := range parseTree(o.Body) {
+				switch {
+				case ti.IsGitlink():
+					// commit in another repo
+				case ti.IsTree():
+					queue = append(queue, pending{ti.Oid, "tree"})
+				default:
+					queue = append(queue, pending{ti.Oid, "blob"})
+				}
+			}
+		case "tag":
+			for _, oid := range o.referredOids() {
+				queue = append(queue, pending{oid, tagTargetType(o.Body)})
+			}
+		}
+	}
+	return result, objs, nil
+}
+
+// allRefOids returns oids of HEAD and all refs, like `git rev-parse --all`.
+func (r *repo) allRefOids() ([]Oid, error) {
+	var oids []Oid
+	oid, err := r.readRef("HEAD", 0)
+	if err != nil {
 		return nil, err
 	}
+	if len(oid) > 0 {
+		oids = append(oids, oid)
+	}
 
-	reader := bufio.NewReader(out)
-	for {
-		line, err := reader.ReadString('\n')
+	refsDir := filepath.Join(r.dir, "refs")
+	err = filepath.Walk(refsDir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
-			break
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
 		}
-		oid := Oid(strings.Split(line, " ")[0][0:40])
-		if oid.IsValid() {
+		name, err := filepath.Rel(r.dir, path)
+		if err != nil {
+			return err
+		}
+		oid, err := r.readRef(filepath.ToSlash(name), 0)
+		if err != nil {
+			return err
+		}
+		if len(oid) > 0 {
 			oids = append(oids, oid)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	packedRefs, err := r.readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	for _, oid := range packedRefs {
+		oids = append(oids, oid)
+	}
+	return minus(oids, nil), nil
+}
+
+// resolveRef resolves ref to a git object ID. It is like `git rev-parse`.
+// ref can be a full ref name, a short branch or tag name, a full or
+// abbreviated hex oid, followed by "^", "^N", "~N", "^{}", "^{type}"
+// suffixes. Unlike listOids, annotated tags are not peeled unless "^{}" is
+// used.
+func (r *repo) resolveRef(ref string) (Oid, error) {
+	if r.gitBinary {
+		return r.resolveRefUsingGit(ref)
+	}
+
+	name, suffix := ref, ""
+	if i := strings.IndexAny(ref, "^~"); i >= 0 {
+		name, suffix = ref[:i], ref[i:]
+	}
+	oid, err := r.resolveName(name)
+	if err != nil {
+		return "", err
+	}
+
+	for len(suffix) > 0 {
+		op := suffix[0]
+		suffix = suffix[1:]
+		if op == '^' && strings.HasPrefix(suffix, "{") {
+			end := strings.IndexByte(suffix, '}')
+			if end < 0 {
+				return "", errUnknownRef(ref)
+			}
+			typ := suffix[1:end]
+			suffix = suffix[end+1:]
+			if oid, err = r.peel(oid, typ); err != nil {
+				return "", err
+			}
+			continue
+		}
+
+		n := 1
+		digits := len(suffix) - len(strings.TrimLeft(suffix, "0123456789"))
+		if digits > 0 {
+			n, _ = strconv.Atoi(suffix[:digits])
+			suffix = suffix[digits:]
+		}
+		if oid, err = r.peel(oid, "commit"); err != nil {
+			return "", err
+		}
+		if op == '^' && n == 0 {
+			continue
+		}
+		steps, nth := n, 1
+		if op == '^' {
+			steps, nth = 1, n
+		}
+		for ; steps > 0; steps-- {
+			o, err := r.readObject(oid)
+			if err != nil {
+				return "", err
+			}
+			// referredOids of a commit: tree, parent1, parent2, ...
+			referred := o.referredOids()
+			if nth >= len(referred) {
+				return "", errUnknownRef(ref)
+			}
+			oid = referred[nth]
+		}
 	}
+	return oid, nil
+}
 
-	cmd.Wait()
-	return oids, nil
+// resolveName resolves a ref name or an oid prefix to an oid, using the
+// rules described by gitrevisions(7).
+func (r *repo) resolveName(name string) (Oid, error) {
+	if Oid(name).IsValid() {
+		return Oid(name), nil
+	}
+	if len(name) > 0 && !strings.Contains(name, "..") {
+		candidates := []string{"refs/" + name, "refs/tags/" + name, "refs/heads/" + name, "refs/remotes/" + name, "refs/remotes/" + name + "/HEAD"}
+		if strings.HasPrefix(name, "refs/") || strings.Trim(name, "ABCDEFGHIJKLMNOPQRSTUVWXYZ_") == "" {
+			candidates = append([]string{name}, candidates...)
+		}
+		for _, c := range candidates {
+			oid, err := r.readRef(c, 0)
+			if err != nil {
+				return "", err
+			}
+			if len(oid) > 0 {
+				return oid, nil
+			}
+		}
+	}
+
+	// Abbreviated oid
+	if len(name) >= 4 && strings.Trim(name, "0123456789abcdef") == "" {
+		oids, err := r.findOidsByPrefix(name)
+		if err != nil {
+			return "", err
+		}
+		if len(oids) > 1 {
+			return "", fmt.Errorf("ambiguous oid prefix: %s", name)
+		}
+		if len(oids) == 1 {
+			return oids[0], nil
+		}
+	}
+	return "", errUnknownRef(name)
 }
 
-// readObjects reads git objects in batch and returns an array of GitObject.
-func (r *repo) readObjects(oids []Oid) (objs []*gitObj, err error) {
-	cmd := exec.Command("git", "--git-dir", r.dir, "cat-file", "--batch")
-	cmd.Stdin = strings.NewReader(joinOids(oids, "\n"))
-	out, err := cmd.StdoutPipe()
+// findOidsByPrefix finds oids of objects starting with a hex prefix.
+func (r *repo) findOidsByPrefix(prefix string) ([]Oid, error) {
+	var oids []Oid
+	for _, dir := range r.objectDirs() {
+		names, _ := filepath.Glob(filepath.Join(dir, prefix[0:2], prefix[2:]+"*"))
+		for _, name := range names {
+			oid := Oid(prefix[0:2] + filepath.Base(name))
+			if oid.IsValid() {
+				oids = append(oids, oid)
+			}
+		}
+	}
+	packs, err := r.openPacks()
 	if err != nil {
 		return nil, err
 	}
+	for _, p := range packs {
+		oids = append(oids, p.findPrefix(prefix)...)
+	}
+	return minus(oids, nil), nil
+}
+
+// readRef reads a ref from a loose ref file or packed-refs, following
+// symbolic refs. Returns an empty Oid if the ref does not exist.
+func (r *repo) readRef(name string, depth int) (Oid, error) {
+	if depth > 5 {
+		return "", fmt.Errorf("symbolic ref nested too deeply: %s", name)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(r.dir, filepath.FromSlash(name)))
+	if err == nil {
+		line := strings.TrimSpace(string(content))
+		if strings.HasPrefix(line, "ref:") {
+			return r.readRef(strings.TrimSpace(line[4:]), depth+1)
+		}
+		if oid := Oid(line); oid.IsValid() {
+			return oid, nil
+		}
+		return "", fmt.Errorf("illformed ref %s: %q", name, line)
+	}
 
-	err = cmd.Start()
+	packedRefs, err := r.readPackedRefs()
 	if err != nil {
+		return "", err
+	}
+	return packedRefs[name], nil
+}
+
+// readPackedRefs reads and caches the packed-refs file.
+func (r *repo) readPackedRefs() (map[string]Oid, error) {
+	if r.packedRefs != nil {
+		return r.packedRefs, nil
+	}
+	refs := make(map[string]Oid)
+	content, err := ioutil.ReadFile(filepath.Join(r.dir, "packed-refs"))
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
+	for _, line := range strings.Split(string(content), "\n") {
+		// "# comment", "oid name", or "^peeled-oid"
+		if len(line) < 42 || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		if oid := Oid(line[0:40]); oid.IsValid() && line[40] == ' ' {
+			refs[strings.TrimSpace(line[41:])] = oid
+		}
+	}
+	r.packedRefs = refs
+	return refs, nil
+}
 
-	objs = make([]*gitObj, 0, len(oids))
+// readShallow reads and caches the shallow file of a shallow clone. It lists
+// commits whose parents are not in the repo.
+func (r *repo) readShallow() (map[Oid]bool, error) {
+	if r.shallow != nil {
+		return r.shallow, nil
+	}
+	shallow := make(map[Oid]bool)
+	content, err := ioutil.ReadFile(filepath.Join(r.dir, "shallow"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Fields(string(content)) {
+		if oid := Oid(line); oid.IsValid() {
+			shallow[oid] = true
+		}
+	}
+	r.shallow = shallow
+	return shallow, nil
+}
+
+// peel follows tags, and commit to tree, until an object of the given type
+// is found. If typ is empty, only tags are peeled, like "^{}".
+func (r *repo) peel(oid Oid, typ string) (Oid, error) {
 	for {
-		// header: sha1 + " " + type + " " + size + "\n"
-		var obj gitObj
-		var size int
-		n, err := fmt.Fscanf(out, "%s %s %d\n", &obj.Oid, &obj.Type, &size)
-		if err != nil || n < 3 {
-			break
+		o, err := r.readObject(oid)
+		if err != nil {
+			return "", err
 		}
+		if o.Type == typ || (typ == "" && o.Type != "tag") {
+			return oid, nil
+		}
+		referred := o.referredOids()
+		if len(referred) == 0 || (o.Type != "tag" && !(o.Type == "commit" && typ == "tree")) {
+			return "", fmt.Errorf("object %s is a %s, cannot be peeled to %s", oid, o.Type, typ)
+		}
+		oid = referred[0]
+	}
+}
 
-		// body: bytes + "\n"
-		obj.Body = make([]byte, size)
-		n, err = io.ReadFull(out, obj.Body)
-		fmt.Fscanf(out, "\n")
-		if err != nil || n < size {
+// tagTargetType returns the "type" header of an annotated tag body, or an
+// empty string if it is missing.
+func tagTargetType(body []byte) string {
+	for _, line := range strings.Split(string(body), "\n") {
+		if len(line) == 0 {
 			break
 		}
-		objs = append(objs, &obj)
+		if strings.HasPrefix(line, "type ") {
+			return line[len("type "):]
+		}
 	}
+	return ""
+}
 
-	cmd.Process.Kill()
-	cmd.Wait()
+// writePack writes objects to a new packfile and its index under
+// objects/pack. The index is written last so git will not see a partially
+// written pack.
+func (r *repo) writePack(objs []*gitObj, deltas bool) error {
+	dir := filepath.Join(r.dir, "objects", "pack")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
 
-	if len(objs) != len(oids) {
-		return objs, fmt.Errorf("git cat-file only returns %d objects, but %d required", len(objs), len(oids))
+	if deltas {
+		sorted := make([]*gitObj, len(objs))
+		copy(sorted, objs)
+		sortObjectsForDeltas(sorted)
+		objs = sorted
 	}
 
-	return objs, nil
-}
+	packFile, err := ioutil.TempFile(dir, "tmp_pack_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(packFile.Name())
+	defer packFile.Close()
 
-// hasOid checks whether an object exists or not.
-// It runs an external git process so do not call frequently.
-func (r *repo) hasOid(oid Oid) bool {
-	cmd := exec.Command("git", "--git-dir", r.dir, "cat-file", "-e", string(oid))
-	err := cmd.Run()
-	return err == nil
+	w := bufio.NewWriter(packFile)
+	pw, err := newPackWriter(w, len(objs), deltas)
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if err := pw.writeObject(o); err != nil {
+			return err
+		}
+	}
+	checksum, err := pw.close()
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := packFile.Close(); err != nil {
+		return err
+	}
+
+	idxFile, err := ioutil.TempFile(dir, "tmp_idx_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(idxFile.Name())
+	defer idxFile.Close()
+	if err := pw.writeIndex(idxFile, checksum); err != nil {
+		return err
+	}
+	if err := idxFile.Close(); err != nil {
+		return err
+	}
+
+	name := filepath.Join(dir, fmt.Sprintf("pack-%x", checksum))
+	for _, tmp := range []struct{ from, to string }{{packFile.Name(), name + ".pack"}, {idxFile.Name(), name + ".idx"}} {
+		if err := os.Chmod(tmp.from, 0444); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp.from, tmp.to); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (r *repo) writeRawObject(oid Oid, zlibContent []byte) error {
@@ -148,3 +696,15 @@ type errUnsafeRefName string
 func (e errUnsafeRefName) Error() string {
 	return "unsafe ref name: " + string(e)
 }
+
+type errUnknownRef string
+
+func (e errUnknownRef) Error() string {
+	return "unknown ref: " + string(e)
+}
+
+type errRepoMissingObject string
+
+func (e errRepoMissingObject) Error() string {
+	return fmt.Sprintf("git object %s required but not found in repository", string(e))
+}
@@ -0,0 +1,114 @@
+package gitdb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// This file contains fallbacks of repo methods that run the external git
+// binary. They are used when repo.gitBinary is set.
+
+// resolveRefUsingGit resolves ref to a git object ID using `git rev-parse`.
+func (r *repo) resolveRefUsingGit(ref string) (Oid, error) {
+	out, err := exec.Command("git", "--git-dir", r.dir, "rev-parse", "--verify", "--quiet", ref).Output()
+	oid := Oid(strings.TrimSpace(string(out)))
+	if err != nil || !oid.IsValid() {
+		return "", errUnknownRef(ref)
+	}
+	return oid, nil
+}
+
+// listOidsUsingGit lists the git object IDs using `git rev-list --objects`.
+func (r *repo) listOidsUsingGit(oids []Oid) ([]Oid, error) {
+	args := []string{"--git-dir", r.dir, "rev-list", "--objects"}
+	for _, oid := range oids {
+		args = append(args, string(oid))
+	}
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	var result []Oid
+	reader := bufio.NewReader(out)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		if len(line) < 40 {
+			continue
+		}
+		oid := Oid(line[0:40])
+		if oid.IsValid() {
+			result = append(result, oid)
+		}
+	}
+
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("git rev-list failed: %s %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return result, nil
+}
+
+// readObjectsUsingGit reads git objects in batch using `git cat-file --batch`.
+func (r *repo) readObjectsUsingGit(oids []Oid) (objs []*gitObj, err error) {
+	cmd := exec.Command("git", "--git-dir", r.dir, "cat-file", "--batch")
+	cmd.Stdin = strings.NewReader(joinOids(oids, "\n") + "\n")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	out := bufio.NewReader(stdout)
+	objs = make([]*gitObj, 0, len(oids))
+	for _, oid := range oids {
+		// header: sha1 + " " + type + " " + size + "\n"
+		// or: sha1 + " missing\n"
+		header, err := out.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("git cat-file exited unexpectedly after %d objects: %s", len(objs), err)
+		}
+		fields := strings.Fields(header)
+		if len(fields) == 2 && fields[1] == "missing" {
+			return nil, errRepoMissingObject(oid)
+		}
+		if len(fields) != 3 || Oid(fields[0]) != oid {
+			return nil, fmt.Errorf("git cat-file returned unexpected header for %s: %q", oid, header)
+		}
+		size, err := strconv.Atoi(fields[2])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("git cat-file returned unexpected header for %s: %q", oid, header)
+		}
+
+		// body: bytes + "\n"
+		obj := gitObj{Oid: oid, Type: fields[1], Body: make([]byte, size+1)}
+		if _, err = io.ReadFull(out, obj.Body); err != nil {
+			return nil, fmt.Errorf("git cat-file returned truncated object %s: %s", oid, err)
+		}
+		obj.Body = obj.Body[0:size]
+		objs = append(objs, &obj)
+	}
+
+	return objs, nil
+}
@@ -142,31 +142,119 @@ func TestRepo(t *testing.T) {
 	}
 
 	n := 30
-	dir := createRandomRepo("a", n, true, true)
-	r := newRepo(dir)
+	dir := createRandomRepo("a", n, false, true)
 
-	// Test ListOids
-	oids, e := r.listOids("HEAD")
-	if e != nil {
-		t.Fatal("Failed to listOids: ", e)
-	}
-	for _, v := range oids {
-		if !v.IsValid() {
-			t.Error("Invalid oid: ", v)
+	// Test both loose objects and packfiles, read natively or by git binary
+	for _, packed := range []bool{false, true} {
+		if packed {
+			if err := exec.Command("git", "--git-dir", filepath.Join(dir, ".git"), "repack", "-a", "-d", "-f", "--depth=20").Run(); err != nil {
+				t.Fatal("git repack error", err)
+			}
+		}
+		var oidSets [2]map[Oid]bool
+		for i, gitBinary := range []bool{false, true} {
+			r := newRepo(dir)
+			r.gitBinary = gitBinary
+
+			head, e := r.resolveRef("HEAD")
+			if e != nil {
+				t.Fatal("Failed to resolveRef: ", e)
+			}
+
+			// Test ListOids
+			oids, e := r.listOids([]Oid{head})
+			if e != nil {
+				t.Fatal("Failed to listOids: ", e)
+			}
+			for _, v := range oids {
+				if !v.IsValid() {
+					t.Error("Invalid oid: ", v)
+				}
+			}
+			if len(oids) < n {
+				t.Fatal("len(oids) = ", len(oids), " < ", n)
+			}
+			oidSets[i] = toSet(oids)
+
+			// Test ReadObjects
+			objs, e := r.readObjects(oids)
+			if e != nil {
+				t.Fatal("Failed to readObjects: ", e)
+			}
+			if len(objs) != len(oids) {
+				t.Fatal("readObjects returns ", len(objs), " objects, expected ", len(oids))
+			}
+			for _, o := range objs {
+				if verifyGitObject(o) == false {
+					t.Error("Git object checksum mismatch: ", o.Oid)
+				}
+			}
+
+			// Test listObjects returns objects read while walking
+			_, listed, e := r.listObjects([]Oid{head})
+			if e != nil {
+				t.Fatal("Failed to listObjects: ", e)
+			}
+			for _, o := range objs {
+				if l := listed[o.Oid]; (l != nil) != (!gitBinary && o.Type != "blob") || (l != nil && !bytes.Equal(l.Body, o.Body)) {
+					t.Error("listObjects returns unexpected object: ", o.Oid)
+				}
+			}
+
+			// Test missing objects
+			missing := Oid("0000000000000000000000000000000000000000")
+			if _, e := r.readObjects([]Oid{head, missing}); e == nil {
+				t.Error("readObjects does not report missing objects")
+			}
+			if r.hasOid(missing) || !r.hasOid(head) {
+				t.Error("hasOid is incorrect")
+			}
+			r.close()
+		}
+		if len(oidSets[0]) != len(oidSets[1]) {
+			t.Fatal("listOids returns different objects with and without git binary")
+		}
+		for oid := range oidSets[0] {
+			if !oidSets[1][oid] {
+				t.Fatal("listOids returns different objects with and without git binary")
+			}
 		}
 	}
-	if len(oids) < n {
-		t.Fatal("len(oids) = ", len(oids), " < ", n)
+}
+
+func TestResolveRef(t *testing.T) {
+	if !checkGit() {
+		return
 	}
 
-	// Test ReadObjects
-	objs, e := r.readObjects(oids)
-	if e != nil {
-		t.Fatal("Failed to readObjects: ", e)
+	dir := createRandomRepo("rev", 20, false, true)
+	gitDir := filepath.Join(dir, ".git")
+	exec.Command("git", "--git-dir", gitDir, "tag", "-a", "-m", "tag", "v1", "HEAD~2").Run()
+	exec.Command("git", "--git-dir", gitDir, "tag", "light", "HEAD^").Run()
+	exec.Command("git", "--git-dir", gitDir, "branch", "topic", "HEAD~3").Run()
+	out, _ := exec.Command("git", "--git-dir", gitDir, "rev-parse", "HEAD").Output()
+	head := string(bytes.TrimSpace(out))
+
+	refs := []string{
+		"HEAD", "master", "refs/heads/master", "heads/master", "topic", "light",
+		"v1", "v1^{}", "v1^{commit}", "v1^{tree}", "v1~1", "tags/v1^0",
+		"HEAD^", "HEAD~2", "HEAD^1^1", "HEAD~0", "HEAD^^2", "master~2^2",
+		head, head[0:7], head[0:7] + "^", "missing", "HEAD~99999", "v1^{blob}",
 	}
-	for _, o := range objs {
-		if verifyGitObject(o) == false {
-			t.Error("Git object checksum mismatch: ", o.Oid)
+	for _, packed := range []bool{false, true} {
+		if packed {
+			exec.Command("git", "--git-dir", gitDir, "pack-refs", "--all").Run()
+			exec.Command("git", "--git-dir", gitDir, "repack", "-a", "-d").Run()
+		}
+		r := newRepo(dir)
+		for _, ref := range refs {
+			out, err := exec.Command("git", "--git-dir", gitDir, "rev-parse", "--verify", "--quiet", ref).Output()
+			expected := Oid(bytes.TrimSpace(out))
+			oid, e := r.resolveRef(ref)
+			if (err != nil) != (e != nil) || oid != expected {
+				t.Errorf("resolveRef(%s) = %s, %v; expected %s, %v", ref, oid, e, expected, err)
+			}
 		}
+		r.close()
 	}
 }
@@ -0,0 +1,418 @@
+package gitdb
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	schemaTable   = "gitdb_schema"
+	settingsTable = "gitdb_settings"
+)
+
+// migrations are ordered steps upgrading the schema. Step i upgrades the
+// schema to version i+1.
+//
+// Steps must be idempotent since databases created before schema versioning
+// already have some of the tables. Released steps must not be changed. New
+// steps are appended.
+var migrations = []func(db *sql.DB, d Dialect) error{
+	// 1: objects and refs
+	func(db *sql.DB, d Dialect) error {
+		if _, err := createObjectTable(db, d); err != nil {
+			return err
+		}
+		_, err := createRefTable(db)
+		return err
+	},
+	// 2: chunks of large objects
+	func(db *sql.DB, d Dialect) error {
+		_, err := createChunkTable(db, d)
+		return err
+	},
+	// 3: objects owned by repos
+	func(db *sql.DB, d Dialect) error {
+		_, err := createMemberTable(db)
+		return err
+	},
+	// 4: modification time of objects, for the GC grace period
+	func(db *sql.DB, d Dialect) error {
+		if rows, err := db.Query("SELECT mtime FROM " + table + " WHERE 1 = 0"); err == nil {
+			rows.Close()
+			return nil
+		}
+		// Existing objects are old enough to be deleted by GC.
+		_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN mtime BIGINT NOT NULL DEFAULT 0")
+		return err
+	},
+	// 5: commit graph with generation numbers
+	func(db *sql.DB, d Dialect) error {
+		if _, err := createCommitGraphTable(db); err != nil {
+			return err
+		}
+		if _, err := createCommitGraphParentsTable(db); err != nil {
+			return err
+		}
+		return fillCommitGraph(db, d)
+	},
+	// 6: settings shared by processes using the database
+	func(db *sql.DB, d Dialect) error {
+		_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + settingsTable + " (" +
+			"name VARCHAR(64) PRIMARY KEY NOT NULL," +
+			"value VARCHAR(255) NOT NULL)")
+		return err
+	},
+	// 7: references between objects, and the commit cache. They are used
+	// if enabled by Migrate options.
+	func(db *sql.DB, d Dialect) error {
+		if _, err := createEdgeTable(db); err != nil {
+			return err
+		}
+		_, err := createCommitCacheTable(db)
+		return err
+	},
+}
+
+// settings are stored in the gitdb_settings table, so all processes using
+// a database agree on them. They are set by Migrate options.
+type settings struct {
+	dialect     Dialect
+	chunkSize   int
+	commitCache bool
+
+	// edges is edgesOn, edgesOff, or empty during the backfill. It is read
+	// by edgesSetting when needed.
+	edges     string
+	edgesRead bool
+}
+
+// edgesSetting reads the edges setting in the transaction, once. Unlike
+// other settings, it is not cached for a *sql.DB, since the backfill relies
+// on writers seeing it change. See enableEdges.
+func (tx *gitTx) edgesSetting() (string, error) {
+	if !tx.edgesRead {
+		var value string
+		err := tx.QueryRow(tx.rebind("SELECT value FROM "+settingsTable+" WHERE name = ?"), settingEdges).Scan(&value)
+		if err != nil && err != sql.ErrNoRows {
+			return "", err
+		}
+		tx.edges, tx.edgesRead = value, true
+	}
+	return tx.edges, nil
+}
+
+// writeEdges tests whether edges of new objects are written. Edges are
+// written during the backfill, so objects written concurrently are not
+// missed.
+func (tx *gitTx) writeEdges() (bool, error) {
+	edges, err := tx.edgesSetting()
+	return edges != edgesOff, err
+}
+
+// readEdges tests whether the edges table is complete, and can be used by
+// reachability queries. If it is used before the backfill completes, or by
+// some processes only, reachable objects would be missed, and GC would
+// delete them.
+func (tx *gitTx) readEdges() (bool, error) {
+	edges, err := tx.edgesSetting()
+	return edges == edgesOn, err
+}
+
+// Names of settings in the gitdb_settings table.
+const (
+	settingDialect     = "dialect"
+	settingChunkSize   = "chunk_size"
+	settingEdges       = "edges"
+	settingCommitCache = "commit_cache"
+)
+
+// Values of the edges setting. If the setting is missing, the edges table
+// is not backfilled yet.
+const (
+	edgesOn  = "on"
+	edgesOff = "off"
+)
+
+// schemaVersion is the schema version required by this version of gitdb.
+func schemaVersion() int {
+	return len(migrations)
+}
+
+type errSchemaVersion struct {
+	actual, expected int
+}
+
+func (e errSchemaVersion) Error() string {
+	if e.actual < e.expected {
+		return fmt.Sprintf("database schema version %d is too old, expected %d: run Migrate to upgrade", e.actual, e.expected)
+	}
+	return fmt.Sprintf("database schema version %d is too new, expected %d: upgrade gitdb", e.actual, e.expected)
+}
+
+// IsSchemaVersionError tests whether err is caused by a database schema
+// version not matching the version required by gitdb.
+func IsSchemaVersionError(err error) bool {
+	_, ok := err.(errSchemaVersion)
+	return ok
+}
+
+// Migrate creates the required tables, or upgrades them to the schema
+// version required by gitdb. It is safe to call Migrate on every start.
+// The schema version is stored in the gitdb_schema table.
+//
+// Migrate refuses to downgrade a schema upgraded by a newer gitdb.
+//
+// Other functions refuse to run against a schema not matching the required
+// version.
+//
+// Options like WithDialect and WithChunkSize are stored in the
+// gitdb_settings table, and are used by all processes sharing the database.
+// Settings not given by options are kept. Other processes notice changed
+// settings, and an upgraded schema, within 10 seconds.
+func Migrate(db *sql.DB, options ...CreateTableOption) error {
+	var cfg createTableConfig
+	for _, option := range options {
+		option(&cfg)
+	}
+	defer forgetSettings(db)
+
+	// The dialect is needed before creating tables
+	stored, err := readSettings(db)
+	if err != nil && !isMissingTable(err) {
+		return err
+	}
+	d := cfg.dialect
+	if name, ok := stored[settingDialect]; ok {
+		if d != nil && d.Name() != name {
+			return fmt.Errorf("database uses dialect %q, not %q", name, d.Name())
+		}
+		if d, err = dialectByName(name); err != nil {
+			return err
+		}
+	} else if d == nil {
+		d = detectDialect(db)
+	}
+
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS " + schemaTable + " (" +
+		"id INT PRIMARY KEY NOT NULL," +
+		"version INT NOT NULL)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(rebind(d, d.InsertIgnore(schemaTable, []string{"id", "version"})), 1, 0)
+	if err != nil {
+		return err
+	}
+
+	version, err := readSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion() {
+		return errSchemaVersion{version, schemaVersion()}
+	}
+	for ; version < schemaVersion(); version++ {
+		if err := migrations[version](db, d); err != nil {
+			return fmt.Errorf("cannot migrate schema to version %d: %s", version+1, err)
+		}
+		_, err = db.Exec(rebind(d, "UPDATE "+schemaTable+" SET version = ? WHERE id = 1 AND version < ?"), version+1, version+1)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Settings
+	if err := writeSetting(db, d, settingDialect, d.Name()); err != nil {
+		return err
+	}
+	if cfg.chunkSize != nil {
+		if err := writeSetting(db, d, settingChunkSize, strconv.Itoa(*cfg.chunkSize)); err != nil {
+			return err
+		}
+	}
+
+	if cfg.commitCache != nil {
+		commitCache := "off"
+		if *cfg.commitCache {
+			commitCache = "on"
+		}
+		if err := writeSetting(db, d, settingCommitCache, commitCache); err != nil {
+			return err
+		}
+	}
+	switch {
+	case cfg.edges != nil && !*cfg.edges:
+		return disableEdges(db, d)
+	case cfg.edges != nil || stored[settingEdges] != edgesOff:
+		// A missing setting means the backfill is not done yet
+		return enableEdges(db, d)
+	}
+	return nil
+}
+
+// readSettings reads the gitdb_settings table.
+func readSettings(dt dbOrTx) (map[string]string, error) {
+	rows, err := dt.Query("SELECT name, value FROM " + settingsTable)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	values := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		values[name] = value
+	}
+	return values, rows.Err()
+}
+
+// writeSetting writes a setting to the gitdb_settings table.
+func writeSetting(dt dbOrTx, d Dialect, name string, value string) error {
+	_, err := dt.Exec(rebind(d, d.InsertIgnore(settingsTable, []string{"name", "value"})), name, value)
+	if err == nil {
+		_, err = dt.Exec(rebind(d, "UPDATE "+settingsTable+" SET value = ? WHERE name = ?"), value, name)
+	}
+	return err
+}
+
+// settingsTTL is how long settings of a *sql.DB or *sql.Tx are cached.
+// Settings changed, or a schema upgraded, by Migrate in other processes are
+// noticed after it.
+const settingsTTL = 10 * time.Second
+
+var (
+	settingsMu    sync.Mutex
+	settingsCache = make(map[dbOrTx]cachedSettings)
+)
+
+type cachedSettings struct {
+	settings
+	expires time.Time
+}
+
+// dbSettings returns settings of a *sql.DB or *sql.Tx loaded by
+// loadSettings, and caches them for settingsTTL. Errors are not cached.
+//
+// A *sql.Tx does not tell which database it belongs to, so its settings are
+// cached separately. Functions called repeatedly in a transaction check the
+// schema version once.
+func dbSettings(dt dbOrTx) (settings, error) {
+	now := time.Now()
+	settingsMu.Lock()
+	c, ok := settingsCache[dt]
+	settingsMu.Unlock()
+	if ok && now.Before(c.expires) {
+		return c.settings, nil
+	}
+
+	s, err := loadSettings(dt)
+	if err != nil {
+		return s, err
+	}
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	// Expired entries, like those of closed databases or finished
+	// transactions, are dropped
+	for k, v := range settingsCache {
+		if !now.Before(v.expires) {
+			delete(settingsCache, k)
+		}
+	}
+	settingsCache[dt] = cachedSettings{s, now.Add(settingsTTL)}
+	return s, nil
+}
+
+// forgetSettings drops cached settings of db. It is called after Migrate
+// changes them.
+func forgetSettings(db *sql.DB) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	delete(settingsCache, db)
+}
+
+// loadSettings checks the schema version, and reads settings of the
+// database, except for the edges setting. See edgesSetting.
+func loadSettings(dt dbOrTx) (settings, error) {
+	s := settings{chunkSize: maxZcontentSize}
+	if err := checkSchemaVersion(dt); err != nil {
+		return s, err
+	}
+	values, err := readSettings(dt)
+	if err != nil {
+		return s, err
+	}
+	if s.dialect, err = dialectByName(values[settingDialect]); err != nil {
+		return s, err
+	}
+	s.commitCache = values[settingCommitCache] == "on"
+	if v, ok := values[settingChunkSize]; ok {
+		if s.chunkSize, err = strconv.Atoi(v); err != nil {
+			return s, fmt.Errorf("invalid %s setting: %q", settingChunkSize, v)
+		}
+	}
+	return s, nil
+}
+
+// readSchemaVersion returns the schema version of database. Returns 0 if
+// the database is not versioned.
+func readSchemaVersion(dt dbOrTx) (int, error) {
+	rows, err := dt.Query("SELECT version FROM " + schemaTable + " WHERE id = 1")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	version := 0
+	for rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			return 0, err
+		}
+	}
+	return version, rows.Err()
+}
+
+// checkSchemaVersion returns an error if the schema version of database
+// does not match the version required by gitdb.
+//
+// A failed query aborts the transaction on PostgreSQL. So in a transaction,
+// whether the schema table exists is tested first. The test fails on other
+// databases, where the table is queried directly.
+func checkSchemaVersion(dt dbOrTx) error {
+	if tx, ok := dt.(*sql.Tx); ok {
+		var n int
+		err := tx.QueryRow("SELECT COUNT(1) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = '" + schemaTable + "'").Scan(&n)
+		if err == nil && n == 0 {
+			return errSchemaVersion{0, schemaVersion()}
+		}
+	}
+	version, err := readSchemaVersion(dt)
+	if isMissingTable(err) {
+		// Databases created before schema versioning do not have the
+		// schema table.
+		return errSchemaVersion{0, schemaVersion()}
+	} else if err != nil {
+		return err
+	}
+	if version != schemaVersion() {
+		return errSchemaVersion{version, schemaVersion()}
+	}
+	return nil
+}
+
+// isMissingTable tests whether err is caused by querying a table that does
+// not exist. Drivers do not share error types, so messages of SQLite, MySQL
+// (error 1146) and PostgreSQL (SQLSTATE 42P01) are matched.
+func isMissingTable(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "no such table") ||
+		strings.Contains(msg, "Error 1146") ||
+		(strings.Contains(msg, "relation") && strings.Contains(msg, "does not exist"))
+}
@@ -0,0 +1,100 @@
+package gitdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	if !checkGit() {
+		return
+	}
+
+	db := createDb("migrate")
+	defer db.Close()
+
+	if v, e := readSchemaVersion(db); e != nil || v != len(migrations) {
+		t.Fatal("schema version should be", len(migrations), v, e)
+	}
+
+	// CreateTable returns a usable result
+	if r, e := CreateTable(db); e != nil || r == nil {
+		t.Fatal("CreateTable unexpected", r, e)
+	} else if _, e := r.RowsAffected(); e != nil {
+		t.Error("RowsAffected error", e)
+	}
+
+	// Migrate is idempotent
+	if e := Migrate(db); e != nil {
+		t.Fatal("Migrate error", e)
+	}
+	if v, _ := readSchemaVersion(db); v != len(migrations) {
+		t.Fatal("schema version should be", len(migrations), v)
+	}
+
+	dir := createRandomRepo("migrate", 5, false, false)
+	_, head, e := Import(db, dir, "HEAD")
+	if e != nil {
+		t.Fatal("Import error", e)
+	}
+
+	// Settings of a transaction are read once
+	tx, _ := db.Begin()
+	if _, _, e := Stat(tx, head, ""); e != nil {
+		t.Fatal("Stat error", e)
+	}
+	tx.Exec("UPDATE " + schemaTable + " SET version = 9999")
+	if _, _, e := Stat(tx, head, ""); e != nil {
+		t.Error("Stat should use cached settings of the transaction", e)
+	}
+	tx.Rollback()
+
+	// Too new. Settings of a *sql.DB are cached, so the upgrade is noticed
+	// by a new transaction passed in, or after the cache expires.
+	db.Exec("UPDATE " + schemaTable + " SET version = 9999")
+	if _, _, e := Import(db, dir, "HEAD"); e != nil {
+		t.Error("Import should use cached settings", e)
+	}
+	tx, _ = db.Begin()
+	if _, _, e := Import(tx, dir, "HEAD"); !IsSchemaVersionError(e) {
+		t.Error("Import should refuse a newer schema in a transaction", e)
+	}
+	tx.Rollback()
+	forgetSettings(db)
+	if _, _, e := Import(db, dir, "HEAD"); !IsSchemaVersionError(e) {
+		t.Error("Import should refuse a newer schema", e)
+	}
+	if e := Migrate(db); !IsSchemaVersionError(e) {
+		t.Error("Migrate should refuse to downgrade", e)
+	}
+
+	// Too old, or created before schema versioning
+	db.Exec("DROP TABLE " + schemaTable)
+	forgetSettings(db)
+	dir2 := filepath.Join(repoDir, "migrate-export")
+	os.RemoveAll(dir2)
+	if _, e := Export(db, dir2, head, "HEAD"); !IsSchemaVersionError(e) {
+		t.Error("Export should refuse an unversioned schema", e)
+	}
+	tx, _ = db.Begin()
+	if _, e := GC(tx, nil); !IsSchemaVersionError(e) {
+		t.Error("GC should refuse an unversioned schema", e)
+	}
+	tx.Rollback()
+
+	// Other errors are not mistaken for an old schema
+	tx, _ = db.Begin()
+	tx.Rollback()
+	if e := checkSchemaVersion(tx); e == nil || IsSchemaVersionError(e) {
+		t.Error("checkSchemaVersion should return the error of a finished transaction", e)
+	}
+
+	// Migrate upgrades existing tables without losing data
+	if e := Migrate(db); e != nil {
+		t.Fatal("Migrate error", e)
+	}
+	if oids, _, e := Import(db, dir, "HEAD"); e != nil || len(oids) != 0 {
+		t.Error("Import should see existing objects after Migrate", oids, e)
+	}
+}
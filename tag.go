@@ -0,0 +1,90 @@
+package gitdb
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Tag is a parsed git annotated tag object.
+type Tag struct {
+	Oid Oid
+	// Object is the oid of the tagged object.
+	Object Oid
+	// ObjectType is the type of the tagged object, usually "commit".
+	ObjectType string
+	Name       string
+	// Tagger is nil for some old tags without a "tagger" header.
+	Tagger *Signature
+	// ExtraHeaders are other headers in original order, including repeated
+	// "object", "type", "tag" and "tagger" headers. Like git, the first one
+	// is used.
+	ExtraHeaders []Header
+	// Message includes the signature of a signed tag.
+	Message string
+
+	// noSeparator is true if the tag has no empty line after headers.
+	noSeparator bool
+	// raw and formatted are like those of Commit.
+	raw, formatted []byte
+}
+
+// Type returns "tag".
+func (t *Tag) Type() string {
+	return "tag"
+}
+
+// Bytes serializes the tag into the body of a git tag object. The body of a
+// tag read from database is returned unchanged unless fields are changed.
+func (t *Tag) Bytes() []byte {
+	body := t.format()
+	if t.raw != nil && bytes.Equal(body, t.formatted) {
+		return t.raw
+	}
+	return body
+}
+
+func (t *Tag) format() []byte {
+	headers := []Header{{"object", string(t.Object)}, {"type", t.ObjectType}, {"tag", t.Name}}
+	if t.Tagger != nil {
+		headers = append(headers, Header{"tagger", t.Tagger.String()})
+	}
+	headers = append(headers, t.ExtraHeaders...)
+	return formatHeaders(headers, t.Message, t.noSeparator)
+}
+
+// parseTag parses the body of a git tag object.
+func parseTag(oid Oid, body []byte) (*Tag, error) {
+	headers, message, noSeparator, err := parseHeaders(body)
+	if err != nil {
+		return nil, fmt.Errorf("tag %s is illformed: %s", oid, err)
+	}
+	t := &Tag{Oid: oid, Message: message, noSeparator: noSeparator}
+	seen := make(map[string]bool)
+	for _, h := range headers {
+		if seen[h.Key] {
+			t.ExtraHeaders = append(t.ExtraHeaders, h)
+			continue
+		}
+		seen[h.Key] = true
+		switch h.Key {
+		case "object":
+			t.Object = Oid(h.Value)
+		case "type":
+			t.ObjectType = h.Value
+		case "tag":
+			t.Name = h.Value
+		case "tagger":
+			tagger := parseSignature(h.Value)
+			t.Tagger = &tagger
+		default:
+			t.ExtraHeaders = append(t.ExtraHeaders, h)
+		}
+	}
+	if !t.Object.IsValid() {
+		return nil, fmt.Errorf("tag %s is illformed: no object", oid)
+	}
+	if formatted := t.format(); !bytes.Equal(formatted, body) {
+		t.raw, t.formatted = body, formatted
+	}
+	return t, nil
+}
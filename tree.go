@@ -1,45 +1,158 @@
 package gitdb
 
 import (
+	"bytes"
 	"encoding/hex"
+	"fmt"
+	"path"
+	"sort"
 	"strconv"
 )
 
-type treeItem struct {
+// File modes of git tree entries.
+const (
+	ModeTree       = 0040000
+	ModeBlob       = 0100644
+	ModeExecutable = 0100755
+	ModeSymlink    = 0120000
+	ModeGitlink    = 0160000
+)
+
+// TreeEntry is an entry of a git tree object.
+type TreeEntry struct {
 	Oid  Oid
 	Name string
 	Mode int32
 }
 
-func (ti *treeItem) IsTree() bool {
-	return ti.Mode&0100000 == 0
+// IsTree tests whether ti refers to a sub-tree (directory).
+func (ti *TreeEntry) IsTree() bool {
+	return ti.Mode&0170000 == ModeTree
+}
+
+// IsGitlink tests whether ti refers to a commit, usually in another repo
+// (submodule).
+func (ti *TreeEntry) IsGitlink() bool {
+	return ti.Mode&0170000 == ModeGitlink
+}
+
+// Tree is a parsed git tree object.
+type Tree struct {
+	Oid     Oid
+	Entries []*TreeEntry
+}
+
+// Type returns "tree".
+func (t *Tree) Type() string {
+	return "tree"
+}
+
+// Bytes serializes the tree into the body of a git tree object. Entries are
+// sorted in git order.
+func (t *Tree) Bytes() []byte {
+	return formatTree(t.Entries)
 }
 
 // parseTree parses a git tree object from its body.
-// Returns an array of treeItem. A treeItem has oid, name and mode.
-func parseTree(body []byte) []*treeItem {
-	var result []*treeItem
-	for pos, startPos, spacePos := 0, 0, 0; pos < len(body)-20; pos++ {
-		switch body[pos] {
-		case ' ':
-			spacePos = pos
-		case 0:
-			// mode +     " " + name + "\0" + binOid (20 bytes)
-			// ^           ^            ^
-			// startPos    spacePos     pos
-			if startPos >= spacePos || spacePos+1 >= pos {
-				// ignore illegal format
-				continue
-			}
-			mode, _ := strconv.ParseUint(string(body[startPos:spacePos]), 8, 64)
-			startPos = pos + 21
-			ti := treeItem{
-				Oid:  Oid(hex.EncodeToString(body[pos+1 : startPos])),
-				Name: string(body[spacePos+1 : pos]),
-				Mode: int32(mode),
-			}
-			result = append(result, &ti)
+// Returns an array of TreeEntry. A TreeEntry has oid, name and mode.
+//
+// An entry is: mode + " " + name + "\0" + binOid (20 bytes). Names may
+// contain spaces, so mode ends at the first space of the entry.
+func parseTree(body []byte) []*TreeEntry {
+	var result []*TreeEntry
+	for pos := 0; pos < len(body); {
+		spacePos := bytes.IndexByte(body[pos:], ' ')
+		nulPos := bytes.IndexByte(body[pos:], 0)
+		if spacePos <= 0 || nulPos <= spacePos+1 || pos+nulPos+21 > len(body) {
+			// ignore illegal format
+			break
 		}
+		spacePos += pos
+		nulPos += pos
+		mode, _ := strconv.ParseUint(string(body[pos:spacePos]), 8, 64)
+		result = append(result, &TreeEntry{
+			Oid:  Oid(hex.EncodeToString(body[nulPos+1 : nulPos+21])),
+			Name: string(body[spacePos+1 : nulPos]),
+			Mode: int32(mode),
+		})
+		pos = nulPos + 21
 	}
 	return result
 }
+
+// checkTree checks whether the body of a tree object is well formed, unlike
+// parseTree which ignores entries after an illegal one.
+func checkTree(oid Oid, body []byte) error {
+	for pos := 0; pos < len(body); {
+		spacePos := bytes.IndexByte(body[pos:], ' ')
+		nulPos := bytes.IndexByte(body[pos:], 0)
+		if spacePos <= 0 || nulPos <= spacePos+1 || pos+nulPos+21 > len(body) {
+			return fmt.Errorf("tree %s is illformed at %d", oid, pos)
+		}
+		if _, err := strconv.ParseUint(string(body[pos:pos+spacePos]), 8, 32); err != nil {
+			return fmt.Errorf("tree %s has a bad mode at %d", oid, pos)
+		}
+		pos += nulPos + 21
+	}
+	return nil
+}
+
+// formatTree serializes tree items into the body of a git tree object.
+// Items are sorted in git order, where a sub-tree sorts as if its name ends
+// with "/".
+func formatTree(items []*TreeEntry) []byte {
+	sorted := make([]*TreeEntry, len(items))
+	copy(sorted, items)
+	sort.Sort(treeEntriesInGitOrder(sorted))
+
+	var b bytes.Buffer
+	for _, ti := range sorted {
+		bin, _ := hex.DecodeString(string(ti.Oid))
+		b.WriteString(strconv.FormatInt(int64(ti.Mode), 8))
+		b.WriteByte(' ')
+		b.WriteString(ti.Name)
+		b.WriteByte(0)
+		b.Write(bin)
+	}
+	return b.Bytes()
+}
+
+type treeEntriesInGitOrder []*TreeEntry
+
+func (s treeEntriesInGitOrder) Len() int      { return len(s) }
+func (s treeEntriesInGitOrder) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s treeEntriesInGitOrder) Less(i, j int) bool {
+	a, b := s[i].Name, s[j].Name
+	if s[i].IsTree() {
+		a += "/"
+	}
+	if s[j].IsTree() {
+		b += "/"
+	}
+	return a < b
+}
+
+// globMatch tests whether path names match pattern segments. A "**" segment
+// matches zero or more names. Other segments are matched using path.Match.
+// If partial is true, globMatch tests whether names could be a directory
+// containing matched paths instead.
+func globMatch(pattern []string, names []string, partial bool) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if globMatch(pattern[1:], names[i:], partial) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return partial
+		}
+		if ok, _ := path.Match(pattern[0], names[0]); !ok {
+			return false
+		}
+		pattern, names = pattern[1:], names[1:]
+	}
+	return len(names) == 0
+}
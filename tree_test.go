@@ -0,0 +1,69 @@
+package gitdb
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		path    string
+		match   bool
+		partial bool
+	}{
+		{"*.yaml", "a.yaml", true, true},
+		{"*.yaml", "d/a.yaml", false, false},
+		{"**/*.yaml", "a.yaml", true, true},
+		{"**/*.yaml", "d/e/a.yaml", true, true},
+		{"**/*.yaml", "d/e", false, true},
+		{"docs/**", "docs/a/b", true, true},
+		{"docs/**", "src", false, false},
+		{"docs/*/*.md", "docs", false, true},
+		{"docs/*/*.md", "docs/a", false, true},
+		{"docs/*/*.md", "docs/a/b.md", true, true},
+		{"a/**/b", "a/b", true, true},
+		{"a/**/b", "a/x/y/b", true, true},
+		{"a/**/b", "a/x/y/c", false, true},
+	} {
+		names := strings.Split(c.path, "/")
+		pattern := strings.Split(c.pattern, "/")
+		if m := globMatch(pattern, names, false); m != c.match {
+			t.Errorf("globMatch(%q, %q) = %v, expected %v", c.pattern, c.path, m, c.match)
+		}
+		if m := globMatch(pattern, names, true); m != c.partial {
+			t.Errorf("globMatch(%q, %q, partial) = %v, expected %v", c.pattern, c.path, m, c.partial)
+		}
+	}
+}
+
+func TestParseTree(t *testing.T) {
+	items := []*TreeEntry{
+		{Oid: Oid(strings.Repeat("20", 20)), Name: "my file.txt", Mode: ModeBlob},
+		{Oid: Oid(strings.Repeat("00", 20)), Name: "my dir", Mode: ModeTree},
+		{Oid: Oid(strings.Repeat("ab", 20)), Name: " a  b ", Mode: ModeExecutable},
+		{Oid: Oid(strings.Repeat("01", 20)), Name: "x", Mode: ModeSymlink},
+	}
+	body := formatTree(items)
+	parsed := parseTree(body)
+	if len(parsed) != len(items) {
+		t.Fatalf("parseTree returned %d entries, expected %d", len(parsed), len(items))
+	}
+	for _, ti := range parsed {
+		found := false
+		for _, item := range items {
+			if *ti == *item {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("parseTree returned unexpected entry %+v", ti)
+		}
+	}
+	if string(formatTree(parsed)) != string(body) {
+		t.Error("formatTree(parseTree(body)) != body")
+	}
+	if n := len(parseTree(body[:len(body)-1])); n != len(items)-1 {
+		t.Errorf("parseTree of a truncated tree returned %d entries", n)
+	}
+}